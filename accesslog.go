@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// accessLogEntry describes an answered request as a single JSON line.
+type accessLogEntry struct {
+	Time      time.Time     `json:"time"`
+	Bucket    string        `json:"bucket,omitempty"`
+	Key       string        `json:"key,omitempty"`
+	Method    string        `json:"method"`
+	Operation string        `json:"operation"`
+	Status    int           `json:"status"`
+	BytesIn   int           `json:"bytesIn"`
+	BytesOut  int           `json:"bytesOut"`
+	Duration  time.Duration `json:"duration"`
+}
+
+// accessLog writes entries to an io.Writer, one line per entry. It is safe
+// for concurrent use.
+type accessLog struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newAccessLog(w io.Writer) *accessLog {
+	return &accessLog{
+		enc: json.NewEncoder(w),
+	}
+}
+
+func (l *accessLog) write(e accessLogEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err := l.enc.Encode(e)
+	if err != nil {
+		log.Printf("ERROR writing access log: %s", err)
+	}
+}
+
+// logRequest records the metrics of every request answered by next like
+// metrics does and writes an entry for it to l.
+func logRequest(l *accessLog, op string, next http.Handler) http.Handler {
+	return observe(op, l, next)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gorilla/pat"
+	"github.com/soundcloud/ent/lib"
+)
+
+func TestLogRequest(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-access-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		buf     = &bytes.Buffer{}
+		fs      = newDiskFS(tmp)
+		b       = ent.NewBucket("access-log", ent.Owner{})
+		content = []byte("logged content")
+		r       = pat.New()
+	)
+
+	r.Add("GET", ent.RouteFile, logRequest(
+		newAccessLog(buf),
+		"handleGet",
+		handleGet(ent.NewMemoryProvider(b), fs),
+	))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	_, err = fs.Create(b, "present.txt", bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"present.txt", "missing.txt"} {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("%s/%s/%s", ts.URL, b.Name, key), nil)
+		// Keep the response uncompressed so its size is known.
+		req.Header.Set("Accept-Encoding", "identity")
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+
+	entries := []accessLogEntry{}
+
+	s := bufio.NewScanner(buf)
+	for s.Scan() {
+		e := accessLogEntry{}
+
+		err := json.Unmarshal(s.Bytes(), &e)
+		if err != nil {
+			t.Fatalf("malformed line %q: %s", s.Text(), err)
+		}
+
+		entries = append(entries, e)
+	}
+
+	if have, want := len(entries), 2; have != want {
+		t.Fatalf("have %d entries, want %d", have, want)
+	}
+
+	for i, want := range []accessLogEntry{
+		{
+			Bucket:    b.Name,
+			Key:       "present.txt",
+			Method:    "GET",
+			Operation: "handleGet",
+			Status:    http.StatusOK,
+			BytesOut:  len(content),
+		},
+		{
+			Bucket:    b.Name,
+			Key:       "missing.txt",
+			Method:    "GET",
+			Operation: "handleGet",
+			Status:    http.StatusNotFound,
+		},
+	} {
+		have := entries[i]
+
+		if have.Time.IsZero() || have.Duration <= 0 {
+			t.Errorf("entry %d: missing time or duration: %+v", i, have)
+		}
+
+		have.Time, have.Duration = want.Time, want.Duration
+		if want.BytesOut == 0 {
+			have.BytesOut = 0
+		}
+
+		if have != want {
+			t.Errorf("entry %d: have %+v, want %+v", i, have, want)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/soundcloud/ent/lib"
+)
+
+// appender is implemented by FileSystems which append to files in place.
+type appender interface {
+	// Append adds the content read from r to the end of the file under key,
+	// which is created if it doesn't exist, and returns the whole file.
+	Append(bucket *ent.Bucket, key string, r io.Reader) (ent.File, error)
+}
+
+// appendFile appends the content read from r to the file under key. Unless fs
+// appends in place the existing content is stored again followed by r, which
+// is as costly as replacing the file and not atomic with respect to
+// concurrent appends.
+func appendFile(fs ent.FileSystem, bucket *ent.Bucket, key string, r io.Reader) (ent.File, error) {
+	if a, ok := fs.(appender); ok {
+		return a.Append(bucket, key, r)
+	}
+
+	return rewriteAppend(fs, bucket, key, r)
+}
+
+// rewriteAppend appends by storing the existing content followed by r.
+func rewriteAppend(fs ent.FileSystem, bucket *ent.Bucket, key string, r io.Reader) (ent.File, error) {
+	f, err := fs.Open(bucket, key)
+	if err == ent.ErrFileNotFound {
+		return fs.Create(bucket, key, r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return fs.Create(bucket, key, io.MultiReader(f, r))
+}
+
+// Append opens the file under key with O_APPEND and writes the content of r to
+// it. The hash covers the whole content, the existing part is read to compute
+// it unless hashing is lazy. Versions share their content with the file, with
+// versioning the file is replaced instead.
+func (fs *diskFS) Append(bucket *ent.Bucket, key string, r io.Reader) (ent.File, error) {
+	if fs.versioning {
+		return rewriteAppend(fs, bucket, key, r)
+	}
+
+	err := checkKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	dst := pathForFile(fs, bucket, key)
+
+	unlock := fs.keys.lock(dst)
+	defer unlock()
+
+	_, err = checkReplace(dst, false)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = os.Stat(dst)
+	isNew := os.IsNotExist(err)
+
+	// Once the file exists its directory is no longer pruned.
+	fs.dirs.RLock()
+	err = os.MkdirAll(filepath.Dir(dst), 0755)
+	var w *os.File
+	if err == nil {
+		w, err = os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	}
+	fs.dirs.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := w.Stat()
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	// A failed append leaves the file as it was, without the part of the
+	// content appended before the failure. Files created by it are removed.
+	size := stat.Size()
+	fail := func(err error) (ent.File, error) {
+		if isNew {
+			os.Remove(dst)
+		} else {
+			w.Truncate(size)
+		}
+		w.Close()
+		return nil, err
+	}
+
+	f := newFile(w, key)
+	f.lazy = fs.lazyHash
+
+	if !f.lazy {
+		err = f.sum()
+		if err != nil {
+			return fail(fmt.Errorf("hashing failed: %s", err))
+		}
+	}
+
+	_, err = io.Copy(f, r)
+	if err != nil {
+		return fail(fmt.Errorf("appending failed: %s", err))
+	}
+
+	if fs.fsync {
+		err = syncFile(w)
+		if err == nil && isNew {
+			err = syncDir(filepath.Dir(dst))
+		}
+		if err != nil {
+			return fail(fmt.Errorf("sync failed: %s", err))
+		}
+	}
+
+	_, err = w.Seek(0, io.SeekStart)
+	if err != nil {
+		return fail(err)
+	}
+
+	stat, err = w.Stat()
+	if err != nil {
+		return fail(err)
+	}
+
+	f.lastModified = stat.ModTime()
+
+	f.created, err = fs.setCreated(dst, f.lastModified, f.storedDigests())
+	if err != nil {
+		return fail(err)
+	}
+
+	return f, nil
+}
+
+// Append appends in place if neither the bucket compresses new files nor the
+// existing file is compressed, otherwise the file is stored again.
+func (fs *compressFS) Append(bucket *ent.Bucket, key string, r io.Reader) (ent.File, error) {
+	m, err := fs.FileSystem.Meta(bucket, key)
+	if err != nil && err != ent.ErrFileNotFound {
+		return nil, err
+	}
+
+	if (bucket.Compression != "" && bucket.Compression != ent.CompressionNone) || m.Compression != "" {
+		return rewriteAppend(fs, bucket, key, r)
+	}
+
+	return appendFile(fs.FileSystem, bucket, key, r)
+}
+
+// Append stores the file again, as sealed chunks can't be extended.
+func (fs *encryptedFS) Append(bucket *ent.Bucket, key string, r io.Reader) (ent.File, error) {
+	return rewriteAppend(fs, bucket, key, r)
+}
+
+// Append appends to the file and indexes the hash of the resulting content.
+func (fs *hashIndexFS) Append(bucket *ent.Bucket, key string, r io.Reader) (ent.File, error) {
+	f, err := appendFile(fs.FileSystem, bucket, key, r)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.index(bucket, f)
+
+	return f, nil
+}
+
+// Append appends to the file of the wrapped FileSystem.
+func (fs *multipartFS) Append(bucket *ent.Bucket, key string, r io.Reader) (ent.File, error) {
+	return appendFile(fs.FileSystem, bucket, key, r)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/pat"
+	"github.com/soundcloud/ent/lib"
+)
+
+func TestDiskFSAppend(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-diskfs-append")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	b := ent.NewBucket("append", ent.Owner{})
+
+	for _, input := range []struct {
+		lazy       bool
+		versioning bool
+	}{
+		{false, false},
+		{true, false},
+		{false, true},
+	} {
+		var (
+			fs  = newDiskFS(tmp, withLazyHash(input.lazy), withVersioning(input.versioning))
+			key = fmt.Sprintf("lazy-%t-versioning-%t.log", input.lazy, input.versioning)
+		)
+
+		testAppend(t, fs, b, key)
+	}
+}
+
+func TestDiskFSAppendFailure(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-diskfs-append-failure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		b  = ent.NewBucket("append", ent.Owner{})
+		fs = newDiskFS(tmp)
+	)
+
+	f, err := fs.Create(b, "kept.log", strings.NewReader("first line\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	for _, key := range []string{"kept.log", "new.log"} {
+		_, err = appendFile(fs, b, key, io.MultiReader(
+			strings.NewReader("partial line"),
+			&failingReader{errors.New("client went away")},
+		))
+		if err == nil {
+			t.Fatalf("%s: expected Append to fail", key)
+		}
+	}
+
+	raw, err := ioutil.ReadFile(filepath.Join(tmp, b.Name, "kept.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := string(raw), "first line\n"; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+
+	_, err = fs.Open(b, "new.log")
+	if err != ent.ErrFileNotFound {
+		t.Errorf("have %v, want %v", err, ent.ErrFileNotFound)
+	}
+}
+
+func TestCompressFSAppend(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-compressfs-append")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		b  = ent.NewBucket("append", ent.Owner{})
+		fs = newCompressFS(newDiskFS(tmp))
+	)
+
+	b.Compression = ent.CompressionGzip
+
+	testAppend(t, fs, b, "compressed.log")
+
+	m, err := fs.Meta(b, "compressed.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := m.Compression, ent.CompressionGzip; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+}
+
+func testAppend(t *testing.T, fs ent.FileSystem, b *ent.Bucket, key string) {
+	content := ""
+
+	for _, part := range []string{"first line\n", "second line\n", "third line\n"} {
+		content += part
+
+		f, err := appendFile(fs, b, key, strings.NewReader(part))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		h, err := f.Hash()
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sum := sha1.Sum([]byte(content))
+
+		if have, want := hex.EncodeToString(h), hex.EncodeToString(sum[:]); have != want {
+			t.Errorf("%s: have %s, want %s", key, have, want)
+		}
+	}
+
+	f, err := fs.Open(b, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	stored, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := string(stored), content; have != want {
+		t.Errorf("%s: have %q, want %q", key, have, want)
+	}
+}
+
+func TestHandleCreateAppend(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-append-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		fs = newHashIndexFS(newCompressFS(newDiskFS(tmp)))
+		b  = ent.NewBucket("ent", ent.Owner{})
+	)
+
+	r := pat.New()
+	r.Post(ent.RouteFile, handleCreate(ent.NewMemoryProvider(b), fs))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	var (
+		ep      = fmt.Sprintf("%s/%s/%s", ts.URL, b.Name, "events.log")
+		content = ""
+	)
+
+	for _, part := range []string{"created\n", "appended\n"} {
+		content += part
+
+		req, err := http.NewRequest("POST", ep, strings.NewReader(part))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(ent.HeaderMode, ent.ModeAppend)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp := ent.ResponseCreated{}
+		err = json.NewDecoder(res.Body).Decode(&resp)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have, want := res.StatusCode, http.StatusCreated; have != want {
+			t.Errorf("have %d, want %d", have, want)
+		}
+
+		sum := sha1.Sum([]byte(content))
+
+		if have, want := resp.File.Hash, hex.EncodeToString(sum[:]); have != want {
+			t.Errorf("have %s, want %s", have, want)
+		}
+
+		if have, want := resp.File.Size, int64(len(content)); have != want {
+			t.Errorf("have %d, want %d", have, want)
+		}
+	}
+
+	f, err := fs.Open(b, "events.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	stored, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := string(stored), content; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+
+	for _, header := range []http.Header{
+		{ent.HeaderMode: {"prepend"}},
+		{ent.HeaderMode: {ent.ModeAppend}, ent.HeaderIfNoneMatch: {"*"}},
+	} {
+		req, err := http.NewRequest("POST", ep, strings.NewReader("invalid\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header = header
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if have, want := res.StatusCode, http.StatusBadRequest; have != want {
+			t.Errorf("%v: have %d, want %d", header, have, want)
+		}
+	}
+}
@@ -0,0 +1,860 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/soundcloud/ent/lib"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// boltChunkSize is the size of the chunks the content of files is stored
+	// in. Every chunk is written in a transaction of its own, so content is
+	// never held in memory as a whole.
+	boltChunkSize = 1 << 20
+	// boltChunkExt is appended to the name of a bucket to name the bolt bucket
+	// holding the chunks of its files. Bucket names can't contain slashes.
+	boltChunkExt = "/chunks"
+	// boltIDSize is the size of the ids content is stored under, the time
+	// storing it began encoded as nanoseconds since epoch followed by random
+	// bytes.
+	boltIDSize = 16
+	// boltValueSize is the size of a value stored under a key without the
+	// optional MD5: the modification time, the size, the id, the SHA1 and the
+	// CRC32C.
+	boltValueSize = 8 + 8 + boltIDSize + sha1.Size + 4
+)
+
+var (
+	errBoltReadOnly = errors.New("bolt file is read-only")
+	errBoltRemoved  = errors.New("bolt file was replaced or deleted while read")
+)
+
+type boltFS struct {
+	db *bolt.DB
+}
+
+func newBoltFS(path string) (*boltFS, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open bolt db failed: %s", err)
+	}
+
+	return &boltFS{
+		db: db,
+	}, nil
+}
+
+func (fs *boltFS) Close() error {
+	return fs.db.Close()
+}
+
+func (fs *boltFS) Create(
+	bucket *ent.Bucket,
+	key string,
+	r io.Reader,
+) (ent.File, error) {
+	return fs.create(bucket, key, r, createOptions{})
+}
+
+func (fs *boltFS) CreateExclusive(
+	bucket *ent.Bucket,
+	key string,
+	r io.Reader,
+) (ent.File, error) {
+	return fs.create(bucket, key, r, createOptions{exclusive: true})
+}
+
+func (fs *boltFS) create(
+	bucket *ent.Bucket,
+	key string,
+	r io.Reader,
+	o createOptions,
+) (ent.File, error) {
+	err := checkKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := fs.storeChunks(bucket, r)
+	if err != nil {
+		return nil, fmt.Errorf("storing failed: %s", err)
+	}
+
+	var created time.Time
+
+	v.lastModified = time.Now()
+
+	err = fs.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket.Name))
+		if err != nil {
+			return err
+		}
+
+		prev := b.Get([]byte(key))
+		exists := prev != nil
+		if exists && o.exclusive {
+			return ent.ErrFileExists
+		}
+
+		m := ent.Meta{}
+		if exists {
+			m, err = boltMeta(tx, bucket, []byte(key))
+			if err != nil {
+				return err
+			}
+		}
+
+		if m.IsRetained(v.lastModified) {
+			return ent.ErrRetentionActive
+		}
+
+		if exists {
+			err = deleteBoltChunks(tx, bucket, prev)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = b.Put([]byte(key), encodeBoltValue(v))
+		if err != nil {
+			return err
+		}
+
+		created = m.Created
+		if created.IsZero() {
+			created = v.lastModified
+		}
+
+		o.meta.Created = created
+
+		return putBoltMeta(tx, bucket, key, o.meta)
+	})
+	if err != nil {
+		fs.discardChunks(bucket, v.id)
+	}
+	if err == ent.ErrFileExists || err == ent.ErrRetentionActive {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("storing failed: %s", err)
+	}
+
+	return fs.newBoltFile(bucket, key, created, v), nil
+}
+
+// storeChunks stores the content read from r in chunks under a new id, each
+// chunk in a transaction of its own. The returned value describes the content
+// and is yet to be stored under a key, the chunks are removed again if
+// storing them fails.
+func (fs *boltFS) storeChunks(bucket *ent.Bucket, r io.Reader) (boltValue, error) {
+	id, err := newBoltID(time.Now())
+	if err != nil {
+		return boltValue{}, err
+	}
+
+	var (
+		v   = boltValue{id: id}
+		d   = newDigest()
+		buf = make([]byte, boltChunkSize)
+	)
+
+	for i := uint32(0); ; i++ {
+		n, rerr := io.ReadFull(io.TeeReader(r, d), buf)
+		if n > 0 {
+			err = fs.db.Update(func(tx *bolt.Tx) error {
+				cb, err := tx.CreateBucketIfNotExists(boltChunkBucket(bucket))
+				if err != nil {
+					return err
+				}
+
+				return cb.Put(boltChunkKey(id, i), buf[:n])
+			})
+			if err != nil {
+				fs.discardChunks(bucket, id)
+				return boltValue{}, err
+			}
+
+			v.size += int64(n)
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			fs.discardChunks(bucket, id)
+			return boltValue{}, rerr
+		}
+	}
+
+	v.hash = d.Hash()
+	v.crc = d.CRC32C()
+	v.md5 = d.MD5()
+
+	return v, nil
+}
+
+// discardChunks removes the chunks stored under id by a write which failed.
+// Chunks it fails to remove are left to Sweep.
+func (fs *boltFS) discardChunks(bucket *ent.Bucket, id []byte) {
+	err := fs.db.Update(func(tx *bolt.Tx) error {
+		cb := tx.Bucket(boltChunkBucket(bucket))
+		if cb == nil {
+			return nil
+		}
+
+		return deleteChunks(cb, id)
+	})
+	if err != nil {
+		log.Printf("ERROR discarding chunks of %s: %s", bucket.Name, err)
+	}
+}
+
+// Sweep removes the chunks of writes begun before pendingBefore which were
+// never stored under a key, like those of writes interrupted by a crash.
+// Replaced and deleted content is removed right away, there are neither
+// staged uploads nor a trash to purge.
+func (fs *boltFS) Sweep(pendingBefore, uploadsBefore, trashBefore time.Time) (sweepStats, error) {
+	stats := sweepStats{}
+
+	err := fs.db.Update(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, cb *bolt.Bucket) error {
+			if !bytes.HasSuffix(name, []byte(boltChunkExt)) {
+				return nil
+			}
+
+			stored := map[string]bool{}
+
+			if b := tx.Bucket(bytes.TrimSuffix(name, []byte(boltChunkExt))); b != nil {
+				err := b.ForEach(func(k, v []byte) error {
+					bv, err := decodeBoltValue(v)
+					if err != nil {
+						return err
+					}
+
+					stored[string(bv.id)] = true
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+
+			orphans := map[string]bool{}
+
+			err := cb.ForEach(func(k, _ []byte) error {
+				if len(k) < boltIDSize {
+					return nil
+				}
+
+				id := k[:boltIDSize]
+				if !stored[string(id)] && boltIDTime(id).Before(pendingBefore) {
+					orphans[string(id)] = true
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			for id := range orphans {
+				err = deleteChunks(cb, []byte(id))
+				if err != nil {
+					return err
+				}
+
+				stats.pending++
+			}
+
+			return nil
+		})
+	})
+	if err != nil {
+		return stats, fmt.Errorf("sweeping chunks failed: %s", err)
+	}
+
+	return stats, nil
+}
+
+func (fs *boltFS) Delete(bucket *ent.Bucket, key string) error {
+	return fs.delete(bucket, key, nil)
+}
+
+// delete removes the file under key if check, which is passed its Meta in the
+// transaction removing it, allows it. A nil check allows every file.
+func (fs *boltFS) delete(bucket *ent.Bucket, key string, check func(ent.Meta) error) error {
+	return fs.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket.Name))
+		if b == nil {
+			return ent.ErrFileNotFound
+		}
+
+		v := b.Get([]byte(key))
+		if v == nil {
+			return ent.ErrFileNotFound
+		}
+
+		m, err := boltMeta(tx, bucket, []byte(key))
+		if err != nil {
+			return err
+		}
+
+		if m.IsRetained(time.Now()) {
+			return ent.ErrRetentionActive
+		}
+
+		if check != nil {
+			err = check(m)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = deleteBoltChunks(tx, bucket, v)
+		if err != nil {
+			return fmt.Errorf("removal failed: %s", err)
+		}
+
+		err = b.Delete([]byte(key))
+		if err != nil {
+			return fmt.Errorf("removal failed: %s", err)
+		}
+
+		if mb := tx.Bucket(boltMetaBucket(bucket)); mb != nil {
+			err = mb.Delete([]byte(key))
+			if err != nil {
+				return fmt.Errorf("meta removal failed: %s", err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// Versions always returns no versions as replaced files are not kept.
+func (fs *boltFS) Versions(bucket *ent.Bucket, key string) ([]ent.Version, error) {
+	return []ent.Version{}, nil
+}
+
+// OpenVersion always returns ErrFileNotFound as replaced files are not kept.
+func (fs *boltFS) OpenVersion(bucket *ent.Bucket, key, hash string) (ent.File, error) {
+	return nil, ent.ErrFileNotFound
+}
+
+// Restore always returns ErrFileNotFound as deleted files are not kept.
+func (fs *boltFS) Restore(bucket *ent.Bucket, key string) error {
+	return ent.ErrFileNotFound
+}
+
+func (fs *boltFS) Open(bucket *ent.Bucket, key string) (ent.File, error) {
+	var f *boltFile
+
+	err := fs.db.View(func(tx *bolt.Tx) error {
+		var err error
+		f, err = fs.open(tx, bucket, key)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// open returns the file stored under key, its content is read from the chunks
+// as it is read.
+func (fs *boltFS) open(tx *bolt.Tx, bucket *ent.Bucket, key string) (*boltFile, error) {
+	b := tx.Bucket([]byte(bucket.Name))
+	if b == nil {
+		return nil, ent.ErrFileNotFound
+	}
+
+	v := b.Get([]byte(key))
+	if v == nil {
+		return nil, ent.ErrFileNotFound
+	}
+
+	bv, err := decodeBoltValue(v)
+	if err != nil {
+		return nil, err
+	}
+
+	created, err := boltCreated(tx, bucket, []byte(key), bv.lastModified)
+	if err != nil {
+		return nil, err
+	}
+
+	return fs.newBoltFile(bucket, key, created, bv), nil
+}
+
+func (fs *boltFS) List(
+	bucket *ent.Bucket,
+	prefix string,
+	limit uint64,
+	sortStrategy ent.SortStrategy,
+) (ent.Files, error) {
+	files := ent.Files{}
+
+	err := fs.Walk(bucket, prefix, ent.ModifiedRange{}, func(f ent.File) error {
+		files = append(files, f)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sortStrategy.Sort(files)
+
+	if limit < uint64(len(files)) {
+		files = files[:limit]
+	}
+
+	return files, nil
+}
+
+// WalkDir walks the files of bucket like Walk, reporting the common prefixes
+// of keys continuing with a slash after prefix to dirFn.
+func (fs *boltFS) WalkDir(
+	bucket *ent.Bucket,
+	prefix string,
+	modified ent.ModifiedRange,
+	fn func(ent.File) error,
+	dirFn func(string) error,
+) error {
+	return fs.Walk(bucket, prefix, modified, ent.DelimitWalk(prefix, fn, dirFn))
+}
+
+// Walk calls fn within a read transaction, which is held open for as long as
+// the walk takes.
+func (fs *boltFS) Walk(
+	bucket *ent.Bucket,
+	prefix string,
+	modified ent.ModifiedRange,
+	fn func(ent.File) error,
+) error {
+	return fs.WalkKeys(bucket, prefix, modified, "", fn)
+}
+
+// WalkKeys walks the files like Walk, which already visits them in key order
+// as they are stored in a B+tree.
+func (fs *boltFS) WalkKeys(
+	bucket *ent.Bucket,
+	prefix string,
+	modified ent.ModifiedRange,
+	start string,
+	fn func(ent.File) error,
+) error {
+	return fs.db.View(func(tx *bolt.Tx) error {
+		// In case no files have been stored yet for a bucket we treat it as if
+		// the bucket is empty.
+		b := tx.Bucket([]byte(bucket.Name))
+		if b == nil {
+			return nil
+		}
+
+		var (
+			c = b.Cursor()
+			p = []byte(prefix)
+		)
+
+		seek := p
+		if start > prefix {
+			seek = []byte(start)
+		}
+
+		for k, v := c.Seek(seek); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			bv, err := decodeBoltValue(v)
+			if err != nil {
+				return err
+			}
+
+			if !modified.Contains(bv.lastModified) {
+				continue
+			}
+
+			created, err := boltCreated(tx, bucket, k, bv.lastModified)
+			if err != nil {
+				return err
+			}
+
+			err = fn(fs.newBoltFile(bucket, string(k), created, bv))
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (fs *boltFS) Usage(bucket *ent.Bucket) (uint64, error) {
+	stats, err := fs.Stats(bucket)
+	return stats.Bytes, err
+}
+
+func (fs *boltFS) Stats(bucket *ent.Bucket) (ent.BucketStats, error) {
+	var stats ent.BucketStats
+
+	err := fs.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket.Name))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			bv, err := decodeBoltValue(v)
+			if err != nil {
+				return err
+			}
+
+			stats.Files++
+			stats.Bytes += uint64(bv.size)
+			return nil
+		})
+	})
+	if err != nil {
+		return ent.BucketStats{}, fmt.Errorf("stats of %s failed: %s", bucket.Name, err)
+	}
+
+	return stats, nil
+}
+
+func (fs *boltFS) Meta(bucket *ent.Bucket, key string) (ent.Meta, error) {
+	m := ent.Meta{}
+
+	err := fs.db.View(func(tx *bolt.Tx) error {
+		mb := tx.Bucket(boltMetaBucket(bucket))
+		if mb == nil {
+			return nil
+		}
+
+		v := mb.Get([]byte(key))
+		if v == nil {
+			return nil
+		}
+
+		return json.Unmarshal(v, &m)
+	})
+	if err != nil {
+		return m, fmt.Errorf("reading meta failed: %s", err)
+	}
+
+	return m, nil
+}
+
+func (fs *boltFS) SetMeta(bucket *ent.Bucket, key string, m ent.Meta) error {
+	return fs.UpdateMeta(bucket, key, func(prev *ent.Meta) {
+		*prev = m
+	})
+}
+
+// boltFile reads its content from the chunks stored under the id of its
+// value, a chunk at a time. Reading content which was replaced or deleted
+// after the file was opened fails with errBoltRemoved.
+type boltFile struct {
+	bucket  *ent.Bucket
+	created time.Time
+	db      *bolt.DB
+	key     string
+	offset  int64
+	value   boltValue
+}
+
+func (fs *boltFS) newBoltFile(bucket *ent.Bucket, key string, created time.Time, v boltValue) *boltFile {
+	return &boltFile{
+		bucket:  bucket,
+		created: created,
+		db:      fs.db,
+		key:     key,
+		value:   v,
+	}
+}
+
+func (f *boltFile) Close() error {
+	return nil
+}
+
+func (f *boltFile) CRC32C() (uint32, error) {
+	return f.value.crc, nil
+}
+
+func (f *boltFile) Created() time.Time {
+	return f.created
+}
+
+func (f *boltFile) ETag() (string, error) {
+	return ent.FileETag(f, func() []byte {
+		return f.value.md5
+	})
+}
+
+func (f *boltFile) Hash() ([]byte, error) {
+	return f.value.hash, nil
+}
+
+func (f *boltFile) Key() string {
+	return f.key
+}
+
+func (f *boltFile) LastModified() time.Time {
+	return f.value.lastModified
+}
+
+func (f *boltFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+
+	if err == io.EOF && n > 0 {
+		return n, nil
+	}
+
+	return n, err
+}
+
+// ReadAt reads the chunks overlapping p in a single read transaction.
+func (f *boltFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= f.value.size {
+		return 0, io.EOF
+	}
+
+	n := 0
+
+	err := f.db.View(func(tx *bolt.Tx) error {
+		cb := tx.Bucket(boltChunkBucket(f.bucket))
+		if cb == nil {
+			return errBoltRemoved
+		}
+
+		for n < len(p) && off < f.value.size {
+			var (
+				chunk = cb.Get(boltChunkKey(f.value.id, uint32(off/boltChunkSize)))
+				start = off % boltChunkSize
+			)
+
+			if int64(len(chunk)) <= start {
+				return errBoltRemoved
+			}
+
+			c := copy(p[n:], chunk[start:])
+			n += c
+			off += int64(c)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func (f *boltFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.value.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	f.offset = offset
+
+	return offset, nil
+}
+
+func (f *boltFile) Size() (int64, error) {
+	return f.value.size, nil
+}
+
+func (f *boltFile) Write(p []byte) (int, error) {
+	return 0, errBoltReadOnly
+}
+
+// boltCreated returns the creation time recorded in the Meta of key, files
+// stored before it was recorded report lastModified instead.
+func boltCreated(tx *bolt.Tx, bucket *ent.Bucket, key []byte, lastModified time.Time) (time.Time, error) {
+	m, err := boltMeta(tx, bucket, key)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if m.Created.IsZero() {
+		return lastModified, nil
+	}
+
+	return m.Created, nil
+}
+
+// boltMeta returns the Meta recorded for key, which is empty if none has been
+// stored yet.
+func boltMeta(tx *bolt.Tx, bucket *ent.Bucket, key []byte) (ent.Meta, error) {
+	var m ent.Meta
+
+	mb := tx.Bucket(boltMetaBucket(bucket))
+	if mb == nil {
+		return m, nil
+	}
+
+	v := mb.Get(key)
+	if v == nil {
+		return m, nil
+	}
+
+	err := json.Unmarshal(v, &m)
+	if err != nil {
+		return ent.Meta{}, fmt.Errorf("reading meta failed: %s", err)
+	}
+
+	return m, nil
+}
+
+// putBoltMeta replaces the Meta recorded for key.
+func putBoltMeta(tx *bolt.Tx, bucket *ent.Bucket, key string, m ent.Meta) error {
+	mb, err := tx.CreateBucketIfNotExists(boltMetaBucket(bucket))
+	if err != nil {
+		return err
+	}
+
+	v, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	return mb.Put([]byte(key), v)
+}
+
+// boltMetaBucket returns the name of the bolt bucket holding the Meta for
+// files of bucket.
+func boltMetaBucket(bucket *ent.Bucket) []byte {
+	return []byte(bucket.Name + metaExt)
+}
+
+// boltValue is stored under the key of a file and describes its content,
+// which is kept in chunks under id.
+type boltValue struct {
+	lastModified time.Time
+	size         int64
+	id           []byte
+	hash         []byte
+	crc          uint32
+	md5          []byte
+}
+
+func encodeBoltValue(bv boltValue) []byte {
+	v := make([]byte, boltValueSize, boltValueSize+len(bv.md5))
+	binary.BigEndian.PutUint64(v, uint64(bv.lastModified.UnixNano()))
+	binary.BigEndian.PutUint64(v[8:], uint64(bv.size))
+	copy(v[16:], bv.id)
+	copy(v[16+boltIDSize:], bv.hash)
+	binary.BigEndian.PutUint32(v[16+boltIDSize+sha1.Size:], bv.crc)
+	return append(v, bv.md5...)
+}
+
+// decodeBoltValue decodes a value, the slices of the result are copies as
+// values are only valid for the life of the transaction.
+func decodeBoltValue(v []byte) (boltValue, error) {
+	if len(v) != boltValueSize && len(v) != boltValueSize+md5.Size {
+		return boltValue{}, fmt.Errorf("corrupt bolt value of %d bytes", len(v))
+	}
+
+	v = append([]byte{}, v...)
+
+	bv := boltValue{
+		lastModified: time.Unix(0, int64(binary.BigEndian.Uint64(v))),
+		size:         int64(binary.BigEndian.Uint64(v[8:])),
+		id:           v[16 : 16+boltIDSize],
+		hash:         v[16+boltIDSize : 16+boltIDSize+sha1.Size],
+		crc:          binary.BigEndian.Uint32(v[16+boltIDSize+sha1.Size:]),
+	}
+	if len(v) > boltValueSize {
+		bv.md5 = v[boltValueSize:]
+	}
+
+	return bv, nil
+}
+
+// newBoltID returns a new id to store content under, which begins at now.
+func newBoltID(now time.Time) ([]byte, error) {
+	id := make([]byte, boltIDSize)
+	binary.BigEndian.PutUint64(id, uint64(now.UnixNano()))
+
+	_, err := rand.Read(id[8:])
+	if err != nil {
+		return nil, err
+	}
+
+	return id, nil
+}
+
+// boltIDTime returns the time storing the content under id began.
+func boltIDTime(id []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(id)))
+}
+
+// boltChunkBucket returns the name of the bolt bucket holding the chunks of
+// files of bucket.
+func boltChunkBucket(bucket *ent.Bucket) []byte {
+	return []byte(bucket.Name + boltChunkExt)
+}
+
+// boltChunkKey returns the key of the i-th chunk of the content stored under
+// id.
+func boltChunkKey(id []byte, i uint32) []byte {
+	k := make([]byte, boltIDSize+4)
+	copy(k, id)
+	binary.BigEndian.PutUint32(k[boltIDSize:], i)
+	return k
+}
+
+// deleteBoltChunks removes the chunks of the content described by the stored
+// value v.
+func deleteBoltChunks(tx *bolt.Tx, bucket *ent.Bucket, v []byte) error {
+	bv, err := decodeBoltValue(v)
+	if err != nil {
+		return err
+	}
+
+	cb := tx.Bucket(boltChunkBucket(bucket))
+	if cb == nil {
+		return nil
+	}
+
+	return deleteChunks(cb, bv.id)
+}
+
+// deleteChunks removes the chunks stored under id from cb. The cursor seeks
+// again after every deletion, as deleting moves it ahead.
+func deleteChunks(cb *bolt.Bucket, id []byte) error {
+	c := cb.Cursor()
+
+	for k, _ := c.Seek(id); k != nil && bytes.HasPrefix(k, id); k, _ = c.Seek(id) {
+		err := c.Delete()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/soundcloud/ent/lib"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestBoltFSCreate(t *testing.T) {
+	fs, cleanup := newTestBoltFS(t)
+	defer cleanup()
+
+	var (
+		b   = ent.NewBucket("create", ent.Owner{})
+		h   = sha1.New()
+		key = filepath.Base(fixtureZip)
+	)
+
+	r, err := os.Open(fixtureZip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	created, err := fs.Create(b, key, io.TeeReader(r, h))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := fs.Open(b, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if have, want := f.LastModified(), created.LastModified(); !have.Equal(want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	s := sha1.New()
+
+	_, err = io.Copy(s, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		have = hex.EncodeToString(s.Sum(nil))
+		want = hex.EncodeToString(h.Sum(nil))
+	)
+
+	if have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	sum, err := f.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have := hex.EncodeToString(sum); have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+}
+
+func TestBoltFSCreated(t *testing.T) {
+	fs, cleanup := newTestBoltFS(t)
+	defer cleanup()
+
+	b := ent.NewBucket("created", ent.Owner{})
+
+	first, err := fs.Create(b, "created.txt", strings.NewReader("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := fs.Create(b, "created.txt", strings.NewReader("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := fs.Open(b, "created.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, f := range []ent.File{second, f} {
+		if have, want := f.Created(), first.Created(); !have.Equal(want) {
+			t.Errorf("have %v, want %v", have, want)
+		}
+	}
+}
+
+func TestBoltFSDelete(t *testing.T) {
+	fs, cleanup := newTestBoltFS(t)
+	defer cleanup()
+
+	var (
+		b   = ent.NewBucket("delete", ent.Owner{})
+		key = "delete.me"
+	)
+
+	err := fs.Delete(b, key)
+	if have, want := err, ent.ErrFileNotFound; have != want {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	_, err = fs.Create(b, key, strings.NewReader("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fs.Delete(b, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = fs.Open(b, key)
+	if !ent.IsFileNotFound(err) {
+		t.Errorf("have %v, want %v", err, ent.ErrFileNotFound)
+	}
+}
+
+func TestBoltFSUsage(t *testing.T) {
+	fs, cleanup := newTestBoltFS(t)
+	defer cleanup()
+
+	b := ent.NewBucket("usage", ent.Owner{})
+
+	for _, key := range []string{"a", "b"} {
+		_, err := fs.Create(b, key, strings.NewReader("12345"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := fs.Usage(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := n, uint64(10); have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+}
+
+func TestBoltFSList(t *testing.T) {
+	fs, cleanup := newTestBoltFS(t)
+	defer cleanup()
+
+	var (
+		b    = ent.NewBucket("list", ent.Owner{})
+		keys = []string{
+			"one",
+			"prefix1",
+			"prefix2",
+			"prefix3",
+			"temp1",
+			"temp2",
+			"test/depth",
+		}
+
+		listTestEntries = []struct {
+			prefix        string
+			limit         uint64
+			expectedCount int
+		}{
+			{"test", 1, 1},
+			{"temp", 1, 1},
+			{"temp", 13, 2},
+			{"prefix", ent.DefaultLimit, 3},
+			{"unexistedPrefix", 1000, 0},
+			{"", ent.DefaultLimit, len(keys)},
+			{"o", 20, 1},
+		}
+	)
+
+	all, err := fs.List(b, "", ent.DefaultLimit, ent.NoOpStrategy())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := len(all), 0; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+
+	for _, key := range keys {
+		_, err := fs.Create(b, key, strings.NewReader(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, input := range listTestEntries {
+		all, err := fs.List(b, input.prefix, input.limit, ent.NoOpStrategy())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have, want := len(all), input.expectedCount; have != want {
+			t.Errorf("%q(%d): have %d, want %d", input.prefix, input.limit, have, want)
+		}
+
+		for _, file := range all {
+			if !strings.HasPrefix(file.Key(), input.prefix) {
+				t.Errorf("%q should start with %q", file.Key(), input.prefix)
+			}
+		}
+	}
+
+	strategy, err := createSortStrategy("-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all, err = fs.List(b, "", ent.DefaultLimit, strategy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := len(all), len(keys); have != want {
+		t.Fatalf("have %d, want %d", have, want)
+	}
+
+	for i := 1; i < len(all); i++ {
+		if all[i-1].Key() < all[i].Key() {
+			t.Errorf("not sorted correctly %s < %s", all[i-1].Key(), all[i].Key())
+			break
+		}
+	}
+
+	strategy, err = createSortStrategy("+lastModified")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all, err = fs.List(b, "", ent.DefaultLimit, strategy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i < len(all); i++ {
+		if all[i-1].LastModified().After(all[i].LastModified()) {
+			t.Errorf("not sorted correctly %s after %s", all[i-1].LastModified(), all[i].LastModified())
+			break
+		}
+	}
+}
+
+func TestBoltFSChunks(t *testing.T) {
+	fs, cleanup := newTestBoltFS(t)
+	defer cleanup()
+
+	var (
+		b       = ent.NewBucket("chunks", ent.Owner{})
+		content = make([]byte, 2*boltChunkSize+1234)
+	)
+
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+
+	_, err := fs.Create(b, "chunked", bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := fs.Open(b, "chunked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	read, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(read, content) {
+		t.Errorf("have %d bytes, want %d", len(read), len(content))
+	}
+
+	// Reads spanning the boundary of chunks.
+	p := make([]byte, 100)
+
+	n, err := f.(io.ReaderAt).ReadAt(p, boltChunkSize-50)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := p[:n], content[boltChunkSize-50:boltChunkSize+50]; !bytes.Equal(have, want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	_, err = f.Seek(-10, io.SeekEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err = f.Read(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := p[:n], content[len(content)-10:]; !bytes.Equal(have, want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	stats, err := fs.Stats(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := stats.Bytes, uint64(len(content)); have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+
+	// Replacing and deleting the file removes its chunks.
+	_, err = fs.Create(b, "chunked", strings.NewReader("replaced"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := countBoltChunks(t, fs, b), 1; have != want {
+		t.Errorf("have %d chunks, want %d", have, want)
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = f.Read(p)
+	if have, want := err, errBoltRemoved; have != want {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	err = fs.Delete(b, "chunked")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := countBoltChunks(t, fs, b), 0; have != want {
+		t.Errorf("have %d chunks, want %d", have, want)
+	}
+}
+
+func TestBoltFSSweep(t *testing.T) {
+	fs, cleanup := newTestBoltFS(t)
+	defer cleanup()
+
+	b := ent.NewBucket("sweep", ent.Owner{})
+
+	_, err := fs.Create(b, "stored", strings.NewReader("stored"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The chunks of a write interrupted before it stored them under a key.
+	_, err = fs.storeChunks(b, strings.NewReader("interrupted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := fs.Sweep(time.Now().Add(-time.Hour), time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := stats.pending, 0; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+
+	stats, err = fs.Sweep(time.Now().Add(time.Hour), time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := stats.pending, 1; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+
+	f, err := fs.Open(b, "stored")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := string(content), "stored"; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+}
+
+func countBoltChunks(t *testing.T, fs *boltFS, bucket *ent.Bucket) int {
+	n := 0
+
+	err := fs.db.View(func(tx *bolt.Tx) error {
+		cb := tx.Bucket(boltChunkBucket(bucket))
+		if cb == nil {
+			return nil
+		}
+
+		n = cb.Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return n
+}
+
+func newTestBoltFS(t *testing.T) (*boltFS, func()) {
+	tmp, err := ioutil.TempDir("", "ent-boltfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs, err := newBoltFS(filepath.Join(tmp, "ent.db"))
+	if err != nil {
+		os.RemoveAll(tmp)
+		t.Fatal(err)
+	}
+
+	return fs, func() {
+		fs.Close()
+		os.RemoveAll(tmp)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+// bufferSize is the size in bytes of the buffers content is copied with.
+var bufferSize = 32 * 1024
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, bufferSize)
+		return &buf
+	},
+}
+
+// copyBuffer copies from r to w like io.Copy, but always through a pooled
+// buffer of bufferSize. ReadFrom of w and WriteTo of r are not used, as they
+// bring buffers of their own.
+func copyBuffer(w io.Writer, r io.Reader) (int64, error) {
+	bp := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(bp)
+
+	// Buffers pooled before bufferSize changed are replaced.
+	if len(*bp) != bufferSize {
+		*bp = make([]byte, bufferSize)
+	}
+
+	return io.CopyBuffer(writerOnly{w}, readerOnly{r}, *bp)
+}
+
+type writerOnly struct {
+	io.Writer
+}
+
+type readerOnly struct {
+	io.Reader
+}
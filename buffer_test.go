@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestCopyBuffer(t *testing.T) {
+	defer func(size int) { bufferSize = size }(bufferSize)
+
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+
+	for _, size := range []int{1, 4096, 1 << 20} {
+		bufferSize = size
+
+		var dst bytes.Buffer
+
+		n, err := copyBuffer(&dst, bytes.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have, want := n, int64(len(content)); have != want {
+			t.Errorf("size %d: have %d, want %d", size, have, want)
+		}
+
+		if !bytes.Equal(dst.Bytes(), content) {
+			t.Errorf("size %d: content differs", size)
+		}
+	}
+}
+
+// BenchmarkDiskFSCreateBufferSize measures storing a large blob when copying
+// it with buffers of different sizes.
+func BenchmarkDiskFSCreateBufferSize(b *testing.B) {
+	defer func(size int) { bufferSize = size }(bufferSize)
+
+	for _, size := range []int{32 << 10, 256 << 10, 1 << 20, 4 << 20} {
+		b.Run(fmt.Sprintf("buffer=%dKB", size>>10), func(b *testing.B) {
+			bufferSize = size
+			benchmarkDiskFSCreate(b, false, withFsync(false))
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/soundcloud/ent/lib"
+)
+
+// bundleWriter writes files as entries of an archive named by their key.
+type bundleWriter interface {
+	Add(f ent.File) error
+	Close() error
+}
+
+type tarBundle struct {
+	w *tar.Writer
+}
+
+func (b tarBundle) Add(f ent.File) error {
+	size, err := f.Size()
+	if err != nil {
+		return err
+	}
+
+	err = b.w.WriteHeader(&tar.Header{
+		Name:    f.Key(),
+		Mode:    0644,
+		Size:    size,
+		ModTime: f.LastModified(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = copyBuffer(b.w, f)
+	return err
+}
+
+func (b tarBundle) Close() error {
+	return b.w.Close()
+}
+
+type zipBundle struct {
+	w *zip.Writer
+}
+
+func (b zipBundle) Add(f ent.File) error {
+	w, err := b.w.CreateHeader(&zip.FileHeader{
+		Name:     f.Key(),
+		Method:   zip.Deflate,
+		Modified: f.LastModified(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = copyBuffer(w, f)
+	return err
+}
+
+func (b zipBundle) Close() error {
+	return b.w.Close()
+}
+
+// handleBundle streams the files whose key starts with the prefix param as a
+// tar or zip archive, following the bundle param. Entries are written as the
+// files are read, only the keys are held in memory. Files expired or deleted
+// in the meantime are left out.
+func handleBundle(p ent.Provider, fs ent.FileSystem) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			bucket = r.URL.Query().Get(ent.KeyBucket)
+			format = r.URL.Query().Get(ent.ParamBundle)
+			prefix = r.URL.Query().Get(ent.ParamPrefix)
+		)
+
+		b, err := getBucket(p, bucket)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		var (
+			bw          bundleWriter
+			contentType string
+		)
+
+		switch format {
+		case ent.BundleTar:
+			bw, contentType = tarBundle{tar.NewWriter(w)}, ent.ContentTypeTar
+		case ent.BundleZip:
+			bw, contentType = zipBundle{zip.NewWriter(w)}, ent.ContentTypeZip
+		default:
+			respondError(w, r, ent.ErrInvalidParam)
+			return
+		}
+
+		// The files are listed first as backends may not allow opening files
+		// while walking them.
+		keys := []string{}
+
+		err = fs.Walk(b, prefix, ent.ModifiedRange{}, func(f ent.File) error {
+			keys = append(keys, f.Key())
+			return nil
+		})
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+			"filename": bundleName(b, prefix, format),
+		}))
+		w.WriteHeader(http.StatusOK)
+
+		for _, key := range keys {
+			err := addToBundle(bw, fs, b, key)
+			if err != nil {
+				log.Printf("ERROR could not stream %s: %s", r.RequestURI, err)
+				return
+			}
+		}
+
+		err = bw.Close()
+		if err != nil {
+			log.Printf("ERROR could not stream %s: %s", r.RequestURI, err)
+		}
+	}
+}
+
+// addToBundle adds the file under key to bw unless it expired or was deleted.
+func addToBundle(bw bundleWriter, fs ent.FileSystem, b *ent.Bucket, key string) error {
+	f, err := fs.Open(b, key)
+	if err == ent.ErrFileNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = checkExpired(fs, b, key)
+	if err == ent.ErrFileNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return bw.Add(f)
+}
+
+// bundleName returns the file name suggested for a bundle, made of the bucket
+// and the prefix, e.g. logs-2016-05.tar for the prefix 2016/05/ in logs.
+func bundleName(b *ent.Bucket, prefix, format string) string {
+	name := b.Name
+
+	if p := strings.Trim(prefix, "/"); p != "" {
+		name += "-" + strings.Replace(p, "/", "-", -1)
+	}
+
+	return name + "." + format
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/pat"
+	"github.com/soundcloud/ent/lib"
+)
+
+func TestHandleBundle(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-bundle-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		b  = ent.NewBucket("bundle", ent.Owner{})
+		fs = newCompressFS(newDiskFS(tmp))
+		r  = pat.New()
+	)
+	b.Compression = ent.CompressionGzip
+
+	r.Get(ent.RouteBucket, handleFileList(ent.NewMemoryProvider(b), fs))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	want := map[string]string{
+		"logs/2016/a.txt":        "first",
+		"logs/2016/nested/b.txt": strings.Repeat("second ", 1000),
+		"logs/2016/empty.txt":    "",
+	}
+
+	for key, content := range want {
+		_, err := fs.Create(b, key, strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = fs.Create(b, "logs/2017/c.txt", strings.NewReader("unrelated"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read := map[string]func([]byte) map[string]string{
+		ent.BundleTar: func(raw []byte) map[string]string {
+			entries := map[string]string{}
+			tr := tar.NewReader(bytes.NewReader(raw))
+
+			for {
+				h, err := tr.Next()
+				if err == io.EOF {
+					return entries
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				content, err := ioutil.ReadAll(tr)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				entries[h.Name] = string(content)
+			}
+		},
+		ent.BundleZip: func(raw []byte) map[string]string {
+			entries := map[string]string{}
+
+			zr, err := zip.NewReader(bytes.NewReader(raw), int64(len(raw)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, f := range zr.File {
+				rc, err := f.Open()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				content, err := ioutil.ReadAll(rc)
+				rc.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				entries[f.Name] = string(content)
+			}
+
+			return entries
+		},
+	}
+
+	for format, read := range read {
+		res, err := http.Get(fmt.Sprintf("%s/%s?prefix=logs/2016/&bundle=%s", ts.URL, b.Name, format))
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have, want := res.StatusCode, http.StatusOK; have != want {
+			t.Fatalf("%s: have %d, want %d", format, have, want)
+		}
+
+		_, params, err := mime.ParseMediaType(res.Header.Get("Content-Disposition"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have, want := params["filename"], "bundle-logs-2016."+format; have != want {
+			t.Errorf("%s: have %s, want %s", format, have, want)
+		}
+
+		// Entries hold the content as uploaded, not as stored.
+		if have := read(raw); !reflect.DeepEqual(have, want) {
+			t.Errorf("%s: have %v, want %v", format, have, want)
+		}
+	}
+
+	res, err := http.Get(fmt.Sprintf("%s/%s?bundle=rar", ts.URL, b.Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if have, want := res.StatusCode, http.StatusBadRequest; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+}
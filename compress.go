@@ -0,0 +1,566 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/soundcloud/ent/lib"
+)
+
+var errCompressedReadOnly = errors.New("compressed file is read-only")
+
+// Streaming encoders are expensive to create, they are pooled and reset to the
+// writer of the file or response they are used for.
+var encoderPools = map[string]*sync.Pool{
+	ent.CompressionGzip: {
+		New: func() interface{} {
+			return gzip.NewWriter(nil)
+		},
+	},
+	ent.CompressionZstd: {
+		New: func() interface{} {
+			w, _ := zstd.NewWriter(nil)
+			return w
+		},
+	},
+}
+
+// responseEncodings lists the content encodings offered for responses in
+// order of preference when the client rates them equally.
+var responseEncodings = []string{ent.CompressionZstd, ent.CompressionGzip}
+
+type resetWriter interface {
+	io.WriteCloser
+	Reset(io.Writer)
+}
+
+// compressFS wraps a FileSystem and compresses files at rest following the
+// Compression policy of their bucket. The codec is recorded in the Meta stored
+// along with every file so it is read back correctly after the policy
+// changed. Content is compressed and decompressed while it streams through.
+type compressFS struct {
+	ent.FileSystem
+}
+
+func newCompressFS(fs ent.FileSystem) *compressFS {
+	return &compressFS{
+		FileSystem: fs,
+	}
+}
+
+func (fs *compressFS) Create(
+	bucket *ent.Bucket,
+	key string,
+	r io.Reader,
+) (ent.File, error) {
+	return fs.create(bucket, key, r, createOptions{})
+}
+
+func (fs *compressFS) CreateExclusive(
+	bucket *ent.Bucket,
+	key string,
+	r io.Reader,
+) (ent.File, error) {
+	return fs.create(bucket, key, r, createOptions{exclusive: true})
+}
+
+// create compresses the content with the codec of the bucket while it is
+// stored, the codec is recorded in the Meta stored along with it.
+func (fs *compressFS) create(
+	bucket *ent.Bucket,
+	key string,
+	r io.Reader,
+	o createOptions,
+) (ent.File, error) {
+	codec := bucket.Compression
+	if codec == ent.CompressionNone {
+		codec = ""
+	}
+
+	o.meta.Compression = codec
+
+	if codec == "" {
+		return createWithMeta(fs.FileSystem, bucket, key, r, o)
+	}
+
+	var (
+		digest = newDigest()
+		pr, pw = io.Pipe()
+		done   = make(chan struct{})
+	)
+
+	o.content = digest
+
+	go func() {
+		defer close(done)
+		pw.CloseWithError(compressTo(pw, codec, io.TeeReader(r, digest)))
+	}()
+
+	f, err := createWithMeta(fs.FileSystem, bucket, key, pr, o)
+
+	// Stops the compression if storing failed before all of it was read.
+	pr.Close()
+	<-done
+
+	if err != nil {
+		return nil, err
+	}
+
+	return newCompressedFile(f, codec, digest), nil
+}
+
+func (fs *compressFS) Open(bucket *ent.Bucket, key string) (ent.File, error) {
+	f, m, err := openWithMeta(fs.FileSystem, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.Compression == "" {
+		return f, nil
+	}
+
+	return newCompressedFile(f, m.Compression, nil), nil
+}
+
+// OpenVersion decompresses the version with the codec recorded for it.
+func (fs *compressFS) OpenVersion(bucket *ent.Bucket, key, hash string) (ent.File, error) {
+	vs, err := fs.FileSystem.Versions(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := fs.FileSystem.OpenVersion(bucket, key, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	codec := ""
+	for _, v := range vs {
+		if v.Hash == hash {
+			codec = v.Compression
+		}
+	}
+
+	if codec == "" {
+		return f, nil
+	}
+
+	return newCompressedFile(f, codec, nil), nil
+}
+
+// SetMeta stores meta while keeping the codec recorded for the file, as it
+// describes the stored content rather than an attribute set by clients.
+func (fs *compressFS) SetMeta(bucket *ent.Bucket, key string, meta ent.Meta) error {
+	return fs.UpdateMeta(bucket, key, func(m *ent.Meta) {
+		*m = meta
+	})
+}
+
+// compressTo writes the content read from r to w compressed with codec.
+func compressTo(w io.Writer, codec string, r io.Reader) error {
+	pool, ok := encoderPools[codec]
+	if !ok {
+		return fmt.Errorf("unknown compression %q", codec)
+	}
+
+	enc := pool.Get().(resetWriter)
+	defer pool.Put(enc)
+
+	enc.Reset(w)
+
+	_, err := copyBuffer(enc, r)
+	if err != nil {
+		return err
+	}
+
+	err = enc.Close()
+	if err != nil {
+		return fmt.Errorf("%s failed: %s", codec, err)
+	}
+
+	return nil
+}
+
+// newDecoder returns a reader decompressing the content read from r with
+// codec.
+func newDecoder(codec string, r io.Reader) (io.ReadCloser, error) {
+	switch codec {
+	case ent.CompressionGzip:
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("gunzip failed: %s", err)
+		}
+
+		return gr, nil
+	case ent.CompressionZstd:
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("zstd failed: %s", err)
+		}
+
+		return d.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("unknown compression %q", codec)
+	}
+}
+
+// compressResponses makes blobs be sent compressed to clients accepting one
+// of the responseEncodings.
+var compressResponses = false
+
+// responseEncoding returns the content encoding the content of a blob is sent
+// with in response to r, which is empty unless compressResponses is set.
+// Range requests are always answered unencoded.
+func responseEncoding(r *http.Request) string {
+	if !compressResponses || r.Header.Get("Range") != "" {
+		return ""
+	}
+
+	return negotiateEncoding(r.Header.Get("Accept-Encoding"))
+}
+
+// encodedETag returns the ETag of content with the given etag sent with a
+// content encoding, keeping the quotes of etag if it has them.
+func encodedETag(etag, encoding string) string {
+	if strings.HasPrefix(etag, `"`) {
+		return `"` + unquoteETag(etag) + "-" + encoding + `"`
+	}
+
+	return etag + "-" + encoding
+}
+
+// negotiateEncoding returns the content encoding to use for a response given
+// the Accept-Encoding header of the request, an empty string is returned if
+// none of the offered encodings is acceptable.
+func negotiateEncoding(accept string) string {
+	var (
+		best     string
+		bestQ    float64
+		accepted = map[string]float64{}
+	)
+
+	for _, part := range strings.Split(accept, ",") {
+		var (
+			fields = strings.Split(part, ";")
+			name   = strings.ToLower(strings.TrimSpace(fields[0]))
+			q      = 1.0
+		)
+
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+
+			v, err := strconv.ParseFloat(param[2:], 64)
+			if err != nil {
+				v = 0
+			}
+			q = v
+		}
+
+		accepted[name] = q
+	}
+
+	for _, encoding := range responseEncodings {
+		q, ok := accepted[encoding]
+		if !ok || q <= bestQ {
+			continue
+		}
+
+		best, bestQ = encoding, q
+	}
+
+	return best
+}
+
+// encodedResponseWriter compresses the body of successful responses with the
+// given content encoding. Other responses, like partial content or not
+// modified, are passed through as is. Close must be called to flush the
+// encoded body.
+type encodedResponseWriter struct {
+	http.ResponseWriter
+
+	encoding    string
+	enc         resetWriter
+	wroteHeader bool
+}
+
+func newEncodedResponseWriter(w http.ResponseWriter, encoding string) *encodedResponseWriter {
+	return &encodedResponseWriter{
+		ResponseWriter: w,
+		encoding:       encoding,
+	}
+}
+
+func (w *encodedResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	if code == http.StatusOK {
+		w.Header().Del("Content-Length")
+		w.Header().Set("Content-Encoding", w.encoding)
+
+		w.enc = encoderPools[w.encoding].Get().(resetWriter)
+		w.enc.Reset(w.ResponseWriter)
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *encodedResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.enc == nil {
+		return w.ResponseWriter.Write(p)
+	}
+
+	return w.enc.Write(p)
+}
+
+// ReadFrom copies r to the encoder with buffers of bufferSize, it is used by
+// http.ServeContent to send the content.
+func (w *encodedResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	return copyBuffer(w, r)
+}
+
+func (w *encodedResponseWriter) Close() error {
+	if w.enc == nil {
+		return nil
+	}
+
+	err := w.enc.Close()
+	encoderPools[w.encoding].Put(w.enc)
+	w.enc = nil
+
+	return err
+}
+
+// compressedFile decompresses the content of a file stored compressed while
+// it is read. Seeking backwards decompresses from the start again. Size, Hash
+// and CRC32C decompress all of the content once, unless it has been digested
+// while it was stored or its digests have been recorded then.
+type compressedFile struct {
+	codec  string
+	dec    io.ReadCloser
+	digest *ent.Digest
+	// pos is the offset of dec in the content, offset the one of the next
+	// Read.
+	pos    int64
+	offset int64
+
+	// File is the file as stored, it provides Key, Created and LastModified.
+	ent.File
+}
+
+func newCompressedFile(f ent.File, codec string, digest *ent.Digest) *compressedFile {
+	return &compressedFile{
+		codec:  codec,
+		digest: digest,
+		File:   f,
+	}
+}
+
+// decoder returns a decoder reading the content from the start, independent
+// of the offset of the stored file.
+func (f *compressedFile) decoder() (io.ReadCloser, error) {
+	size, err := f.File.Size()
+	if err != nil {
+		return nil, err
+	}
+
+	return newDecoder(f.codec, io.NewSectionReader(f.File, 0, size))
+}
+
+func (f *compressedFile) Close() error {
+	if f.dec != nil {
+		f.dec.Close()
+	}
+
+	return f.File.Close()
+}
+
+func (f *compressedFile) Read(p []byte) (int, error) {
+	if f.dec == nil || f.offset < f.pos {
+		if f.dec != nil {
+			f.dec.Close()
+		}
+
+		dec, err := f.decoder()
+		if err != nil {
+			return 0, err
+		}
+
+		f.dec, f.pos = dec, 0
+	}
+
+	if f.offset > f.pos {
+		n, err := io.CopyN(ioutil.Discard, f.dec, f.offset-f.pos)
+		f.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.dec.Read(p)
+	f.pos += int64(n)
+	f.offset = f.pos
+
+	return n, err
+}
+
+// ReadAt decompresses the content up to off with a decoder of its own, so it
+// doesn't affect Read.
+func (f *compressedFile) ReadAt(p []byte, off int64) (int, error) {
+	dec, err := f.decoder()
+	if err != nil {
+		return 0, err
+	}
+	defer dec.Close()
+
+	_, err = io.CopyN(ioutil.Discard, dec, off)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.ReadFull(dec, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+
+	return n, err
+}
+
+func (f *compressedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		size, err := f.Size()
+		if err != nil {
+			return 0, err
+		}
+		offset += size
+	default:
+		return 0, errors.New("compressedFile.Seek: invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, errors.New("compressedFile.Seek: negative position")
+	}
+
+	f.offset = offset
+
+	return offset, nil
+}
+
+// recorded returns the digests recorded for the decompressed content, nil if
+// the content has been digested while stored already or none were recorded.
+func (f *compressedFile) recorded() *contentDigests {
+	if f.digest != nil {
+		return nil
+	}
+	return recordedContent(f.File)
+}
+
+// recordedMD5 returns the MD5 of the decompressed content if it has been
+// digested while stored or recorded then.
+func (f *compressedFile) recordedMD5() []byte {
+	if f.digest != nil {
+		return f.digest.MD5()
+	}
+	if c := recordedContent(f.File); c != nil {
+		return c.md5()
+	}
+	return nil
+}
+
+// digested returns the digest of the whole content.
+func (f *compressedFile) digested() (*ent.Digest, error) {
+	if f.digest != nil {
+		return f.digest, nil
+	}
+
+	dec, err := f.decoder()
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+
+	d := newDigest()
+
+	_, err = copyBuffer(d, dec)
+	if err != nil {
+		return nil, err
+	}
+
+	f.digest = d
+
+	return d, nil
+}
+
+func (f *compressedFile) CRC32C() (uint32, error) {
+	if c := f.recorded(); c != nil {
+		if sum, ok := c.crc32c(); ok {
+			return sum, nil
+		}
+	}
+
+	d, err := f.digested()
+	if err != nil {
+		return 0, err
+	}
+
+	return d.CRC32C(), nil
+}
+
+// ETag returns the ETag of the decompressed content.
+func (f *compressedFile) ETag() (string, error) {
+	return ent.FileETag(f, f.recordedMD5)
+}
+
+func (f *compressedFile) Hash() ([]byte, error) {
+	if c := f.recorded(); c != nil {
+		if h, ok := c.hash(); ok {
+			return h, nil
+		}
+	}
+
+	d, err := f.digested()
+	if err != nil {
+		return nil, err
+	}
+
+	return d.Hash(), nil
+}
+
+// Size returns the size of the decompressed content.
+func (f *compressedFile) Size() (int64, error) {
+	if c := f.recorded(); c != nil && c.Hash != "" {
+		return c.Size, nil
+	}
+
+	d, err := f.digested()
+	if err != nil {
+		return 0, err
+	}
+
+	return d.Len(), nil
+}
+
+func (f *compressedFile) Write(p []byte) (int, error) {
+	return 0, errCompressedReadOnly
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/pat"
+	"github.com/soundcloud/ent/lib"
+)
+
+func TestCompressFSPolicyChange(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-compressfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		b       = ent.NewBucket("compressed", ent.Owner{})
+		fs      = newCompressFS(newDiskFS(tmp))
+		content = strings.Repeat("text heavy content ", 64)
+		stored  = map[string]string{}
+	)
+
+	for _, codec := range []string{
+		ent.CompressionGzip,
+		ent.CompressionZstd,
+		ent.CompressionNone,
+	} {
+		b.Compression = codec
+		key := codec + ".txt"
+
+		f, err := fs.Create(b, key, strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		m, err := fs.Meta(b, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stored[key] = m.Compression
+	}
+
+	if have, want := stored["gzip.txt"], ent.CompressionGzip; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+
+	if have, want := stored["none.txt"], ""; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+
+	raw, err := ioutil.ReadFile(filepath.Join(tmp, b.Name, "zstd.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(raw) >= len(content) {
+		t.Errorf("stored %d bytes, want less than %d", len(raw), len(content))
+	}
+
+	// Every file is read with the codec it was stored with regardless of the
+	// current policy.
+	for _, codec := range []string{ent.CompressionGzip, ent.CompressionNone} {
+		b.Compression = codec
+
+		for key := range stored {
+			f, err := fs.Open(b, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			raw, err := ioutil.ReadAll(f)
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(raw) != content {
+				t.Errorf("policy %s: %s read back %d bytes differing", codec, key, len(raw))
+			}
+		}
+	}
+}
+
+func TestCompressedFileSeek(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-compressfs-seek")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		b       = ent.NewBucket("compressed", ent.Owner{})
+		fs      = newCompressFS(newDiskFS(tmp))
+		content = strings.Repeat("0123456789", 1<<14)
+		sum     = sha1.Sum([]byte(content))
+	)
+
+	for _, codec := range []string{ent.CompressionGzip, ent.CompressionZstd} {
+		b.Compression = codec
+
+		created, err := fs.Create(b, codec, strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := fs.Open(b, codec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The file created has been digested while stored, the one opened
+		// is digested once asked for.
+		for _, f := range []ent.File{created, f} {
+			h, err := f.Hash()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if have, want := h, sum[:]; !bytes.Equal(have, want) {
+				t.Errorf("%s: have %x, want %x", codec, have, want)
+			}
+
+			size, err := f.Seek(0, io.SeekEnd)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if have, want := size, int64(len(content)); have != want {
+				t.Errorf("%s: have %d, want %d", codec, have, want)
+			}
+		}
+		created.Close()
+
+		for _, off := range []int64{100000, 10, 123456} {
+			_, err = f.Seek(off, io.SeekStart)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			p := make([]byte, 20)
+
+			_, err = io.ReadFull(f, p)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if have, want := string(p), content[off:off+20]; have != want {
+				t.Errorf("%s at %d: have %q, want %q", codec, off, have, want)
+			}
+
+			_, err = f.ReadAt(p, off+1)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if have, want := string(p), content[off+1:off+21]; have != want {
+				t.Errorf("%s at %d: have %q, want %q", codec, off+1, have, want)
+			}
+		}
+		f.Close()
+	}
+}
+
+func TestCompressFSSetMetaKeepsCodec(t *testing.T) {
+	var (
+		b  = &ent.Bucket{Name: "compressed", Compression: ent.CompressionGzip}
+		fs = newCompressFS(ent.NewMemoryFS())
+	)
+
+	_, err := fs.Create(b, "retained.txt", strings.NewReader("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fs.SetMeta(b, "retained.txt", ent.Meta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := fs.Meta(b, "retained.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := m.Compression, ent.CompressionGzip; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	for _, input := range []struct {
+		accept string
+		want   string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", ent.CompressionGzip},
+		{"gzip, deflate, br, zstd", ent.CompressionZstd},
+		{"zstd;q=0.5, gzip", ent.CompressionGzip},
+		{"zstd;q=0, gzip;q=0", ""},
+		{"br, ZSTD", ent.CompressionZstd},
+	} {
+		if have, want := negotiateEncoding(input.accept), input.want; have != want {
+			t.Errorf("%q: have %q, want %q", input.accept, have, want)
+		}
+	}
+}
+
+func TestHandleGetContentEncoding(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-content-encoding")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		b       = &ent.Bucket{Name: "encoded", Compression: ent.CompressionZstd}
+		fs      = newCompressFS(newDiskFS(tmp))
+		r       = pat.New()
+		content = strings.Repeat("text heavy content ", 64)
+	)
+
+	r.Get(ent.RouteFile, handleGet(ent.NewMemoryProvider(b), fs))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	_, err = fs.Create(b, "encoded.txt", strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(encoding, etag string) *http.Response {
+		req, err := http.NewRequest("GET", ts.URL+"/"+b.Name+"/encoded.txt", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept-Encoding", encoding)
+		if etag != "" {
+			req.Header.Set(ent.HeaderIfNoneMatch, etag)
+		}
+
+		// The transport would ask for gzip and decode it on its own.
+		res, err := (&http.Transport{DisableCompression: true}).RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return res
+	}
+
+	// Responses are only compressed if enabled.
+	res := get(ent.CompressionGzip, "")
+	res.Body.Close()
+
+	if have, want := res.Header.Get("Content-Encoding"), ""; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+
+	if have, want := res.Header.Get("Content-Length"), strconv.Itoa(len(content)); have != want {
+		t.Errorf("have Content-Length %q, want %q", have, want)
+	}
+
+	plainETag := res.Header.Get(ent.HeaderETag)
+
+	defer func(enabled bool) { compressResponses = enabled }(compressResponses)
+	compressResponses = true
+
+	for _, encoding := range []string{ent.CompressionZstd, ent.CompressionGzip} {
+		res := get(encoding, "")
+
+		raw, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have, want := res.Header.Get("Content-Encoding"), encoding; have != want {
+			t.Fatalf("have %q, want %q", have, want)
+		}
+
+		etag := res.Header.Get(ent.HeaderETag)
+		if have, want := etag, plainETag+"-"+encoding; have != want {
+			t.Errorf("have ETag %q, want %q", have, want)
+		}
+
+		res = get(encoding, etag)
+		res.Body.Close()
+
+		if have, want := res.StatusCode, http.StatusNotModified; have != want {
+			t.Errorf("%s: have %d, want %d", encoding, have, want)
+		}
+
+		dec, err := newDecoder(encoding, bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		raw, err = ioutil.ReadAll(dec)
+		dec.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(raw) != content {
+			t.Errorf("%s: decoded %d bytes differing from content", encoding, len(raw))
+		}
+	}
+}
@@ -6,6 +6,11 @@ single instance per host or as many instnaces scaled out horizontally.
 Within a bucket, you can use any names for your objects, but bucket names must
 be unique. Only one Owner can exist per Bucket.
 
+Access to a bucket can be restricted by listing writers and readers in its
+policy. Callers identify themselves with the X-Ent-Owner header carrying their
+email address, unauthorized requests are answered with 403. A bucket without
+writers and readers is accessible by everybody.
+
 API
 
 POST /{bucket}/{key} - Provide a request body with the binary data of the blob
@@ -25,13 +30,20 @@ you want to store.
     }
   }
 
+A blob can be protected from being overwritten or deleted by passing the
+X-Ent-Retain-Until header with an RFC 3339 timestamp. Until then requests
+modifying the blob are answered with 403.
+
 GET /{bucket}/{key} - Returns the blob data in binary format in the response
-body.
+body. With the retention param the retention of the blob is returned instead.
 
   $ curl -s 'http://localhost:5555/ent/my/big.blob > big.blob
   $ sha1sum big.blob
   e9f6f0657f6d33aa15cfd885bc34713a266a729a  big.blob
 
+GET /{bucket}/_by-hash/{sha1} - Returns the blob data of the first key, in
+lexical order, whose content has the given SHA1.
+
 GET / - Returns the list of existing buckets.
 
   $ curl -s 'http://localhost:555/
@@ -52,6 +64,11 @@ GET / - Returns the list of existing buckets.
     ]
   }
 
+POST /_reload - Rereads the bucket policies from the provider directory and
+returns the list of buckets now known.
+
+  $ curl -s -X POST 'http://localhost:5555/_reload
+
 DESIGN
 
 Ent is organised around the FileSystem interface which supports a CRUD feature
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/soundcloud/ent/lib"
+)
+
+// encryptionAES256GCM is recorded in the Meta of files stored encrypted.
+const encryptionAES256GCM = "aes-256-gcm"
+
+// Encrypted files start with a random nonce prefix followed by the content in
+// chunks of encryptChunkSize, each sealed on its own with a nonce made of the
+// prefix and the index of the chunk. The last chunk is sealed as such, so
+// chunks can neither be reordered nor cut off unnoticed. As chunks are opened
+// on demand encrypted files are read without holding them in memory.
+const (
+	encryptChunkSize = 64 << 10
+	encryptPrefixLen = 8
+)
+
+var errEncryptedReadOnly = errors.New("encrypted file is read-only")
+
+// encryptedFS wraps a FileSystem and encrypts files at rest with AES-256-GCM.
+// Encryption is recorded in the Meta of every file, so files stored before it
+// was enabled are still read as they are.
+type encryptedFS struct {
+	ent.FileSystem
+
+	aead cipher.AEAD
+}
+
+func newEncryptedFS(fs ent.FileSystem, key []byte) (*encryptedFS, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("encryption key has %d bytes, want 32", len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptedFS{
+		FileSystem: fs,
+		aead:       aead,
+	}, nil
+}
+
+// loadEncryptionKey decodes the hex encoded key, which is read from file if
+// given.
+func loadEncryptionKey(key, file string) ([]byte, error) {
+	if file != "" {
+		raw, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("reading encryption key failed: %s", err)
+		}
+
+		key = strings.TrimSpace(string(raw))
+	}
+
+	raw, err := hex.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %s", err)
+	}
+
+	return raw, nil
+}
+
+func (fs *encryptedFS) Create(
+	bucket *ent.Bucket,
+	key string,
+	r io.Reader,
+) (ent.File, error) {
+	return fs.create(bucket, key, r, createOptions{})
+}
+
+func (fs *encryptedFS) CreateExclusive(
+	bucket *ent.Bucket,
+	key string,
+	r io.Reader,
+) (ent.File, error) {
+	return fs.create(bucket, key, r, createOptions{exclusive: true})
+}
+
+// create encrypts the content while it is stored, the encryption is recorded
+// in the Meta stored along with it.
+func (fs *encryptedFS) create(
+	bucket *ent.Bucket,
+	key string,
+	r io.Reader,
+	o createOptions,
+) (ent.File, error) {
+	prefix := make([]byte, encryptPrefixLen)
+
+	_, err := io.ReadFull(rand.Reader, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("encryption failed: %s", err)
+	}
+
+	o.meta.Encryption = encryptionAES256GCM
+
+	// Content compressed before is digested by the compressFS already, the
+	// digests of the compressed content are not recorded.
+	var digest *ent.Digest
+	if o.content == nil {
+		digest = newDigest()
+		o.content = digest
+		r = io.TeeReader(r, digest)
+	}
+
+	f, err := createWithMeta(fs.FileSystem, bucket, key, newEncryptReader(fs.aead, prefix, r), o)
+	if err != nil {
+		return nil, err
+	}
+
+	ef, err := newEncryptedFile(fs.aead, f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if digest != nil {
+		ef.hash = digest.Hash()
+		ef.crc = digest.CRC32C()
+		ef.md5 = digest.MD5()
+	}
+
+	return ef, nil
+}
+
+func (fs *encryptedFS) Open(bucket *ent.Bucket, key string) (ent.File, error) {
+	f, _, err := fs.OpenMeta(bucket, key)
+	return f, err
+}
+
+// OpenVersion decrypts the version if it was stored encrypted.
+func (fs *encryptedFS) OpenVersion(bucket *ent.Bucket, key, hash string) (ent.File, error) {
+	vs, err := fs.FileSystem.Versions(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := fs.FileSystem.OpenVersion(bucket, key, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	encryption := ""
+	for _, v := range vs {
+		if v.Hash == hash {
+			encryption = v.Encryption
+		}
+	}
+
+	return fs.decrypt(f, encryption)
+}
+
+// SetMeta stores meta while keeping the encryption recorded for the file, as
+// it describes the stored content rather than an attribute set by clients.
+func (fs *encryptedFS) SetMeta(bucket *ent.Bucket, key string, meta ent.Meta) error {
+	return fs.UpdateMeta(bucket, key, func(m *ent.Meta) {
+		*m = meta
+	})
+}
+
+func (fs *encryptedFS) decrypt(f ent.File, encryption string) (ent.File, error) {
+	switch encryption {
+	case "":
+		return f, nil
+	case encryptionAES256GCM:
+		ef, err := newEncryptedFile(fs.aead, f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		return ef, nil
+	default:
+		f.Close()
+		return nil, fmt.Errorf("unknown encryption %q", encryption)
+	}
+}
+
+// chunkNonce returns the nonce the chunk with the given index is sealed with.
+func chunkNonce(prefix []byte, index uint32) []byte {
+	nonce := make([]byte, encryptPrefixLen+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encryptPrefixLen:], index)
+	return nonce
+}
+
+// chunkData returns the additional data authenticated with a chunk, which
+// tells whether it is the last one.
+func chunkData(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// encryptReader reads the encrypted form of the content read from src.
+type encryptReader struct {
+	aead   cipher.AEAD
+	prefix []byte
+	src    *bufio.Reader
+
+	chunk   []byte
+	sealed  []byte
+	pending []byte
+	index   uint32
+	done    bool
+}
+
+func newEncryptReader(aead cipher.AEAD, prefix []byte, src io.Reader) *encryptReader {
+	return &encryptReader{
+		aead:    aead,
+		prefix:  prefix,
+		src:     bufio.NewReader(src),
+		chunk:   make([]byte, encryptChunkSize),
+		sealed:  make([]byte, 0, encryptChunkSize+aead.Overhead()),
+		pending: prefix,
+	}
+}
+
+func (r *encryptReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+
+		err := r.seal()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+
+	return n, nil
+}
+
+// seal reads the next chunk from src and seals it. A full chunk is the last
+// one only if nothing follows it.
+func (r *encryptReader) seal() error {
+	n, err := io.ReadFull(r.src, r.chunk)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	last := err != nil
+	if !last {
+		_, err = r.src.Peek(1)
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		last = err == io.EOF
+	}
+
+	r.sealed = r.aead.Seal(r.sealed[:0], chunkNonce(r.prefix, r.index), r.chunk[:n], chunkData(last))
+	r.pending = r.sealed
+	r.index++
+	r.done = last
+
+	return nil
+}
+
+// encryptedFile decrypts a file stored by encryptedFS, the chunk holding the
+// current position is opened when read. Hash and CRC32C describe the
+// decrypted content, so they don't change with the key.
+type encryptedFile struct {
+	ent.File
+
+	aead   cipher.AEAD
+	prefix []byte
+	size   int64
+	chunks int64
+	pos    int64
+
+	index  int64
+	sealed []byte
+	plain  []byte
+
+	hash []byte
+	crc  uint32
+	md5  []byte
+	// recorded takes the digests recorded for the content as read back for
+	// the ones of the decrypted content.
+	recorded bool
+}
+
+func newEncryptedFile(aead cipher.AEAD, f ent.File) (*encryptedFile, error) {
+	stored, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, encryptPrefixLen)
+
+	_, err = io.ReadFull(f, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("decryption failed: %s", err)
+	}
+
+	var (
+		sealedSize = int64(encryptChunkSize + aead.Overhead())
+		body       = stored - encryptPrefixLen
+		chunks     = (body + sealedSize - 1) / sealedSize
+		size       = body - chunks*int64(aead.Overhead())
+	)
+	if chunks == 0 || size < 0 {
+		return nil, errors.New("decryption failed: file truncated")
+	}
+
+	return &encryptedFile{
+		File:   f,
+		aead:   aead,
+		prefix: prefix,
+		size:   size,
+		chunks: chunks,
+		index:  -1,
+		sealed: make([]byte, sealedSize),
+	}, nil
+}
+
+func (f *encryptedFile) Read(p []byte) (int, error) {
+	if f.pos >= f.size {
+		return 0, io.EOF
+	}
+
+	i := f.pos / encryptChunkSize
+	if i != f.index {
+		err := f.open(i)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, f.plain[f.pos-i*encryptChunkSize:])
+	f.pos += int64(n)
+
+	return n, nil
+}
+
+// open reads and opens the chunk with index i.
+func (f *encryptedFile) open(i int64) error {
+	f.index = -1
+
+	plain, err := f.openChunk(i, f.sealed, f.plain)
+	if err != nil {
+		return err
+	}
+
+	f.plain = plain
+	f.index = i
+
+	return nil
+}
+
+// openChunk reads the chunk with index i into sealed and opens it into plain.
+// It reads at the offset of the chunk, so it leaves the position of the
+// underlying file alone.
+func (f *encryptedFile) openChunk(i int64, sealed, plain []byte) ([]byte, error) {
+	n, err := f.File.ReadAt(sealed, encryptPrefixLen+i*int64(len(sealed)))
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("decryption failed: %s", err)
+	}
+
+	plain, err = f.aead.Open(plain[:0], chunkNonce(f.prefix, uint32(i)), sealed[:n], chunkData(i == f.chunks-1))
+	if err != nil {
+		return nil, fmt.Errorf("decryption failed: %s", err)
+	}
+
+	return plain, nil
+}
+
+// ReadAt opens the chunks holding the range with buffers of its own, so it is
+// safe for concurrent use and doesn't affect Read.
+func (f *encryptedFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("encryptedFile.ReadAt: negative offset")
+	}
+
+	var (
+		n      int
+		sealed = make([]byte, encryptChunkSize+f.aead.Overhead())
+		plain  []byte
+	)
+
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= f.size {
+			return n, io.EOF
+		}
+
+		i := pos / encryptChunkSize
+
+		var err error
+		plain, err = f.openChunk(i, sealed, plain)
+		if err != nil {
+			return n, err
+		}
+
+		n += copy(p[n:], plain[pos-i*encryptChunkSize:])
+	}
+
+	return n, nil
+}
+
+func (f *encryptedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return 0, errors.New("encryptedFile.Seek: invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, errors.New("encryptedFile.Seek: negative position")
+	}
+
+	f.pos = offset
+
+	return offset, nil
+}
+
+func (f *encryptedFile) CRC32C() (uint32, error) {
+	err := f.digest()
+	if err != nil {
+		return 0, err
+	}
+
+	return f.crc, nil
+}
+
+// ETag returns the ETag of the decrypted content.
+func (f *encryptedFile) ETag() (string, error) {
+	return ent.FileETag(f, f.recordedMD5)
+}
+
+func (f *encryptedFile) Hash() ([]byte, error) {
+	err := f.digest()
+	if err != nil {
+		return nil, err
+	}
+
+	return f.hash, nil
+}
+
+// digest hashes the decrypted content once, the position is kept. Digests
+// recorded when the content was stored are taken if there are any.
+func (f *encryptedFile) digest() error {
+	if f.hash != nil {
+		return nil
+	}
+
+	if c := recordedContent(f.File); c != nil && f.recorded {
+		h, ok := c.hash()
+		crc, crcOK := c.crc32c()
+		if ok && crcOK {
+			f.hash, f.crc = h, crc
+			return nil
+		}
+	}
+
+	var (
+		pos = f.pos
+		h   = sha1.New()
+		crc = crc32.New(ent.CRC32CTable)
+	)
+
+	f.pos = 0
+
+	_, err := io.Copy(io.MultiWriter(h, crc), f)
+	f.pos = pos
+	if err != nil {
+		return err
+	}
+
+	f.hash = h.Sum(nil)
+	f.crc = crc.Sum32()
+
+	return nil
+}
+
+// recordedContent returns the digests recorded for the content as read back,
+// which is decompressed after it is decrypted if it was compressed.
+func (f *encryptedFile) recordedContent() *contentDigests {
+	return recordedContent(f.File)
+}
+
+// recordedMD5 returns the MD5 of the decrypted content if it has been
+// digested while stored or recorded then.
+func (f *encryptedFile) recordedMD5() []byte {
+	if f.md5 != nil {
+		return f.md5
+	}
+	if c := recordedContent(f.File); c != nil && f.recorded {
+		return c.md5()
+	}
+	return nil
+}
+
+// Size returns the size of the decrypted content.
+func (f *encryptedFile) Size() (int64, error) {
+	return f.size, nil
+}
+
+func (f *encryptedFile) Write(p []byte) (int, error) {
+	return 0, errEncryptedReadOnly
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/soundcloud/ent/lib"
+)
+
+func TestEncryptedFS(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-encryptedfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	fs, err := newEncryptedFS(newDiskFS(tmp), bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := ent.NewBucket("encrypted", ent.Owner{})
+
+	for _, size := range []int{0, 100, encryptChunkSize, 3*encryptChunkSize + 123} {
+		var (
+			key     = "sized.txt"
+			content = make([]byte, size)
+		)
+
+		_, err := rand.Read(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := fs.Create(b, key, bytes.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		raw, err := ioutil.ReadFile(filepath.Join(tmp, b.Name, key))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if size > 0 && bytes.Contains(raw, content) {
+			t.Errorf("%d bytes: content stored in plain", size)
+		}
+
+		f, err = fs.Open(b, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		have, err := ioutil.ReadAll(f)
+		if err != nil {
+			t.Fatalf("%d bytes: %s", size, err)
+		}
+
+		if !bytes.Equal(have, content) {
+			t.Errorf("%d bytes: decrypted content differs", size)
+		}
+
+		h, err := f.Hash()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have, want := h, sha1.Sum(content); !bytes.Equal(have, want[:]) {
+			t.Errorf("%d bytes: have hash %x, want %x", size, have, want)
+		}
+
+		if size > encryptChunkSize {
+			off := int64(encryptChunkSize + 10)
+
+			_, err = f.Seek(off, io.SeekStart)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			p := make([]byte, 5)
+
+			_, err = io.ReadFull(f, p)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if have, want := p, content[off:off+5]; !bytes.Equal(have, want) {
+				t.Errorf("have %x, want %x", have, want)
+			}
+
+			p = make([]byte, 2*encryptChunkSize)
+
+			_, err = f.ReadAt(p, off)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if have, want := p, content[off:off+int64(len(p))]; !bytes.Equal(have, want) {
+				t.Errorf("%d bytes: ReadAt across chunks differs", size)
+			}
+		}
+		f.Close()
+
+		m, err := fs.Meta(b, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have, want := m.Encryption, encryptionAES256GCM; have != want {
+			t.Errorf("have %q, want %q", have, want)
+		}
+	}
+}
+
+func TestEncryptedFSTampered(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-encryptedfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		b       = ent.NewBucket("encrypted", ent.Owner{})
+		content = strings.Repeat("secret ", encryptChunkSize/3)
+		key     = bytes.Repeat([]byte{1}, 32)
+	)
+
+	fs, err := newEncryptedFS(newDiskFS(tmp), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"flipped.txt", "truncated.txt", "plain.txt"} {
+		_, err := fs.Create(b, name, strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p := filepath.Join(tmp, b.Name, "flipped.txt")
+
+	raw, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[len(raw)/2] ^= 1
+
+	err = ioutil.WriteFile(p, raw, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cutting off the last chunk leaves a file of valid chunks only.
+	err = os.Truncate(filepath.Join(tmp, b.Name, "truncated.txt"), encryptPrefixLen+int64(encryptChunkSize+16))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := newEncryptedFS(newDiskFS(tmp), bytes.Repeat([]byte{2}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		fs  *encryptedFS
+		key string
+	}{
+		{fs, "flipped.txt"},
+		{fs, "truncated.txt"},
+		{other, "plain.txt"},
+	} {
+		f, err := test.fs.Open(b, test.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = ioutil.ReadAll(f)
+		f.Close()
+		if err == nil {
+			t.Errorf("%s: decrypted without error", test.key)
+		}
+	}
+
+	_, err = newEncryptedFS(newDiskFS(tmp), key[:16])
+	if err == nil {
+		t.Error("short key accepted")
+	}
+}
+
+func TestEncryptedFSCompressed(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-encryptedfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	// The codec and the encryption are stored in the same step as the
+	// content, never set afterwards.
+	efs, err := newEncryptedFS(noSetMetaFS{newDiskFS(tmp).(*diskFS)}, bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		fs      = newCompressFS(efs)
+		b       = ent.NewBucket("compressed", ent.Owner{})
+		content = strings.Repeat("text heavy content ", 64)
+	)
+	b.Compression = ent.CompressionGzip
+
+	_, err = fs.Create(b, "both.txt", strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := fs.Meta(b, "both.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Compression != ent.CompressionGzip || m.Encryption != encryptionAES256GCM {
+		t.Errorf("have compression %q and encryption %q", m.Compression, m.Encryption)
+	}
+
+	f, err := fs.Open(b, "both.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	raw, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := string(raw), content; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+}
+
+// noSetMetaFS fails SetMeta, so only Meta stored along with the content is
+// recorded.
+type noSetMetaFS struct {
+	*diskFS
+}
+
+func (fs noSetMetaFS) SetMeta(bucket *ent.Bucket, key string, m ent.Meta) error {
+	return errors.New("SetMeta called")
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/soundcloud/ent/lib"
+)
+
+// responseHash makes responses to writes carry the ETag and CRC32C of the file
+// stored. Without it they are never computed for the response, which spares
+// reading large files back if they weren't hashed while being written.
+var responseHash = true
+
+// newDigest returns a Digest for content being stored or read, which
+// accumulates the MD5 as well if ETags are formed from it.
+func newDigest() *ent.Digest {
+	if ent.ETagStyle == ent.ETagMD5Quoted {
+		return ent.NewMD5Digest()
+	}
+	return ent.NewDigest()
+}
+
+// notModified reports whether the ETag set on w matches the If-None-Match
+// header of r or, if r has none, whether the file wasn't modified after the
+// If-Modified-Since header of r. As HTTP dates lack sub-second precision,
+// lastModified is compared in whole seconds.
+func notModified(w http.ResponseWriter, r *http.Request, lastModified time.Time) bool {
+	header := r.Header.Get(ent.HeaderIfNoneMatch)
+	if header != "" {
+		return etagMatches(header, w.Header().Get(ent.HeaderETag))
+	}
+
+	since, err := http.ParseTime(r.Header.Get(ent.HeaderIfModifiedSince))
+	if err != nil || lastModified.IsZero() {
+		return false
+	}
+
+	return !lastModified.Truncate(time.Second).After(since)
+}
+
+// etagMatches reports whether etag is listed in the If-None-Match header.
+// Quotes and weak validator prefixes are ignored, so quoted and bare ETags can
+// be compared with each other.
+func etagMatches(header, etag string) bool {
+	etag = unquoteETag(etag)
+	if etag == "" {
+		return false
+	}
+
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+
+		if candidate == "*" || unquoteETag(candidate) == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+func unquoteETag(etag string) string {
+	etag = strings.TrimPrefix(etag, "W/")
+	return strings.Trim(etag, `"`)
+}
+
+// fileCRC32C returns the hex encoded CRC32C checksum of f.
+func fileCRC32C(f ent.File) (string, error) {
+	sum, err := f.CRC32C()
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%08x", sum), nil
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/pat"
+	"github.com/soundcloud/ent/lib"
+)
+
+func TestETagMatches(t *testing.T) {
+	for _, test := range []struct {
+		header string
+		etag   string
+		match  bool
+	}{
+		{`abc`, `abc`, true},
+		{`"abc"`, `abc`, true},
+		{`abc`, `"abc"`, true},
+		{`W/"abc"`, `"abc"`, true},
+		{`"xyz", "abc"`, `"abc"`, true},
+		{`*`, `"abc"`, true},
+		{`"xyz"`, `"abc"`, false},
+		{`"abc"`, ``, false},
+	} {
+		if have, want := etagMatches(test.header, test.etag), test.match; have != want {
+			t.Errorf("%s vs %s: have %t, want %t", test.header, test.etag, have, want)
+		}
+	}
+}
+
+func TestFileETag(t *testing.T) {
+	defer func(style string) { ent.ETagStyle = style }(ent.ETagStyle)
+
+	tmp, err := ioutil.TempDir("", "ent-file-etag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		fs      = newDiskFS(tmp)
+		b       = ent.NewBucket("etag", ent.Owner{})
+		content = []byte("content with a stable etag")
+		sha     = sha1.Sum(content)
+		md      = md5.Sum(content)
+	)
+
+	f, err := fs.Create(b, "stable.txt", bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	for style, want := range map[string]string{
+		ent.ETagSHA1:      hex.EncodeToString(sha[:]),
+		ent.ETagMD5Quoted: `"` + hex.EncodeToString(md[:]) + `"`,
+	} {
+		ent.ETagStyle = style
+
+		f, err := fs.Open(b, "stable.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		etag, err := f.ETag()
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		if etag != want {
+			t.Errorf("%s: have %s, want %s", style, etag, want)
+		}
+
+		for _, header := range []string{etag, `"` + unquoteETag(etag) + `"`, `W/` + etag} {
+			if !etagMatches(header, etag) {
+				t.Errorf("%s: %s doesn't match %s", style, header, etag)
+			}
+		}
+	}
+}
+
+func TestHandleGetQuotedMD5ETag(t *testing.T) {
+	defer func(style string) { ent.ETagStyle = style }(ent.ETagStyle)
+	ent.ETagStyle = ent.ETagMD5Quoted
+
+	tmp, err := ioutil.TempDir("", "ent-etag-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		fs      = newDiskFS(tmp)
+		b       = ent.NewBucket("etag", ent.Owner{})
+		p       = ent.NewMemoryProvider(b)
+		r       = pat.New()
+		key     = "quoted.txt"
+		content = []byte("content with an md5 etag")
+		sum     = md5.Sum(content)
+		etag    = `"` + hex.EncodeToString(sum[:]) + `"`
+	)
+
+	r.Add("HEAD", ent.RouteFile, handleExists(p, fs))
+	r.Get(ent.RouteFile, handleGet(p, fs))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	_, err = fs.Create(b, key, bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ep := fmt.Sprintf("%s/%s/%s", ts.URL, b.Name, key)
+
+	res, err := http.Get(ep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := res.Header.Get(ent.HeaderETag), etag; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	// Computing the ETag must not consume the content served.
+	if have, want := string(raw), string(content); have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+
+	for _, method := range []string{"GET", "HEAD"} {
+		req, err := http.NewRequest(method, ep, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(ent.HeaderIfNoneMatch, etag)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if have, want := res.StatusCode, http.StatusNotModified; have != want {
+			t.Errorf("%s: have %d, want %d", method, have, want)
+		}
+
+		if have, want := res.Header.Get(ent.HeaderETag), etag; have != want {
+			t.Errorf("%s: have %s, want %s", method, have, want)
+		}
+	}
+}
+
+// unreadFS stores files like the wrapped FileSystem but returns files failing
+// to be read or hashed from Create.
+type unreadFS struct {
+	ent.FileSystem
+}
+
+func (fs unreadFS) Create(b *ent.Bucket, key string, r io.Reader) (ent.File, error) {
+	f, err := fs.FileSystem.Create(b, key, r)
+	if err != nil {
+		return nil, err
+	}
+
+	return unreadFile{f}, nil
+}
+
+type unreadFile struct {
+	ent.File
+}
+
+var errUnread = errors.New("file read back")
+
+func (f unreadFile) CRC32C() (uint32, error)        { return 0, errUnread }
+func (f unreadFile) ETag() (string, error)          { return "", errUnread }
+func (f unreadFile) Hash() ([]byte, error)          { return nil, errUnread }
+func (f unreadFile) Read(p []byte) (int, error)     { return 0, errUnread }
+func (f unreadFile) Seek(int64, int) (int64, error) { return 0, errUnread }
+
+func TestHandleCreateWithoutResponseHash(t *testing.T) {
+	defer func(enabled bool) { responseHash = enabled }(responseHash)
+	responseHash = false
+
+	var (
+		b  = ent.NewBucket("unhashed", ent.Owner{})
+		fs = unreadFS{ent.NewMemoryFS()}
+		w  = httptest.NewRecorder()
+	)
+
+	r, err := http.NewRequest("POST", "/?"+url.Values{
+		ent.KeyBucket: {b.Name},
+		ent.KeyBlob:   {"unhashed.txt"},
+	}.Encode(), strings.NewReader("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handleCreate(ent.NewMemoryProvider(b), fs).ServeHTTP(w, r)
+
+	if have, want := w.Code, http.StatusCreated; have != want {
+		t.Fatalf("have %d, want %d: %s", have, want, w.Body)
+	}
+
+	for _, header := range []string{ent.HeaderETag, ent.HeaderCRC32C} {
+		if have := w.Header().Get(header); have != "" {
+			t.Errorf("%s: have %q, want none", header, have)
+		}
+	}
+
+	created := ent.ResponseCreated{}
+
+	err = json.NewDecoder(w.Body).Decode(&created)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := created.File.CRC32C, ""; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+}
+
+func BenchmarkHandleCreateResponseHash(b *testing.B) {
+	defer func(enabled bool) { responseHash = enabled }(responseHash)
+
+	tmp, err := ioutil.TempDir("", "ent-response-hash-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		bucket  = ent.NewBucket("bench", ent.Owner{})
+		content = bytes.Repeat([]byte("a"), 8<<20)
+		// Lazily hashed files are read back for the hash, like encrypted
+		// files are.
+		h = handleCreate(ent.NewMemoryProvider(bucket), newDiskFS(tmp, withLazyHash(true)))
+	)
+
+	for _, enabled := range []bool{true, false} {
+		responseHash = enabled
+
+		b.Run(fmt.Sprintf("hash=%t", enabled), func(b *testing.B) {
+			b.SetBytes(int64(len(content)))
+
+			for i := 0; i < b.N; i++ {
+				r, err := http.NewRequest("POST", "/?"+url.Values{
+					ent.KeyBucket: {bucket.Name},
+					ent.KeyBlob:   {"bench.blob"},
+				}.Encode(), bytes.NewReader(content))
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, r)
+
+				if w.Code != http.StatusCreated {
+					b.Fatalf("have %d, want %d", w.Code, http.StatusCreated)
+				}
+			}
+		})
+	}
+}
+
+func TestRecordedMD5ETag(t *testing.T) {
+	defer func(style string) { ent.ETagStyle = style }(ent.ETagStyle)
+	ent.ETagStyle = ent.ETagMD5Quoted
+
+	tmp, err := ioutil.TempDir("", "ent-recorded-md5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	encrypted, err := newEncryptedFS(newDiskFS(tmp), bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		content = strings.Repeat("recorded ", 1<<10)
+		sum     = md5.Sum([]byte(content))
+		etag    = `"` + hex.EncodeToString(sum[:]) + `"`
+		b       = ent.NewBucket("recorded-md5", ent.Owner{})
+	)
+	b.Compression = ent.CompressionGzip
+
+	for name, fs := range map[string]ent.FileSystem{
+		"disk":              newDiskFS(tmp),
+		"compress":          newCompressFS(newDiskFS(tmp)),
+		"encrypt":           encrypted,
+		"compress, encrypt": newCompressFS(encrypted),
+	} {
+		key := strings.Replace(name, ", ", "-", -1) + ".txt"
+
+		f, err := fs.Create(b, key, strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		have, err := f.ETag()
+		f.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		if want := etag; have != want {
+			t.Errorf("%s: have %s, want %s", name, have, want)
+		}
+
+		// With the stored content zeroed the ETag has to come from the sidecar.
+		p := filepath.Join(tmp, b.Name, key)
+
+		stat, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = ioutil.WriteFile(p, make([]byte, stat.Size()), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		os.Chtimes(p, stat.ModTime(), stat.ModTime())
+
+		f, err = fs.Open(b, key)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		have, err = f.ETag()
+		f.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		if want := etag; have != want {
+			t.Errorf("%s: have %s, want %s", name, have, want)
+		}
+	}
+
+	// Blobs stored before the style was set are read to compute the ETag.
+	ent.ETagStyle = ent.ETagSHA1
+
+	fs := newDiskFS(tmp)
+
+	f, err := fs.Create(b, "before.txt", strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	ent.ETagStyle = ent.ETagMD5Quoted
+
+	f, err = fs.Open(b, "before.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	have, err := f.ETag()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := etag; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+}
@@ -1,78 +1,1151 @@
 package main
 
 import (
-	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	"hash"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/soundcloud/ent/lib"
 )
 
+// Meta of a file is stored in a sidecar next to it.
+const metaExt = ".entmeta"
+
 type diskFS struct {
-	root string
+	root        string
+	tmpDir      string
+	ignore      []string
+	directWrite bool
+	fsync       bool
+	lazyHash    bool
+	pruneDirs   bool
+	trash       bool
+	versioning  bool
+	shard       bool
+	listMode    string
+
+	// dirs guards the creation of directories for new files against the
+	// pruning of empty directories. It is only held while directories are
+	// created and files placed in them, not while content is written.
+	dirs sync.RWMutex
+	// versionsMu guards the indexes of versions.
+	versionsMu sync.Mutex
+	// keys serializes replacing and removing the file of a key, so concurrent
+	// Creates of the same key don't interleave their renames. It is acquired
+	// before dirs. The lock only covers this process, instances sharing the
+	// root over NFS still race each other.
+	keys keyLocks
+}
+
+// diskOption configures optional behaviour of a diskFS.
+type diskOption func(*diskFS)
+
+// pendingPrefix starts the names of temporary files files are written to
+// before they are moved in place.
+const pendingPrefix = "pending-"
+
+// withFsync makes Create sync the content of files and the directory they are
+// stored in to disk before returning, so stored files survive a crash.
+func withFsync(enabled bool) diskOption {
+	return func(fs *diskFS) {
+		fs.fsync = enabled
+	}
+}
+
+// withLazyHash makes Create skip hashing files while writing them, they are
+// read again once their hash is requested instead. It saves the hashing for
+// files whose hash is never needed.
+func withLazyHash(enabled bool) diskOption {
+	return func(fs *diskFS) {
+		fs.lazyHash = enabled
+	}
+}
+
+// syncFile and syncDir flush files and directories to disk, they are replaced
+// in tests.
+var (
+	syncFile = (*os.File).Sync
+	syncDir  = func(dir string) error {
+		d, err := os.Open(dir)
+		if err != nil {
+			return err
+		}
+		defer d.Close()
+
+		return d.Sync()
+	}
+)
+
+// defaultIgnore lists the names of the bookkeeping files and directories of
+// diskFS which are no files of a bucket.
+var defaultIgnore = []string{
+	pendingPrefix + "*",
+	"*" + metaExt,
+	trashDir,
+	versionsDir,
+}
+
+// withIgnore adds patterns of names excluded from listings to defaultIgnore,
+// matched against the base name of every file and directory. The syntax is
+// the one of filepath.Match. The bookkeeping files are always excluded.
+func withIgnore(patterns []string) diskOption {
+	return func(fs *diskFS) {
+		fs.ignore = append(append([]string{}, defaultIgnore...), patterns...)
+	}
+}
+
+// withTempDir makes Create write files to dir before moving them in place
+// instead of the directory of their bucket. If dir is on another filesystem
+// than the root the file is copied next to its destination first, as only a
+// rename within a filesystem is atomic.
+func withTempDir(dir string) diskOption {
+	return func(fs *diskFS) {
+		fs.tmpDir = dir
+	}
+}
+
+// withDirectWrite makes Create write straight to the destination instead of a
+// temporary file which is renamed once complete. It saves the rename at the
+// cost of atomicity: Opens of the key wait for the write to complete, but
+// readers which opened the file before can observe partially written content.
+func withDirectWrite(enabled bool) diskOption {
+	return func(fs *diskFS) {
+		fs.directWrite = enabled
+	}
+}
+
+// Modes of listing the files directly below a prefix.
+const (
+	// listModeReadDir reads the directory of the prefix only.
+	listModeReadDir = "readdir"
+	// listModeWalk walks every file below the prefix.
+	listModeWalk = "walk"
+)
+
+// withListMode sets how WalkDir finds the files directly below a prefix, by
+// reading its directory, the default, or by walking all files below it.
+func withListMode(mode string) diskOption {
+	return func(fs *diskFS) {
+		fs.listMode = mode
+	}
+}
+
+// withPruneDirs makes Delete remove parent directories left empty up to the
+// bucket directory.
+func withPruneDirs(enabled bool) diskOption {
+	return func(fs *diskFS) {
+		fs.pruneDirs = enabled
+	}
+}
+
+func newDiskFS(root string, opts ...diskOption) ent.FileSystem {
+	fs := &diskFS{
+		root:   root,
+		ignore: defaultIgnore,
+	}
+
+	for _, opt := range opts {
+		opt(fs)
+	}
+
+	return fs
+}
+
+func (fs *diskFS) Create(
+	bucket *ent.Bucket,
+	key string,
+	r io.Reader,
+) (ent.File, error) {
+	return fs.create(bucket, key, r, createOptions{})
+}
+
+func (fs *diskFS) CreateExclusive(
+	bucket *ent.Bucket,
+	key string,
+	r io.Reader,
+) (ent.File, error) {
+	return fs.create(bucket, key, r, createOptions{exclusive: true})
+}
+
+func (fs *diskFS) create(
+	bucket *ent.Bucket,
+	key string,
+	r io.Reader,
+	o createOptions,
+) (ent.File, error) {
+	err := checkKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	dst := pathForFile(fs, bucket, key)
+
+	if s, ok := r.(*stagedRange); ok && s.fs == fs {
+		return fs.createStaged(bucket, dst, key, s, o)
+	}
+
+	if fs.directWrite {
+		// Archiving and removing the content replaced are part of replacing
+		// it and happen under the lock as well.
+		unlock := fs.keys.lock(dst)
+		defer unlock()
+
+		prev, err := checkReplace(dst, o.exclusive)
+		if err != nil {
+			return nil, err
+		}
+
+		if fs.versioning && !o.exclusive {
+			err = fs.archive(bucket, key, dst)
+			if err != nil {
+				return nil, err
+			}
+
+			// Writing in place would alter the archived content sharing the
+			// file.
+			err = os.Remove(dst)
+			if err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+
+		f, err := fs.createDirect(dst, key, r, o.exclusive)
+		if err != nil {
+			return nil, err
+		}
+
+		// Content written in place is visible before its Meta, which is only
+		// known once all of it has been written.
+		s := newSidecar(prev, o, f.lastModified, f.storedDigests())
+
+		err = fs.writeSidecar(dst, s)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		f.created = s.Created
+
+		if fs.fsync {
+			err = syncDir(filepath.Dir(dst))
+			if err != nil {
+				f.Close()
+				return nil, fmt.Errorf("sync failed: %s", err)
+			}
+		}
+
+		return f, nil
+	}
+
+	// Temporary files are written to the bucket directory, which is never
+	// pruned, unless a directory of their own is set.
+	tmpDir := fs.tmpDir
+	if tmpDir == "" {
+		tmpDir = filepath.Join(fs.root, bucket.Name)
+	}
+
+	err = os.MkdirAll(tmpDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := ioutil.TempFile(tmpDir, pendingPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	// Partially written files must not be left behind.
+	renamed := false
+	defer func() {
+		tmp.Close()
+		if !renamed {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	f := newFile(tmp, key)
+	f.lazy = fs.lazyHash
+
+	_, err = io.Copy(f, r)
+	if err != nil {
+		return nil, fmt.Errorf("storing failed: %s", err)
+	}
+
+	if fs.fsync {
+		err = syncFile(tmp)
+		if err != nil {
+			return nil, fmt.Errorf("sync failed: %s", err)
+		}
+	}
+
+	stat, err := tmp.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	// The file is reopened under the lock as well, so the content returned is
+	// the one written by this call.
+	unlock := fs.keys.lock(dst)
+	defer unlock()
+
+	prev, err := checkReplace(dst, o.exclusive)
+	if err != nil {
+		return nil, err
+	}
+
+	// The content replaced is archived with the Meta it was stored with.
+	if fs.versioning && !o.exclusive {
+		err = fs.archive(bucket, key, dst)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sc := newSidecar(prev, o, stat.ModTime(), f.storedDigests())
+
+	renamed, err = fs.place(tmp.Name(), dst, prev, sc, o.exclusive)
+	if err != nil {
+		return nil, err
+	}
+
+	err = f.reopen(dst, sc.Created)
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// reopen opens the file placed under dst in place of the one written, the
+// caller holds the lock of the key.
+func (f *file) reopen(dst string, created time.Time) error {
+	fd, err := os.Open(dst)
+	if err != nil {
+		return fmt.Errorf("open failed: %s", err)
+	}
+
+	stat, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return err
+	}
+
+	f.File = fd
+	f.created = created
+	f.lastModified = stat.ModTime()
+
+	return nil
+}
+
+// place moves the temporary file tmp in place under dst along with the
+// sidecar s, dirs is held meanwhile so the directory of dst isn't pruned
+// before the file is in it. Exclusively placed files are linked, tmp is left
+// in place then. It reports whether tmp has been moved. The caller holds the
+// lock of the key.
+func (fs *diskFS) place(tmp, dst string, prev, s sidecar, exclusive bool) (bool, error) {
+	fs.dirs.RLock()
+	defer fs.dirs.RUnlock()
+
+	err := os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return false, err
+	}
+
+	renamed := false
+	if exclusive {
+		// Linking fails if dst exists, which makes the check and the store
+		// atomic across processes as well. The sidecar is only written once
+		// the link succeeded, the one of a file placed by another process is
+		// left alone.
+		_, err = moveInPlace(tmp, dst, os.Link)
+		if os.IsExist(err) {
+			return false, ent.ErrFileExists
+		}
+		if err != nil {
+			return false, fmt.Errorf("link failed: %s", err)
+		}
+
+		err = fs.writeSidecar(dst, s)
+		if err != nil {
+			os.Remove(dst)
+			return false, err
+		}
+	} else {
+		// The Meta is in place before the content it describes, readers
+		// holding the lock of the key never see one without the other.
+		err = fs.writeSidecar(dst, s)
+		if err != nil {
+			return false, err
+		}
+
+		renamed, err = moveInPlace(tmp, dst, os.Rename)
+		if err != nil {
+			fs.restoreSidecar(dst, prev)
+			return renamed, fmt.Errorf("rename failed: %s", err)
+		}
+	}
+
+	// The new name is only durable once the directory is synced.
+	if fs.fsync {
+		err = syncDir(filepath.Dir(dst))
+		if err != nil {
+			return renamed, fmt.Errorf("sync failed: %s", err)
+		}
+	}
+
+	return renamed, nil
+}
+
+// checkReplace returns the sidecar of the file at p before it is replaced,
+// which is empty if there is no file. It fails with ErrFileExists for
+// exclusive Creates of existing files and with ErrRetentionActive for files
+// under retention. The caller holds the lock of the key.
+func checkReplace(p string, exclusive bool) (sidecar, error) {
+	_, err := os.Lstat(p)
+	if os.IsNotExist(err) {
+		return sidecar{}, nil
+	}
+	if err != nil {
+		return sidecar{}, err
+	}
+
+	if exclusive {
+		return sidecar{}, ent.ErrFileExists
+	}
+
+	s, err := readSidecar(p)
+	if err != nil {
+		return sidecar{}, err
+	}
+
+	if s.IsRetained(time.Now()) {
+		return sidecar{}, ent.ErrRetentionActive
+	}
+
+	return s, nil
+}
+
+// newSidecar returns the sidecar of content replacing the file described by
+// prev with the Meta of o, keeping the time its key was first stored at. The
+// content has been modified last at lastModified and digested to d while
+// stored.
+func newSidecar(prev sidecar, o createOptions, lastModified time.Time, d digests) sidecar {
+	m := o.meta
+
+	m.Created = prev.Created
+	if m.Created.IsZero() {
+		m.Created = lastModified
+	}
+
+	return sidecar{
+		Meta:    m,
+		digests: d,
+		Content: newContentDigests(o.content),
+	}
+}
+
+// restoreSidecar puts back the sidecar of the file at p after placing the
+// content replacing it failed.
+func (fs *diskFS) restoreSidecar(p string, prev sidecar) {
+	if prev == (sidecar{}) {
+		os.Remove(p + metaExt)
+		return
+	}
+
+	fs.writeSidecar(p, prev)
+}
+
+// moveInPlace places the file at src under dst with move, which is os.Rename
+// or os.Link. If src is on another filesystem it is copied next to dst and
+// moved from there instead, leaving src in place. It reports whether src has
+// been moved.
+func moveInPlace(src, dst string, move func(string, string) error) (bool, error) {
+	err := move(src, dst)
+	if err == nil {
+		return true, nil
+	}
+
+	if lerr, ok := err.(*os.LinkError); !ok || lerr.Err != syscall.EXDEV {
+		return false, err
+	}
+
+	staged, err := copyToDir(src, filepath.Dir(dst))
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(staged)
+
+	return false, move(staged, dst)
+}
+
+// copyToDir copies the file at src to a new temporary file in dir, which is
+// synced to disk before its path is returned.
+func copyToDir(src, dir string) (string, error) {
+	r, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	w, err := ioutil.TempFile(dir, pendingPrefix)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(w, r)
+	if err == nil {
+		err = w.Sync()
+	}
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(w.Name())
+		return "", err
+	}
+
+	return w.Name(), nil
+}
+
+func (fs *diskFS) createDirect(
+	dst, key string,
+	r io.Reader,
+	exclusive bool,
+) (*file, error) {
+	flag := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	if exclusive {
+		flag = os.O_RDWR | os.O_CREATE | os.O_EXCL
+	}
+
+	// Once the file exists its directory is no longer pruned.
+	fs.dirs.RLock()
+	err := os.MkdirAll(filepath.Dir(dst), 0755)
+	var w *os.File
+	if err == nil {
+		w, err = os.OpenFile(dst, flag, 0600)
+	}
+	fs.dirs.RUnlock()
+	if err != nil {
+		if exclusive && os.IsExist(err) {
+			err = ent.ErrFileExists
+		}
+		return nil, err
+	}
+
+	// A file created by an exclusive Create is only partially written if it
+	// fails, it is removed rather than left for the next exclusive Create to
+	// conflict with.
+	fail := func(err error) (*file, error) {
+		w.Close()
+		if exclusive {
+			os.Remove(dst)
+		}
+		return nil, err
+	}
+
+	f := newFile(w, key)
+	f.lazy = fs.lazyHash
+
+	_, err = io.Copy(f, r)
+	if err != nil {
+		return fail(fmt.Errorf("storing failed: %s", err))
+	}
+
+	if fs.fsync {
+		err = syncFile(w)
+		if err != nil {
+			return fail(fmt.Errorf("sync failed: %s", err))
+		}
+	}
+
+	_, err = w.Seek(0, 0)
+	if err != nil {
+		return fail(err)
+	}
+
+	stat, err := w.Stat()
+	if err != nil {
+		return fail(err)
+	}
+
+	f.lastModified = stat.ModTime()
+
+	return f, nil
+}
+
+func (fs *diskFS) Delete(bucket *ent.Bucket, key string) error {
+	return fs.delete(bucket, key, nil)
+}
+
+// delete removes the file under key if check, which is passed its Meta under
+// the lock of the key, allows it. A nil check allows every file.
+func (fs *diskFS) delete(bucket *ent.Bucket, key string, check func(ent.Meta) error) error {
+	p := pathForFile(fs, bucket, key)
+
+	err := fs.deleteLocked(bucket, key, p, check)
+	if err != nil {
+		return err
+	}
+
+	// Pruning acquires dirs, which must not happen while holding the lock of
+	// the key.
+	if fs.pruneDirs {
+		fs.prune(bucket, filepath.Dir(p))
+	}
+
+	return nil
+}
+
+// deleteLocked removes or trashes the file at p holding the lock of the key.
+func (fs *diskFS) deleteLocked(bucket *ent.Bucket, key, p string, check func(ent.Meta) error) error {
+	unlock := fs.keys.lock(p)
+	defer unlock()
+
+	_, err := os.Stat(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = ent.ErrFileNotFound
+		}
+		return err
+	}
+
+	m, err := readMeta(p)
+	if err != nil {
+		return err
+	}
+
+	if m.IsRetained(time.Now()) {
+		return ent.ErrRetentionActive
+	}
+
+	if check != nil {
+		err = check(m)
+		if err != nil {
+			return err
+		}
+	}
+
+	if fs.versioning {
+		err = fs.archive(bucket, key, p)
+		if err != nil {
+			return err
+		}
+	}
+
+	if fs.trash {
+		return fs.moveToTrash(bucket, key, p)
+	}
+
+	return fs.remove(p)
+}
+
+// remove removes the file at p and its Meta.
+func (fs *diskFS) remove(p string) error {
+	err := os.Remove(p)
+	if err != nil {
+		return fmt.Errorf("removal failed: %s", err)
+	}
+
+	err = os.Remove(p + metaExt)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("meta removal failed: %s", err)
+	}
+
+	return nil
+}
+
+// prune removes dir and its parents as long as they are empty, stopping at the
+// bucket directory.
+func (fs *diskFS) prune(bucket *ent.Bucket, dir string) {
+	bucketDir := filepath.Join(fs.root, bucket.Name)
+
+	fs.dirs.Lock()
+	defer fs.dirs.Unlock()
+
+	for strings.HasPrefix(dir, bucketDir+string(filepath.Separator)) {
+		// Removal fails for directories which are not empty, which is where
+		// pruning ends.
+		if os.Remove(dir) != nil {
+			return
+		}
+
+		dir = filepath.Dir(dir)
+	}
+}
+
+// Open opens the file and reads its sidecar under the lock of the key, the
+// digests recorded in it are those of the content opened.
+func (fs *diskFS) Open(bucket *ent.Bucket, key string) (ent.File, error) {
+	unlock := fs.keys.lock(pathForFile(fs, bucket, key))
+	defer unlock()
+
+	return fs.open(bucket, key)
+}
+
+// open opens the file under key along with its sidecar. The caller holds the
+// lock of the key.
+func (fs *diskFS) open(bucket *ent.Bucket, key string) (*file, error) {
+	path := pathForFile(fs, bucket, key)
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = ent.ErrFileNotFound
+		}
+		return nil, err
+	}
+
+	// If the requested key only matches a sub-directory and not a file we handle
+	// it as if no file was found.
+	if stat.IsDir() {
+		return nil, ent.ErrFileNotFound
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file := newFile(f, key)
+	file.metaPath = path
+
+	_, err = file.recorded()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return file, nil
+}
+
+func (fs *diskFS) List(
+	bucket *ent.Bucket,
+	prefix string,
+	limit uint64,
+	sortStrategy ent.SortStrategy,
+) (ent.Files, error) {
+	files := ent.Files{}
+
+	err := fs.Walk(bucket, prefix, ent.ModifiedRange{}, func(f ent.File) error {
+		files = append(files, f)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sortStrategy.Sort(files)
+
+	if limit < uint64(len(files)) {
+		files = files[:limit]
+	}
+
+	return files, nil
+}
+
+func (fs *diskFS) Walk(
+	bucket *ent.Bucket,
+	prefix string,
+	modified ent.ModifiedRange,
+	fn func(ent.File) error,
+) error {
+	bucketDir := filepath.Join(fs.root, bucket.Name)
+
+	// In case the directory does not exist yet for a bucket, because no files
+	// have been stored yet we treat it as if the bucket is empty.
+	_, err := os.Stat(bucketDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return filepath.Walk(bucketDir, listWalk(fn, prefix, modified, bucketDir, fs.ignore, fs.shard))
+}
+
+// WalkDir walks the files of bucket like Walk, reporting the common prefixes
+// of keys continuing with a slash after prefix to dirFn. Unless the files are
+// walked, see withListMode, only the directory the prefix ends in is read,
+// its subdirectories are reported as common prefixes without descending into
+// them. Empty directories are reported as well, they are only removed with
+// withPruneDirs.
+func (fs *diskFS) WalkDir(
+	bucket *ent.Bucket,
+	prefix string,
+	modified ent.ModifiedRange,
+	fn func(ent.File) error,
+	dirFn func(string) error,
+) error {
+	// Keys are spread over the shard directories, the directory of a prefix
+	// doesn't exist.
+	if fs.listMode == listModeWalk || fs.shard {
+		return fs.Walk(bucket, prefix, modified, ent.DelimitWalk(prefix, fn, dirFn))
+	}
+
+	var (
+		i      = strings.LastIndex(prefix, "/")
+		dirKey = prefix[:i+1]
+		name   = prefix[i+1:]
+		dir    = filepath.Join(fs.root, bucket.Name, dirKey)
+	)
+
+	// Directories of prefixes no files have been stored under are treated as
+	// empty, just like prefixes which name a file.
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) || isNotDir(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		if !strings.HasPrefix(info.Name(), name) || isIgnored(fs.ignore, info.Name()) {
+			continue
+		}
+
+		key := dirKey + info.Name()
+
+		if info.IsDir() {
+			err = dirFn(key + "/")
+		} else if modified.Contains(info.ModTime()) {
+			// The file is only opened once read, like when walking.
+			f := newFile(nil, key)
+			f.lastModified = info.ModTime()
+			f.metaPath = filepath.Join(dir, info.Name())
+			f.path = f.metaPath
+
+			err = fn(f)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isNotDir reports whether err is caused by a path component which is no
+// directory.
+func isNotDir(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		return pe.Err == syscall.ENOTDIR
+	}
+	return false
+}
+
+func (fs *diskFS) Usage(bucket *ent.Bucket) (uint64, error) {
+	stats, err := fs.Stats(bucket)
+	return stats.Bytes, err
+}
+
+func (fs *diskFS) Stats(bucket *ent.Bucket) (ent.BucketStats, error) {
+	var (
+		stats     ent.BucketStats
+		bucketDir = filepath.Join(fs.root, bucket.Name)
+	)
+
+	err := filepath.Walk(bucketDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Meta sidecars and ignored files are bookkeeping and not files of
+		// the bucket.
+		if path != bucketDir && isIgnored(fs.ignore, info.Name()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() || filepath.Ext(path) == metaExt {
+			return nil
+		}
+
+		stats.Files++
+		stats.Bytes += uint64(info.Size())
+
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return ent.BucketStats{}, nil
+	}
+	if err != nil {
+		return ent.BucketStats{}, fmt.Errorf("stats of %s failed: %s", bucket.Name, err)
+	}
+
+	return stats, nil
+}
+
+func (fs *diskFS) Meta(bucket *ent.Bucket, key string) (ent.Meta, error) {
+	return readMeta(pathForFile(fs, bucket, key))
+}
+
+// SetMeta replaces the Meta in the sidecar under the lock of the key.
+func (fs *diskFS) SetMeta(bucket *ent.Bucket, key string, m ent.Meta) error {
+	return fs.UpdateMeta(bucket, key, func(prev *ent.Meta) {
+		*prev = m
+	})
+}
+
+// setCreated records the time the file at p was created unless it has been
+// recorded by an earlier Create of the key, and returns the time recorded.
+// The hash of the content just stored is recorded alongside, it is empty if
+// the file has been stored without hashing it. The caller holds the lock of
+// the key.
+func (fs *diskFS) setCreated(p string, created time.Time, d digests) (time.Time, error) {
+	s, err := readSidecar(p)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if s.Created.IsZero() {
+		s.Created = created
+	}
+	// Content appended in place isn't encoded.
+	s.digests = d
+	s.Content = nil
+
+	return s.Created, fs.writeSidecar(p, s)
+}
+
+// sidecar is the content of the sidecar of a file, its Meta and what the
+// diskFS keeps about it for itself.
+type sidecar struct {
+	ent.Meta
+	digests
+
+	// Content digests the content as read back if it is encoded when stored,
+	// like compressed or encrypted content.
+	Content *contentDigests `json:"content,omitempty"`
+}
+
+// digests are the hex encoded digests of the content recorded when it was
+// stored, so they are known without reading it. They are empty if the
+// content hasn't been digested while it was stored, like with lazy hashing.
+type digests struct {
+	// Hash is the SHA1 of the content.
+	Hash string `json:"hash,omitempty"`
+	// CRC32C is the CRC32C checksum of the content.
+	CRC32C string `json:"crc32c,omitempty"`
+	// MD5 is the MD5 of the content, it is only recorded if ETags are
+	// formed from it.
+	MD5 string `json:"md5,omitempty"`
+}
+
+// newDigests returns the digests of the content digested by d.
+func newDigests(d *ent.Digest) digests {
+	ds := digests{
+		Hash:   hex.EncodeToString(d.Hash()),
+		CRC32C: fmt.Sprintf("%08x", d.CRC32C()),
+	}
+
+	if sum := d.MD5(); sum != nil {
+		ds.MD5 = hex.EncodeToString(sum)
+	}
+
+	return ds
 }
 
-func newDiskFS(root string) ent.FileSystem {
-	return &diskFS{
-		root: root,
+// hash returns the decoded hash, ok is false if none has been recorded.
+func (d digests) hash() ([]byte, bool) {
+	if d.Hash == "" {
+		return nil, false
 	}
+
+	h, err := hex.DecodeString(d.Hash)
+	return h, err == nil
 }
 
-func (fs *diskFS) Create(
-	bucket *ent.Bucket,
-	key string,
-	r io.Reader,
-) (ent.File, error) {
-	dst := pathForFile(fs, bucket, key)
+// md5 returns the decoded MD5, nil if none has been recorded.
+func (d digests) md5() []byte {
+	if d.MD5 == "" {
+		return nil
+	}
 
-	err := os.MkdirAll(filepath.Dir(dst), 0755)
+	sum, err := hex.DecodeString(d.MD5)
 	if err != nil {
-		return nil, err
+		return nil
+	}
+	return sum
+}
+
+// crc32c returns the decoded checksum, ok is false if none has been recorded.
+func (d digests) crc32c() (uint32, bool) {
+	if d.CRC32C == "" {
+		return 0, false
+	}
+
+	sum, err := strconv.ParseUint(d.CRC32C, 16, 32)
+	return uint32(sum), err == nil
+}
+
+// contentDigests are the digests and size of content encoded when stored, as
+// read back after decoding it.
+type contentDigests struct {
+	digests
+	Size int64 `json:"size"`
+}
+
+// newContentDigests returns the digests of the content digested by d, nil if
+// d is nil.
+func newContentDigests(d *ent.Digest) *contentDigests {
+	if d == nil {
+		return nil
+	}
+
+	return &contentDigests{
+		digests: newDigests(d),
+		Size:    d.Len(),
+	}
+}
+
+// contentRecorder is implemented by Files which know the digests recorded for
+// their content as read back after decoding it.
+type contentRecorder interface {
+	recordedContent() *contentDigests
+}
+
+// recordedContent returns the digests recorded for the content of f as read
+// back after decoding it, nil if there are none.
+func recordedContent(f ent.File) *contentDigests {
+	if cr, ok := f.(contentRecorder); ok {
+		return cr.recordedContent()
+	}
+	return nil
+}
+
+// readMeta reads the Meta sidecar of the file at p, which is empty if none
+// has been stored yet.
+func readMeta(p string) (ent.Meta, error) {
+	s, err := readSidecar(p)
+	return s.Meta, err
+}
+
+// readSidecar reads the sidecar of the file at p, which is empty if none has
+// been stored yet.
+func readSidecar(p string) (sidecar, error) {
+	s := sidecar{}
+
+	f, err := os.Open(p + metaExt)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
 	}
+	defer f.Close()
 
-	tmp, err := ioutil.TempFile(filepath.Join(fs.root, bucket.Name), "pending-")
+	err = json.NewDecoder(f).Decode(&s)
 	if err != nil {
-		return nil, err
+		return s, fmt.Errorf("decoding meta failed: %s", err)
 	}
-	defer tmp.Close()
 
-	f := newFile(tmp, key)
+	return s, nil
+}
 
-	_, err = io.Copy(f, r)
+// writeSidecar replaces the sidecar of the file at p.
+func (fs *diskFS) writeSidecar(p string, s sidecar) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(p), pendingPrefix)
 	if err != nil {
-		return nil, fmt.Errorf("storing failed: %s", err)
+		return err
 	}
+	defer tmp.Close()
 
-	err = os.Rename(tmp.Name(), dst)
+	err = json.NewEncoder(tmp).Encode(s)
 	if err != nil {
-		return nil, fmt.Errorf("rename failed: %s", err)
+		os.Remove(tmp.Name())
+		return fmt.Errorf("storing meta failed: %s", err)
+	}
+
+	// The sidecar holds the digests of the content, it has to survive a
+	// crash as well as the content does.
+	if fs.fsync {
+		err = syncFile(tmp)
+		if err != nil {
+			os.Remove(tmp.Name())
+			return fmt.Errorf("sync failed: %s", err)
+		}
 	}
 
-	f.File, err = os.Open(dst)
+	err = os.Rename(tmp.Name(), p+metaExt)
 	if err != nil {
-		return nil, fmt.Errorf("open failed: %s", err)
+		os.Remove(tmp.Name())
+		return fmt.Errorf("rename failed: %s", err)
 	}
 
-	stat, err := f.File.Stat()
+	return nil
+}
+
+// Ready reports an error if files can't be written to the root directory.
+func (fs *diskFS) Ready() error {
+	err := os.MkdirAll(fs.root, 0755)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	f.lastModified = stat.ModTime()
+	tmp, err := ioutil.TempFile(fs.root, "ready-")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
 
-	return f, nil
+	return os.Remove(tmp.Name())
 }
 
-func (fs *diskFS) Delete(bucket *ent.Bucket, key string) error {
-	p := pathForFile(fs, bucket, key)
+type file struct {
+	created time.Time
 
-	_, err := os.Stat(p)
+	// digest accumulates the hash and checksum of the content written, or
+	// read to hash it. It covers all of the content once its length matches
+	// the size of the file.
+	digest *ent.Digest
+
+	key          string
+	lastModified time.Time
+
+	// metaPath is the path of the file, its sidecar is read on first access
+	// to the creation time or the digests recorded in it.
+	metaPath string
+	sidecar  *sidecar
+
+	// lazy skips hashing while writing, Hash reads the file instead.
+	lazy bool
+
+	// path is set for files which have not been opened yet, they are opened on
+	// first access.
+	path string
+
+	*os.File
+}
+
+func newFile(f *os.File, key string) *file {
+	return &file{
+		digest: newDigest(),
+		key:    key,
+		File:   f,
+	}
+}
+
+// open opens the underlying file of handles returned by List.
+func (f *file) open() error {
+	if f.File != nil {
+		return nil
+	}
+	if f.path == "" {
+		return os.ErrInvalid
+	}
+
+	fd, err := os.Open(f.path)
 	if err != nil {
 		if os.IsNotExist(err) {
 			err = ent.ErrFileNotFound
@@ -80,165 +1153,392 @@ func (fs *diskFS) Delete(bucket *ent.Bucket, key string) error {
 		return err
 	}
 
-	err = os.Remove(p)
-	if err != nil {
-		return fmt.Errorf("removal failed: %s", err)
-	}
+	f.File = fd
 
 	return nil
 }
 
-func (fs *diskFS) Open(bucket *ent.Bucket, key string) (ent.File, error) {
-	path := pathForFile(fs, bucket, key)
+func (f *file) Close() error {
+	if f.File == nil {
+		return nil
+	}
+	return f.File.Close()
+}
 
-	stat, err := os.Stat(path)
+func (f *file) Read(p []byte) (int, error) {
+	err := f.open()
 	if err != nil {
-		if os.IsNotExist(err) {
-			err = ent.ErrFileNotFound
+		return 0, err
+	}
+	return f.File.Read(p)
+}
+
+// ReadAt reads from the file at off without affecting Read, it is safe for
+// concurrent use once the file has been opened.
+func (f *file) ReadAt(p []byte, off int64) (int, error) {
+	err := f.open()
+	if err != nil {
+		return 0, err
+	}
+	return f.File.ReadAt(p, off)
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	err := f.open()
+	if err != nil {
+		return 0, err
+	}
+	return f.File.Seek(offset, whence)
+}
+
+func (f *file) Key() string {
+	return f.key
+}
+
+func (f *file) LastModified() time.Time {
+	return f.lastModified
+}
+
+// Created returns the time recorded on the first Create of the key. Files
+// stored before it was recorded report their last modification instead, as do
+// walked files whose sidecar fails to be read.
+func (f *file) Created() time.Time {
+	if f.created.IsZero() {
+		s, err := f.recorded()
+		if err != nil {
+			log.Printf("ERROR reading created of %s: %s", f.key, err)
 		}
-		return nil, err
+
+		f.created = s.Created
 	}
 
-	// If the requested key only matches a sub-directory and not a file we handle
-	// it as if no file was found.
-	if stat.IsDir() {
-		return nil, ent.ErrFileNotFound
+	if f.created.IsZero() {
+		return f.lastModified
 	}
 
-	f, err := os.Open(path)
+	return f.created
+}
+
+// Size returns the size of the content in bytes.
+func (f *file) Size() (int64, error) {
+	err := f.open()
 	if err != nil {
-		return nil, err
+		return 0, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
 	}
 
-	return newFile(f, key), nil
+	return fi.Size(), nil
 }
 
-func (fs *diskFS) List(
-	bucket *ent.Bucket,
-	prefix string,
-	limit uint64,
-	sortStrategy ent.SortStrategy,
-) (ent.Files, error) {
-	var (
-		files      = ent.Files{}
-		bucketDir  = filepath.Join(fs.root, bucket.Name)
-		prefixGlob = filepath.Join(bucketDir, prefix)
-	)
+// CRC32C returns the checksum recorded when the content was stored unless
+// the content has been digested since.
+func (f *file) CRC32C() (uint32, error) {
+	d, err := f.recordedDigests()
+	if err != nil {
+		return 0, err
+	}
 
-	// In case the directory does not exist yet for a bucket, because no files
-	// have been stored yet we treat it as if the bucket is empty.
-	_, err := os.Stat(bucketDir)
-	if os.IsNotExist(err) {
-		return files, nil
+	if sum, ok := d.crc32c(); ok {
+		return sum, nil
+	}
+
+	err = f.sum()
+	if err != nil {
+		return 0, err
 	}
+
+	return f.digest.CRC32C(), nil
+}
+
+// ETag returns the ETag formed from the digests recorded when the content
+// was stored unless the content has been digested since.
+func (f *file) ETag() (string, error) {
+	return ent.FileETag(f, f.recordedMD5)
+}
+
+// Hash returns the hash recorded when the content was stored unless the
+// content has been digested since.
+func (f *file) Hash() ([]byte, error) {
+	d, err := f.recordedDigests()
 	if err != nil {
 		return nil, err
 	}
 
-	err = filepath.Walk(bucketDir, listWalk(&files, prefixGlob, bucketDir))
+	if h, ok := d.hash(); ok {
+		return h, nil
+	}
+
+	err = f.sum()
 	if err != nil {
 		return nil, err
 	}
 
-	sortStrategy.Sort(files)
+	return f.digest.Hash(), nil
+}
 
-	if limit < uint64(len(files)) {
-		files = files[:limit]
+// recorded returns the sidecar of the file, which is read once. Files which
+// have not been stored yet have none.
+func (f *file) recorded() (sidecar, error) {
+	if f.sidecar == nil {
+		if f.metaPath == "" {
+			return sidecar{}, nil
+		}
+
+		s, err := readSidecar(f.metaPath)
+		if err != nil {
+			return sidecar{}, err
+		}
+
+		f.sidecar = &s
 	}
 
-	return files, nil
+	return *f.sidecar, nil
 }
 
-type file struct {
-	hash         hash.Hash
-	hashed       int64
-	key          string
-	lastModified time.Time
+// recordedDigests returns the digests recorded in the sidecar, which are
+// empty if the content written has been digested in full and needn't be
+// read again anyway.
+func (f *file) recordedDigests() (digests, error) {
+	err := f.open()
+	if err != nil {
+		return digests{}, err
+	}
 
-	*os.File
+	fi, err := f.Stat()
+	if err != nil {
+		return digests{}, err
+	}
+	if f.digest.Len() == fi.Size() {
+		return digests{}, nil
+	}
+
+	s, err := f.recorded()
+	if err != nil {
+		return digests{}, err
+	}
+
+	return s.digests, nil
 }
 
-func newFile(f *os.File, key string) *file {
-	return &file{
-		hash:   sha1.New(),
-		hashed: 0,
-		key:    key,
-		File:   f,
+// storedDigests returns the digests of the content written to be recorded,
+// which are empty unless all of it has been digested while writing, unlike
+// for lazy files.
+func (f *file) storedDigests() digests {
+	if f.lazy {
+		return digests{}
 	}
+
+	fi, err := f.Stat()
+	if err != nil || fi.Size() != f.digest.Len() {
+		return digests{}
+	}
+
+	return newDigests(f.digest)
 }
 
-func (f *file) Key() string {
-	return f.key
+// recordedMD5 returns the MD5 digested while the content was written or
+// recorded in the sidecar.
+func (f *file) recordedMD5() []byte {
+	d, err := f.recordedDigests()
+	if err != nil {
+		return nil
+	}
+
+	if sum := d.md5(); sum != nil {
+		return sum
+	}
+
+	fi, err := f.Stat()
+	if err != nil || f.digest.Len() != fi.Size() {
+		return nil
+	}
+
+	// The content written has been digested in full.
+	return f.digest.MD5()
 }
 
-func (f *file) LastModified() time.Time {
-	return f.lastModified
+// recordedContent returns the digests of the content as read back recorded
+// in the sidecar.
+func (f *file) recordedContent() *contentDigests {
+	s, err := f.recorded()
+	if err != nil {
+		return nil
+	}
+
+	return s.Content
 }
 
-func (f *file) Hash() ([]byte, error) {
+// sum brings the digest up to date with the content, which is read again
+// unless all of it has been digested while writing. The content is read
+// without seeking, the offset of Read is left alone.
+func (f *file) sum() error {
+	err := f.open()
+	if err != nil {
+		return err
+	}
+
 	fi, err := f.Stat()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if f.hashed == fi.Size() {
-		return f.hash.Sum(nil), nil
+	if f.digest.Len() == fi.Size() {
+		return nil
 	}
 
-	f.hash.Reset()
-	f.hashed = 0
+	d := newDigest()
 
-	_, err = f.Seek(0, 0)
+	_, err = io.Copy(d, io.NewSectionReader(f.File, 0, fi.Size()))
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	n, err := io.Copy(f.hash, f)
-	if err != nil {
-		return nil, err
+	f.digest = d
+
+	return nil
+}
+
+// ReadFrom digests the content while writing it unless the file is lazy. It
+// shadows ReadFrom of the embedded *os.File which io.Copy would otherwise use,
+// bypassing Write, and copies with buffers of bufferSize.
+func (f *file) ReadFrom(r io.Reader) (int64, error) {
+	if f.lazy {
+		return copyBuffer(f.File, r)
 	}
 
-	f.hashed += int64(n)
+	return copyBuffer(f.File, io.TeeReader(r, f.digest))
+}
 
-	return f.hash.Sum(nil), nil
+// WriteString shadows WriteString of the embedded *os.File, which io.Copy
+// would otherwise use for readers like strings.Reader, bypassing Write.
+func (f *file) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
 }
 
 func (f *file) Write(p []byte) (int, error) {
-	n, err := f.hash.Write(p)
-	if err != nil {
-		return n, err
+	if f.lazy {
+		return f.File.Write(p)
 	}
-	f.hashed += int64(n)
 
-	return f.File.Write(p)
+	n, err := f.File.Write(p)
+	f.digest.Write(p[:n])
+
+	return n, err
 }
 
 func listWalk(
-	files *ent.Files,
+	fn func(ent.File) error,
 	prefix string,
+	modified ent.ModifiedRange,
 	bucketDir string,
+	ignore []string,
+	sharded bool,
 ) filepath.WalkFunc {
 	return func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return fmt.Errorf("error walking tree: %s", err)
 		}
 
-		if !info.IsDir() && strings.HasPrefix(path, prefix) {
-			stat, err := os.Stat(path)
-			if err != nil {
-				return err
+		// The key is without leading slash and matched against the prefix as a
+		// whole, so prefix "a/b/" matches "a/b/c" but not "a/bc".
+		key := strings.TrimPrefix(path, bucketDir+"/")
+
+		if path != bucketDir && isIgnored(ignore, info.Name()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if sharded && path != bucketDir {
+			// Shard directories hold keys of any prefix.
+			if info.IsDir() && strings.Count(key, "/") < shardLevels {
+				return nil
+			}
+
+			var ok bool
+
+			key, ok = unshard(key)
+			if !ok && !info.IsDir() {
+				return nil
+			}
+		}
+
+		if info.IsDir() {
+			// Skip directories which can't contain keys with the prefix.
+			dir := key + "/"
+			if path != bucketDir &&
+				!strings.HasPrefix(dir, prefix) &&
+				!strings.HasPrefix(prefix, dir) {
+				return filepath.SkipDir
 			}
+			return nil
+		}
 
-			// The key is without leading slash.
-			f := newFile(nil, strings.TrimPrefix(path, bucketDir+"/"))
-			f.lastModified = stat.ModTime()
+		if strings.HasPrefix(key, prefix) && modified.Contains(info.ModTime()) {
+			// The file is only opened once read to not hold a descriptor for
+			// every listed file.
+			f := newFile(nil, key)
+			f.lastModified = info.ModTime()
+			f.metaPath = path
+			f.path = path
 
-			*files = append(*files, f)
+			return fn(f)
 		}
 
 		return nil
 	}
 }
 
+// checkKey rejects keys which are not normalized with ErrInvalidParam, so
+// files are stored under the key they are listed with.
+func checkKey(key string) error {
+	k, err := ent.NormalizeKey(key)
+	if err != nil {
+		return err
+	}
+
+	if k != key || isReserved(key) {
+		return ent.ErrInvalidParam
+	}
+
+	return nil
+}
+
+// isReserved reports whether a segment of key names a bookkeeping file of
+// diskFS, like the sidecar of another file or a temporary file, which files
+// must not be stored under. They would be hidden from listings and removed
+// by the garbage collection.
+func isReserved(key string) bool {
+	for _, segment := range strings.Split(key, "/") {
+		switch {
+		case strings.HasSuffix(segment, metaExt),
+			strings.HasPrefix(segment, pendingPrefix),
+			segment == trashDir,
+			segment == versionsDir:
+			return true
+		}
+	}
+
+	return false
+}
+
+// isIgnored reports whether name matches one of the patterns.
+func isIgnored(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := filepath.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
 func pathForFile(fs *diskFS, bucket *ent.Bucket, key string) string {
+	if fs.shard {
+		return filepath.Join(fs.root, bucket.Name, shardDir(key), key)
+	}
 	return filepath.Join(fs.root, bucket.Name, key)
 }
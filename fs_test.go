@@ -1,13 +1,22 @@
 package main
 
 import (
+	"bytes"
 	"crypto/sha1"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
@@ -69,6 +78,781 @@ func TestDiskFSCreate(t *testing.T) {
 	}
 }
 
+func TestDiskFSCreateHashedWhileWriting(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-diskfs-hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		b       = ent.NewBucket("hash", ent.Owner{})
+		content = bytes.Repeat([]byte("ent"), 1<<16)
+		sum     = sha1.Sum(content)
+	)
+
+	for _, fs := range []ent.FileSystem{
+		newDiskFS(tmp),
+		newDiskFS(tmp, withDirectWrite(true)),
+	} {
+		f, err := fs.Create(b, "hashed", bytes.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The hash has to be complete without reading the file back.
+		if have, want := f.(*file).digest.Len(), int64(len(content)); have != want {
+			t.Errorf("have %d, want %d", have, want)
+		}
+
+		h, err := f.Hash()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have, want := hex.EncodeToString(h), hex.EncodeToString(sum[:]); have != want {
+			t.Errorf("have %s, want %s", have, want)
+		}
+
+		f.Close()
+	}
+}
+
+func BenchmarkDiskFSCreate(b *testing.B) {
+	for _, fsync := range []bool{false, true} {
+		b.Run(fmt.Sprintf("fsync=%t", fsync), func(b *testing.B) {
+			benchmarkDiskFSCreate(b, true, withFsync(fsync))
+		})
+	}
+}
+
+// BenchmarkDiskFSCreateUnhashed measures uploads whose hash is never read.
+func BenchmarkDiskFSCreateUnhashed(b *testing.B) {
+	for _, lazy := range []bool{false, true} {
+		b.Run(fmt.Sprintf("lazy=%t", lazy), func(b *testing.B) {
+			benchmarkDiskFSCreate(b, false, withLazyHash(lazy))
+		})
+	}
+}
+
+func benchmarkDiskFSCreate(b *testing.B, hash bool, opts ...diskOption) {
+	tmp, err := ioutil.TempDir("", "ent-diskfs-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		bucket  = ent.NewBucket("bench", ent.Owner{})
+		fs      = newDiskFS(tmp, opts...)
+		content = bytes.Repeat([]byte{'x'}, 32<<20)
+	)
+
+	b.SetBytes(int64(len(content)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		f, err := fs.Create(bucket, "large", bytes.NewReader(content))
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if hash {
+			_, err = f.Hash()
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		f.Close()
+	}
+}
+
+func TestDiskFSCreateLazyHash(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-diskfs-lazy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		b       = ent.NewBucket("lazy", ent.Owner{})
+		content = bytes.Repeat([]byte("lazy"), 1<<12)
+		sum     = sha1.Sum(content)
+	)
+
+	for _, input := range []struct {
+		directWrite bool
+		lazy        bool
+		hashed      int64
+	}{
+		{false, false, int64(len(content))},
+		{false, true, 0},
+		{true, false, int64(len(content))},
+		{true, true, 0},
+	} {
+		fs := newDiskFS(tmp, withDirectWrite(input.directWrite), withLazyHash(input.lazy))
+
+		f, err := fs.Create(b, "hashed.txt", bytes.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have, want := f.(*file).digest.Len(), input.hashed; have != want {
+			t.Errorf("direct %t lazy %t: have %d bytes hashed, want %d", input.directWrite, input.lazy, have, want)
+		}
+
+		h, err := f.Hash()
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have, want := hex.EncodeToString(h), hex.EncodeToString(sum[:]); have != want {
+			t.Errorf("direct %t lazy %t: have %s, want %s", input.directWrite, input.lazy, have, want)
+		}
+	}
+}
+
+func TestDiskFSCreateCRC32C(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-diskfs-crc32c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	raw, err := ioutil.ReadFile(fixtureZip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		b    = ent.NewBucket("crc32c", ent.Owner{})
+		want = crc32.Checksum(raw, crc32.MakeTable(crc32.Castagnoli))
+	)
+
+	for _, lazy := range []bool{false, true} {
+		fs := newDiskFS(tmp, withLazyHash(lazy))
+
+		f, err := fs.Create(b, "test.zip", bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sum, err := f.CRC32C()
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have := sum; have != want {
+			t.Errorf("lazy %t: have %08x, want %08x", lazy, have, want)
+		}
+
+		// Files opened later compute the checksum from their content.
+		f, err = fs.Open(b, "test.zip")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sum, err = f.CRC32C()
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have := sum; have != want {
+			t.Errorf("lazy %t: have %08x, want %08x", lazy, have, want)
+		}
+	}
+}
+
+func TestDiskFSCreateFsync(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-diskfs-fsync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		b                 = ent.NewBucket("fsync", ent.Owner{})
+		files, dirs       int
+		origFile, origDir = syncFile, syncDir
+	)
+	defer func() {
+		syncFile, syncDir = origFile, origDir
+	}()
+
+	syncFile = func(f *os.File) error {
+		files++
+		return origFile(f)
+	}
+	syncDir = func(dir string) error {
+		if have, want := dir, filepath.Join(tmp, b.Name, "nested"); have != want {
+			t.Errorf("have %s, want %s", have, want)
+		}
+		dirs++
+		return origDir(dir)
+	}
+
+	// The content and its sidecar are synced, the directory holding both
+	// once.
+	for _, input := range []struct {
+		directWrite bool
+		fsync       bool
+		fileSyncs   int
+		dirSyncs    int
+	}{
+		{false, false, 0, 0},
+		{false, true, 2, 1},
+		{true, false, 0, 0},
+		{true, true, 2, 1},
+	} {
+		files, dirs = 0, 0
+
+		fs := newDiskFS(tmp, withDirectWrite(input.directWrite), withFsync(input.fsync))
+
+		f, err := fs.Create(b, "nested/synced.txt", strings.NewReader("content"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		if have, want := files, input.fileSyncs; have != want {
+			t.Errorf("direct %t fsync %t: have %d file syncs, want %d", input.directWrite, input.fsync, have, want)
+		}
+
+		if have, want := dirs, input.dirSyncs; have != want {
+			t.Errorf("direct %t fsync %t: have %d dir syncs, want %d", input.directWrite, input.fsync, have, want)
+		}
+	}
+}
+
+func TestDiskFSCreateFailureRemovesTempFile(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-diskfs-create-failure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		b  = ent.NewBucket("create-failure", ent.Owner{})
+		fs = newDiskFS(tmp)
+		r  = io.MultiReader(
+			strings.NewReader("partial content"),
+			&failingReader{errors.New("client went away")},
+		)
+	)
+
+	_, err = fs.Create(b, "failed", r)
+	if err == nil {
+		t.Fatal("expected Create to fail")
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Join(tmp, b.Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range entries {
+		t.Errorf("unexpected file %s left behind", e.Name())
+	}
+}
+
+type failingReader struct {
+	err error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+func TestDiskFSCreateDirectWrite(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-diskfs-direct")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	if newDiskFS(tmp).(*diskFS).directWrite {
+		t.Fatal("direct write must not be the default")
+	}
+
+	var (
+		b   = ent.NewBucket("direct", ent.Owner{})
+		fs  = newDiskFS(tmp, withDirectWrite(true))
+		key = "nested/direct.file"
+	)
+
+	for _, content := range []string{"longer initial content", "short"} {
+		f, err := fs.Create(b, key, strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		raw, err := ioutil.ReadFile(filepath.Join(tmp, b.Name, key))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have, want := string(raw), content; have != want {
+			t.Errorf("have %q, want %q", have, want)
+		}
+	}
+
+	// No temporary files are involved in direct mode.
+	entries, err := ioutil.ReadDir(filepath.Join(tmp, b.Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "pending-") {
+			t.Errorf("unexpected temporary file %s", e.Name())
+		}
+	}
+}
+
+func TestDiskFSCreateExclusive(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-diskfs-exclusive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	b := ent.NewBucket("exclusive", ent.Owner{})
+
+	for _, directWrite := range []bool{false, true} {
+		var (
+			fs  = newDiskFS(tmp, withDirectWrite(directWrite))
+			key = fmt.Sprintf("nested/exclusive-%t.file", directWrite)
+		)
+
+		f, err := fs.CreateExclusive(b, key, strings.NewReader("first"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		_, err = fs.CreateExclusive(b, key, strings.NewReader("second"))
+		if !ent.IsFileExists(err) {
+			t.Errorf("direct %t: have %v, want %v", directWrite, err, ent.ErrFileExists)
+		}
+
+		raw, err := ioutil.ReadFile(filepath.Join(tmp, b.Name, key))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have, want := string(raw), "first"; have != want {
+			t.Errorf("direct %t: have %q, want %q", directWrite, have, want)
+		}
+	}
+
+	// A failed exclusive Create doesn't leave its partial content to conflict
+	// with the next one.
+	direct := newDiskFS(tmp, withDirectWrite(true))
+
+	_, err = direct.CreateExclusive(b, "nested/failed.file", io.MultiReader(
+		strings.NewReader("partial content"),
+		&failingReader{errors.New("client went away")},
+	))
+	if err == nil {
+		t.Fatal("expected CreateExclusive to fail")
+	}
+
+	f, err := direct.CreateExclusive(b, "nested/failed.file", strings.NewReader("retried"))
+	if err != nil {
+		t.Fatalf("retry failed: %s", err)
+	}
+	f.Close()
+
+	err = direct.Delete(b, "nested/failed.file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Join(tmp, b.Name, "nested"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both files are stored along with the Meta recording their creation.
+	if have, want := len(entries), 4; have != want {
+		t.Errorf("have %d files, want %d", have, want)
+	}
+}
+
+func TestDiskFSPlaceExclusiveRace(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-diskfs-place-race")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		b       = ent.NewBucket("place-race", ent.Owner{})
+		expires = time.Now().Add(time.Hour).Round(0)
+		winner  = newDiskFS(tmp).(*diskFS)
+		loser   = newDiskFS(tmp).(*diskFS)
+		dst     = filepath.Join(tmp, b.Name, "raced.txt")
+		pending = filepath.Join(tmp, "pending-raced")
+	)
+
+	f, err := createWithMeta(winner, b, "raced.txt", strings.NewReader("winner"), createOptions{
+		meta:      ent.Meta{Expires: expires},
+		exclusive: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// Another process checked before the winner placed its file and links
+	// its own content after.
+	err = ioutil.WriteFile(pending, []byte("loser"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = loser.place(pending, dst, sidecar{}, sidecar{}, true)
+	if have, want := err, ent.ErrFileExists; have != want {
+		t.Fatalf("have %v, want %v", have, want)
+	}
+
+	m, err := winner.Meta(b, "raced.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := m.Expires, expires; !have.Equal(want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+}
+
+func TestDiskFSCreated(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-diskfs-created")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	b := ent.NewBucket("created", ent.Owner{})
+
+	for _, directWrite := range []bool{false, true} {
+		var (
+			fs  = newDiskFS(tmp, withDirectWrite(directWrite))
+			key = fmt.Sprintf("created-%t.txt", directWrite)
+		)
+
+		first, err := fs.Create(b, key, strings.NewReader("first"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		first.Close()
+
+		time.Sleep(10 * time.Millisecond)
+
+		second, err := fs.Create(b, key, strings.NewReader("second"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		second.Close()
+
+		if have, want := second.Created(), first.Created(); !have.Equal(want) {
+			t.Errorf("direct %t: have created %v, want %v", directWrite, have, want)
+		}
+
+		if !second.LastModified().After(first.LastModified()) {
+			t.Errorf("direct %t: last modified %v not after %v", directWrite, second.LastModified(), first.LastModified())
+		}
+
+		f, err := fs.Open(b, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		if have, want := f.Created(), first.Created(); !have.Equal(want) {
+			t.Errorf("direct %t: have created %v, want %v", directWrite, have, want)
+		}
+
+		files, err := fs.List(b, key, ent.DefaultLimit, ent.NoOpStrategy())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have, want := files[0].Created(), first.Created(); !have.Equal(want) {
+			t.Errorf("direct %t: have listed created %v, want %v", directWrite, have, want)
+		}
+	}
+}
+
+func TestDiskFSCreateMalformedKey(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-diskfs-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		b  = ent.NewBucket("keys", ent.Owner{})
+		fs = newDiskFS(tmp)
+	)
+
+	for _, key := range []string{"", "a/", "a//b", "/a", "./a", "a/../../b"} {
+		_, err := fs.Create(b, key, strings.NewReader("content"))
+		if have, want := err, ent.ErrInvalidParam; have != want {
+			t.Errorf("%q: have %v, want %v", key, have, want)
+		}
+	}
+
+	entries, err := ioutil.ReadDir(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := len(entries), 0; have != want {
+		t.Errorf("have %d files, want %d", have, want)
+	}
+}
+
+func TestDiskFSCreateConcurrent(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-diskfs-concurrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		b        = ent.NewBucket("concurrent", ent.Owner{})
+		contents = map[string]bool{}
+		inputs   = [][]byte{}
+	)
+
+	for i := 0; i < 16; i++ {
+		content := bytes.Repeat([]byte{byte('a' + i)}, 1<<16)
+		sum := sha1.Sum(content)
+
+		inputs = append(inputs, content)
+		contents[hex.EncodeToString(sum[:])] = true
+	}
+
+	for _, directWrite := range []bool{false, true} {
+		var (
+			fs   = newDiskFS(tmp, withDirectWrite(directWrite))
+			key  = fmt.Sprintf("nested/concurrent-%t.file", directWrite)
+			wg   sync.WaitGroup
+			errs = make(chan error, len(inputs))
+		)
+
+		for _, content := range inputs {
+			wg.Add(1)
+
+			go func(content []byte) {
+				defer wg.Done()
+
+				f, err := fs.Create(b, key, bytes.NewReader(content))
+				if err != nil {
+					errs <- err
+					return
+				}
+				defer f.Close()
+
+				// Every Create returns the content it stored.
+				raw, err := ioutil.ReadAll(f)
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				if !bytes.Equal(raw, content) {
+					errs <- fmt.Errorf("direct %t: returned content of another Create", directWrite)
+				}
+			}(content)
+		}
+
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			t.Error(err)
+		}
+
+		raw, err := ioutil.ReadFile(filepath.Join(tmp, b.Name, key))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sum := sha1.Sum(raw)
+		if !contents[hex.EncodeToString(sum[:])] {
+			t.Errorf("direct %t: stored content matches none of the inputs", directWrite)
+		}
+	}
+}
+
+func TestDiskFSCreateTempDir(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-diskfs-tempdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		scratch = filepath.Join(tmp, "scratch")
+		root    = filepath.Join(tmp, "root")
+		fs      = newDiskFS(root, withTempDir(scratch))
+		b       = ent.NewBucket("tempdir", ent.Owner{})
+	)
+
+	err = os.MkdirAll(scratch, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := fs.Create(b, "nested/file.txt", strings.NewReader("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	entries, err := ioutil.ReadDir(scratch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := len(entries), 0; have != want {
+		t.Errorf("have %d temporary files, want %d", have, want)
+	}
+
+	// A Create in progress in the bucket directory.
+	err = ioutil.WriteFile(filepath.Join(root, b.Name, pendingPrefix+"123"), []byte("partial"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := fs.List(b, "", ent.DefaultLimit, ent.ByKeyStrategy(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []string{}
+	for _, f := range files {
+		keys = append(keys, f.Key())
+	}
+
+	if have, want := keys, []string{"nested/file.txt"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+}
+
+func TestDiskFSListIgnore(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-diskfs-ignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	b := ent.NewBucket("ignore", ent.Owner{})
+
+	for _, input := range []struct {
+		ignore []string
+		keys   []string
+	}{
+		{nil, []string{"blob.txt", "nested/.hidden", "nested/blob.txt"}},
+		{[]string{".*"}, []string{"blob.txt", "nested/blob.txt"}},
+		// Custom patterns don't replace the ones of the bookkeeping files.
+		{[]string{"*.txt"}, []string{"nested/.hidden"}},
+	} {
+		fs := newDiskFS(tmp, withIgnore(input.ignore))
+
+		for _, key := range []string{"blob.txt", "nested/blob.txt", "nested/.hidden"} {
+			_, err := fs.Create(b, key, strings.NewReader("content"))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err = fs.SetMeta(b, "blob.txt", ent.Meta{RetainUntil: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		files, err := fs.List(b, "", ent.DefaultLimit, ent.ByKeyStrategy(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys := []string{}
+		for _, f := range files {
+			keys = append(keys, f.Key())
+		}
+
+		if have, want := keys, input.keys; !reflect.DeepEqual(have, want) {
+			t.Errorf("ignore %v: have %v, want %v", input.ignore, have, want)
+		}
+	}
+}
+
+func TestMoveInPlaceCrossDevice(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-diskfs-move")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		src = filepath.Join(tmp, "src")
+		dst = filepath.Join(tmp, "dir", "dst")
+	)
+
+	err = os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(src, []byte("content"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Renames of src behave like src was on another filesystem.
+	rename := func(from, to string) error {
+		if from == src {
+			return &os.LinkError{Op: "rename", Old: from, New: to, Err: syscall.EXDEV}
+		}
+		return os.Rename(from, to)
+	}
+
+	moved, err := moveInPlace(src, dst, rename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if moved {
+		t.Error("src reported as moved")
+	}
+
+	raw, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := string(raw), "content"; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Dir(dst))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := len(entries), 1; have != want {
+		t.Errorf("have %d files, want %d", have, want)
+	}
+}
+
 func TestDiskFSDelete(t *testing.T) {
 	tmp, err := ioutil.TempDir("", "diskfs-delete")
 	if err != nil {
@@ -77,56 +861,302 @@ func TestDiskFSDelete(t *testing.T) {
 	defer os.RemoveAll(tmp)
 
 	var (
-		b    = ent.NewBucket("delete", ent.Owner{})
+		b    = ent.NewBucket("delete", ent.Owner{})
+		fs   = newDiskFS(tmp)
+		file = "./fixture/test.zip"
+		key  = filepath.Base(file)
+		dst  = filepath.Join(tmp, b.Name, key)
+	)
+
+	r, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	f, err := fs.Create(b, key, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fs.Delete(b, f.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = os.Stat(dst)
+	if !os.IsNotExist(err) {
+		t.Errorf("want %v, got %v", os.ErrNotExist, err)
+	}
+}
+
+func TestDiskFSDeletePruneDirs(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "diskfs-delete-prune")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		b         = ent.NewBucket("delete-prune", ent.Owner{})
+		fs        = newDiskFS(tmp, withPruneDirs(true))
+		bucketDir = filepath.Join(tmp, b.Name)
+		deep      = "a/b/c/deep.file"
+		sibling   = "a/sibling.file"
+	)
+
+	for _, key := range []string{deep, sibling} {
+		_, err := fs.Create(b, key, strings.NewReader(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = fs.Delete(b, deep)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dir := range []string{"a/b/c", "a/b"} {
+		_, err = os.Stat(filepath.Join(bucketDir, dir))
+		if !os.IsNotExist(err) {
+			t.Errorf("%s: want %v, got %v", dir, os.ErrNotExist, err)
+		}
+	}
+
+	// The directory still holds a file and has to survive.
+	_, err = os.Stat(filepath.Join(bucketDir, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fs.Delete(b, sibling)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = os.Stat(filepath.Join(bucketDir, "a"))
+	if !os.IsNotExist(err) {
+		t.Errorf("want %v, got %v", os.ErrNotExist, err)
+	}
+
+	_, err = os.Stat(bucketDir)
+	if err != nil {
+		t.Errorf("bucket directory removed: %s", err)
+	}
+}
+
+func TestDiskFSDeleteDuringUpload(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "diskfs-delete-upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	b := ent.NewBucket("delete-upload", ent.Owner{})
+
+	for name, fs := range map[string]ent.FileSystem{
+		"rename": newDiskFS(tmp, withPruneDirs(true)),
+		"direct": newDiskFS(tmp, withPruneDirs(true), withDirectWrite(true)),
+	} {
+		key := name + "/deleted.file"
+
+		_, err := fs.Create(b, key, strings.NewReader(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var (
+			r, w = io.Pipe()
+			done = make(chan error, 1)
+		)
+
+		go func() {
+			_, err := fs.Create(b, name+"/uploading/slow.file", r)
+			done <- err
+		}()
+
+		w.Write([]byte("first chunk"))
+
+		// Pruning directories must not wait for the upload to finish.
+		deleted := make(chan error, 1)
+		go func() {
+			deleted <- fs.Delete(b, key)
+		}()
+
+		select {
+		case err := <-deleted:
+			if err != nil {
+				t.Errorf("%s: %s", name, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: delete blocked by upload", name)
+		}
+
+		w.Close()
+
+		err = <-done
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+}
+
+func TestDiskFSDeleteFileNotFound(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "diskfs-delete-notfound")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		b  = ent.NewBucket("delete-notfound", ent.Owner{})
+		fs = newDiskFS(tmp)
+	)
+
+	err = fs.Delete(b, "non-exisiting-file")
+
+	if want, got := ent.ErrFileNotFound, err; want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
+
+func TestDiskFSUsage(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-diskfs-usage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		b  = ent.NewBucket("usage", ent.Owner{})
+		fs = newDiskFS(tmp)
+	)
+
+	n, err := fs.Usage(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := n, uint64(0); have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+
+	for key, content := range map[string]string{
+		"a":        "1234",
+		"nested/b": "123456",
+	} {
+		_, err := fs.Create(b, key, strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Meta sidecars are not accounted.
+	err = fs.SetMeta(b, "a", ent.Meta{RetainUntil: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err = fs.Usage(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := n, uint64(10); have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+
+	stats, err := fs.Stats(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := stats, (ent.BucketStats{Files: 2, Bytes: 10}); have != want {
+		t.Errorf("have %+v, want %+v", have, want)
+	}
+}
+
+func TestDiskFSMeta(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "diskfs-meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		b    = ent.NewBucket("meta", ent.Owner{})
 		fs   = newDiskFS(tmp)
-		file = "./fixture/test.zip"
-		key  = filepath.Base(file)
-		dst  = filepath.Join(tmp, b.Name, key)
+		key  = "nested/meta.file"
+		meta = ent.Meta{RetainUntil: time.Now().Add(time.Hour).Round(0)}
 	)
 
-	r, err := os.Open(file)
+	err = fs.SetMeta(b, key, meta)
+	if have, want := err, ent.ErrFileNotFound; have != want {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	_, err = fs.Create(b, key, strings.NewReader("content"))
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer r.Close()
 
-	f, err := fs.Create(b, key, r)
+	err = fs.SetMeta(b, key, meta)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	_, err = os.Stat(dst)
+	m, err := fs.Meta(b, key)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	err = fs.Delete(b, f.Key())
+	if have, want := m.RetainUntil, meta.RetainUntil; !have.Equal(want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	all, err := fs.List(b, "", ent.DefaultLimit, ent.NoOpStrategy())
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	_, err = os.Stat(dst)
-	if !os.IsNotExist(err) {
-		t.Errorf("want %v, got %v", os.ErrNotExist, err)
+	if have, want := len(all), 1; have != want {
+		t.Fatalf("have %d, want %d", have, want)
 	}
-}
 
-func TestDiskFSDeleteFileNotFound(t *testing.T) {
-	tmp, err := ioutil.TempDir("", "diskfs-delete-notfound")
+	if have, want := all[0].Key(), key; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	// Retention is enforced under the lock of the key, not only by handlers.
+	_, err = fs.Create(b, key, strings.NewReader("replaced"))
+	if have, want := err, ent.ErrRetentionActive; have != want {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	err = fs.Delete(b, key)
+	if have, want := err, ent.ErrRetentionActive; have != want {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	err = fs.SetMeta(b, key, ent.Meta{})
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer os.RemoveAll(tmp)
-
-	var (
-		b  = ent.NewBucket("delete-notfound", ent.Owner{})
-		fs = newDiskFS(tmp)
-	)
 
-	err = fs.Delete(b, "non-exisiting-file")
+	err = fs.Delete(b, key)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	if want, got := ent.ErrFileNotFound, err; want != got {
-		t.Errorf("want %v, got %v", want, got)
+	_, err = os.Stat(filepath.Join(tmp, b.Name, key+metaExt))
+	if !os.IsNotExist(err) {
+		t.Errorf("want %v, got %v", os.ErrNotExist, err)
 	}
 }
 
@@ -363,6 +1393,348 @@ func TestDiskFSList(t *testing.T) {
 	}
 }
 
+func TestListFilesModifiedRange(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-diskfs-list-modified")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		fs   = newDiskFS(tmp)
+		b    = ent.NewBucket("modified", ent.Owner{})
+		base = time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+	)
+
+	for i := 0; i < 4; i++ {
+		key := fmt.Sprintf("file-%d", i)
+
+		_, err := fs.Create(b, key, strings.NewReader("content"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mtime := base.Add(time.Duration(i) * time.Hour)
+
+		err = os.Chtimes(filepath.Join(tmp, b.Name, key), mtime, mtime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, input := range []struct {
+		modified ent.ModifiedRange
+		keys     []string
+	}{
+		{ent.ModifiedRange{}, []string{"file-0", "file-1", "file-2", "file-3"}},
+		{ent.ModifiedRange{Since: base.Add(time.Hour)}, []string{"file-1", "file-2", "file-3"}},
+		{ent.ModifiedRange{Before: base.Add(time.Hour)}, []string{"file-0"}},
+		{
+			ent.ModifiedRange{Since: base.Add(30 * time.Minute), Before: base.Add(3 * time.Hour)},
+			[]string{"file-1", "file-2"},
+		},
+		{ent.ModifiedRange{Since: base.Add(4 * time.Hour)}, []string{}},
+	} {
+		files, err := listFiles(fs, b, "", input.modified, ent.DefaultLimit, ent.ByKeyStrategy(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys := []string{}
+		for _, f := range files {
+			keys = append(keys, f.Key())
+		}
+
+		if have, want := keys, input.keys; !reflect.DeepEqual(have, want) {
+			t.Errorf("%+v: have %v, want %v", input.modified, have, want)
+		}
+	}
+}
+
+func TestDiskFSListPrefixBoundaries(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-diskfs-list-prefix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		b    = ent.NewBucket("prefix", ent.Owner{})
+		fs   = newDiskFS(tmp)
+		keys = []string{"a/b/c", "a/b/d/e", "a/bc", "a/bcd/e", "ab"}
+	)
+
+	for _, key := range keys {
+		f, err := fs.Create(b, key, strings.NewReader(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+
+	for prefix, want := range map[string][]string{
+		"":      keys,
+		"a":     keys,
+		"a/":    {"a/b/c", "a/b/d/e", "a/bc", "a/bcd/e"},
+		"a/b":   {"a/b/c", "a/b/d/e", "a/bc", "a/bcd/e"},
+		"a/b/":  {"a/b/c", "a/b/d/e"},
+		"a/bc":  {"a/bc", "a/bcd/e"},
+		"a/bc/": {},
+		"a/b/d": {"a/b/d/e"},
+	} {
+		all, err := fs.List(b, prefix, ent.DefaultLimit, ent.ByKeyStrategy(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		have := []string{}
+		for _, f := range all {
+			have = append(have, f.Key())
+		}
+
+		if !reflect.DeepEqual(have, want) {
+			t.Errorf("prefix %q: have %v, want %v", prefix, have, want)
+		}
+	}
+}
+
+func TestDiskFSWalkDir(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-diskfs-walk-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		b    = ent.NewBucket("walk-dir", ent.Owner{})
+		keys = []string{"a/b/c", "a/b/d/e", "a/bc", "a/bcd/e", "ab", "top"}
+		fses = map[string]ent.FileSystem{
+			listModeReadDir: newDiskFS(filepath.Join(tmp, listModeReadDir), withListMode(listModeReadDir)),
+			listModeWalk:    newDiskFS(filepath.Join(tmp, listModeWalk), withListMode(listModeWalk)),
+			"shard":         newDiskFS(filepath.Join(tmp, "shard"), withSharding(true)),
+			"memory":        ent.NewMemoryFS(),
+		}
+	)
+
+	type listing struct {
+		files    []string
+		prefixes []string
+	}
+
+	for name, fs := range fses {
+		for _, key := range keys {
+			_, err := fs.Create(b, key, strings.NewReader(key))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for prefix, want := range map[string]listing{
+			"":         {[]string{"ab", "top"}, []string{"a/"}},
+			"a":        {[]string{"ab"}, []string{"a/"}},
+			"a/":       {[]string{"a/bc"}, []string{"a/b/", "a/bcd/"}},
+			"a/b":      {[]string{"a/bc"}, []string{"a/b/", "a/bcd/"}},
+			"a/b/":     {[]string{"a/b/c"}, []string{"a/b/d/"}},
+			"a/bc/":    {[]string{}, []string{}},
+			"missing/": {[]string{}, []string{}},
+		} {
+			have := listing{[]string{}, []string{}}
+
+			err := fs.WalkDir(
+				b,
+				prefix,
+				ent.ModifiedRange{},
+				func(f ent.File) error {
+					have.files = append(have.files, f.Key())
+					return nil
+				},
+				func(p string) error {
+					have.prefixes = append(have.prefixes, p)
+					return nil
+				},
+			)
+			if err != nil {
+				t.Fatalf("%s: %s", name, err)
+			}
+
+			sort.Strings(have.files)
+			sort.Strings(have.prefixes)
+
+			if !reflect.DeepEqual(have, want) {
+				t.Errorf("%s: prefix %q: have %v, want %v", name, prefix, have, want)
+			}
+		}
+	}
+}
+
+// BenchmarkDiskFSWalkDir lists the top level of a deep tree, which reading
+// the directory does without visiting the files below.
+func BenchmarkDiskFSWalkDir(b *testing.B) {
+	tmp, err := ioutil.TempDir("", "ent-diskfs-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		bucket = ent.NewBucket("bench", ent.Owner{})
+		seed   = newDiskFS(tmp, withFsync(false))
+	)
+
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 10; j++ {
+			for k := 0; k < 20; k++ {
+				key := fmt.Sprintf("%02d/%02d/%02d/file-%02d", i, j, k%4, k)
+
+				_, err := seed.Create(bucket, key, strings.NewReader(key))
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	}
+
+	for _, mode := range []string{listModeWalk, listModeReadDir} {
+		b.Run(mode, func(b *testing.B) {
+			fs := newDiskFS(tmp, withListMode(mode))
+
+			for i := 0; i < b.N; i++ {
+				files, prefixes, err := listDir(fs, bucket, "", ent.ModifiedRange{}, ent.DefaultLimit, ent.NoOpStrategy())
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				if len(files) != 0 || len(prefixes) != 10 {
+					b.Fatalf("have %d files and %d prefixes", len(files), len(prefixes))
+				}
+			}
+		})
+	}
+}
+
+func TestDiskFSListLazyOpen(t *testing.T) {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skipf("can't count open descriptors: %s", err)
+	}
+
+	tmp, err := ioutil.TempDir("", "ent-diskfs-list-lazy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		b     = ent.NewBucket("lazy", ent.Owner{})
+		fs    = newDiskFS(tmp)
+		count = 256
+	)
+
+	for i := 0; i < count; i++ {
+		f, err := fs.Create(b, fmt.Sprintf("file-%d", i), strings.NewReader(strconv.Itoa(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+
+	fds, err = ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := len(fds)
+
+	all, err := fs.List(b, "", ent.DefaultLimit, ent.ByKeyStrategy(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := len(all), count; have != want {
+		t.Fatalf("have %d, want %d", have, want)
+	}
+
+	fds, err = ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := len(fds), before; have > want {
+		t.Errorf("have %d open descriptors, want at most %d", have, want)
+	}
+
+	f := all[0]
+	defer f.Close()
+
+	raw, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := string(raw), "0"; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+}
+
+func TestDiskFSReadAtConcurrent(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-diskfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		b       = ent.NewBucket("readat", ent.Owner{})
+		fs      = newDiskFS(tmp)
+		content = []byte(strings.Repeat("range read ", 10000))
+		size    = 1000
+	)
+
+	_, err = fs.Create(b, "ranges.txt", bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := fs.Open(b, "ranges.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var wg sync.WaitGroup
+
+	for off := 0; off < len(content); off += size {
+		wg.Add(1)
+
+		go func(off int) {
+			defer wg.Done()
+
+			p := make([]byte, size)
+
+			n, err := f.ReadAt(p, int64(off))
+			if err != nil && err != io.EOF {
+				t.Error(err)
+				return
+			}
+
+			if have, want := p[:n], content[off:off+n]; !bytes.Equal(have, want) {
+				t.Errorf("offset %d: content differs", off)
+			}
+		}(off)
+	}
+
+	wg.Wait()
+
+	// ReadAt leaves the offset of Read alone.
+	have, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(have, content) {
+		t.Errorf("read %d bytes, want %d", len(have), len(content))
+	}
+}
+
 func TestFileHash(t *testing.T) {
 	testFile := "./fixture/test.zip"
 	h := sha1.New()
@@ -402,3 +1774,54 @@ func TestFileHash(t *testing.T) {
 		t.Errorf("hash miss-match: %s != %s", got, expected)
 	}
 }
+
+func TestFileHashKeepsOffset(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-file-hash-offset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		b       = ent.NewBucket("hash-offset", ent.Owner{})
+		fs      = newDiskFS(tmp)
+		content = "hashed without seeking"
+	)
+
+	_, err = fs.Create(b, "key", strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := fs.Open(b, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	head := make([]byte, 6)
+
+	_, err = io.ReadFull(f, head)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := f.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := hex.EncodeToString(h), fmt.Sprintf("%x", sha1.Sum([]byte(content))); have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	// Reading continues where it stopped before hashing.
+	rest, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := string(head)+string(rest), content; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+}
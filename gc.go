@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/soundcloud/ent/lib"
+)
+
+// sweeper is implemented by FileSystems which leave files behind that are not
+// removed in the course of regular operation, like the temporary files of
+// writes interrupted by a crash.
+type sweeper interface {
+	Sweep(pendingBefore, uploadsBefore, trashBefore time.Time) (sweepStats, error)
+}
+
+// sweepStats counts the files removed by a sweep.
+type sweepStats struct {
+	pending int
+	trash   int
+	uploads int
+}
+
+// Sweep removes the temporary files of writes last modified before
+// pendingBefore and the staged resumable uploads last modified before
+// uploadsBefore, and purges the files deleted before trashBefore from the
+// trash. Temporary files of writes still in progress are modified
+// continuously, the threshold has to leave them enough time to complete.
+func (fs *diskFS) Sweep(pendingBefore, uploadsBefore, trashBefore time.Time) (sweepStats, error) {
+	stats := sweepStats{}
+
+	dirs := []string{fs.root}
+	if fs.tmpDir != "" {
+		dirs = append(dirs, fs.tmpDir)
+	}
+
+	for _, dir := range dirs {
+		pending, uploads, err := fs.sweepPending(dir, pendingBefore, uploadsBefore)
+		stats.pending += pending
+		stats.uploads += uploads
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	n, err := fs.PurgeTrash(trashBefore)
+	stats.trash = n
+
+	return stats, err
+}
+
+// sweepPending removes the temporary files below dir last modified before the
+// given time and the staged uploads last modified before uploadsBefore, and
+// returns their numbers. The trash is left alone.
+func (fs *diskFS) sweepPending(dir string, before, uploadsBefore time.Time) (int, int, error) {
+	var (
+		pending = 0
+		uploads = 0
+		trash   = filepath.Join(fs.root, trashDir)
+	)
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		// Temporary files vanish once their write completes.
+		if os.IsNotExist(err) && path != dir {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			if path == trash {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !strings.HasPrefix(info.Name(), pendingPrefix) {
+			return nil
+		}
+
+		staged := strings.HasPrefix(info.Name(), rangePrefix)
+
+		switch {
+		case staged && !info.ModTime().Before(uploadsBefore):
+			return nil
+		case !staged && !info.ModTime().Before(before):
+			return nil
+		}
+
+		err = os.Remove(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("sweep failed: %s", err)
+		}
+
+		if staged {
+			uploads++
+		} else {
+			pending++
+		}
+
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+
+	return pending, uploads, err
+}
+
+// handleGC sweeps the files left behind by s, which is nil for FileSystems
+// leaving none, and the uploads of fs abandoned for longer than uploadAge.
+func handleGC(
+	s sweeper,
+	fs *multipartFS,
+	pendingAge, uploadAge, trashRetention time.Duration,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			start = time.Now()
+			stats = sweepStats{}
+			err   error
+		)
+
+		if s != nil {
+			stats, err = s.Sweep(
+				start.Add(-pendingAge),
+				start.Add(-uploadAge),
+				start.Add(-trashRetention),
+			)
+			if err != nil {
+				respondError(w, r, err)
+				return
+			}
+		}
+
+		n, err := fs.SweepUploads(start.Add(-uploadAge))
+		stats.uploads += n
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		log.Printf(
+			"gc pending=%d trash=%d uploads=%d duration=%s",
+			stats.pending,
+			stats.trash,
+			stats.uploads,
+			time.Since(start),
+		)
+
+		respondJSON(w, http.StatusOK, ent.ResponseGC{
+			Pending:  stats.pending,
+			Trash:    stats.trash,
+			Uploads:  stats.uploads,
+			Duration: time.Since(start),
+		})
+	}
+}
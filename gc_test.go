@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/soundcloud/ent/lib"
+)
+
+func TestDiskFSSweep(t *testing.T) {
+	root, err := ioutil.TempDir("", "ent-gc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	var (
+		b     = ent.NewBucket("gc", ent.Owner{})
+		fs    = newDiskFS(root, withTrash(true))
+		stale = time.Now().Add(-48 * time.Hour)
+		seed  = func(p string, modified time.Time) {
+			err := os.MkdirAll(filepath.Dir(p), 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = ioutil.WriteFile(p, []byte("partial"), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = os.Chtimes(p, modified, modified)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	)
+
+	_, err = fs.Create(b, "nested/kept.txt", strings.NewReader("kept"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = fs.Create(b, "deleted.txt", strings.NewReader("deleted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fs.Delete(b, "deleted.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		removed = []string{
+			filepath.Join(root, b.Name, pendingPrefix+"1"),
+			filepath.Join(root, b.Name, "nested", pendingPrefix+"2"),
+		}
+		kept = []string{
+			filepath.Join(root, b.Name, pendingPrefix+"3"),
+			filepath.Join(root, b.Name, "nested", "kept.txt"),
+			// Staged uploads are kept for longer than temporary files.
+			filepath.Join(root, b.Name, rangePrefix+"paused-8"),
+		}
+		abandoned = filepath.Join(root, b.Name, rangePrefix+"abandoned-8")
+	)
+
+	for _, p := range removed {
+		seed(p, stale)
+	}
+	seed(kept[0], time.Now())
+	seed(kept[2], stale)
+	seed(abandoned, time.Now().Add(-96*time.Hour))
+	removed = append(removed, abandoned)
+
+	// Old files which aren't temporary are never swept.
+	err = os.Chtimes(kept[1], stale, stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := fs.(sweeper).Sweep(time.Now().Add(-24*time.Hour), time.Now().Add(-72*time.Hour), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := stats, (sweepStats{pending: 2, trash: 1, uploads: 1}); have != want {
+		t.Errorf("have %+v, want %+v", have, want)
+	}
+
+	for _, p := range removed {
+		_, err := os.Stat(p)
+		if !os.IsNotExist(err) {
+			t.Errorf("%s not removed: %v", p, err)
+		}
+	}
+
+	for _, p := range kept {
+		_, err := os.Stat(p)
+		if err != nil {
+			t.Errorf("%s removed: %v", p, err)
+		}
+	}
+}
+
+func TestDiskFSSweepTempDir(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-gc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		root    = filepath.Join(tmp, "root")
+		fs      = newDiskFS(root, withTempDir(filepath.Join(tmp, "pending")))
+		p       = filepath.Join(tmp, "pending", pendingPrefix+"1")
+		stale   = time.Now().Add(-48 * time.Hour)
+		handler = handleGC(fs.(sweeper), newMultipartFS(fs, filepath.Join(tmp, "uploads")), time.Hour, time.Hour, time.Hour)
+	)
+
+	err = os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(p, []byte("partial"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Chtimes(p, stale, stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The root doesn't exist before the first file is stored.
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/_gc", nil))
+
+	if have, want := w.Code, http.StatusOK; have != want {
+		t.Fatalf("have %d, want %d", have, want)
+	}
+
+	res := ent.ResponseGC{}
+
+	err = json.NewDecoder(w.Body).Decode(&res)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := res.Pending, 1; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+
+	_, err = os.Stat(p)
+	if !os.IsNotExist(err) {
+		t.Errorf("%s not removed: %v", p, err)
+	}
+}
+
+func TestAdminOnly(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	for _, input := range []struct {
+		admins   []string
+		identity string
+		status   int
+	}{
+		{nil, "", http.StatusForbidden},
+		{nil, "ops@example.com", http.StatusForbidden},
+		{[]string{"ops@example.com"}, "", http.StatusForbidden},
+		{[]string{"ops@example.com"}, "dev@example.com", http.StatusForbidden},
+		{[]string{"ops@example.com"}, "Ops@example.com", http.StatusOK},
+		{[]string{"ops@example.com"}, "Ops <ops@example.com>", http.StatusOK},
+	} {
+		req := httptest.NewRequest("POST", "/_gc", nil)
+		req.Header.Set(ent.HeaderOwner, input.identity)
+
+		w := httptest.NewRecorder()
+		adminOnly(input.admins, next).ServeHTTP(w, req)
+
+		if have, want := w.Code, input.status; have != want {
+			t.Errorf("%v %q: have %d, want %d", input.admins, input.identity, have, want)
+		}
+	}
+}
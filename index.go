@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/hex"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/soundcloud/ent/lib"
+)
+
+// hashIndexFS wraps a FileSystem and maintains a secondary index from content
+// hash to keys, allowing files to be opened by their hash. The index of a
+// bucket is built on first lookup and maintained on Create and Delete after.
+// Every index has a lock of its own and files are hashed outside of it, so
+// lookups and writes of other buckets never wait for them.
+type hashIndexFS struct {
+	ent.FileSystem
+
+	mu      sync.Mutex // guards indexes
+	indexes map[string]*hashIndex
+}
+
+func newHashIndexFS(fs ent.FileSystem) *hashIndexFS {
+	return &hashIndexFS{
+		FileSystem: fs,
+		indexes:    map[string]*hashIndex{},
+	}
+}
+
+func (fs *hashIndexFS) Create(
+	bucket *ent.Bucket,
+	key string,
+	r io.Reader,
+) (ent.File, error) {
+	f, err := fs.FileSystem.Create(bucket, key, r)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.index(bucket, f)
+
+	return f, nil
+}
+
+func (fs *hashIndexFS) CreateExclusive(
+	bucket *ent.Bucket,
+	key string,
+	r io.Reader,
+) (ent.File, error) {
+	f, err := fs.FileSystem.CreateExclusive(bucket, key, r)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.index(bucket, f)
+
+	return f, nil
+}
+
+func (fs *hashIndexFS) Delete(bucket *ent.Bucket, key string) error {
+	err := fs.FileSystem.Delete(bucket, key)
+	if err != nil {
+		return err
+	}
+
+	fs.unindex(bucket, key)
+
+	return nil
+}
+
+// unindex removes the file under key from the index of bucket if it has been
+// built.
+func (fs *hashIndexFS) unindex(bucket *ent.Bucket, key string) {
+	if idx := fs.bucketIndex(bucket, false); idx != nil {
+		idx.update(hashChange{key: key})
+	}
+}
+
+func (fs *hashIndexFS) Restore(bucket *ent.Bucket, key string) error {
+	err := fs.FileSystem.Restore(bucket, key)
+	if err != nil {
+		return err
+	}
+
+	f, err := fs.FileSystem.Open(bucket, key)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fs.index(bucket, f)
+
+	return nil
+}
+
+// OpenByHash returns the file with the given hex encoded hash. If several
+// files share the same content the one with the lowest key is returned.
+func (fs *hashIndexFS) OpenByHash(bucket *ent.Bucket, hash string) (ent.File, error) {
+	idx := fs.bucketIndex(bucket, true)
+
+	err := fs.build(bucket, idx)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := idx.lookup(hash)
+	if len(keys) == 0 {
+		return nil, ent.ErrFileNotFound
+	}
+
+	return fs.FileSystem.Open(bucket, keys[0])
+}
+
+// bucketIndex returns the index of bucket, which is added if create is set.
+// Without create nil is returned if no lookup asked for the index yet.
+func (fs *hashIndexFS) bucketIndex(bucket *ent.Bucket, create bool) *hashIndex {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	idx, ok := fs.indexes[bucket.Name]
+	if !ok && create {
+		idx = newHashIndex()
+		fs.indexes[bucket.Name] = idx
+	}
+
+	return idx
+}
+
+// index adds a newly stored file to the index of its bucket, if the index has
+// been asked for already.
+func (fs *hashIndexFS) index(bucket *ent.Bucket, f ent.File) {
+	idx := fs.bucketIndex(bucket, false)
+	if idx == nil {
+		return
+	}
+
+	h, err := f.Hash()
+	if err != nil {
+		// Without the hash the index can't be kept accurate, it is rebuilt on
+		// the next lookup.
+		idx.invalidate()
+		return
+	}
+
+	idx.update(hashChange{hash: hex.EncodeToString(h), key: f.Key()})
+}
+
+// build builds idx from the files of bucket unless it has been built already.
+// The files are hashed without holding the lock of idx, changes made
+// meanwhile are recorded and applied once all files are hashed. Concurrent
+// lookups wait for the build in progress.
+func (fs *hashIndexFS) build(bucket *ent.Bucket, idx *hashIndex) error {
+	for {
+		idx.mu.Lock()
+
+		if idx.built {
+			idx.mu.Unlock()
+			return nil
+		}
+
+		if done := idx.building; done != nil {
+			idx.mu.Unlock()
+			<-done
+			continue
+		}
+
+		done := make(chan struct{})
+		idx.building = done
+		idx.changes = nil
+		idx.stale = false
+
+		idx.mu.Unlock()
+
+		hashes, err := fs.hashes(bucket)
+
+		idx.mu.Lock()
+
+		if err == nil && !idx.stale {
+			idx.reset()
+
+			for key, hash := range hashes {
+				idx.add(hash, key)
+			}
+			for _, c := range idx.changes {
+				idx.apply(c)
+			}
+
+			idx.built = true
+		}
+
+		idx.building = nil
+		idx.changes = nil
+
+		idx.mu.Unlock()
+
+		close(done)
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// hashes returns the hex encoded hashes of all files of bucket by key.
+func (fs *hashIndexFS) hashes(bucket *ent.Bucket) (map[string]string, error) {
+	keys := []string{}
+
+	err := fs.FileSystem.Walk(bucket, "", ent.ModifiedRange{}, func(f ent.File) error {
+		keys = append(keys, f.Key())
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := map[string]string{}
+
+	for _, key := range keys {
+		f, err := fs.FileSystem.Open(bucket, key)
+		if ent.IsFileNotFound(err) {
+			// Deleted since the walk, which is recorded as a change.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		h, err := f.Hash()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		hashes[key] = hex.EncodeToString(h)
+	}
+
+	return hashes, nil
+}
+
+// hashChange adds key with hash to an index, or removes key if hash is empty.
+type hashChange struct {
+	hash string
+	key  string
+}
+
+// hashIndex maps the hashes of the files of a bucket to their keys.
+type hashIndex struct {
+	mu sync.Mutex
+
+	// built is set once the index holds all files of the bucket.
+	built bool
+	// building is closed once the build in progress completes, changes
+	// recorded while it is in progress are applied to the built index.
+	building chan struct{}
+	changes  []hashChange
+	// stale discards the build in progress, a change couldn't be recorded.
+	stale bool
+
+	hashes map[string]string
+	keys   map[string]map[string]struct{}
+}
+
+func newHashIndex() *hashIndex {
+	idx := &hashIndex{}
+	idx.reset()
+	return idx
+}
+
+func (idx *hashIndex) reset() {
+	idx.hashes = map[string]string{}
+	idx.keys = map[string]map[string]struct{}{}
+}
+
+// update applies c if the index is built and records it for the build in
+// progress. Changes before the first build are left to it.
+func (idx *hashIndex) update(c hashChange) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if idx.building != nil {
+		idx.changes = append(idx.changes, c)
+	}
+	if idx.built {
+		idx.apply(c)
+	}
+}
+
+// invalidate has the index rebuilt on the next lookup.
+func (idx *hashIndex) invalidate() {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.built = false
+	idx.stale = idx.building != nil
+}
+
+func (idx *hashIndex) apply(c hashChange) {
+	if c.hash == "" {
+		idx.remove(c.key)
+		return
+	}
+
+	idx.add(c.hash, c.key)
+}
+
+func (idx *hashIndex) add(hash, key string) {
+	// An overwrite replaces the content previously stored under key.
+	idx.remove(key)
+
+	if _, ok := idx.keys[hash]; !ok {
+		idx.keys[hash] = map[string]struct{}{}
+	}
+
+	idx.keys[hash][key] = struct{}{}
+	idx.hashes[key] = hash
+}
+
+func (idx *hashIndex) remove(key string) {
+	hash, ok := idx.hashes[key]
+	if !ok {
+		return
+	}
+
+	delete(idx.hashes, key)
+	delete(idx.keys[hash], key)
+
+	if len(idx.keys[hash]) == 0 {
+		delete(idx.keys, hash)
+	}
+}
+
+func (idx *hashIndex) lookup(hash string) []string {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	keys := make([]string, 0, len(idx.keys[hash]))
+
+	for key := range idx.keys[hash] {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
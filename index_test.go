@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/pat"
+	"github.com/soundcloud/ent/lib"
+)
+
+func TestHandleGetByHash(t *testing.T) {
+	var (
+		b       = ent.NewBucket("by-hash", ent.Owner{})
+		fs      = newHashIndexFS(ent.NewMemoryFS())
+		r       = pat.New()
+		content = "content addressed"
+		sum     = sha1.Sum([]byte(content))
+		hash    = hex.EncodeToString(sum[:])
+	)
+
+	r.Get(ent.RouteFileByHash, handleGetByHash(ent.NewMemoryProvider(b), fs))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	// Stored before the index is built.
+	_, err := fs.Create(b, "b/second.txt", strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.Get(fmt.Sprintf("%s/%s/_by-hash/%s", ts.URL, b.Name, hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if have, want := res.StatusCode, http.StatusOK; have != want {
+		t.Fatalf("have %d, want %d", have, want)
+	}
+
+	raw, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := string(raw), content; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	unknown := sha1.Sum([]byte("unknown"))
+
+	res, err = http.Get(fmt.Sprintf("%s/%s/_by-hash/%x", ts.URL, b.Name, unknown))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if have, want := res.StatusCode, http.StatusNotFound; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+}
+
+func TestHashIndexFSMaintained(t *testing.T) {
+	var (
+		b       = ent.NewBucket("by-hash", ent.Owner{})
+		fs      = newHashIndexFS(ent.NewMemoryFS())
+		content = "shared content"
+		sum     = sha1.Sum([]byte(content))
+		hash    = hex.EncodeToString(sum[:])
+	)
+
+	// Build the empty index upfront so further changes are maintained.
+	_, err := fs.OpenByHash(b, hash)
+	if !ent.IsFileNotFound(err) {
+		t.Fatalf("have %v, want %v", err, ent.ErrFileNotFound)
+	}
+
+	for _, key := range []string{"z", "a"} {
+		_, err := fs.Create(b, key, strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := fs.OpenByHash(b, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := f.Key(), "a"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	err = fs.Delete(b, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Overwriting changes the hash of the key.
+	_, err = fs.Create(b, "z", strings.NewReader("other content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = fs.OpenByHash(b, hash)
+	if !ent.IsFileNotFound(err) {
+		t.Errorf("have %v, want %v", err, ent.ErrFileNotFound)
+	}
+}
+
+func TestHashIndexFSBuildConcurrent(t *testing.T) {
+	var (
+		b       = ent.NewBucket("by-hash-build", ent.Owner{})
+		walking = &walkHookFS{FileSystem: ent.NewMemoryFS()}
+		fs      = newHashIndexFS(walking)
+		content = "stored while building"
+		sum     = sha1.Sum([]byte(content))
+	)
+
+	_, err := fs.Create(b, "before", strings.NewReader("before"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Files are stored and deleted while the index is built, which must not
+	// wait for the build and is recorded by it.
+	walking.afterWalk = func() {
+		_, err := fs.Create(b, "during", strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = fs.Delete(b, "before")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := fs.OpenByHash(b, hex.EncodeToString(sum[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := f.Key(), "during"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	before := sha1.Sum([]byte("before"))
+
+	_, err = fs.OpenByHash(b, hex.EncodeToString(before[:]))
+	if !ent.IsFileNotFound(err) {
+		t.Errorf("have %v, want %v", err, ent.ErrFileNotFound)
+	}
+}
+
+// walkHookFS calls afterWalk once after the first Walk.
+type walkHookFS struct {
+	ent.FileSystem
+
+	afterWalk func()
+}
+
+func (fs *walkHookFS) Walk(
+	bucket *ent.Bucket,
+	prefix string,
+	modified ent.ModifiedRange,
+	fn func(ent.File) error,
+) error {
+	err := fs.FileSystem.Walk(bucket, prefix, modified, fn)
+
+	if hook := fs.afterWalk; hook != nil {
+		fs.afterWalk = nil
+		hook()
+	}
+
+	return err
+}
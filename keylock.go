@@ -0,0 +1,46 @@
+package main
+
+import "sync"
+
+// keyLocks serializes operations on the same key while operations on
+// different keys proceed concurrently. Locks are dropped once nobody holds or
+// waits for them, so the number kept is bounded by the concurrent operations.
+type keyLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock blocks until the lock for name is acquired and returns the function
+// releasing it.
+func (l *keyLocks) lock(name string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = map[string]*keyLock{}
+	}
+
+	kl, ok := l.locks[name]
+	if !ok {
+		kl = &keyLock{}
+		l.locks[name] = kl
+	}
+	kl.refs++
+	l.mu.Unlock()
+
+	kl.Lock()
+
+	return func() {
+		kl.Unlock()
+
+		l.mu.Lock()
+		kl.refs--
+		if kl.refs == 0 {
+			delete(l.locks, name)
+		}
+		l.mu.Unlock()
+	}
+}
@@ -1,16 +1,43 @@
 package ent
 
 import (
+	"encoding/json"
 	"net/mail"
+	"regexp"
+	"strings"
+	"time"
 )
 
 // A Bucket carries configuration for namespaces like ownership and
 // restrictions.
 type Bucket struct {
-	Name  string `json:"name"`
-	Owner Owner  `json:"owner"`
+	Name    string  `json:"name" yaml:"name"`
+	Owner   Owner   `json:"owner" yaml:"owner"`
+	Writers []Owner `json:"writers,omitempty" yaml:"writers,omitempty"`
+	Readers []Owner `json:"readers,omitempty" yaml:"readers,omitempty"`
+
+	// RejectEmpty disallows storing files without content.
+	RejectEmpty bool `json:"rejectEmpty,omitempty" yaml:"rejectEmpty,omitempty"`
+	// ReadOnly disallows storing and deleting files, they can only be
+	// retrieved and listed.
+	ReadOnly bool `json:"readOnly,omitempty" yaml:"readOnly,omitempty"`
+	// Compression names the codec new files are compressed with at rest,
+	// files are stored as is if empty.
+	Compression string `json:"compression,omitempty" yaml:"compression,omitempty"`
+	// KeyPattern is a regular expression keys of new files have to match,
+	// any key is allowed if empty.
+	KeyPattern string `json:"keyPattern,omitempty" yaml:"keyPattern,omitempty"`
+
+	keyPattern *regexp.Regexp
 }
 
+// Compression codecs supported for files at rest.
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
 // NewBucket returns a new Bucket given a name and an Owner.
 func NewBucket(name string, owner Owner) *Bucket {
 	return &Bucket{
@@ -19,7 +46,111 @@ func NewBucket(name string, owner Owner) *Bucket {
 	}
 }
 
-// An Owner represents the identity of a person or group.
+// CompileKeyPattern prepares the KeyPattern for matching keys, it has to be
+// called before the Bucket is used concurrently.
+func (b *Bucket) CompileKeyPattern() error {
+	if b.KeyPattern == "" {
+		b.keyPattern = nil
+		return nil
+	}
+
+	re, err := regexp.Compile(b.KeyPattern)
+	if err != nil {
+		return err
+	}
+
+	b.keyPattern = re
+
+	return nil
+}
+
+// AllowsKey reports whether key matches the KeyPattern of the Bucket. Patterns
+// which haven't been compiled are compiled for every call and don't allow any
+// key if invalid.
+func (b *Bucket) AllowsKey(key string) bool {
+	if b.KeyPattern == "" {
+		return true
+	}
+
+	if b.keyPattern != nil && b.keyPattern.String() == b.KeyPattern {
+		return b.keyPattern.MatchString(key)
+	}
+
+	ok, err := regexp.MatchString(b.KeyPattern, key)
+	return err == nil && ok
+}
+
+// IsOpen reports whether the Bucket has no access restrictions, which is the
+// case when neither Writers nor Readers are configured.
+func (b *Bucket) IsOpen() bool {
+	return len(b.Writers) == 0 && len(b.Readers) == 0
+}
+
+// CanWrite reports whether the identity given by addr is allowed to store and
+// delete files in the Bucket. The Owner is always allowed to write.
+func (b *Bucket) CanWrite(addr string) bool {
+	if b.IsOpen() || b.Owner.Is(addr) {
+		return true
+	}
+
+	return containsOwner(b.Writers, addr)
+}
+
+// CanRead reports whether the identity given by addr is allowed to retrieve
+// files from the Bucket. Everybody who can write can also read.
+func (b *Bucket) CanRead(addr string) bool {
+	if b.CanWrite(addr) {
+		return true
+	}
+
+	return containsOwner(b.Readers, addr)
+}
+
+// An Owner represents the identity of a person or group. Policies only have to
+// give the Email, the other fields are optional.
 type Owner struct {
-	Email mail.Address `json:"email"`
+	Email mail.Address `json:"email" yaml:"email"`
+	// ID identifies the Owner in systems outside of ent, e.g. a directory.
+	ID   string `json:"id,omitempty" yaml:"id,omitempty"`
+	Team string `json:"team,omitempty" yaml:"team,omitempty"`
+	// CreatedAt is the time the Owner was registered, zero if unknown.
+	CreatedAt time.Time `json:"createdAt" yaml:"createdAt,omitempty"`
+}
+
+// MarshalJSON returns the JSON encoding of the Owner, leaving out CreatedAt if
+// it is unknown.
+func (o Owner) MarshalJSON() ([]byte, error) {
+	type owner Owner
+
+	var createdAt *time.Time
+	if !o.CreatedAt.IsZero() {
+		createdAt = &o.CreatedAt
+	}
+
+	return json.Marshal(struct {
+		owner
+		CreatedAt *time.Time `json:"createdAt,omitempty"`
+	}{
+		owner:     owner(o),
+		CreatedAt: createdAt,
+	})
+}
+
+// Is reports whether addr matches the email address of the Owner.
+func (o Owner) Is(addr string) bool {
+	if addr == "" || o.Email.Address == "" {
+		return false
+	}
+
+	return strings.EqualFold(o.Email.Address, addr)
+}
+
+func containsOwner(owners []Owner, addr string) bool {
+	for _, o := range owners {
+		if o.Is(addr) {
+			return true
+		}
+	}
+
+	return false
 }
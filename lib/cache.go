@@ -0,0 +1,165 @@
+package ent
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ErrCacheMiss is returned by a Cache which holds no content for a key.
+var ErrCacheMiss = errors.New("not cached")
+
+// Cache holds the content of blobs along with their ETag, so GetCached only
+// downloads blobs which changed since they were cached.
+type Cache interface {
+	// Open returns the content and ETag cached under key or ErrCacheMiss.
+	Open(key string) (io.ReadCloser, string, error)
+	// Store caches the content read from r under key along with its ETag,
+	// replacing previously cached content.
+	Store(key, etag string, r io.Reader) error
+}
+
+// WithCache makes GetCached keep the content of blobs in cache.
+func WithCache(cache Cache) ClientOption {
+	return func(c *Client) {
+		c.cache = cache
+	}
+}
+
+// MemoryCache is a Cache holding content in memory.
+type MemoryCache struct {
+	mu      sync.RWMutex
+	entries map[string]memoryCacheEntry
+}
+
+type memoryCacheEntry struct {
+	etag    string
+	content []byte
+}
+
+// NewMemoryCache returns an empty MemoryCache.
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{
+		entries: map[string]memoryCacheEntry{},
+	}
+}
+
+// Open returns the content and ETag cached under key or ErrCacheMiss.
+func (c *MemoryCache) Open(key string) (io.ReadCloser, string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, "", ErrCacheMiss
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(e.content)), e.etag, nil
+}
+
+// Store caches the content read from r under key along with its ETag.
+func (c *MemoryCache) Store(key, etag string, r io.Reader) error {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[key] = memoryCacheEntry{
+		etag:    etag,
+		content: content,
+	}
+
+	return nil
+}
+
+// DiskCache is a Cache holding content in files in a directory. Every file
+// starts with the ETag on a line of its own followed by the content, so both
+// are replaced at once.
+type DiskCache struct {
+	dir string
+}
+
+// NewDiskCache returns a DiskCache storing files in dir, which is created if
+// it doesn't exist.
+func NewDiskCache(dir string) (*DiskCache, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DiskCache{dir: dir}, nil
+}
+
+// Open returns the content and ETag cached under key or ErrCacheMiss.
+func (c *DiskCache) Open(key string) (io.ReadCloser, string, error) {
+	f, err := os.Open(c.path(key))
+	if os.IsNotExist(err) {
+		return nil, "", ErrCacheMiss
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	r := bufio.NewReader(f)
+
+	etag, err := r.ReadString('\n')
+	if err != nil {
+		f.Close()
+		return nil, "", fmt.Errorf("reading cached %s failed: %s", key, err)
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, f}, strings.TrimSuffix(etag, "\n"), nil
+}
+
+// Store caches the content read from r under key along with its ETag. The
+// content is written to a temporary file first, readers never observe
+// partially stored content.
+func (c *DiskCache) Store(key, etag string, r io.Reader) error {
+	if strings.Contains(etag, "\n") {
+		return fmt.Errorf("invalid etag %q", etag)
+	}
+
+	tmp, err := ioutil.TempFile(c.dir, ".ent-cache-")
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(tmp, etag+"\n")
+	if err == nil {
+		_, err = io.Copy(tmp, r)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.path(key))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return nil
+}
+
+// path returns the path of the file caching key, keys are hashed as they may
+// contain slashes.
+func (c *DiskCache) path(key string) string {
+	h := sha1.Sum([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(h[:]))
+}
@@ -0,0 +1,94 @@
+package ent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gorilla/pat"
+)
+
+func TestClientGetCached(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	disk, err := NewDiskCache(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		body   = "cached content"
+		bodies = 0
+		bucket = "cached"
+		key    = "nested/content.log"
+		r      = pat.New()
+	)
+
+	r.Get(RouteFile, func(w http.ResponseWriter, r *http.Request) {
+		h := sha1.Sum([]byte(body))
+		w.Header().Set(HeaderETag, hex.EncodeToString(h[:]))
+
+		if r.Header.Get(HeaderIfNoneMatch) != w.Header().Get(HeaderETag) {
+			bodies++
+		}
+
+		http.ServeContent(w, r, key, time.Time{}, bytes.NewReader([]byte(body)))
+	})
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	for name, cache := range map[string]Cache{
+		"disk":   disk,
+		"memory": NewMemoryCache(),
+	} {
+		var (
+			client = New(ts.URL, nil, WithCache(cache))
+			get    = func(content string) {
+				buf := &bytes.Buffer{}
+
+				n, err := client.GetCached(bucket, key, buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if have, want := n, int64(len(content)); have != want {
+					t.Errorf("%s: have %d, want %d", name, have, want)
+				}
+
+				if have, want := buf.String(), content; have != want {
+					t.Errorf("%s: have %q, want %q", name, have, want)
+				}
+			}
+		)
+
+		body, bodies = "cached content", 0
+
+		get(body)
+		get(body)
+
+		if have, want := bodies, 1; have != want {
+			t.Errorf("%s: have %d bodies sent, want %d", name, have, want)
+		}
+
+		// Changed content is downloaded and replaces the cached one.
+		body = "changed content"
+
+		get(body)
+		get(body)
+
+		if have, want := bodies, 2; have != want {
+			t.Errorf("%s: have %d bodies sent, want %d", name, have, want)
+		}
+	}
+}
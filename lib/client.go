@@ -1,11 +1,19 @@
 package ent
 
 import (
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
 var defaultListOptions = &ListOptions{
@@ -14,23 +22,70 @@ var defaultListOptions = &ListOptions{
 	Sort:   NoOpStrategy(),
 }
 
+// walkPageSize is the number of files fetched at a time by Walk if no limit is
+// given.
+const walkPageSize = 1000
+
 // Client provides an interface to interact with Ent over HTTP.
 type Client struct {
 	addr   string
 	client *http.Client
+
+	retries int
+	backoff time.Duration
+
+	cache Cache
+
+	header http.Header
+}
+
+// ClientOption configures optional behaviour of a Client.
+type ClientOption func(*Client)
+
+// WithRetry makes the Client retry requests failing with a connection error or
+// a 502, 503 or 504 response up to max times. The first retry is made after
+// base, every further retry waits twice as long as the previous one. Only
+// idempotent requests and creates with a source implementing io.Seeker are
+// retried.
+func WithRetry(max int, base time.Duration) ClientOption {
+	return func(c *Client) {
+		c.retries = max
+		c.backoff = base
+	}
+}
+
+// WithHeader makes the Client send the header key with value on every request,
+// e.g. to pass an Authorization or X-Request-ID. It can be given several times
+// to send several values of a header. Headers set by methods of the Client
+// take precedence.
+func WithHeader(key, value string) ClientOption {
+	return func(c *Client) {
+		if c.header == nil {
+			c.header = http.Header{}
+		}
+		c.header.Add(key, value)
+	}
 }
 
 // New returns a new Client instance given an address and an http.Client,
-// http.DefaultClient is used if client is not passed.
-func New(addr string, client *http.Client) *Client {
+// http.DefaultClient is used if client is not passed. The address may include
+// a path prefix, e.g. https://host/storage for an Ent mounted behind a reverse
+// proxy, trailing slashes are ignored.
+func New(addr string, client *http.Client, opts ...ClientOption) *Client {
 	if client == nil {
 		client = http.DefaultClient
 	}
 
-	return &Client{
-		addr:   addr,
+	c := &Client{
+		addr:   strings.TrimRight(addr, "/"),
 		client: client,
 	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
 }
 
 // Create stores or replaces the blob under key with the content of src.
@@ -55,7 +110,62 @@ func (c *Client) Create(
 		u = fmt.Sprintf("%s/%s", bucket, key)
 	)
 
-	_, err := c.request("POST", u, src, r)
+	_, err := c.request("POST", u, nil, src, r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &r.File, nil
+}
+
+// CreateOptions specifies optional behaviour of a create.
+type CreateOptions struct {
+	// ProgressFunc is called with the total number of bytes sent so far
+	// whenever a chunk of the source was read for the upload.
+	ProgressFunc func(bytesSent int64)
+}
+
+// CreateWithOptions stores or replaces the blob under key with the content of
+// src like Create. Creates reporting progress are not retried as the source
+// can't be rewound.
+func (c *Client) CreateWithOptions(
+	bucket, key string,
+	src io.Reader,
+	opts *CreateOptions,
+) (*ResponseFile, error) {
+	if opts != nil && opts.ProgressFunc != nil && src != nil {
+		src = &progressReader{
+			Reader: src,
+			fn:     opts.ProgressFunc,
+		}
+	}
+
+	return c.Create(bucket, key, src)
+}
+
+// Copy stores the file under srcBucket and srcKey as dstKey in dstBucket. The
+// content is copied by the server and not transferred to the Client.
+func (c *Client) Copy(
+	srcBucket, srcKey string,
+	dstBucket, dstKey string,
+) (*ResponseFile, error) {
+	if srcBucket == "" || dstBucket == "" {
+		return nil, ErrEmptyBucket
+	}
+
+	if srcKey == "" || dstKey == "" {
+		return nil, ErrEmptyKey
+	}
+
+	var (
+		r = &ResponseCreated{}
+		u = fmt.Sprintf("%s/%s", dstBucket, dstKey)
+		h = http.Header{}
+	)
+
+	h.Set(HeaderCopySource, fmt.Sprintf("%s/%s", srcBucket, srcKey))
+
+	_, err := c.request("POST", u, h, nil, r)
 	if err != nil {
 		return nil, err
 	}
@@ -75,7 +185,232 @@ func (c *Client) Get(bucket, key string) (io.ReadCloser, error) {
 
 	u := fmt.Sprintf("%s/%s", bucket, key)
 
-	return c.request("GET", u, nil, nil)
+	res, err := c.request("GET", u, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Body, nil
+}
+
+// Exists reports whether a file is stored under bucket and key. As responses
+// to HEAD have no body the cause of a 404 is told by the X-Ent-Error header, a
+// missing bucket fails with ErrBucketNotFound.
+func (c *Client) Exists(bucket, key string) (bool, error) {
+	if bucket == "" {
+		return false, ErrEmptyBucket
+	}
+
+	if key == "" {
+		return false, ErrEmptyKey
+	}
+
+	res, err := c.request("HEAD", fmt.Sprintf("%s/%s", bucket, key), nil, nil, nil)
+	if err != nil {
+		if e, ok := err.(*Error); ok {
+			switch e.Header.Get(HeaderError) {
+			case ErrFileNotFound.Error():
+				return false, nil
+			case ErrBucketNotFound.Error():
+				e.err = ErrBucketNotFound
+			}
+		}
+
+		return false, err
+	}
+	res.Body.Close()
+
+	return true, nil
+}
+
+// Stat returns the description of the file stored under bucket and key,
+// including its size, hash and Meta, without transferring its content.
+func (c *Client) Stat(bucket, key string) (*ResponseFile, error) {
+	if bucket == "" {
+		return nil, ErrEmptyBucket
+	}
+
+	if key == "" {
+		return nil, ErrEmptyKey
+	}
+
+	var (
+		r = &ResponseFile{}
+		u = fmt.Sprintf("%s/%s?%s", bucket, key, ParamMeta)
+	)
+
+	_, err := c.request("GET", u, nil, nil, r)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// GetTo copies the file stored under bucket and key to w and returns the
+// number of bytes copied.
+func (c *Client) GetTo(bucket, key string, w io.Writer) (int64, error) {
+	r, err := c.Get(bucket, key)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	n, err := io.Copy(w, r)
+	if err != nil {
+		return n, newError(ErrClient, err.Error())
+	}
+
+	return n, nil
+}
+
+// GetCached copies the file stored under bucket and key to w like GetTo. With
+// a Cache configured the ETag of the content cached under bucket/key is sent
+// in If-None-Match and the cached content is copied if the file didn't change,
+// otherwise the content downloaded is cached along with its ETag.
+func (c *Client) GetCached(bucket, key string, w io.Writer) (int64, error) {
+	if c.cache == nil {
+		return c.GetTo(bucket, key, w)
+	}
+
+	if bucket == "" {
+		return 0, ErrEmptyBucket
+	}
+
+	if key == "" {
+		return 0, ErrEmptyKey
+	}
+
+	var (
+		u = fmt.Sprintf("%s/%s", bucket, key)
+		h = http.Header{}
+	)
+
+	cached, etag, err := c.cache.Open(u)
+	if err != nil && err != ErrCacheMiss {
+		return 0, newError(ErrClient, err.Error())
+	}
+	if cached != nil {
+		defer cached.Close()
+		h.Set(HeaderIfNoneMatch, etag)
+	}
+
+	res, err := c.request("GET", u, h, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	notModified := res.StatusCode == http.StatusNotModified && cached != nil
+
+	src := res.Body
+	if notModified {
+		src = cached
+	}
+
+	// Bytes are counted as they are written to w, which happens as the cache
+	// reads them.
+	r := &progressReader{
+		Reader: io.TeeReader(src, w),
+		fn:     func(int64) {},
+	}
+
+	etag = res.Header.Get(HeaderETag)
+	if notModified || etag == "" {
+		_, err = io.Copy(ioutil.Discard, r)
+	} else {
+		err = c.cache.Store(u, etag, r)
+	}
+	if err != nil {
+		return r.sent, newError(ErrClient, err.Error())
+	}
+
+	return r.sent, nil
+}
+
+// FileInfo describes a file downloaded with Download.
+type FileInfo struct {
+	Key          string
+	Hash         string
+	Size         int64
+	LastModified time.Time
+}
+
+// Download stores the file under bucket and key at destPath. The content is
+// written to a temporary file next to destPath first and only moved into
+// place if its hash matches the ETag of the response, ErrHashMismatch is
+// returned otherwise. Bare SHA1 as well as quoted MD5 ETags are verified.
+func (c *Client) Download(bucket, key, destPath string) (*FileInfo, error) {
+	if bucket == "" {
+		return nil, ErrEmptyBucket
+	}
+
+	if key == "" {
+		return nil, ErrEmptyKey
+	}
+
+	u := fmt.Sprintf("%s/%s", bucket, key)
+
+	res, err := c.request("GET", u, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(destPath), ".ent-download-")
+	if err != nil {
+		return nil, newError(ErrClient, err.Error())
+	}
+
+	// The temporary file must not be left behind on failure.
+	renamed := false
+	defer func() {
+		tmp.Close()
+		if !renamed {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	var (
+		want = strings.Trim(res.Header.Get(HeaderETag), `"`)
+		h    = sha1.New()
+	)
+
+	if len(want) == 2*md5.Size {
+		h = md5.New()
+	}
+
+	n, err := io.Copy(io.MultiWriter(tmp, h), res.Body)
+	if err != nil {
+		return nil, newError(ErrClient, err.Error())
+	}
+
+	have := hex.EncodeToString(h.Sum(nil))
+
+	if have != want {
+		return nil, newError(
+			ErrHashMismatch,
+			fmt.Sprintf("content %s differs from etag %q", have, want),
+		)
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return nil, newError(ErrClient, err.Error())
+	}
+
+	err = os.Rename(tmp.Name(), destPath)
+	if err != nil {
+		return nil, newError(ErrClient, err.Error())
+	}
+	renamed = true
+
+	return &FileInfo{
+		Key:          key,
+		Hash:         have,
+		Size:         n,
+		LastModified: parseLastModified(res.Header.Get(HeaderLastModified)),
+	}, nil
 }
 
 // List returns the list of ResponseFiles for a bucket potentially
@@ -92,45 +427,197 @@ func (c *Client) List(
 		opts = defaultListOptions
 	}
 
+	l, err := c.list(bucket, *opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return l.Files, nil
+}
+
+// ListPage returns a page of the ResponseFiles for a bucket like List and the
+// marker to pass as opts.Marker to fetch the next page, which is empty for the
+// last page.
+func (c *Client) ListPage(
+	bucket string,
+	opts *ListOptions,
+) ([]ResponseFile, string, error) {
+	if bucket == "" {
+		return nil, "", ErrEmptyBucket
+	}
+
+	if opts == nil {
+		opts = defaultListOptions
+	}
+
+	l, err := c.list(bucket, *opts)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return l.Files, l.NextMarker, nil
+}
+
+// Walk calls fn for every file in bucket matching opts in ascending key order,
+// fetching opts.Limit files at a time or walkPageSize if no limit is set.
+// opts.Sort is ignored. Walking stops at the first error returned by fn, which
+// is returned by Walk.
+func (c *Client) Walk(
+	bucket string,
+	opts *ListOptions,
+	fn func(ResponseFile) error,
+) error {
+	if bucket == "" {
+		return ErrEmptyBucket
+	}
+
+	if opts == nil {
+		opts = defaultListOptions
+	}
+
+	page := *opts
+	page.Sort = ByKeyStrategy(true)
+
+	if page.Limit == 0 || page.Limit == DefaultLimit {
+		page.Limit = walkPageSize
+	}
+
+	for {
+		l, err := c.list(bucket, page)
+		if err != nil {
+			return err
+		}
+
+		for _, f := range l.Files {
+			err := fn(f)
+			if err != nil {
+				return err
+			}
+		}
+
+		if l.NextMarker == "" {
+			return nil
+		}
+
+		page.Marker = l.NextMarker
+	}
+}
+
+func (c *Client) list(bucket string, opts ListOptions) (ResponseFileList, error) {
 	var (
 		l = ResponseFileList{}
 		u = fmt.Sprintf("%s?%s", bucket, opts.EncodeParams())
 	)
 
-	_, err := c.request("GET", u, nil, &l)
+	_, err := c.request("GET", u, nil, nil, &l)
+
+	return l, err
+}
+
+// Ping checks the server is able to answer requests and returns the round-trip
+// latency.
+func (c *Client) Ping() (time.Duration, error) {
+	start := time.Now()
+
+	_, err := c.request("GET", strings.TrimPrefix(RouteHealth, "/"), nil, nil, &ResponseHealth{})
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 
-	return l.Files, nil
+	return time.Since(start), nil
 }
 
 func (c *Client) request(
 	method string,
 	uri string,
+	header http.Header,
+	body io.Reader,
+	obj interface{},
+) (*http.Response, error) {
+	var (
+		seeker, rewindable = body.(io.Seeker)
+		offset             int64
+	)
+
+	if rewindable {
+		var err error
+
+		offset, err = seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, newError(ErrClient, err.Error())
+		}
+	}
+
+	// The transport closes bodies implementing io.Closer after sending them,
+	// which would prevent them from being rewound.
+	if _, ok := body.(io.Closer); ok && rewindable && c.retries > 0 {
+		body = ioutil.NopCloser(body)
+	}
+
+	retry := rewindable
+	switch method {
+	case "DELETE", "GET", "HEAD":
+		retry = true
+	}
+
+	for attempt := 0; ; attempt++ {
+		res, err := c.do(method, uri, header, body, obj)
+		if !retry || attempt >= c.retries || !shouldRetry(err) {
+			return res, err
+		}
+
+		if rewindable {
+			_, serr := seeker.Seek(offset, io.SeekStart)
+			if serr != nil {
+				return res, err
+			}
+		}
+
+		time.Sleep(c.backoff << uint(attempt))
+	}
+}
+
+// do sends a single request. If obj is given the response is decoded into it
+// and no response is returned, otherwise the caller has to close the body of
+// the returned response.
+func (c *Client) do(
+	method string,
+	uri string,
+	header http.Header,
 	body io.Reader,
 	obj interface{},
-) (io.ReadCloser, error) {
-	req, err := http.NewRequest(method, fmt.Sprintf("%s/%s", c.addr, uri), body)
+) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.addr+"/"+strings.TrimPrefix(uri, "/"), body)
 	if err != nil {
 		return nil, newError(ErrClient, err.Error())
 	}
 
+	for k, vs := range c.header {
+		req.Header[k] = vs
+	}
+
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+
 	res, err := c.client.Do(req)
 	if err != nil {
 		return nil, newError(ErrClient, err.Error())
 	}
 
 	if res.StatusCode >= 400 {
+		defer res.Body.Close()
+
 		rErr := &ResponseError{}
 
 		err := json.NewDecoder(res.Body).Decode(rErr)
 		if err != nil {
-			return nil, newError(ErrClient, err.Error())
+			return nil, newResponseError(ErrClient, res, err.Error())
 		}
 
-		return nil, newError(
+		return nil, newResponseError(
 			ErrClient,
+			res,
 			fmt.Sprintf("response %d: %s", rErr.Code, rErr.Error),
 		)
 	}
@@ -139,29 +626,91 @@ func (c *Client) request(
 		defer res.Body.Close()
 
 		if res.Header.Get("Content-Type") != "application/json" {
-			return nil, newError(
+			return nil, newResponseError(
 				ErrClient,
+				res,
 				fmt.Sprintf("unexpected content-type: %s", res.Header.Get("Content-Type")),
 			)
 		}
 
 		err = json.NewDecoder(res.Body).Decode(obj)
 		if err != nil {
-			return nil, newError(ErrClient, fmt.Sprintf("decode: %s", err))
+			return nil, newResponseError(
+				ErrClient,
+				res,
+				fmt.Sprintf("decode: %s", err),
+			)
 		}
 
 		return nil, nil
 	}
 
-	return res.Body, nil
+	return res, nil
+}
+
+// parseLastModified parses the Last-Modified header in the HTTP date format
+// used by the server for blobs, falling back to RFC 3339.
+func parseLastModified(v string) time.Time {
+	t, err := http.ParseTime(v)
+	if err == nil {
+		return t
+	}
+
+	t, _ = time.Parse(time.RFC3339Nano, v)
+
+	return t
+}
+
+// progressReader reports the number of bytes read so far after every Read.
+type progressReader struct {
+	io.Reader
+	fn   func(int64)
+	sent int64
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.sent += int64(n)
+		r.fn(r.sent)
+	}
+
+	return n, err
+}
+
+// shouldRetry reports whether the error is likely transient, which is the case
+// for connection errors and responses of overloaded or unreachable upstreams.
+func shouldRetry(err error) bool {
+	e, ok := err.(*Error)
+	if !ok || e.err != ErrClient {
+		return false
+	}
+
+	switch e.StatusCode {
+	case 0, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
 }
 
 // ListOptions specifies the details of a listing like prefix to filter, amount
-// of files to return.
+// of files to return. Only files last modified at or after ModifiedSince and
+// before ModifiedBefore are listed, zero times don't restrict the listing.
 type ListOptions struct {
-	Limit  uint64
-	Prefix string
-	Sort   SortStrategy
+	Limit          uint64
+	ModifiedBefore time.Time
+	ModifiedSince  time.Time
+	Prefix         string
+	Sort           SortStrategy
+	// Marker continues a listing after the key, usually the NextMarker of the
+	// previous page. Listings continued by a Marker are sorted by key.
+	Marker string
+	// StartAfter and EndBefore restrict a listing to the keys in the range
+	// [StartAfter, EndBefore), an empty key leaves the respective end open.
+	// Listings restricted to a key range are sorted by key.
+	StartAfter string
+	EndBefore  string
 }
 
 // EncodeParams returns a string that can be used as URL params.
@@ -172,6 +721,26 @@ func (o ListOptions) EncodeParams() string {
 		vs.Set(ParamLimit, fmt.Sprintf("%d", o.Limit))
 	}
 
+	if !o.ModifiedSince.IsZero() {
+		vs.Set(ParamModifiedSince, o.ModifiedSince.Format(time.RFC3339Nano))
+	}
+
+	if !o.ModifiedBefore.IsZero() {
+		vs.Set(ParamModifiedBefore, o.ModifiedBefore.Format(time.RFC3339Nano))
+	}
+
+	if o.Marker != "" {
+		vs.Set(ParamMarker, o.Marker)
+	}
+
+	if o.StartAfter != "" {
+		vs.Set(ParamStartAfter, o.StartAfter)
+	}
+
+	if o.EndBefore != "" {
+		vs.Set(ParamEndBefore, o.EndBefore)
+	}
+
 	if o.Prefix != "" {
 		vs.Set(ParamPrefix, o.Prefix)
 	}
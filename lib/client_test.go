@@ -2,11 +2,21 @@ package ent
 
 import (
 	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -66,6 +76,112 @@ func TestClientCreate(t *testing.T) {
 	}
 }
 
+func TestClientCopy(t *testing.T) {
+	var (
+		fs      = NewMemoryFS()
+		src     = NewBucket("src", Owner{})
+		dst     = NewBucket("dst", Owner{})
+		buckets = map[string]*Bucket{src.Name: src, dst.Name: dst}
+		content = "copied content"
+		r       = pat.New()
+	)
+
+	_, err := fs.Create(src, "original.txt", strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.Post(RouteFile, func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		source := strings.SplitN(r.Header.Get(HeaderCopySource), "/", 2)
+		if len(source) != 2 {
+			t.Fatalf("invalid copy source %q", r.Header.Get(HeaderCopySource))
+		}
+
+		raw, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have, want := len(raw), 0; have != want {
+			t.Errorf("have %d bytes, want %d", have, want)
+		}
+
+		f, err := fs.Open(buckets[source[0]], source[1])
+		if err != nil {
+			respondJSON(w, http.StatusNotFound, ResponseError{Code: http.StatusNotFound})
+			return
+		}
+
+		var (
+			b   = buckets[r.URL.Query().Get(KeyBucket)]
+			key = r.URL.Query().Get(KeyBlob)
+		)
+
+		created, err := fs.Create(b, key, f)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		respondJSON(w, http.StatusCreated, ResponseCreated{
+			File: ResponseFile{
+				Key:          key,
+				Bucket:       b,
+				LastModified: created.LastModified(),
+			},
+		})
+	})
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	client := New(ts.URL, nil)
+
+	file, err := client.Copy(src.Name, "original.txt", dst.Name, "copy.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := file.Key, "copy.txt"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	if have, want := file.Bucket.Name, dst.Name; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	if file.LastModified.IsZero() {
+		t.Errorf("missing LastModified")
+	}
+
+	f, err := fs.Open(dst, "copy.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := string(raw), content; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+
+	for _, ids := range [][4]string{
+		{"", "a", "b", "c"},
+		{"a", "", "b", "c"},
+		{"a", "b", "", "c"},
+		{"a", "b", "c", ""},
+	} {
+		_, err := client.Copy(ids[0], ids[1], ids[2], ids[3])
+		if err == nil {
+			t.Errorf("%q: expected error", ids)
+		}
+	}
+}
+
 func TestClientCreateInvalid(t *testing.T) {
 	client := New("lolcathost.org", nil)
 
@@ -85,6 +201,218 @@ func TestClientCreateInvalid(t *testing.T) {
 	}
 }
 
+func TestClientCreateWithOptionsProgress(t *testing.T) {
+	var (
+		body = bytes.Repeat([]byte("progress"), 64*1024)
+		r    = pat.New()
+	)
+
+	r.Post(RouteFile, func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		_, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		respondJSON(w, http.StatusCreated, ResponseCreated{})
+	})
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	var (
+		client = New(ts.URL, nil)
+		calls  int
+		sent   int64
+	)
+
+	_, err := client.CreateWithOptions("progress", "big.blob", bytes.NewReader(body), &CreateOptions{
+		ProgressFunc: func(n int64) {
+			if n < sent {
+				t.Errorf("progress went back from %d to %d", sent, n)
+			}
+
+			calls++
+			sent = n
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := sent, int64(len(body)); have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+
+	if calls < 2 {
+		t.Errorf("have %d progress calls, want several", calls)
+	}
+}
+
+func TestClientGetTo(t *testing.T) {
+	var (
+		body   = "content is here"
+		bucket = "get"
+		key    = "content.log"
+		r      = pat.New()
+	)
+
+	r.Get(RouteFile, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get(KeyBlob) != key {
+			respondJSON(w, http.StatusNotFound, ResponseError{
+				Code:  http.StatusNotFound,
+				Error: ErrFileNotFound.Error(),
+			})
+			return
+		}
+
+		http.ServeContent(w, r, key, time.Now(), bytes.NewReader([]byte(body)))
+	})
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	var (
+		buf    = &bytes.Buffer{}
+		client = New(ts.URL, nil)
+	)
+
+	n, err := client.GetTo(bucket, key, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := n, int64(len(body)); have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+
+	if have, want := buf.String(), body; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+
+	_, err = client.GetTo(bucket, "missing.log", buf)
+	if !IsNotFound(err) {
+		t.Errorf("want file not found, have %v", err)
+	}
+}
+
+func TestClientExists(t *testing.T) {
+	r := pat.New()
+
+	r.Add("HEAD", RouteFile, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		switch {
+		case r.URL.Query().Get(KeyBucket) != "exists":
+			err = ErrBucketNotFound
+		case r.URL.Query().Get(KeyBlob) != "stored.log":
+			err = ErrFileNotFound
+		default:
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		w.Header().Set(HeaderError, err.Error())
+		w.WriteHeader(http.StatusNotFound)
+	}))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	client := New(ts.URL, nil)
+
+	ok, err := client.Exists("exists", "stored.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !ok {
+		t.Error("stored file reported missing")
+	}
+
+	ok, err = client.Exists("exists", "missing.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok {
+		t.Error("missing file reported stored")
+	}
+
+	_, err = client.Exists("missing", "stored.log")
+	if !IsBucketNotFound(err) {
+		t.Errorf("have %v, want %v", err, ErrBucketNotFound)
+	}
+}
+
+func TestClientStat(t *testing.T) {
+	var (
+		bucket = "stat"
+		key    = "nested/stat.log"
+		stat   = ResponseFile{
+			Key:          key,
+			Bucket:       NewBucket(bucket, Owner{}),
+			Created:      time.Now().Add(-time.Hour).UTC(),
+			LastModified: time.Now().UTC(),
+			Size:         1234,
+			Hash:         "f572d396fae9206628714fb2ce00f72e94f2258f",
+			Meta: &Meta{
+				Expires:     time.Now().Add(time.Hour).UTC(),
+				Compression: CompressionGzip,
+			},
+		}
+		r = pat.New()
+	)
+
+	r.Get(RouteFile, func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.URL.Query()[ParamMeta]; !ok {
+			t.Errorf("missing %s param", ParamMeta)
+		}
+
+		if r.URL.Query().Get(KeyBlob) != key {
+			respondJSON(w, http.StatusNotFound, ResponseError{
+				Code:  http.StatusNotFound,
+				Error: ErrFileNotFound.Error(),
+			})
+			return
+		}
+
+		respondJSON(w, http.StatusOK, stat)
+	})
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	client := New(ts.URL, nil)
+
+	have, err := client.Stat(bucket, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have.Key != stat.Key ||
+		have.Size != stat.Size ||
+		have.Hash != stat.Hash ||
+		!have.Created.Equal(stat.Created) ||
+		!have.LastModified.Equal(stat.LastModified) {
+		t.Errorf("have %+v, want %+v", have, stat)
+	}
+
+	if have.Meta == nil {
+		t.Fatal("meta missing")
+	}
+
+	if have, want := *have.Meta, *stat.Meta; !have.Expires.Equal(want.Expires) || have.Compression != want.Compression {
+		t.Errorf("have %+v, want %+v", have, want)
+	}
+
+	_, err = client.Stat(bucket, "missing.log")
+	if !IsNotFound(err) {
+		t.Errorf("have %v, want %v", err, ErrFileNotFound)
+	}
+}
+
 func TestClientGet(t *testing.T) {
 	var (
 		body   = "content is here"
@@ -127,6 +455,87 @@ func TestClientGet(t *testing.T) {
 	}
 }
 
+func TestClientDownload(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-client-download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		content      = []byte("downloaded content")
+		sum          = sha1.Sum(content)
+		lastModified = time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+		etag         = hex.EncodeToString(sum[:])
+		r            = pat.New()
+	)
+
+	r.Get(RouteFile, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(HeaderETag, etag)
+		http.ServeContent(w, r, "file.txt", lastModified, bytes.NewReader(content))
+	})
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	var (
+		client = New(ts.URL, nil)
+		dest   = filepath.Join(tmp, "file.txt")
+	)
+
+	info, err := client.Download("download", "file.txt", dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := *info, (FileInfo{
+		Key:          "file.txt",
+		Hash:         etag,
+		Size:         int64(len(content)),
+		LastModified: lastModified,
+	}); !reflect.DeepEqual(have, want) {
+		t.Errorf("have %+v, want %+v", have, want)
+	}
+
+	raw, err := ioutil.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := sha1.Sum(raw), sum; have != want {
+		t.Errorf("have %x, want %x", have, want)
+	}
+
+	md5Sum := md5.Sum(content)
+	etag = `"` + hex.EncodeToString(md5Sum[:]) + `"`
+
+	info, err = client.Download("download", "file.txt", filepath.Join(tmp, "quoted.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := info.Hash, hex.EncodeToString(md5Sum[:]); have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	etag = strings.Repeat("0", 40)
+	dest = filepath.Join(tmp, "mismatch.txt")
+
+	_, err = client.Download("download", "file.txt", dest)
+	if have, want := err, ErrHashMismatch; !IsHashMismatch(err) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	entries, err := ioutil.ReadDir(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := len(entries), 2; have != want {
+		t.Errorf("have %d files, want %d", have, want)
+	}
+}
+
 func TestClientListFiles(t *testing.T) {
 	var (
 		bucket = "files"
@@ -205,6 +614,222 @@ func TestClientListFiles(t *testing.T) {
 	}
 }
 
+func TestClientWalk(t *testing.T) {
+	var (
+		b     = NewBucket("walk", Owner{})
+		keys  = []string{}
+		pages int
+		r     = pat.New()
+	)
+
+	for i := 0; i < 30; i++ {
+		keys = append(keys, fmt.Sprintf("file-%02d", i))
+	}
+
+	r.Get(RouteBucket, func(w http.ResponseWriter, r *http.Request) {
+		pages++
+
+		if have, want := r.URL.Query().Get(ParamSort), "+key"; have != want {
+			t.Errorf("have %q, want %q", have, want)
+		}
+
+		limit, err := strconv.Atoi(r.URL.Query().Get(ParamLimit))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var (
+			marker = r.URL.Query().Get(ParamMarker)
+			list   = ResponseFileList{Bucket: b, Files: []ResponseFile{}}
+		)
+
+		for _, key := range keys {
+			if key <= marker {
+				continue
+			}
+
+			if len(list.Files) == limit {
+				list.NextMarker = list.Files[limit-1].Key
+				break
+			}
+
+			list.Files = append(list.Files, ResponseFile{Key: key, Bucket: b})
+		}
+
+		respondJSON(w, http.StatusOK, list)
+	})
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	var (
+		client = New(ts.URL, nil)
+		walked = []string{}
+	)
+
+	err := client.Walk(b.Name, &ListOptions{Limit: 7}, func(f ResponseFile) error {
+		walked = append(walked, f.Key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := walked, keys; !reflect.DeepEqual(have, want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	if have, want := pages, 5; have != want {
+		t.Errorf("have %d pages, want %d", have, want)
+	}
+
+	// Walking stops at the first error of fn.
+	var (
+		errStop = errors.New("stop")
+		n       int
+	)
+
+	err = client.Walk(b.Name, &ListOptions{Limit: 7}, func(f ResponseFile) error {
+		n++
+		if n == 10 {
+			return errStop
+		}
+		return nil
+	})
+	if have, want := err, errStop; have != want {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	if have, want := n, 10; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+
+	err = client.Walk("", nil, nil)
+	if have, want := err, ErrEmptyBucket; have != want {
+		t.Errorf("have %v, want %v", have, want)
+	}
+}
+
+func TestClientListPage(t *testing.T) {
+	var (
+		b    = NewBucket("pages", Owner{})
+		keys = []string{}
+		r    = pat.New()
+	)
+
+	for i := 0; i < 20; i++ {
+		keys = append(keys, fmt.Sprintf("file-%02d", i))
+	}
+
+	r.Get(RouteBucket, func(w http.ResponseWriter, r *http.Request) {
+		limit, err := strconv.Atoi(r.URL.Query().Get(ParamLimit))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var (
+			marker = r.URL.Query().Get(ParamMarker)
+			list   = ResponseFileList{Bucket: b, Files: []ResponseFile{}}
+		)
+
+		for _, key := range keys {
+			if key <= marker {
+				continue
+			}
+
+			if len(list.Files) == limit {
+				list.NextMarker = list.Files[limit-1].Key
+				break
+			}
+
+			list.Files = append(list.Files, ResponseFile{Key: key, Bucket: b})
+		}
+
+		respondJSON(w, http.StatusOK, list)
+	})
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	var (
+		client = New(ts.URL, nil)
+		opts   = &ListOptions{Limit: 8, Sort: ByKeyStrategy(true)}
+		listed = []string{}
+		pages  = 0
+	)
+
+	for {
+		files, next, err := client.ListPage(b.Name, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages++
+
+		for _, f := range files {
+			listed = append(listed, f.Key)
+		}
+
+		if next == "" {
+			break
+		}
+
+		// Every page ends with the marker of the next one.
+		if have, want := next, files[len(files)-1].Key; have != want {
+			t.Errorf("have %s, want %s", have, want)
+		}
+
+		opts.Marker = next
+	}
+
+	if have, want := listed, keys; !reflect.DeepEqual(have, want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	if have, want := pages, 3; have != want {
+		t.Errorf("have %d pages, want %d", have, want)
+	}
+}
+
+func TestListOptionsEncodeParams(t *testing.T) {
+	opts := ListOptions{
+		ModifiedBefore: time.Date(2016, 5, 2, 0, 0, 0, 0, time.UTC),
+		ModifiedSince:  time.Date(2016, 5, 1, 12, 30, 0, 500, time.UTC),
+		Prefix:         "sync/",
+		Marker:         "sync/2016",
+		StartAfter:     "sync/2016/05",
+		EndBefore:      "sync/2016/06",
+	}
+
+	vs, err := url.ParseQuery(opts.EncodeParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := vs.Get(ParamModifiedSince), "2016-05-01T12:30:00.0000005Z"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	if have, want := vs.Get(ParamModifiedBefore), "2016-05-02T00:00:00Z"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	if have, want := vs.Get(ParamPrefix), "sync/"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	if have, want := vs.Get(ParamMarker), "sync/2016"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	if have, want := vs.Get(ParamStartAfter), "sync/2016/05"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	if have, want := vs.Get(ParamEndBefore), "sync/2016/06"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+}
+
 func TestClientListFilesInvalid(t *testing.T) {
 	client := New("lolcathost.org", nil)
 
@@ -214,6 +839,208 @@ func TestClientListFilesInvalid(t *testing.T) {
 	}
 }
 
+func TestClientPing(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != RouteHealth {
+				http.NotFound(w, r)
+				return
+			}
+
+			respondJSON(w, http.StatusOK, ResponseHealth{Status: "ok"})
+		}),
+	)
+
+	client := New(ts.URL, nil)
+
+	d, err := client.Ping()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d <= 0 {
+		t.Errorf("have %v, want positive duration", d)
+	}
+
+	ts.Close()
+
+	_, err = client.Ping()
+	if have, want := err, ErrClient; !IsClient(err) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+}
+
+func TestClientPathPrefix(t *testing.T) {
+	var paths []string
+
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			paths = append(paths, r.URL.Path)
+			respondJSON(w, http.StatusOK, ResponseHealth{Status: "ok"})
+		}),
+	)
+	defer ts.Close()
+
+	inputs := []struct {
+		addr string
+		path string
+	}{
+		{ts.URL, RouteHealth},
+		{ts.URL + "/", RouteHealth},
+		{ts.URL + "/storage", "/storage" + RouteHealth},
+		{ts.URL + "/storage/", "/storage" + RouteHealth},
+	}
+
+	for _, input := range inputs {
+		paths = nil
+
+		_, err := New(input.addr, nil).Ping()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have, want := paths, []string{input.path}; !reflect.DeepEqual(have, want) {
+			t.Errorf("%s: have %v, want %v", input.addr, have, want)
+		}
+	}
+}
+
+func TestClientRetry(t *testing.T) {
+	var (
+		body  = "retried content"
+		calls int
+	)
+
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+
+			raw, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if calls < 3 {
+				respondJSON(w, http.StatusServiceUnavailable, ResponseError{
+					Code:  http.StatusServiceUnavailable,
+					Error: http.StatusText(http.StatusServiceUnavailable),
+				})
+				return
+			}
+
+			if r.Method == "POST" && string(raw) != body {
+				t.Errorf("have %q, want %q", raw, body)
+			}
+
+			respondJSON(w, http.StatusCreated, ResponseCreated{})
+		}),
+	)
+	defer ts.Close()
+
+	client := New(ts.URL, nil, WithRetry(3, time.Millisecond))
+
+	rc, err := client.Get("retry", "file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Close()
+
+	if have, want := calls, 3; have != want {
+		t.Errorf("have %d calls, want %d", have, want)
+	}
+
+	calls = 0
+
+	_, err = client.Create("retry", "file.txt", bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := calls, 3; have != want {
+		t.Errorf("have %d calls, want %d", have, want)
+	}
+
+	// Sources which can't be rewound are sent only once.
+	calls = 0
+
+	_, err = client.Create("retry", "file.txt", ioutil.NopCloser(bytes.NewReader([]byte(body))))
+	if have, want := err, ErrClient; !IsClient(err) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	if have, want := calls, 1; have != want {
+		t.Errorf("have %d calls, want %d", have, want)
+	}
+}
+
+func TestClientWithHeader(t *testing.T) {
+	var (
+		r        = pat.New()
+		received = []http.Header{}
+	)
+
+	record := func(w http.ResponseWriter, r *http.Request) {
+		received = append(received, r.Header)
+
+		respondJSON(w, http.StatusCreated, ResponseCreated{
+			File: ResponseFile{
+				Key:          r.URL.Query().Get(KeyBlob),
+				LastModified: time.Now(),
+			},
+		})
+	}
+
+	r.Get(RouteFile, record)
+	r.Post(RouteFile, record)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	client := New(
+		ts.URL,
+		nil,
+		WithHeader("Authorization", "Bearer secret"),
+		WithHeader("X-Request-ID", "first"),
+		WithHeader("X-Request-ID", "second"),
+		// Headers set by the Client win over injected ones.
+		WithHeader(HeaderCopySource, "injected/source"),
+	)
+
+	_, err := client.Create("header", "created.log", strings.NewReader("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.Copy("header", "created.log", "header", "copied.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rc, err := client.Get("header", "created.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Close()
+
+	if have, want := len(received), 3; have != want {
+		t.Fatalf("have %d requests, want %d", have, want)
+	}
+
+	for i, h := range received {
+		if have, want := h.Get("Authorization"), "Bearer secret"; have != want {
+			t.Errorf("request %d: have %q, want %q", i, have, want)
+		}
+
+		if have, want := h["X-Request-Id"], []string{"first", "second"}; !reflect.DeepEqual(have, want) {
+			t.Errorf("request %d: have %q, want %q", i, have, want)
+		}
+	}
+
+	if have, want := received[1].Get(HeaderCopySource), "header/created.log"; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+}
+
 func TestRequestError(t *testing.T) {
 	ts := httptest.NewServer(
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -225,12 +1052,48 @@ func TestRequestError(t *testing.T) {
 	)
 	defer ts.Close()
 
-	_, err := New(ts.URL, nil).request("GET", "/", nil, &struct{}{})
+	_, err := New(ts.URL, nil).request("GET", "/", nil, nil, &struct{}{})
 	if have, want := err, ErrClient; !IsClient(err) {
 		t.Errorf("have %v, want %v", have, want)
 	}
 }
 
+func TestRequestErrorStatus(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Request-Id", "42")
+			http.NotFound(w, r)
+		}),
+	)
+	defer ts.Close()
+
+	_, err := New(ts.URL, nil).Get("bucket", "missing.txt")
+	if have, want := err, ErrClient; !IsClient(err) {
+		t.Fatalf("have %v, want %v", have, want)
+	}
+
+	if !IsNotFound(err) {
+		t.Errorf("have %v, want not found", err)
+	}
+
+	if IsForbidden(err) {
+		t.Errorf("have %v, want not forbidden", err)
+	}
+
+	e, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("have %T, want *Error", err)
+	}
+
+	if have, want := e.StatusCode, http.StatusNotFound; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+
+	if have, want := e.Header.Get("X-Request-Id"), "42"; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+}
+
 func respondJSON(w http.ResponseWriter, code int, obj interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
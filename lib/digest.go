@@ -0,0 +1,70 @@
+package ent
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"hash"
+	"hash/crc32"
+)
+
+// Digest accumulates the SHA1 and CRC32C of content written to it. Files pass
+// their content through it while it is written, e.g. with io.TeeReader in
+// Create, so Hash and CRC32C don't have to seek and read it again later.
+type Digest struct {
+	crc  hash.Hash32
+	hash hash.Hash
+	md5  hash.Hash
+	n    int64
+}
+
+// NewDigest returns an empty Digest.
+func NewDigest() *Digest {
+	return &Digest{
+		crc:  crc32.New(CRC32CTable),
+		hash: sha1.New(),
+	}
+}
+
+// NewMD5Digest returns an empty Digest which accumulates the MD5 of the
+// content as well, for ETags formed from it.
+func NewMD5Digest() *Digest {
+	d := NewDigest()
+	d.md5 = md5.New()
+	return d
+}
+
+// Write adds p to the content digested, it never fails.
+func (d *Digest) Write(p []byte) (int, error) {
+	d.hash.Write(p)
+	d.crc.Write(p)
+	if d.md5 != nil {
+		d.md5.Write(p)
+	}
+	d.n += int64(len(p))
+
+	return len(p), nil
+}
+
+// Hash returns the SHA1 of the content written so far.
+func (d *Digest) Hash() []byte {
+	return d.hash.Sum(nil)
+}
+
+// MD5 returns the MD5 of the content written so far, which is nil unless the
+// Digest has been returned by NewMD5Digest.
+func (d *Digest) MD5() []byte {
+	if d.md5 == nil {
+		return nil
+	}
+	return d.md5.Sum(nil)
+}
+
+// CRC32C returns the CRC32C checksum of the content written so far.
+func (d *Digest) CRC32C() uint32 {
+	return d.crc.Sum32()
+}
+
+// Len returns the number of bytes written so far.
+func (d *Digest) Len() int64 {
+	return d.n
+}
@@ -0,0 +1,57 @@
+package ent
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"hash/crc32"
+	"io"
+	"testing"
+)
+
+// onceReader hides every method but Read of its reader, so it can't be
+// rewound.
+type onceReader struct {
+	io.Reader
+}
+
+func TestDigest(t *testing.T) {
+	var (
+		content = []byte("digested while written")
+		sum     = sha1.Sum(content)
+		d       = NewDigest()
+		dst     = &bytes.Buffer{}
+	)
+
+	_, err := io.Copy(dst, io.TeeReader(onceReader{bytes.NewReader(content)}, d))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := d.Hash(), sum[:]; !bytes.Equal(have, want) {
+		t.Errorf("have %x, want %x", have, want)
+	}
+
+	if have, want := d.Len(), int64(len(content)); have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+
+	if have, want := d.CRC32C(), crc32.Checksum(content, CRC32CTable); have != want {
+		t.Errorf("have %08x, want %08x", have, want)
+	}
+}
+
+func TestMD5Digest(t *testing.T) {
+	content := []byte("digested for an md5 etag")
+
+	d := NewMD5Digest()
+	d.Write(content)
+
+	if have, want := d.MD5(), md5.Sum(content); !bytes.Equal(have, want[:]) {
+		t.Errorf("have %x, want %x", have, want)
+	}
+
+	if have := NewDigest().MD5(); have != nil {
+		t.Errorf("have %x, want nil", have)
+	}
+}
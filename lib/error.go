@@ -3,23 +3,43 @@ package ent
 import (
 	"errors"
 	"fmt"
+	"net/http"
 )
 
 // Error codes returned by Ent for missing entities.
 var (
-	ErrBucketNotFound = errors.New("bucket not found")
-	ErrClient         = errors.New("ent.Client")
-	ErrEmptyBucket    = errors.New("bucket not provided")
-	ErrEmptyKey       = errors.New("key not provided")
-	ErrEmptySource    = errors.New("source not provided")
-	ErrFileNotFound   = errors.New("file not found")
-	ErrInvalidParam   = errors.New("invalid param")
+	ErrBucketNotFound   = errors.New("bucket not found")
+	ErrBucketReadOnly   = errors.New("bucket read-only")
+	ErrClient           = errors.New("ent.Client")
+	ErrEmptyBody        = errors.New("body empty")
+	ErrEmptyBucket      = errors.New("bucket not provided")
+	ErrEmptyKey         = errors.New("key not provided")
+	ErrEmptySource      = errors.New("source not provided")
+	ErrFileExists       = errors.New("file exists")
+	ErrFileNotFound     = errors.New("file not found")
+	ErrForbidden        = errors.New("forbidden")
+	ErrHashMismatch     = errors.New("hash mismatch")
+	ErrInvalidBody      = errors.New("body invalid")
+	ErrInvalidParam     = errors.New("invalid param")
+	ErrKeyNotAllowed    = errors.New("key not allowed")
+	ErrMethodNotAllowed = errors.New("method not allowed")
+	ErrNotSeekable      = errors.New("file not seekable")
+	ErrRetentionActive  = errors.New("retention active")
+	ErrUploadNotFound   = errors.New("upload not found")
+	ErrUploadOffset     = errors.New("upload offset mismatch")
 )
 
 // Error is a wrapper for Ent returned errors.
 type Error struct {
 	err error
 	msg string
+
+	// StatusCode is the HTTP status code of the response which caused the
+	// error, it is 0 if no response could be obtained.
+	StatusCode int
+	// Header holds the headers of the response which caused the error, it is
+	// nil if no response could be obtained.
+	Header http.Header
 }
 
 func newError(err error, msg string) error {
@@ -29,6 +49,15 @@ func newError(err error, msg string) error {
 	}
 }
 
+func newResponseError(err error, res *http.Response, msg string) error {
+	return &Error{
+		err:        err,
+		msg:        msg,
+		StatusCode: res.StatusCode,
+		Header:     res.Header,
+	}
+}
+
 func (e *Error) Error() string {
 	return fmt.Sprintf("%s %s", e.err, e.msg)
 }
@@ -39,11 +68,22 @@ func IsBucketNotFound(err error) bool {
 	return unwrapErr(err) == ErrBucketNotFound
 }
 
+// IsBucketReadOnly returns a boolean indicating the error is
+// ErrBucketReadOnly.
+func IsBucketReadOnly(err error) bool {
+	return unwrapErr(err) == ErrBucketReadOnly
+}
+
 // IsClient returns a boolean indicating if the error is ErrClient.
 func IsClient(err error) bool {
 	return unwrapErr(err) == ErrClient
 }
 
+// IsEmptyBody returns a boolean indicating if the error is ErrEmptyBody.
+func IsEmptyBody(err error) bool {
+	return unwrapErr(err) == ErrEmptyBody
+}
+
 // IsEmptyBucket returns a boolean indicating if the error is ErrEmptyBucket.
 func IsEmptyBucket(err error) bool {
 	return unwrapErr(err) == ErrEmptyBucket
@@ -59,12 +99,65 @@ func IsEmptySource(err error) bool {
 	return unwrapErr(err) == ErrEmptySource
 }
 
+// IsFileExists returns a boolean indicating the error is ErrFileExists.
+func IsFileExists(err error) bool {
+	return unwrapErr(err) == ErrFileExists
+}
+
 // IsFileNotFound returns a boolean indicating the error is
 // ErrFileNotFound.
 func IsFileNotFound(err error) bool {
 	return unwrapErr(err) == ErrFileNotFound
 }
 
+// IsForbidden returns a boolean indicating the error is ErrForbidden or has
+// been caused by a 403 response.
+func IsForbidden(err error) bool {
+	return unwrapErr(err) == ErrForbidden || statusCode(err) == http.StatusForbidden
+}
+
+// IsNotFound returns a boolean indicating the error is ErrBucketNotFound,
+// ErrFileNotFound or ErrUploadNotFound or has been caused by a 404 response.
+func IsNotFound(err error) bool {
+	switch unwrapErr(err) {
+	case ErrBucketNotFound, ErrFileNotFound, ErrUploadNotFound:
+		return true
+	}
+	return statusCode(err) == http.StatusNotFound
+}
+
+// IsHashMismatch returns a boolean indicating the error is ErrHashMismatch.
+func IsHashMismatch(err error) bool {
+	return unwrapErr(err) == ErrHashMismatch
+}
+
+// IsInvalidBody returns a boolean indicating the error is ErrInvalidBody.
+func IsInvalidBody(err error) bool {
+	return unwrapErr(err) == ErrInvalidBody
+}
+
+// IsKeyNotAllowed returns a boolean indicating the error is ErrKeyNotAllowed.
+func IsKeyNotAllowed(err error) bool {
+	return unwrapErr(err) == ErrKeyNotAllowed
+}
+
+// IsRetentionActive returns a boolean indicating the error is
+// ErrRetentionActive.
+func IsRetentionActive(err error) bool {
+	return unwrapErr(err) == ErrRetentionActive
+}
+
+// IsUploadNotFound returns a boolean indicating the error is
+// ErrUploadNotFound.
+func IsUploadNotFound(err error) bool {
+	return unwrapErr(err) == ErrUploadNotFound
+}
+
+// IsUploadOffset returns a boolean indicating the error is ErrUploadOffset.
+func IsUploadOffset(err error) bool {
+	return unwrapErr(err) == ErrUploadOffset
+}
+
 func unwrapErr(err error) error {
 	switch e := err.(type) {
 	case *Error:
@@ -72,3 +165,10 @@ func unwrapErr(err error) error {
 	}
 	return err
 }
+
+func statusCode(err error) int {
+	if e, ok := err.(*Error); ok {
+		return e.StatusCode
+	}
+	return 0
+}
@@ -0,0 +1,56 @@
+package ent
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+// ETag styles
+const (
+	// ETagSHA1 is the bare hex encoded SHA1 of the content.
+	ETagSHA1 = "sha1"
+	// ETagMD5Quoted is the hex encoded MD5 of the content in double quotes as
+	// expected by S3 clients and CDNs.
+	ETagMD5Quoted = "md5-quoted"
+)
+
+// ETagStyle selects how the ETags of Files are formed.
+var ETagStyle = ETagSHA1
+
+// FileETag returns the ETag of f following ETagStyle. Files form their ETag
+// with it, so headers, listings and If-None-Match all agree on the format.
+// For md5-quoted ETags recorded is asked for the MD5 of the content if it is
+// not nil. Unless it knows the MD5 it is computed from the content, f is
+// rewound after.
+func FileETag(f File, recorded func() []byte) (string, error) {
+	if ETagStyle != ETagMD5Quoted {
+		h, err := f.Hash()
+		if err != nil {
+			return "", err
+		}
+
+		return hex.EncodeToString(h), nil
+	}
+
+	if recorded != nil {
+		if sum := recorded(); sum != nil {
+			return `"` + hex.EncodeToString(sum) + `"`, nil
+		}
+	}
+
+	h := md5.New()
+
+	_, err := io.Copy(h, f)
+	if err != nil {
+		return "", fmt.Errorf("md5 failed: %s", err)
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+
+	return `"` + hex.EncodeToString(h.Sum(nil)) + `"`, nil
+}
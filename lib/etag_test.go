@@ -0,0 +1,59 @@
+package ent
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestMemoryFileETag(t *testing.T) {
+	defer func(style string) { ETagStyle = style }(ETagStyle)
+
+	var (
+		fs      = NewMemoryFS()
+		b       = NewBucket("etag", Owner{})
+		content = "content with a stable etag"
+		sha     = sha1.Sum([]byte(content))
+		md      = md5.Sum([]byte(content))
+	)
+
+	for style, want := range map[string]string{
+		ETagSHA1:      hex.EncodeToString(sha[:]),
+		ETagMD5Quoted: `"` + hex.EncodeToString(md[:]) + `"`,
+	} {
+		ETagStyle = style
+
+		f, err := fs.Create(b, style+".txt", strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		etag, err := f.ETag()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have := etag; have != want {
+			t.Errorf("%s: have %s, want %s", style, have, want)
+		}
+
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Forming the ETag leaves the content to be read.
+		read, err := ioutil.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have, want := string(read), content; have != want {
+			t.Errorf("%s: have %q, want %q", style, have, want)
+		}
+	}
+}
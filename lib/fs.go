@@ -2,11 +2,14 @@ package ent
 
 import (
 	"bytes"
+	"crypto/md5"
 	"crypto/sha1"
 	"errors"
 	"hash"
+	"hash/crc32"
 	"io"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -14,19 +17,121 @@ import (
 // namespaced into buckets.
 type FileSystem interface {
 	Create(bucket *Bucket, key string, data io.Reader) (File, error)
+	// CreateExclusive behaves like Create but fails with ErrFileExists if a
+	// file is already stored under key.
+	CreateExclusive(bucket *Bucket, key string, data io.Reader) (File, error)
 	Delete(bucket *Bucket, key string) error
 	Open(bucket *Bucket, key string) (File, error)
+	// Versions lists the versions kept of the file under key, oldest first.
+	Versions(bucket *Bucket, key string) ([]Version, error)
+	// OpenVersion returns the version of the file under key with the given
+	// hash.
+	OpenVersion(bucket *Bucket, key, hash string) (File, error)
+	// Restore brings back the file most recently deleted under key, if the
+	// FileSystem keeps deleted files. ErrFileNotFound is returned otherwise.
+	Restore(bucket *Bucket, key string) error
+	// List returns up to limit files of bucket with the prefix in the order of
+	// sort. Listings filtered further walk the files instead.
 	List(bucket *Bucket, prefix string, limit uint64, sort SortStrategy) (Files, error)
+	// Walk calls fn for every file of bucket with the prefix and last
+	// modified in the range, in no particular order and without collecting
+	// them first. An error returned by fn stops the walk and is returned.
+	Walk(
+		bucket *Bucket,
+		prefix string,
+		modified ModifiedRange,
+		fn func(File) error,
+	) error
+	// WalkDir walks the files of bucket like Walk but only calls fn for the
+	// files whose key has no slash after the prefix. Keys continuing with a
+	// slash are reported to dirFn as their common prefix up to and including
+	// the slash, once per common prefix.
+	WalkDir(
+		bucket *Bucket,
+		prefix string,
+		modified ModifiedRange,
+		fn func(File) error,
+		dirFn func(string) error,
+	) error
+	// Usage returns the number of bytes stored for the files of bucket.
+	Usage(bucket *Bucket) (uint64, error)
+	// Stats counts the files of bucket and the bytes stored for them in a
+	// single pass.
+	Stats(bucket *Bucket) (BucketStats, error)
+
+	// Meta returns the Meta stored for the file, a zero Meta is returned if
+	// none has been stored yet.
+	Meta(bucket *Bucket, key string) (Meta, error)
+	// SetMeta stores meta alongside an existing file replacing previous Meta.
+	SetMeta(bucket *Bucket, key string, meta Meta) error
+}
+
+// Meta carries attributes of a File which are stored alongside its content.
+type Meta struct {
+	// Created is the time the file was first stored under its key, it is
+	// kept when the file is overwritten.
+	Created     time.Time `json:"created"`
+	RetainUntil time.Time `json:"retainUntil"`
+	// Expires is the time after which the file is deleted, it never expires
+	// if zero.
+	Expires time.Time `json:"expires"`
+	// Compression names the codec the content was stored with.
+	Compression string `json:"compression,omitempty"`
+	// Encryption names the cipher the content was stored with.
+	Encryption string `json:"encryption,omitempty"`
+}
+
+// BucketStats summarizes the files stored for a bucket.
+type BucketStats struct {
+	Files int
+	Bytes uint64
+}
+
+// Version describes a version of a File kept after it was replaced or
+// deleted. Hash is the hex encoded SHA1 of the content as stored.
+type Version struct {
+	Hash         string    `json:"hash"`
+	LastModified time.Time `json:"lastModified"`
+	// Compression names the codec the content was stored with.
+	Compression string `json:"compression,omitempty"`
+	// Encryption names the cipher the content was stored with.
+	Encryption string `json:"encryption,omitempty"`
+	// Current marks the version currently stored under the key.
+	Current bool `json:"current,omitempty"`
+}
+
+// IsRetained reports whether the file must not be overwritten or deleted at
+// the given time.
+func (m Meta) IsRetained(now time.Time) bool {
+	return now.Before(m.RetainUntil)
+}
+
+// IsExpired reports whether the file is to be treated as deleted at the given
+// time.
+func (m Meta) IsExpired(now time.Time) bool {
+	return !m.Expires.IsZero() && !now.Before(m.Expires)
 }
 
 // File represents a handle to an open file handle.
 type File interface {
+	// CRC32C returns the CRC32C checksum, using CRC32CTable, of the content as
+	// served, after it has been decompressed and decrypted, so it matches the
+	// checksum clients compute over the bytes they receive.
+	CRC32C() (uint32, error)
+	// Created returns the time the File was first stored under its key, which
+	// unlike LastModified is kept across overwrites.
+	Created() time.Time
+	// ETag returns the validator of the content sent in the ETag header and
+	// compared with If-None-Match, formed by FileETag.
+	ETag() (string, error)
 	Hash() ([]byte, error)
 	Key() string
 	LastModified() time.Time
+	Size() (int64, error)
 
 	io.Closer
 	io.Reader
+	io.ReaderAt
 	io.Seeker
 	io.Writer
 }
@@ -34,15 +139,82 @@ type File interface {
 // Files represents group of file
 type Files []File
 
-// MemoryFS is an in-memory implementation of FileSystem.
+// ModifiedRange restricts a listing to files last modified at or after Since
+// and before Before. A zero time leaves the respective end of the range open.
+type ModifiedRange struct {
+	Since  time.Time
+	Before time.Time
+}
+
+// Contains reports whether t lies within the range.
+func (r ModifiedRange) Contains(t time.Time) bool {
+	if !r.Since.IsZero() && t.Before(r.Since) {
+		return false
+	}
+
+	if !r.Before.IsZero() && !t.Before(r.Before) {
+		return false
+	}
+
+	return true
+}
+
+// CRC32CTable is the table of the Castagnoli polynomial used for the CRC32C
+// checksum of Files.
+var CRC32CTable = crc32.MakeTable(crc32.Castagnoli)
+
+// NormalizeKey returns key with runs of slashes collapsed into one. Keys which
+// are empty, start or end with a slash or have a segment . or .. are rejected
+// with ErrInvalidParam, as they don't name a single file the same way on
+// every FileSystem.
+func NormalizeKey(key string) (string, error) {
+	for strings.Contains(key, "//") {
+		key = strings.Replace(key, "//", "/", -1)
+	}
+
+	if key == "" || strings.HasPrefix(key, "/") || strings.HasSuffix(key, "/") {
+		return "", ErrInvalidParam
+	}
+
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "." || segment == ".." {
+			return "", ErrInvalidParam
+		}
+	}
+
+	return key, nil
+}
+
+// checkKey rejects keys which are not normalized with ErrInvalidParam.
+func checkKey(key string) error {
+	k, err := NormalizeKey(key)
+	if err != nil {
+		return err
+	}
+
+	if k != key {
+		return ErrInvalidParam
+	}
+
+	return nil
+}
+
+// MemoryFS is an in-memory implementation of FileSystem. It is safe for
+// concurrent use.
 type MemoryFS struct {
-	buckets map[*Bucket]map[string]File
+	mu sync.RWMutex
+
+	// Files and Meta are kept by bucket name to not depend on the identity of
+	// the *Bucket passed.
+	buckets map[string]map[string]File
+	meta    map[string]map[string]Meta
 }
 
 // NewMemoryFS returns an instance of MemoryFS.
 func NewMemoryFS() FileSystem {
 	return &MemoryFS{
-		buckets: map[*Bucket]map[string]File{},
+		buckets: map[string]map[string]File{},
+		meta:    map[string]map[string]Meta{},
 	}
 }
 
@@ -53,40 +225,98 @@ func (fs *MemoryFS) Create(
 	key string,
 	src io.Reader,
 ) (File, error) {
-	f := NewMemoryFile(key, nil)
+	return fs.create(bucket, key, src, false)
+}
 
-	_, err := io.Copy(f, src)
+// CreateExclusive given a Bucket and a key stores the content of src into a
+// MemoryFile unless a File is already stored under key.
+func (fs *MemoryFS) CreateExclusive(
+	bucket *Bucket,
+	key string,
+	src io.Reader,
+) (File, error) {
+	return fs.create(bucket, key, src, true)
+}
+
+func (fs *MemoryFS) create(
+	bucket *Bucket,
+	key string,
+	src io.Reader,
+	exclusive bool,
+) (File, error) {
+	err := checkKey(key)
 	if err != nil {
 		return nil, err
 	}
 
-	if _, ok := fs.buckets[bucket]; !ok {
-		fs.buckets[bucket] = map[string]File{}
+	f := NewMemoryFile(key, nil).(*MemoryFile)
+
+	_, err = io.Copy(f, src)
+	if err != nil {
+		return nil, err
 	}
 
-	fs.buckets[bucket][f.Key()] = f
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, ok := fs.buckets[bucket.Name][key]; ok && exclusive {
+		return nil, ErrFileExists
+	}
+
+	if _, ok := fs.buckets[bucket.Name]; !ok {
+		fs.buckets[bucket.Name] = map[string]File{}
+	}
+
+	// Overwrites keep the time the key was first stored.
+	if old, ok := fs.buckets[bucket.Name][key]; ok {
+		f.created = old.Created()
+	}
+
+	fs.buckets[bucket.Name][f.Key()] = f
 
 	return f, nil
 }
 
 // Delete removes the File stored in the given Bucket under key.
 func (fs *MemoryFS) Delete(bucket *Bucket, key string) error {
-	if _, ok := fs.buckets[bucket]; !ok {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, ok := fs.buckets[bucket.Name]; !ok {
 		return nil
 	}
 
-	delete(fs.buckets[bucket], key)
+	delete(fs.buckets[bucket.Name], key)
+	delete(fs.meta[bucket.Name], key)
 
 	return nil
 }
 
+// Versions always returns no versions as replaced Files are not kept.
+func (fs *MemoryFS) Versions(bucket *Bucket, key string) ([]Version, error) {
+	return []Version{}, nil
+}
+
+// OpenVersion always returns ErrFileNotFound as replaced Files are not kept.
+func (fs *MemoryFS) OpenVersion(bucket *Bucket, key, hash string) (File, error) {
+	return nil, ErrFileNotFound
+}
+
+// Restore always returns ErrFileNotFound as deleted Files are not kept.
+func (fs *MemoryFS) Restore(bucket *Bucket, key string) error {
+	return ErrFileNotFound
+}
+
 // Open returns the File stored under the key.
 func (fs *MemoryFS) Open(bucket *Bucket, key string) (File, error) {
-	if _, ok := fs.buckets[bucket]; !ok {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	if _, ok := fs.buckets[bucket.Name]; !ok {
 		return nil, ErrFileNotFound
 	}
 
-	f, ok := fs.buckets[bucket][key]
+	f, ok := fs.buckets[bucket.Name][key]
 	if !ok {
 		return nil, ErrFileNotFound
 	}
@@ -101,38 +331,152 @@ func (fs *MemoryFS) List(
 	limit uint64,
 	sort SortStrategy,
 ) (Files, error) {
-	files := Files{}
+	// files is a copy private to this call and can be sorted without holding
+	// the lock.
+	files := fs.collect(bucket, prefix, ModifiedRange{})
 
-	b, ok := fs.buckets[bucket]
-	if !ok {
-		return files, nil
+	sort.Sort(files)
+
+	if limit < uint64(len(files)) {
+		files = files[:limit]
 	}
 
-	for key, file := range b {
-		if !strings.HasPrefix(key, prefix) {
+	return files, nil
+}
+
+// collect returns the Files of bucket matching prefix and modified.
+func (fs *MemoryFS) collect(bucket *Bucket, prefix string, modified ModifiedRange) Files {
+	files := Files{}
+
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	for key, file := range fs.buckets[bucket.Name] {
+		if !strings.HasPrefix(key, prefix) ||
+			!modified.Contains(file.LastModified()) {
 			continue
 		}
 
 		files = append(files, file)
 	}
 
-	sort.Sort(files)
+	return files
+}
 
-	if limit < uint64(len(files)) {
-		files = files[:limit]
+// Walk calls fn for every File of bucket matching prefix and modified. The
+// Files are collected before, so fn is free to use fs.
+func (fs *MemoryFS) Walk(
+	bucket *Bucket,
+	prefix string,
+	modified ModifiedRange,
+	fn func(File) error,
+) error {
+	for _, f := range fs.collect(bucket, prefix, modified) {
+		err := fn(f)
+		if err != nil {
+			return err
+		}
 	}
 
-	return files, nil
+	return nil
+}
+
+// WalkDir walks the Files of bucket like Walk, reporting the common prefixes
+// of keys continuing with a slash after prefix to dirFn.
+func (fs *MemoryFS) WalkDir(
+	bucket *Bucket,
+	prefix string,
+	modified ModifiedRange,
+	fn func(File) error,
+	dirFn func(string) error,
+) error {
+	return fs.Walk(bucket, prefix, modified, DelimitWalk(prefix, fn, dirFn))
+}
+
+// DelimitWalk returns the function to pass to Walk to walk files like WalkDir.
+// Files whose key continues with a slash after prefix are reported to dirFn as
+// their common prefix the first time it is seen, other files are passed to fn.
+func DelimitWalk(prefix string, fn func(File) error, dirFn func(string) error) func(File) error {
+	seen := map[string]bool{}
+
+	return func(f File) error {
+		rest := strings.TrimPrefix(f.Key(), prefix)
+
+		i := strings.Index(rest, "/")
+		if i < 0 {
+			return fn(f)
+		}
+
+		p := prefix + rest[:i+1]
+		if seen[p] {
+			return nil
+		}
+		seen[p] = true
+
+		return dirFn(p)
+	}
+}
+
+// Usage returns the number of bytes written to the Files of bucket.
+func (fs *MemoryFS) Usage(bucket *Bucket) (uint64, error) {
+	stats, err := fs.Stats(bucket)
+	return stats.Bytes, err
+}
+
+// Stats counts the Files of bucket and the bytes written to them.
+func (fs *MemoryFS) Stats(bucket *Bucket) (BucketStats, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	stats := BucketStats{Files: len(fs.buckets[bucket.Name])}
+
+	for _, file := range fs.buckets[bucket.Name] {
+		if f, ok := file.(*MemoryFile); ok {
+			stats.Bytes += uint64(f.size)
+		}
+	}
+
+	return stats, nil
+}
+
+// Meta returns the Meta stored for the File under key.
+func (fs *MemoryFS) Meta(bucket *Bucket, key string) (Meta, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	return fs.meta[bucket.Name][key], nil
+}
+
+// SetMeta stores meta for the File under key.
+func (fs *MemoryFS) SetMeta(bucket *Bucket, key string, meta Meta) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, ok := fs.buckets[bucket.Name][key]; !ok {
+		return ErrFileNotFound
+	}
+
+	if _, ok := fs.meta[bucket.Name]; !ok {
+		fs.meta[bucket.Name] = map[string]Meta{}
+	}
+
+	fs.meta[bucket.Name][key] = meta
+
+	return nil
 }
 
 // MemoryFile is an in-memory implementation of the File interface meant for use
 // in testing scenarios.
 type MemoryFile struct {
-	buffer *bytes.Buffer
-	hash   hash.Hash
-	index  int64
-	key    string
-	time   time.Time
+	buffer  *bytes.Buffer
+	crc     hash.Hash32
+	created time.Time
+	data    []byte
+	hash    hash.Hash
+	index   int64
+	key     string
+	size    int64
+	time    time.Time
 }
 
 // NewMemoryFile returns a MemoryFile.
@@ -141,12 +485,19 @@ func NewMemoryFile(key string, data []byte) File {
 		data = []byte{}
 	}
 
+	now := time.Now()
+
 	f := &MemoryFile{
-		buffer: bytes.NewBuffer(data),
-		hash:   sha1.New(),
-		key:    key,
-		time:   time.Now(),
+		buffer:  bytes.NewBuffer(data),
+		crc:     crc32.New(CRC32CTable),
+		created: now,
+		data:    append([]byte(nil), data...),
+		hash:    sha1.New(),
+		key:     key,
+		size:    int64(len(data)),
+		time:    now,
 	}
+	f.crc.Write(data)
 
 	return f
 }
@@ -161,6 +512,19 @@ func (f *MemoryFile) Key() string {
 	return f.key
 }
 
+// CRC32C returns the CRC32C checksum of the content.
+func (f *MemoryFile) CRC32C() (uint32, error) {
+	return f.crc.Sum32(), nil
+}
+
+// ETag returns the ETag of the content.
+func (f *MemoryFile) ETag() (string, error) {
+	return FileETag(f, func() []byte {
+		sum := md5.Sum(f.data)
+		return sum[:]
+	})
+}
+
 // Hash returns the
 func (f *MemoryFile) Hash() ([]byte, error) {
 	return f.hash.Sum(nil), nil
@@ -171,6 +535,26 @@ func (f *MemoryFile) Read(b []byte) (int, error) {
 	return f.buffer.Read(b)
 }
 
+// ReadAt reads len(b) bytes of the content starting at off. It reads from a
+// copy of the content as Read consumes the buffer, so it doesn't affect
+// Read and is safe for concurrent use while the File isn't written.
+func (f *MemoryFile) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("MemoryFile.ReadAt: negative offset")
+	}
+
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(b, f.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
 // Seek sets the offset for the next Read or Write on File.
 func (f *MemoryFile) Seek(offset int64, whence int) (int64, error) {
 	var abs int64
@@ -202,7 +586,11 @@ func (f *MemoryFile) Write(b []byte) (int, error) {
 		return n, err
 	}
 
+	f.crc.Write(b)
+	f.data = append(f.data, b...)
+
 	n, err = f.buffer.Write(b)
+	f.size += int64(n)
 	if err != nil {
 		return n, err
 	}
@@ -212,7 +600,17 @@ func (f *MemoryFile) Write(b []byte) (int, error) {
 	return n, nil
 }
 
+// Created returns the time the File was first stored under its key.
+func (f *MemoryFile) Created() time.Time {
+	return f.created
+}
+
 // LastModified returns the time of last modification.
 func (f *MemoryFile) LastModified() time.Time {
 	return f.time
 }
+
+// Size returns the size of the content in bytes.
+func (f *MemoryFile) Size() (int64, error) {
+	return f.size, nil
+}
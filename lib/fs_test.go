@@ -3,10 +3,15 @@ package ent
 import (
 	"crypto/sha1"
 	"encoding/hex"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestMemoryFSCreate(t *testing.T) {
@@ -54,6 +59,100 @@ func TestMemoryFSCreate(t *testing.T) {
 	}
 }
 
+func TestMemoryFileCRC32C(t *testing.T) {
+	var (
+		content = []byte(strings.Repeat("checksum", 1024))
+		f       = NewMemoryFile("crc32c", nil)
+	)
+
+	_, err := f.Write(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum, err := f.CRC32C()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := sum, crc32.Checksum(content, crc32.MakeTable(crc32.Castagnoli)); have != want {
+		t.Errorf("have %08x, want %08x", have, want)
+	}
+}
+
+func TestMemoryFileReadAt(t *testing.T) {
+	var (
+		content = []byte(strings.Repeat("0123456789", 100))
+		f       = NewMemoryFile("readat", nil)
+	)
+
+	_, err := f.Write(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+
+	for off := 0; off < len(content); off += 100 {
+		wg.Add(1)
+
+		go func(off int) {
+			defer wg.Done()
+
+			p := make([]byte, 100)
+
+			_, err := f.ReadAt(p, int64(off))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			if have, want := string(p), string(content[off:off+100]); have != want {
+				t.Errorf("offset %d: have %q, want %q", off, have, want)
+			}
+		}(off)
+	}
+
+	wg.Wait()
+
+	p := make([]byte, 10)
+
+	n, err := f.ReadAt(p, int64(len(content)-5))
+	if have, want := err, io.EOF; have != want {
+		t.Errorf("have %v, want %v", have, want)
+	}
+	if have, want := n, 5; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+}
+
+func TestMemoryFSCreated(t *testing.T) {
+	var (
+		b  = NewBucket("created", Owner{})
+		fs = NewMemoryFS()
+	)
+
+	first, err := fs.Create(b, "created.txt", strings.NewReader("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	second, err := fs.Create(b, "created.txt", strings.NewReader("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := second.Created(), first.Created(); !have.Equal(want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	if !second.LastModified().After(first.LastModified()) {
+		t.Errorf("last modified %v not after %v", second.LastModified(), first.LastModified())
+	}
+}
+
 func TestMemoryFSDelete(t *testing.T) {
 	var (
 		b   = NewBucket("delete", Owner{})
@@ -93,3 +192,184 @@ func TestMemoryFSDelete(t *testing.T) {
 		t.Errorf("have %v, want %v", have, want)
 	}
 }
+
+func TestMemoryFSConcurrentCreateList(t *testing.T) {
+	var (
+		b  = NewBucket("concurrent", Owner{})
+		fs = NewMemoryFS()
+		wg sync.WaitGroup
+	)
+
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+
+		go func(i int) {
+			defer wg.Done()
+
+			_, err := fs.Create(b, fmt.Sprintf("file-%d", i), strings.NewReader("content"))
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+
+		go func() {
+			defer wg.Done()
+
+			_, err := fs.List(b, "file-", DefaultLimit, ByKeyStrategy(true))
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	files, err := fs.List(b, "", DefaultLimit, NoOpStrategy())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := len(files), 10; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+}
+
+func TestMemoryFSWalkModifiedRange(t *testing.T) {
+	var (
+		fs   = NewMemoryFS()
+		b    = NewBucket("modified", Owner{})
+		base = time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+	)
+
+	for i := 0; i < 4; i++ {
+		f, err := fs.Create(b, fmt.Sprintf("file-%d", i), strings.NewReader("content"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f.(*MemoryFile).time = base.Add(time.Duration(i) * time.Hour)
+	}
+
+	files := Files{}
+
+	err := fs.Walk(
+		b,
+		"",
+		ModifiedRange{Since: base.Add(time.Hour), Before: base.Add(3 * time.Hour)},
+		func(f File) error {
+			files = append(files, f)
+			return nil
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ByKeyStrategy(true).Sort(files)
+
+	if have, want := len(files), 2; have != want {
+		t.Fatalf("have %d, want %d", have, want)
+	}
+
+	for i, key := range []string{"file-1", "file-2"} {
+		if have, want := files[i].Key(), key; have != want {
+			t.Errorf("have %s, want %s", have, want)
+		}
+	}
+}
+
+func TestMemoryFSBucketByName(t *testing.T) {
+	var (
+		fs  = NewMemoryFS()
+		key = "by-name"
+	)
+
+	_, err := fs.Create(NewBucket("name", Owner{}), key, strings.NewReader("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := NewBucket("name", Owner{})
+
+	_, err = fs.Open(b, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := fs.List(b, "", DefaultLimit, NoOpStrategy())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := len(files), 1; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+}
+
+func TestNormalizeKey(t *testing.T) {
+	inputs := []struct {
+		key  string
+		want string
+		err  error
+	}{
+		{"a/b", "a/b", nil},
+		{"a//b", "a/b", nil},
+		{"a///b//c.txt", "a/b/c.txt", nil},
+		{"a.b/..c", "a.b/..c", nil},
+		{"", "", ErrInvalidParam},
+		{"a/", "", ErrInvalidParam},
+		{"a//", "", ErrInvalidParam},
+		{"/a", "", ErrInvalidParam},
+		{"./a", "", ErrInvalidParam},
+		{"a/../b", "", ErrInvalidParam},
+		{"a/..", "", ErrInvalidParam},
+	}
+
+	for _, input := range inputs {
+		have, err := NormalizeKey(input.key)
+		if err != input.err {
+			t.Errorf("%q: have %v, want %v", input.key, err, input.err)
+		}
+
+		if have != input.want {
+			t.Errorf("%q: have %q, want %q", input.key, have, input.want)
+		}
+	}
+}
+
+func TestMemoryFSCreateMalformedKey(t *testing.T) {
+	var (
+		b  = NewBucket("keys", Owner{})
+		fs = NewMemoryFS()
+	)
+
+	for _, key := range []string{"", "a/", "a//b", "/a", "./a", "a/../b"} {
+		_, err := fs.Create(b, key, strings.NewReader("content"))
+		if have, want := err, ErrInvalidParam; have != want {
+			t.Errorf("%q: have %v, want %v", key, have, want)
+		}
+	}
+
+	key, err := NormalizeKey("nested//dir///file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = fs.Create(b, key, strings.NewReader("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := fs.List(b, "", DefaultLimit, NoOpStrategy())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := len(files), 1; have != want {
+		t.Fatalf("have %d, want %d", have, want)
+	}
+
+	if have, want := files[0].Key(), "nested/dir/file.txt"; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+}
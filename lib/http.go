@@ -2,6 +2,7 @@ package ent
 
 import (
 	"encoding/json"
+	"encoding/xml"
 	"math"
 	"time"
 )
@@ -10,23 +11,77 @@ import (
 const (
 	DefaultLimit uint64 = math.MaxUint64
 
-	HeaderETag         = "ETag"
-	HeaderLastModified = "Last-Modified"
+	BundleTar = "tar"
+	BundleZip = "zip"
+
+	ContentTypeNDJSON = "application/x-ndjson"
+	ContentTypeTar    = "application/x-tar"
+	ContentTypeZip    = "application/zip"
+
+	FormatJSON = "json"
+	FormatXML  = "xml"
+
+	HeaderBucketFileCount = "X-Ent-Bucket-File-Count"
+	HeaderContentRange    = "Content-Range"
+	HeaderCopySource      = "X-Ent-Copy-Source"
+	HeaderCRC32C          = "X-Ent-CRC32C"
+	HeaderError           = "X-Ent-Error"
+	HeaderETag            = "ETag"
+	HeaderExpires         = "X-Ent-Expires"
+	HeaderIfModifiedSince = "If-Modified-Since"
+	HeaderIfNoneMatch     = "If-None-Match"
+	HeaderLastModified    = "Last-Modified"
+	HeaderMode            = "X-Ent-Mode"
+	HeaderNextMarker      = "X-Ent-Next-Marker"
+	HeaderOwner           = "X-Ent-Owner"
+	HeaderRetainUntil     = "X-Ent-Retain-Until"
+	HeaderSHA1            = "X-Ent-SHA1"
+	HeaderUploadOffset    = "X-Ent-Upload-Offset"
+
+	ModeAppend  = "append"
+	ModeReplace = "replace"
 
 	KeyBucket = ":bucket"
 	KeyBlob   = ":key"
+	KeyHash   = ":hash"
 
 	OrderKey          = "key"
 	OrderLastModified = "lastModified"
 	OrderAscending    = "+"
 	OrderDescending   = "-"
 
-	ParamLimit  = "limit"
-	ParamPrefix = "prefix"
-	ParamSort   = "sort"
+	VerifyMatch    = "match"
+	VerifyMismatch = "mismatch"
+	VerifyRecorded = "recorded"
+
+	ParamAll            = "all"
+	ParamBundle         = "bundle"
+	ParamDelimiter      = "delimiter"
+	ParamEndBefore      = "endBefore"
+	ParamFormat         = "format"
+	ParamLimit          = "limit"
+	ParamMarker         = "marker"
+	ParamMeta           = "meta"
+	ParamModifiedBefore = "modifiedBefore"
+	ParamModifiedSince  = "modifiedSince"
+	ParamPart           = "part"
+	ParamPrefix         = "prefix"
+	ParamRestore        = "restore"
+	ParamRetention      = "retention"
+	ParamSort           = "sort"
+	ParamStartAfter     = "startAfter"
+	ParamStats          = "stats"
+	ParamUploadID       = "uploadId"
+	ParamUploads        = "uploads"
+	ParamVerify         = "verify"
+	ParamVersion        = "version"
+	ParamVersions       = "versions"
 
-	RouteBucket = `/{bucket}`
-	RouteFile   = `/{bucket}/{key:[a-zA-Z0-9\-_\.~\+\/]+}`
+	RouteBucket     = `/{bucket}`
+	RouteFile       = `/{bucket}/{key:[a-zA-Z0-9\-_\.~\+\/]+}`
+	RouteFileByHash = `/{bucket}/_by-hash/{hash:[0-9a-f]{40}}`
+	RouteHealth     = `/_health`
+	RouteReady      = `/_ready`
 
 	timeFormat = time.RFC3339Nano
 )
@@ -38,6 +93,35 @@ type ResponseCreated struct {
 	File     ResponseFile  `json:"file"`
 }
 
+// ResponseUpload is used as the intermediate type to craft a response for the
+// begin of a multipart upload.
+type ResponseUpload struct {
+	Bucket   string `json:"bucket"`
+	Key      string `json:"key"`
+	UploadID string `json:"uploadId"`
+}
+
+// ResponsePart is used as the intermediate type to craft a response for a
+// successful upload of a part.
+type ResponsePart struct {
+	Part int    `json:"part"`
+	SHA1 string `json:"sha1"`
+}
+
+// ResponseUploadOffset is used as the intermediate type to craft a response
+// for a range of a resumable upload which didn't complete it. Offset is the
+// number of bytes received, the upload is resumed from it.
+type ResponseUploadOffset struct {
+	Offset int64 `json:"offset"`
+}
+
+// RequestComplete lists the parts of a multipart upload to concatenate, in
+// ascending order. If SHA1 is set the concatenated content has to match it.
+type RequestComplete struct {
+	Parts []int  `json:"parts"`
+	SHA1  string `json:"sha1,omitempty"`
+}
+
 // ResponseDeleted is used as the intermediate type to craft a response for a
 // successfull file deletion
 type ResponseDeleted struct {
@@ -45,6 +129,22 @@ type ResponseDeleted struct {
 	File     ResponseFile  `json:"file"`
 }
 
+// ResponseBatchDelete is used as the intermediate type to craft a response for
+// the deletion of all files with a prefix. Files which couldn't be deleted are
+// listed in Errors.
+type ResponseBatchDelete struct {
+	Deleted  int                   `json:"deleted"`
+	Failed   int                   `json:"failed"`
+	Errors   []ResponseDeleteError `json:"errors,omitempty"`
+	Duration time.Duration         `json:"duration"`
+}
+
+// ResponseDeleteError describes why the file under Key wasn't deleted.
+type ResponseDeleteError struct {
+	Key   string `json:"key"`
+	Error string `json:"error"`
+}
+
 // ResponseBucketList is used as the intermediate type to craft a response for
 // the retrieval of all buckets.
 type ResponseBucketList struct {
@@ -56,10 +156,93 @@ type ResponseBucketList struct {
 // ResponseFileList is used as the intermediate type to craft a response for
 // the retrieval of all files in a bucket.
 type ResponseFileList struct {
-	Count    int            `json:"count"`
-	Duration time.Duration  `json:"duration"`
-	Bucket   *Bucket        `json:"bucket"`
-	Files    []ResponseFile `json:"files"`
+	Count      int            `json:"count"`
+	Duration   time.Duration  `json:"duration"`
+	Bucket     *Bucket        `json:"bucket"`
+	Files      []ResponseFile `json:"files"`
+	NextMarker string         `json:"nextMarker,omitempty"`
+	// CommonPrefixes lists the common prefixes of the keys below the prefix
+	// of a listing passing a delimiter, in ascending order.
+	CommonPrefixes []string `json:"commonPrefixes,omitempty"`
+}
+
+// ResponseBucketStats is used as the intermediate type to craft a response for
+// the retrieval of the number of files in a bucket and the bytes they take.
+type ResponseBucketStats struct {
+	FileCount  int           `json:"fileCount"`
+	TotalBytes int64         `json:"totalBytes"`
+	Duration   time.Duration `json:"duration"`
+}
+
+// ResponseListBucketResult is used as the intermediate type to craft an S3
+// compatible XML response for the retrieval of all files in a bucket.
+type ResponseListBucketResult struct {
+	XMLName        xml.Name                 `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name           string                   `xml:"Name"`
+	Prefix         string                   `xml:"Prefix"`
+	Marker         string                   `xml:"Marker"`
+	NextMarker     string                   `xml:"NextMarker,omitempty"`
+	MaxKeys        uint64                   `xml:"MaxKeys"`
+	IsTruncated    bool                     `xml:"IsTruncated"`
+	Contents       []ResponseBucketContents `xml:"Contents"`
+	Delimiter      string                   `xml:"Delimiter,omitempty"`
+	CommonPrefixes []ResponseCommonPrefix   `xml:"CommonPrefixes,omitempty"`
+}
+
+// ResponseCommonPrefix describes a common prefix of the keys of a
+// ResponseListBucketResult passing a delimiter.
+type ResponseCommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// ResponseBucketContents describes a single file of a
+// ResponseListBucketResult.
+type ResponseBucketContents struct {
+	Key          string    `xml:"Key"`
+	LastModified time.Time `xml:"LastModified"`
+	ETag         string    `xml:"ETag"`
+	Size         int64     `xml:"Size"`
+}
+
+// ResponseGC is used as the intermediate type to craft a response for the
+// sweep of files left behind by the FileSystem.
+type ResponseGC struct {
+	Pending  int           `json:"pending"`
+	Trash    int           `json:"trash"`
+	Uploads  int           `json:"uploads"`
+	Duration time.Duration `json:"duration"`
+}
+
+// ResponseHealth is used as the intermediate type to craft a response for
+// health and readiness probes.
+type ResponseHealth struct {
+	Status  string `json:"status"`
+	Version string `json:"version,omitempty"`
+}
+
+// ResponseRetention is used as the intermediate type to craft a response for
+// the retrieval of the retention of a file.
+type ResponseRetention struct {
+	Key         string    `json:"key"`
+	RetainUntil time.Time `json:"retainUntil"`
+}
+
+// ResponseVersions is used as the intermediate type to craft a response for
+// the retrieval of the versions of a file.
+type ResponseVersions struct {
+	Key      string    `json:"key"`
+	Versions []Version `json:"versions"`
+}
+
+// ResponseVerify is used as the intermediate type to craft a response for the
+// verification of the content of a file against the hash recorded when it
+// was stored. Hash and Expected are hex encoded SHA1s of the content as
+// stored, Expected is empty if no hash had been recorded before.
+type ResponseVerify struct {
+	Key      string `json:"key"`
+	Status   string `json:"status"`
+	Hash     string `json:"hash"`
+	Expected string `json:"expected,omitempty"`
 }
 
 // ResponseError is used as the intermediate type to craft a response for any
@@ -75,17 +258,37 @@ type ResponseError struct {
 // the retrieval metadata of a File.
 type ResponseFile struct {
 	Key          string
+	Created      time.Time
 	LastModified time.Time
 	Bucket       *Bucket
+	// CRC32C is the hex encoded CRC32C of the content, it is only set in
+	// responses to creates.
+	CRC32C string
+	// Size, Hash and Meta are only set in responses to stats, Size and Hash
+	// in responses to appends as well. Hash is the hex encoded SHA1 of the
+	// content.
+	Size int64
+	Hash string
+	Meta *Meta
 }
 
 // MarshalJSON returns a ResponseFile JSON encoding with conversion of the
 // files SHA1 to hex.
 func (r ResponseFile) MarshalJSON() ([]byte, error) {
+	created := ""
+	if !r.Created.IsZero() {
+		created = r.Created.Format(timeFormat)
+	}
+
 	return json.Marshal(responseFileWrapper{
 		Key:          r.Key,
+		Created:      created,
 		LastModified: r.LastModified.Format(timeFormat),
 		Bucket:       r.Bucket,
+		CRC32C:       r.CRC32C,
+		Size:         r.Size,
+		Hash:         r.Hash,
+		Meta:         r.Meta,
 	})
 }
 
@@ -100,13 +303,28 @@ func (r *ResponseFile) UnmarshalJSON(d []byte) error {
 	}
 
 	r.Key = w.Key
+	if w.Created != "" {
+		r.Created, err = time.Parse(timeFormat, w.Created)
+		if err != nil {
+			return err
+		}
+	}
 	r.LastModified, err = time.Parse(timeFormat, w.LastModified)
 	r.Bucket = w.Bucket
+	r.CRC32C = w.CRC32C
+	r.Size = w.Size
+	r.Hash = w.Hash
+	r.Meta = w.Meta
 	return err
 }
 
 type responseFileWrapper struct {
 	Key          string  `json:"key"`
+	Created      string  `json:"created,omitempty"`
 	LastModified string  `json:"lastModified"`
 	Bucket       *Bucket `json:"bucket"`
+	CRC32C       string  `json:"crc32c,omitempty"`
+	Size         int64   `json:"size,omitempty"`
+	Hash         string  `json:"hash,omitempty"`
+	Meta         *Meta   `json:"meta,omitempty"`
 }
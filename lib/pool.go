@@ -0,0 +1,173 @@
+package ent
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrNoServer is returned by a ClientPool which has no servers configured.
+var ErrNoServer = errors.New("no server available")
+
+// ClientPool provides an interface to interact with several Ent servers.
+// Writes always go to the primary, which is the first server given. Reads are
+// distributed round-robin over all servers which passed the last health check
+// and fail over to the next server on connection errors or 5xx responses.
+type ClientPool struct {
+	clients []*Client
+	next    uint32
+
+	mu      sync.RWMutex
+	healthy []bool
+}
+
+// NewClientPool returns a new ClientPool instance given the addresses of the
+// servers and an http.Client, http.DefaultClient is used if client is not
+// passed. The first address designates the primary.
+func NewClientPool(addrs []string, client *http.Client) *ClientPool {
+	p := &ClientPool{
+		clients: make([]*Client, len(addrs)),
+		healthy: make([]bool, len(addrs)),
+	}
+
+	for i, addr := range addrs {
+		p.clients[i] = New(addr, client)
+		p.healthy[i] = true
+	}
+
+	return p
+}
+
+// Check probes all servers and marks the ones not responding as ineligible
+// for reads until the next Check.
+func (p *ClientPool) Check() {
+	var wg sync.WaitGroup
+
+	for i, c := range p.clients {
+		wg.Add(1)
+
+		go func(i int, c *Client) {
+			defer wg.Done()
+
+			_, err := c.Ping()
+			p.mark(i, err == nil)
+		}(i, c)
+	}
+
+	wg.Wait()
+}
+
+// Create stores or replaces the blob under key with the content of src on the
+// primary server.
+func (p *ClientPool) Create(
+	bucket, key string,
+	src io.Reader,
+) (*ResponseFile, error) {
+	if len(p.clients) == 0 {
+		return nil, newError(ErrClient, ErrNoServer.Error())
+	}
+
+	return p.clients[0].Create(bucket, key, src)
+}
+
+// Get returns the file stored under bucket and key from the first eligible
+// server able to answer.
+func (p *ClientPool) Get(bucket, key string) (io.ReadCloser, error) {
+	var rc io.ReadCloser
+
+	err := p.read(func(c *Client) error {
+		var err error
+		rc, err = c.Get(bucket, key)
+		return err
+	})
+
+	return rc, err
+}
+
+// List returns the list of ResponseFiles for a bucket from the first eligible
+// server able to answer.
+func (p *ClientPool) List(
+	bucket string,
+	opts *ListOptions,
+) ([]ResponseFile, error) {
+	var files []ResponseFile
+
+	err := p.read(func(c *Client) error {
+		var err error
+		files, err = c.List(bucket, opts)
+		return err
+	})
+
+	return files, err
+}
+
+func (p *ClientPool) read(fn func(*Client) error) error {
+	if len(p.clients) == 0 {
+		return newError(ErrClient, ErrNoServer.Error())
+	}
+
+	var (
+		err   error
+		start = int(atomic.AddUint32(&p.next, 1) - 1)
+		order = p.eligible(start)
+	)
+
+	for _, i := range order {
+		err = fn(p.clients[i])
+		if !shouldFailover(err) {
+			return err
+		}
+
+		p.mark(i, false)
+	}
+
+	return err
+}
+
+// eligible returns the indexes of the servers to try in order starting at
+// offset. If no server is considered healthy all of them are returned to give
+// them a chance to recover.
+func (p *ClientPool) eligible(offset int) []int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var (
+		n     = len(p.clients)
+		order = make([]int, 0, n)
+	)
+
+	for j := 0; j < n; j++ {
+		i := (offset + j) % n
+		if p.healthy[i] {
+			order = append(order, i)
+		}
+	}
+
+	if len(order) == 0 {
+		for j := 0; j < n; j++ {
+			order = append(order, (offset+j)%n)
+		}
+	}
+
+	return order
+}
+
+func (p *ClientPool) mark(i int, healthy bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.healthy[i] = healthy
+}
+
+// shouldFailover reports whether the error indicates a server which is
+// unreachable or failing, in which case another server should be tried.
+func shouldFailover(err error) bool {
+	e, ok := err.(*Error)
+	if !ok {
+		return false
+	}
+
+	return e.err == ErrClient && (e.StatusCode == 0 || e.StatusCode >= 500)
+}
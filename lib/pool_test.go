@@ -0,0 +1,118 @@
+package ent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/pat"
+)
+
+func TestClientPoolGetFailover(t *testing.T) {
+	var (
+		body   = "served by the second"
+		bucket = "pool"
+		key    = "failover.log"
+		r      = pat.New()
+	)
+
+	failing := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			respondJSON(w, http.StatusInternalServerError, &ResponseError{
+				Code:  http.StatusInternalServerError,
+				Error: http.StatusText(http.StatusInternalServerError),
+			})
+		}),
+	)
+	defer failing.Close()
+
+	r.Get(RouteFile, func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, key, time.Now(), bytes.NewReader([]byte(body)))
+	})
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	pool := NewClientPool([]string{failing.URL, ts.URL}, nil)
+
+	// Issue more requests than servers to make sure round-robin never ends up on
+	// the failing server without failing over.
+	for i := 0; i < 3; i++ {
+		file, err := pool.Get(bucket, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		raw, err := ioutil.ReadAll(file)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have, want := string(raw), body; have != want {
+			t.Errorf("have %v, want %v", have, want)
+		}
+	}
+}
+
+func TestClientPoolListUnreachable(t *testing.T) {
+	var (
+		bucket = "pool"
+		r      = pat.New()
+	)
+
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	r.Get(RouteBucket, func(w http.ResponseWriter, r *http.Request) {
+		respondJSON(w, http.StatusOK, ResponseFileList{
+			Bucket: NewBucket(bucket, Owner{}),
+			Count:  1,
+			Files:  []ResponseFile{{Key: "listed", LastModified: time.Now()}},
+		})
+	})
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	pool := NewClientPool([]string{unreachable.URL, ts.URL}, nil)
+
+	files, err := pool.List(bucket, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := len(files), 1; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+}
+
+func TestClientPoolGetNotFound(t *testing.T) {
+	var calls int
+
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			respondJSON(w, http.StatusNotFound, &ResponseError{
+				Code:  http.StatusNotFound,
+				Error: ErrFileNotFound.Error(),
+			})
+		}),
+	)
+	defer ts.Close()
+
+	pool := NewClientPool([]string{ts.URL, ts.URL}, nil)
+
+	_, err := pool.Get("pool", "missing")
+	if have, want := err, ErrClient; !IsClient(err) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	// A 4xx is a valid answer and must not be retried on another server.
+	if have, want := calls, 1; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+}
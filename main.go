@@ -1,17 +1,30 @@
 package main
 
 import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"flag"
 	"io"
 	logpkg "log"
+	"net"
 	"net/http"
+	"net/mail"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/gorilla/pat"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/soundcloud/ent/lib"
@@ -29,9 +42,30 @@ var (
 var (
 	labelNames = []string{"bucket", "method", "operation", "status"}
 
+	requestDurations        *prometheus.SummaryVec
+	requestDurationsSeconds *prometheus.HistogramVec
+	requestBytes            *prometheus.CounterVec
+	responseBytes           *prometheus.CounterVec
+	inflightRequests        *prometheus.GaugeVec
+	bucketBytes             *prometheus.GaugeVec
+
+	log = logpkg.New(os.Stdout, "", logpkg.LstdFlags|logpkg.Lmicroseconds)
+)
+
+func init() {
+	setupMetrics(Program, "")
+}
+
+// setupMetrics creates the metrics with names prefixed by namespace and
+// subsystem, it has to be called before they are registered.
+func setupMetrics(namespace, subsystem string) {
+	// Deprecated: The summary can't be aggregated across instances, use the
+	// histogram 'requestDurationsSeconds' instead. It will be removed in the
+	// next release.
 	requestDurations = prometheus.NewSummaryVec(
 		prometheus.SummaryOpts{
-			Namespace: Program,
+			Namespace: namespace,
+			Subsystem: subsystem,
 			Name:      "requests_duration_nanoseconds",
 			Help:      "Amounts of time ent has spent answering requests in nanoseconds.",
 		},
@@ -42,9 +76,20 @@ var (
 	// 'ent_requests_duration_nanoseconds_sum', counting the total number of
 	// requests made and summing up the total amount of time ent has spent
 	// to answer requests, respectively.
+	requestDurationsSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "request_duration_seconds",
+			Help:      "Amounts of time ent has spent answering requests in seconds.",
+			Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+		},
+		labelNames,
+	)
 	requestBytes = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Namespace: Program,
+			Namespace: namespace,
+			Subsystem: subsystem,
 			Name:      "request_bytes_total",
 			Help:      "Total volume of request payloads emitted in bytes.",
 		},
@@ -52,50 +97,477 @@ var (
 	)
 	responseBytes = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Namespace: Program,
+			Namespace: namespace,
+			Subsystem: subsystem,
 			Name:      "response_bytes_total",
 			Help:      "Total volume of response payloads emitted in bytes.",
 		},
 		labelNames,
 	)
 
-	log = logpkg.New(os.Stdout, "", logpkg.LstdFlags|logpkg.Lmicroseconds)
-)
+	inflightRequests = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "inflight_requests",
+			Help:      "Number of requests currently being answered.",
+		},
+		[]string{"operation"},
+	)
+	bucketBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "bucket_bytes",
+			Help:      "Volume of the files stored in a bucket in bytes.",
+		},
+		[]string{"bucket"},
+	)
+}
 
 func main() {
 	var (
-		fsRoot      = flag.String("fs.root", "/tmp", "FileSystem root directory")
-		httpAddress = flag.String("http.addr", ":5555", "HTTP listen address")
-		providerDir = flag.String("provider.dir", "/tmp", "Provider directory with bucket policies")
+		adminOwners  = flag.String("admin.owners", "", "Comma-separated list of owners allowed to call /_gc and /_reload, they are answered with 403 if empty")
+		corsExpose   = flag.String("cors.expose", strings.Join(corsExposeHeaders, ", "), "Comma-separated list of response headers exposed to cross-origin requests")
+		corsHeaders  = flag.String("cors.headers", strings.Join(corsRequestHeaders, ", "), "Comma-separated list of request headers allowed in cross-origin requests")
+		corsMethods  = flag.String("cors.methods", "GET, HEAD, POST, PUT, DELETE", "Comma-separated list of methods allowed in cross-origin requests")
+		corsOrigins  = flag.String("cors.origins", "", "Comma-separated list of origins allowed to make cross-origin requests, all origins are allowed if empty")
+		encKey       = flag.String("encryption.key", "", "Hex encoded 32 byte key files are encrypted at rest with (AES-256-GCM), encryption is disabled if empty")
+		encKeyFile   = flag.String("encryption.key-file", "", "File holding the hex encoded encryption key, takes precedence over -encryption.key")
+		etagMode     = flag.String("etag.style", ent.ETagSHA1, "ETag of files (sha1, md5-quoted)")
+		fsBackend    = flag.String("fs.backend", "disk", "FileSystem backend (disk, bolt)")
+		fsDB         = flag.String("fs.db", "/tmp/ent.db", "FileSystem database file for the bolt backend")
+		fsDirect     = flag.Bool("fs.direct-write", false, "Write files in place instead of renaming a temporary file, readers may see partial content (disk backend)")
+		fsFsync      = flag.Bool("fs.fsync", true, "Sync stored files and their directory to disk before answering (disk backend)")
+		fsIgnore     = flag.String("fs.ignore", "", "Comma-separated list of patterns of file names excluded from listings in addition to the bookkeeping files (disk backend)")
+		fsLazyHash   = flag.Bool("fs.lazy-hash", false, "Hash files when their hash is first needed instead of while writing them, which reads them again (disk backend)")
+		fsListMode   = flag.String("fs.list-mode", listModeReadDir, "How listings passing a delimiter find the files directly below their prefix (readdir, walk), readdir only reads the directory of the prefix (disk backend)")
+		fsMaxKey     = flag.Int("fs.max-key-len", maxKeyLen, "Maximum length of keys in bytes, 0 disables the limit")
+		fsMaxSegment = flag.Int("fs.max-segment-len", maxSegmentLen, "Maximum length in bytes of the segments of keys between slashes, 0 disables the limit")
+		fsPrune      = flag.Bool("fs.prune", false, "Remove directories left empty after deleting files (disk backend)")
+		fsRoot       = flag.String("fs.root", "/tmp", "FileSystem root directory")
+		fsShard      = flag.Bool("fs.shard", false, "Store files in directories derived from the SHA1 of their key, bucket/ab/cd/key, files stored with the other layout are not found (disk backend)")
+		fsTmp        = flag.String("fs.tmp", "", "Directory files are written to before they are moved in place, the directory of their bucket if empty (disk backend)")
+		gcPending    = flag.Duration("gc.pending-age", 24*time.Hour, "Age after which POST /_gc removes the temporary files of interrupted writes (disk backend)")
+		gcUploads    = flag.Duration("gc.upload-age", 7*24*time.Hour, "Age after which POST /_gc removes multipart and resumable uploads which received no content")
+		httpAddress  = flag.String("http.addr", ":5555", "HTTP listen address")
+		httpDrain    = flag.Duration("http.shutdown-timeout", 30*time.Second, "Time in-flight requests are given to complete on shutdown")
+		httpHeader   = flag.Duration("http.read-header-timeout", 10*time.Second, "Time allowed to read request headers")
+		httpIdle     = flag.Duration("http.idle-timeout", 2*time.Minute, "Time keep-alive connections are kept open between requests")
+		httpUnix     = flag.String("http.unix", "", "Path of a Unix domain socket to listen on as well, a stale socket left there is replaced; pass an empty -http.addr to only listen on the socket")
+		httpWrite    = flag.Duration("http.write-timeout", 0, "Time allowed to write a response, 0 disables the timeout")
+		ioBuffer     = flag.Int("io.buffer-bytes", bufferSize, "Size in bytes of the buffers content is copied with when storing and compressing files")
+		listSort     = flag.String("list.default-sort", "", "Sort of listings passing no sort parameter (+key, -key, +lastModified, -lastModified), the order is undefined if empty")
+		logFile      = flag.String("log.file", "", "File the access log is appended to, stdout if empty")
+		logFormat    = flag.String("log.format", "report", "Access log format (report, json)")
+		metricsLabel = flag.String("metrics.bucket-label", bucketLabelAll, "Buckets recorded in the bucket label of metrics (all, known), with known requests for buckets missing from the Provider are recorded as "+unknownBucketLabel)
+		metricsNS    = flag.String("metrics.namespace", Program, "Namespace the names of metrics are prefixed with")
+		metricsSub   = flag.String("metrics.subsystem", "", "Subsystem the names of metrics are prefixed with after the namespace")
+		usageEvery   = flag.Duration("metrics.usage-interval", time.Minute, "Interval in which the storage usage of buckets is measured, 0 disables measuring it")
+		multipartDir = flag.String("multipart.dir", "/tmp/ent-multipart", "Directory parts of multipart uploads and ranges of resumable uploads are staged in")
+		providerKind = flag.String("provider.backend", "disk", "Comma-separated list of Providers of bucket policies tried in order (disk, env, http), env reads them from "+envBuckets)
+		providerDir  = flag.String("provider.dir", "/tmp", "Provider directory with bucket policies")
+		providerTTL  = flag.Duration("provider.ttl", time.Minute, "Time buckets fetched from the control plane are cached (http provider)")
+		providerURL  = flag.String("provider.url", "", "URL of the control plane listing buckets under /buckets (http provider)")
+		providerTest = flag.Bool("provider.validate", false, "Load the bucket policies, report the invalid ones and exit without serving")
+		reapEvery    = flag.Duration("reaper.interval", time.Minute, "Interval in which expired files are deleted, 0 disables the reaper")
+		respCompress = flag.Bool("response.compress", false, "Compress blobs sent to clients accepting gzip or zstd, the responses carry no Content-Length and an ETag of their own")
+		respHash     = flag.Bool("response.hash", true, "Send the ETag and CRC32C of stored files in responses to writes, computing them may read the files back")
+		selfTestRun  = flag.Bool("selftest", false, "Verify the FileSystem with a canary file before serving")
+		tlsCert      = flag.String("tls.cert", "", "Certificate file to serve HTTPS with, requires -tls.key")
+		tlsClientCA  = flag.String("tls.client-ca", "", "CA file client certificates are required to be signed by (HTTPS only)")
+		tlsKey       = flag.String("tls.key", "", "Key file of the certificate to serve HTTPS with, requires -tls.cert")
+		trashOn      = flag.Bool("trash.enabled", false, "Move deleted files to a trash they can be restored from (disk backend)")
+		trashKeep    = flag.Duration("trash.retention", 7*24*time.Hour, "Time deleted files are kept in the trash before the reaper purges them")
+		versionsOn   = flag.Bool("versioning.enabled", false, "Keep replaced and deleted content as versions of files (disk backend)")
 	)
 	flag.Parse()
 
+	if *providerTest {
+		err := (&diskProvider{dir: *providerDir}).Validate()
+		if err != nil {
+			log.Fatalf("invalid policies:\n%s", err)
+		}
+
+		log.Printf("policies in %s are valid", *providerDir)
+		return
+	}
+
+	cors := corsConfig{
+		origins: splitList(*corsOrigins),
+		methods: splitList(*corsMethods),
+		headers: splitList(*corsHeaders),
+		expose:  splitList(*corsExpose),
+	}
+
+	switch *etagMode {
+	case ent.ETagSHA1, ent.ETagMD5Quoted:
+		ent.ETagStyle = *etagMode
+	default:
+		log.Fatalf("unknown ETag style %q", *etagMode)
+	}
+
+	responseHash = *respHash
+	compressResponses = *respCompress
+
+	_, err := createSortStrategy(*listSort)
+	if err != nil {
+		log.Fatalf("invalid default sort %q", *listSort)
+	}
+	defaultSort = *listSort
+
+	switch *metricsLabel {
+	case bucketLabelAll, bucketLabelKnown:
+	default:
+		log.Fatalf("unknown bucket label mode %q", *metricsLabel)
+	}
+
+	setupMetrics(*metricsNS, *metricsSub)
+
+	maxKeyLen = *fsMaxKey
+	maxSegmentLen = *fsMaxSegment
+
+	if *ioBuffer <= 0 {
+		log.Fatalf("buffer size must be positive, got %d", *ioBuffer)
+	}
+	bufferSize = *ioBuffer
+
 	prometheus.MustRegister(requestDurations)
+	prometheus.MustRegister(requestDurationsSeconds)
 	prometheus.MustRegister(requestBytes)
 	prometheus.MustRegister(responseBytes)
+	prometheus.MustRegister(inflightRequests)
+	prometheus.MustRegister(bucketBytes)
+
+	var backend ent.FileSystem
+
+	defer closeExitClosers()
+
+	switch *fsBackend {
+	case "disk":
+		if *fsTmp != "" {
+			err := os.MkdirAll(*fsTmp, 0755)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		switch *fsListMode {
+		case listModeReadDir, listModeWalk:
+		default:
+			log.Fatalf("unknown list mode %q", *fsListMode)
+		}
+
+		ignore := splitList(*fsIgnore)
+		for _, pattern := range ignore {
+			_, err := filepath.Match(pattern, "")
+			if err != nil {
+				log.Fatalf("invalid ignore pattern %q: %s", pattern, err)
+			}
+		}
+
+		backend = newDiskFS(
+			*fsRoot,
+			withIgnore(ignore),
+			withTempDir(*fsTmp),
+			withDirectWrite(*fsDirect),
+			withFsync(*fsFsync),
+			withLazyHash(*fsLazyHash),
+			withListMode(*fsListMode),
+			withPruneDirs(*fsPrune),
+			withSharding(*fsShard),
+			withTrash(*trashOn),
+			withVersioning(*versionsOn),
+		)
+	case "bolt":
+		bfs, err := newBoltFS(*fsDB)
+		if err != nil {
+			fatal(err)
+		}
+		closeOnExit(bfs)
+
+		backend = bfs
+	default:
+		fatalf("unknown FileSystem backend %q", *fsBackend)
+	}
+
+	stored := backend
+	if *encKey != "" || *encKeyFile != "" {
+		key, err := loadEncryptionKey(*encKey, *encKeyFile)
+		if err != nil {
+			fatal(err)
+		}
+
+		stored, err = newEncryptedFS(backend, key)
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	fs := newHashIndexFS(newCompressFS(stored))
+
+	if *selfTestRun {
+		purger, _ := backend.(bucketPurger)
+		steps, err := selfTest(fs, purger)
+		for _, step := range steps {
+			log.Printf(
+				"selftest step=%s duration=%s error=%v",
+				step.Name,
+				step.Duration,
+				step.Err,
+			)
+		}
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	p, err := newProvider(splitList(*providerKind), providerConfig{
+		dir: *providerDir,
+		url: *providerURL,
+		ttl: *providerTTL,
+	})
+	if err != nil {
+		fatal(err)
+	}
+
+	if *metricsLabel == bucketLabelKnown {
+		bucketLabels = p
+	}
+
+	if *usageEvery > 0 {
+		go reportUsage(p, fs, *usageEvery)
+	}
+
+	if *reapEvery > 0 {
+		trash, _ := backend.(trashPurger)
+		go runReaper(p, fs, trash, *trashKeep, *reapEvery)
+	}
+
+	mfs := newMultipartFS(fs, *multipartDir)
+
+	out := io.Writer(os.Stdout)
+	if *logFile != "" {
+		f, err := os.OpenFile(*logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			fatal(err)
+		}
+		closeOnExit(f)
+
+		out = f
+	}
+
+	var instrument func(op string, next http.Handler) http.Handler
+
+	switch *logFormat {
+	case "report":
+		instrument = func(op string, next http.Handler) http.Handler {
+			return report.JSON(out, metrics(op, next))
+		}
+	case "json":
+		accessLog := newAccessLog(out)
+		instrument = func(op string, next http.Handler) http.Handler {
+			return logRequest(accessLog, op, next)
+		}
+	default:
+		fatalf("unknown log format %q", *logFormat)
+	}
+
+	r := newRouter(routerConfig{
+		provider:       p,
+		backend:        backend,
+		fs:             fs,
+		mfs:            mfs,
+		cors:           cors,
+		admins:         splitList(*adminOwners),
+		instrument:     instrument,
+		pendingAge:     *gcPending,
+		uploadAge:      *gcUploads,
+		trashRetention: *trashKeep,
+	})
+
+	var tlsConfig *tls.Config
+
+	switch {
+	case *tlsCert != "" && *tlsKey != "":
+		tlsConfig, err = newTLSConfig(*tlsCert, *tlsKey, *tlsClientCA)
+		if err != nil {
+			fatal(err)
+		}
+	case *tlsCert != "" || *tlsKey != "" || *tlsClientCA != "":
+		fatal("-tls.cert and -tls.key are both required to serve HTTPS")
+	}
 
 	var (
-		fs = newDiskFS(*fsRoot)
-		r  = pat.New()
+		listeners = []net.Listener{}
+		addresses = []string{}
 	)
 
-	p, err := newDiskProvider(*providerDir)
+	if *httpAddress != "" {
+		l, err := net.Listen("tcp", *httpAddress)
+		if err != nil {
+			fatal(err)
+		}
+
+		if tlsConfig != nil {
+			l = tls.NewListener(l, tlsConfig)
+		}
+
+		listeners = append(listeners, l)
+		addresses = append(addresses, *httpAddress)
+	}
+
+	// Processes colocated with ent reach it through the socket, which is
+	// served without TLS.
+	if *httpUnix != "" {
+		l, err := listenUnix(*httpUnix)
+		if err != nil {
+			fatal(err)
+		}
+
+		listeners = append(listeners, l)
+		addresses = append(addresses, "unix:"+*httpUnix)
+	}
+
+	if len(listeners) == 0 {
+		fatal("-http.addr or -http.unix is required")
+	}
+
+	srv := &http.Server{
+		Handler:           r,
+		ReadHeaderTimeout: *httpHeader,
+		WriteTimeout:      *httpWrite,
+		IdleTimeout:       *httpIdle,
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	log.Printf("ent %s listening on %s", Version, strings.Join(addresses, ", "))
+
+	err = serve(srv, listeners, stop, *httpDrain)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
+}
+
+// routerConfig holds what the routes of the server are served from.
+type routerConfig struct {
+	provider ent.Provider
+	// backend is the FileSystem files are stored in, which may sweep and
+	// check its readiness.
+	backend ent.FileSystem
+	fs      *hashIndexFS
+	mfs     *multipartFS
+
+	cors       corsConfig
+	admins     []string
+	instrument func(op string, next http.Handler) http.Handler
+
+	pendingAge     time.Duration
+	uploadAge      time.Duration
+	trashRetention time.Duration
+}
+
+// newRouter returns the router serving every route of the server.
+func newRouter(c routerConfig) *pat.Router {
+	var (
+		r          = pat.New()
+		p          = c.provider
+		backend    = c.backend
+		fs         = c.fs
+		mfs        = c.mfs
+		cors       = c.cors
+		admins     = c.admins
+		instrument = c.instrument
+	)
+
+	// Routes match paths by prefix and GET / matches every path, requests
+	// only fail to be routed if no route accepts their method.
+	r.MethodNotAllowedHandler = instrument("handleMethodNotAllowed", handleMethodNotAllowed(r))
 
 	// GET /metrics
 	r.Handle("/metrics", prometheus.Handler())
 
+	// Maintenance endpoints act on all buckets and are reserved to admins.
+	// POST /_reload
+	if rp, ok := p.(reloadProvider); ok {
+		r.Add(
+			"POST",
+			"/_reload",
+			instrument(
+				"handleReload",
+				adminOnly(admins, handleReload(rp)),
+			),
+		)
+	}
+
+	// POST /_gc
+	s, _ := backend.(sweeper)
+	r.Add(
+		"POST",
+		"/_gc",
+		instrument(
+			"handleGC",
+			adminOnly(admins, handleGC(s, mfs, c.pendingAge, c.uploadAge, c.trashRetention)),
+		),
+	)
+
+	// GET /_health
+	r.Add(
+		"GET",
+		ent.RouteHealth,
+		instrument(
+			"handleHealth",
+			handleHealth(),
+		),
+	)
+
+	// GET /_ready
+	checks := []readinessChecker{}
+	if c, ok := p.(readinessChecker); ok {
+		checks = append(checks, c)
+	}
+	if c, ok := backend.(readinessChecker); ok {
+		checks = append(checks, c)
+	}
+
+	r.Add(
+		"GET",
+		ent.RouteReady,
+		instrument(
+			"handleReady",
+			handleReady(checks...),
+		),
+	)
+
 	// DELETE /$bucket/$file
 	r.Add(
 		"DELETE",
 		ent.RouteFile,
-		report.JSON(
-			os.Stdout,
-			metrics(
-				"handleDelete",
-				handleDelete(p, fs),
+		instrument(
+			"handleDelete",
+			addCORSHeaders(
+				cors,
+				authorize(
+					p,
+					normalizeKey(handleRemove(p, mfs)),
+				),
+			),
+		),
+	)
+	// GET /$bucket/_by-hash/$hash
+	r.Add(
+		"GET",
+		ent.RouteFileByHash,
+		instrument(
+			"handleGetByHash",
+			addCORSHeaders(
+				cors,
+				authorize(
+					p,
+					handleGetByHash(p, fs),
+				),
 			),
 		),
 	)
@@ -103,12 +575,13 @@ func main() {
 	r.Add(
 		"GET",
 		ent.RouteFile,
-		report.JSON(
-			os.Stdout,
-			metrics(
-				"handleGet",
-				addCORSHeaders(
-					handleGet(p, fs),
+		instrument(
+			"handleGet",
+			addCORSHeaders(
+				cors,
+				authorize(
+					p,
+					normalizeKey(handleGet(p, fs)),
 				),
 			),
 		),
@@ -117,303 +590,1992 @@ func main() {
 	r.Add(
 		"HEAD",
 		ent.RouteFile,
-		report.JSON(
-			os.Stdout,
-			metrics(
-				"handleExists",
-				handleExists(p, fs),
+		instrument(
+			"handleExists",
+			addCORSHeaders(
+				cors,
+				authorize(
+					p,
+					normalizeKey(handleExists(p, fs)),
+				),
 			),
 		),
 	)
 	// POST /$bucket/$file
-	r.Add(
-		"POST",
-		ent.RouteFile,
-		report.JSON(
-			os.Stdout,
-			metrics(
+	// PUT /$bucket/$file
+	for _, method := range []string{"POST", "PUT"} {
+		r.Add(
+			method,
+			ent.RouteFile,
+			instrument(
 				"handleCreate",
 				addCORSHeaders(
-					handleCreate(p, fs),
+					cors,
+					authorize(
+						p,
+						normalizeKey(handleUpload(p, mfs)),
+					),
 				),
 			),
-		),
-	)
+		)
+	}
 
 	// GET /$bucket
 	r.Add(
 		"GET",
 		ent.RouteBucket,
-		report.JSON(
-			os.Stdout,
-			metrics(
-				"handleFileList",
-				addCORSHeaders(
+		instrument(
+			"handleFileList",
+			addCORSHeaders(
+				cors,
+				authorize(
+					p,
 					handleFileList(p, fs),
 				),
 			),
 		),
 	)
 
+	// POST /$bucket
+	r.Add(
+		"POST",
+		ent.RouteBucket,
+		instrument(
+			"handleVerifyBucket",
+			authorize(
+				p,
+				handleVerifyBucket(p, fs),
+			),
+		),
+	)
+
+	// DELETE /$bucket
+	r.Add(
+		"DELETE",
+		ent.RouteBucket,
+		instrument(
+			"handleDeletePrefix",
+			addCORSHeaders(
+				cors,
+				authorize(
+					p,
+					handleDeletePrefix(p, fs),
+				),
+			),
+		),
+	)
+
+	// HEAD /$bucket
+	r.Add(
+		"HEAD",
+		ent.RouteBucket,
+		instrument(
+			"handleBucketExists",
+			addCORSHeaders(
+				cors,
+				authorize(
+					p,
+					handleBucketExists(p, fs),
+				),
+			),
+		),
+	)
+
 	// GET /
 	r.Add(
 		"GET",
 		"/",
-		report.JSON(
-			os.Stdout,
-			metrics(
-				"handleBucketList",
-				addCORSHeaders(
-					handleBucketList(p),
-				),
+		instrument(
+			"handleBucketList",
+			addCORSHeaders(
+				cors,
+				handleBucketList(p),
 			),
 		),
 	)
 
-	r.Add(
-		"OPTIONS",
-		"/{.*}",
-		report.JSON(
-			os.Stdout,
-			metrics(
+	// OPTIONS /$bucket/$file
+	// OPTIONS /$bucket
+	// OPTIONS /
+	for _, route := range []struct {
+		pattern string
+		methods []string
+	}{
+		{ent.RouteFile, []string{"GET", "HEAD", "POST", "PUT", "DELETE"}},
+		{ent.RouteBucket, []string{"GET", "HEAD", "POST", "DELETE"}},
+		{"/", []string{"GET"}},
+	} {
+		r.Add(
+			"OPTIONS",
+			route.pattern,
+			instrument(
 				"handleOptions",
 				addCORSHeaders(
-					handleOptions(),
+					cors,
+					handleOptions(p, route.methods...),
 				),
 			),
-		),
-	)
+		)
+	}
 
-	log.Printf("ent %s listening on %s", Version, *httpAddress)
-	log.Fatal(http.ListenAndServe(*httpAddress, http.Handler(r)))
+	return r
 }
 
-func handleCreate(p ent.Provider, fs ent.FileSystem) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		var (
-			bucket = r.URL.Query().Get(ent.KeyBucket)
-			key    = r.URL.Query().Get(ent.KeyBlob)
-			start  = time.Now()
-		)
-		defer r.Body.Close()
+// exitClosers are closed before the process exits, see closeOnExit.
+var exitClosers []io.Closer
+
+// closeOnExit has c closed before the process exits, both when main returns
+// and when it exits through fatal, which skips deferred calls.
+func closeOnExit(c io.Closer) {
+	exitClosers = append(exitClosers, c)
+}
 
-		b, err := p.Get(bucket)
+// closeExitClosers closes the exitClosers in reverse order.
+func closeExitClosers() {
+	for i := len(exitClosers) - 1; i >= 0; i-- {
+		err := exitClosers[i].Close()
 		if err != nil {
-			respondError(w, r, err)
+			log.Printf("ERROR closing on exit: %s", err)
+		}
+	}
+
+	exitClosers = nil
+}
+
+// fatal is log.Fatal closing the exitClosers first.
+func fatal(v ...interface{}) {
+	closeExitClosers()
+	log.Fatal(v...)
+}
+
+// fatalf is log.Fatalf closing the exitClosers first.
+func fatalf(format string, v ...interface{}) {
+	closeExitClosers()
+	log.Fatalf(format, v...)
+}
+
+// serve runs srv on every listener of ls until a signal is received on stop.
+// New connections are refused from then on while in-flight requests are given
+// up to drain to complete.
+func serve(
+	srv *http.Server,
+	ls []net.Listener,
+	stop <-chan os.Signal,
+	drain time.Duration,
+) error {
+	errc := make(chan error, len(ls))
+
+	for _, l := range ls {
+		go func(l net.Listener) {
+			errc <- srv.Serve(l)
+		}(l)
+	}
+
+	select {
+	case err := <-errc:
+		return err
+	case sig := <-stop:
+		log.Printf("received %s, shutting down", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+
+	return srv.Shutdown(ctx)
+}
+
+// handleUpload answers creates of files in a single request as well as the
+// steps of multipart uploads, which are told apart by their params.
+func handleUpload(p ent.Provider, fs *multipartFS) http.HandlerFunc {
+	var (
+		create   = handleCreate(p, fs)
+		begin    = handleCreateMultipart(p, fs)
+		part     = handlePutPart(p, fs)
+		complete = handleCompleteMultipart(p, fs)
+		putRange = handlePutRange(p, fs)
+		restore  = handleRestore(p, fs)
+		copyFile = handleCopy(p, fs)
+		verify   = handleVerify(p, fs)
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+
+		if _, ok := q[ent.ParamUploads]; ok {
+			begin(w, r)
 			return
 		}
 
-		f, err := fs.Create(b, key, r.Body)
-		if err != nil {
-			respondError(w, r, err)
+		if _, ok := q[ent.ParamRestore]; ok {
+			restore(w, r)
 			return
 		}
-		defer f.Close()
 
-		err = writeBlobHeaders(w, f)
-		if err != nil {
-			respondError(w, r, err)
+		if _, ok := q[ent.ParamVerify]; ok {
+			verify(w, r)
 			return
 		}
-		respondJSON(w, http.StatusCreated, ent.ResponseCreated{
-			Duration: time.Since(start),
-			File: ent.ResponseFile{
-				Key:          key,
-				Bucket:       b,
-				LastModified: f.LastModified(),
-			},
-		})
+
+		if r.Header.Get(ent.HeaderCopySource) != "" {
+			copyFile(w, r)
+			return
+		}
+
+		switch {
+		case q.Get(ent.ParamUploadID) != "" && q.Get(ent.ParamPart) != "":
+			part(w, r)
+		case q.Get(ent.ParamUploadID) != "":
+			complete(w, r)
+		case r.Header.Get(ent.HeaderContentRange) != "":
+			putRange(w, r)
+		default:
+			create(w, r)
+		}
 	}
 }
 
-func handleDelete(p ent.Provider, fs ent.FileSystem) http.HandlerFunc {
+// handleRemove answers deletes of files as well as aborts of multipart
+// uploads, which pass the id of the upload.
+func handleRemove(p ent.Provider, fs *multipartFS) http.HandlerFunc {
+	var (
+		remove = handleDelete(p, fs)
+		abort  = handleAbortMultipart(p, fs)
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get(ent.ParamUploadID) != "" {
+			abort(w, r)
+			return
+		}
+
+		remove(w, r)
+	}
+}
+
+func handleCreateMultipart(p ent.Provider, fs *multipartFS) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var (
 			bucket = r.URL.Query().Get(ent.KeyBucket)
 			key    = r.URL.Query().Get(ent.KeyBlob)
-			start  = time.Now()
 		)
 		defer r.Body.Close()
 
-		b, err := p.Get(bucket)
+		b, err := getBucket(p, bucket)
 		if err != nil {
 			respondError(w, r, err)
 			return
 		}
 
-		f, err := fs.Open(b, key)
-		if err != nil {
+		if b.ReadOnly {
+			respondError(w, r, ent.ErrBucketReadOnly)
+			return
+		}
+
+		if !b.AllowsKey(key) {
+			respondError(w, r, ent.ErrKeyNotAllowed)
+			return
+		}
+
+		id, err := fs.CreateMultipart(b, key)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		respondJSON(w, http.StatusOK, ent.ResponseUpload{
+			Bucket:   b.Name,
+			Key:      key,
+			UploadID: id,
+		})
+	}
+}
+
+func handlePutPart(p ent.Provider, fs *multipartFS) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			bucket = r.URL.Query().Get(ent.KeyBucket)
+			key    = r.URL.Query().Get(ent.KeyBlob)
+			id     = r.URL.Query().Get(ent.ParamUploadID)
+		)
+		defer r.Body.Close()
+
+		b, err := getBucket(p, bucket)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		n, err := strconv.Atoi(r.URL.Query().Get(ent.ParamPart))
+		if err != nil {
+			respondError(w, r, ent.ErrInvalidParam)
+			return
+		}
+
+		h, err := fs.PutPart(b, key, id, n, r.Body)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		w.Header().Set(ent.HeaderETag, hex.EncodeToString(h))
+		respondJSON(w, http.StatusOK, ent.ResponsePart{
+			Part: n,
+			SHA1: hex.EncodeToString(h),
+		})
+	}
+}
+
+func handleCompleteMultipart(p ent.Provider, fs *multipartFS) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			bucket = r.URL.Query().Get(ent.KeyBucket)
+			key    = r.URL.Query().Get(ent.KeyBlob)
+			id     = r.URL.Query().Get(ent.ParamUploadID)
+			start  = time.Now()
+		)
+		defer r.Body.Close()
+
+		b, err := getBucket(p, bucket)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		if b.ReadOnly {
+			respondError(w, r, ent.ErrBucketReadOnly)
+			return
+		}
+
+		req := ent.RequestComplete{}
+
+		err = json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			respondError(w, r, ent.ErrInvalidParam)
+			return
+		}
+
+		err = checkRetention(fs, b, key)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		f, err := fs.CompleteMultipart(b, key, id, req.Parts, req.SHA1)
+		if err != nil {
 			respondError(w, r, err)
 			return
 		}
 		defer f.Close()
 
-		err = fs.Delete(b, key)
+		// An expiry recorded for previous content doesn't apply to the new one.
+		err = setExpires(fs, b, key, time.Time{})
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		err = writeCreatedHeaders(w, f)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+		respondJSON(w, http.StatusCreated, ent.ResponseCreated{
+			Duration: time.Since(start),
+			File: ent.ResponseFile{
+				Key:          key,
+				Bucket:       b,
+				Created:      f.Created(),
+				LastModified: f.LastModified(),
+				CRC32C:       w.Header().Get(ent.HeaderCRC32C),
+			},
+		})
+	}
+}
+
+func handleAbortMultipart(p ent.Provider, fs *multipartFS) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			bucket = r.URL.Query().Get(ent.KeyBucket)
+			key    = r.URL.Query().Get(ent.KeyBlob)
+			id     = r.URL.Query().Get(ent.ParamUploadID)
+		)
+		defer r.Body.Close()
+
+		b, err := getBucket(p, bucket)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		err = fs.AbortMultipart(b, key, id)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		respondJSON(w, http.StatusOK, ent.ResponseUpload{
+			Bucket:   b.Name,
+			Key:      key,
+			UploadID: id,
+		})
+	}
+}
+
+// handlePutRange answers ranges of resumable uploads sent with Content-Range.
+// Every response carries the number of bytes received so far, the upload is
+// answered with 201 once the last of them is received and with 202 before.
+func handlePutRange(p ent.Provider, fs *multipartFS) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			bucket = r.URL.Query().Get(ent.KeyBucket)
+			key    = r.URL.Query().Get(ent.KeyBlob)
+			start  = time.Now()
+		)
+		defer r.Body.Close()
+
+		b, err := getBucket(p, bucket)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		if b.ReadOnly {
+			respondError(w, r, ent.ErrBucketReadOnly)
+			return
+		}
+
+		if !b.AllowsKey(key) {
+			respondError(w, r, ent.ErrKeyNotAllowed)
+			return
+		}
+
+		rng, err := parseContentRange(r.Header.Get(ent.HeaderContentRange))
 		if err != nil {
 			respondError(w, r, err)
 			return
 		}
 
-		respondJSON(w, http.StatusOK, ent.ResponseCreated{
-			Duration: time.Since(start),
-			File: ent.ResponseFile{
-				Bucket:       b,
-				Key:          key,
-				LastModified: f.LastModified(),
-			},
-		})
+		err = checkRetention(fs, b, key)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		received, f, err := fs.PutRange(b, key, rng, r.Body)
+		w.Header().Set(ent.HeaderUploadOffset, strconv.FormatInt(received, 10))
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		if f == nil {
+			respondJSON(w, http.StatusAccepted, ent.ResponseUploadOffset{
+				Offset: received,
+			})
+			return
+		}
+		defer f.Close()
+
+		// An expiry recorded for previous content doesn't apply to the new one.
+		err = setExpires(fs, b, key, time.Time{})
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		err = writeCreatedHeaders(w, f)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+		respondJSON(w, http.StatusCreated, ent.ResponseCreated{
+			Duration: time.Since(start),
+			File: ent.ResponseFile{
+				Key:          key,
+				Bucket:       b,
+				Created:      f.Created(),
+				LastModified: f.LastModified(),
+				CRC32C:       w.Header().Get(ent.HeaderCRC32C),
+			},
+		})
+	}
+}
+
+func handleCreate(p ent.Provider, fs ent.FileSystem) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			bucket = r.URL.Query().Get(ent.KeyBucket)
+			key    = r.URL.Query().Get(ent.KeyBlob)
+			start  = time.Now()
+		)
+		defer r.Body.Close()
+
+		b, err := getBucket(p, bucket)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		if b.ReadOnly {
+			respondError(w, r, ent.ErrBucketReadOnly)
+			return
+		}
+
+		if !b.AllowsKey(key) {
+			respondError(w, r, ent.ErrKeyNotAllowed)
+			return
+		}
+
+		var retainUntil time.Time
+		if v := r.Header.Get(ent.HeaderRetainUntil); v != "" {
+			retainUntil, err = time.Parse(time.RFC3339, v)
+			if err != nil {
+				respondError(w, r, ent.ErrInvalidParam)
+				return
+			}
+		}
+
+		var expires time.Time
+		if v := r.Header.Get(ent.HeaderExpires); v != "" {
+			expires, err = time.Parse(time.RFC3339, v)
+			if err != nil {
+				respondError(w, r, ent.ErrInvalidParam)
+				return
+			}
+		}
+
+		// Appends neither replace a file nor check whether it exists.
+		mode := r.Header.Get(ent.HeaderMode)
+		switch mode {
+		case "", ent.ModeReplace:
+		case ent.ModeAppend:
+			if r.Header.Get(ent.HeaderIfNoneMatch) == "*" {
+				respondError(w, r, ent.ErrInvalidParam)
+				return
+			}
+		default:
+			respondError(w, r, ent.ErrInvalidParam)
+			return
+		}
+
+		var (
+			src io.Reader = r.Body
+			gz  *gzipBody
+		)
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err = newGzipBody(r.Body)
+			if err != nil {
+				respondError(w, r, ent.ErrInvalidBody)
+				return
+			}
+			src = gz
+		}
+
+		body := bufio.NewReader(src)
+
+		if b.RejectEmpty {
+			_, err := body.Peek(1)
+			if err == io.EOF {
+				respondError(w, r, ent.ErrEmptyBody)
+				return
+			}
+		}
+
+		err = checkRetention(fs, b, key)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		// The Meta of new content is stored along with it, so it is never
+		// read without its retention or expiry.
+		var (
+			o = createOptions{
+				meta: ent.Meta{RetainUntil: retainUntil, Expires: expires},
+			}
+			create = func(b *ent.Bucket, key string, r io.Reader) (ent.File, error) {
+				return createWithMeta(fs, b, key, r, o)
+			}
+			f      ent.File
+			status = http.StatusCreated
+		)
+		switch {
+		case mode == ent.ModeAppend:
+			create = func(b *ent.Bucket, key string, r io.Reader) (ent.File, error) {
+				return appendFile(fs, b, key, r)
+			}
+		case r.Header.Get(ent.HeaderIfNoneMatch) == "*":
+			o.exclusive = true
+		default:
+			f, err = openUnchanged(fs, b, key, r.Header.Get(ent.HeaderSHA1))
+			if err != nil {
+				respondError(w, r, err)
+				return
+			}
+		}
+
+		if f != nil {
+			status = http.StatusOK
+		} else {
+			f, err = create(b, key, body)
+			if err != nil {
+				if gz != nil && gz.err != nil {
+					err = ent.ErrInvalidBody
+				}
+				respondError(w, r, err)
+				return
+			}
+		}
+		defer f.Close()
+
+		// Appended and unchanged content is kept, its Meta is updated.
+		if mode == ent.ModeAppend || status == http.StatusOK {
+			if !retainUntil.IsZero() {
+				err := updateMeta(fs, b, key, func(m *ent.Meta) {
+					m.RetainUntil = retainUntil
+				})
+				if err != nil {
+					respondError(w, r, err)
+					return
+				}
+			}
+
+			err = setExpires(fs, b, key, expires)
+			if err != nil {
+				respondError(w, r, err)
+				return
+			}
+		}
+
+		err = writeCreatedHeaders(w, f)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		res := ent.ResponseFile{
+			Key:          key,
+			Bucket:       b,
+			Created:      f.Created(),
+			LastModified: f.LastModified(),
+			CRC32C:       w.Header().Get(ent.HeaderCRC32C),
+		}
+
+		// Clients only know the part they appended, the size and hash are
+		// the ones of the whole file.
+		if mode == ent.ModeAppend {
+			res.Size, err = f.Size()
+			if err != nil {
+				respondError(w, r, err)
+				return
+			}
+
+			h, err := f.Hash()
+			if err != nil {
+				respondError(w, r, err)
+				return
+			}
+			res.Hash = hex.EncodeToString(h)
+		}
+
+		respondJSON(w, status, ent.ResponseCreated{
+			Duration: time.Since(start),
+			File:     res,
+		})
+	}
+}
+
+// gzipBody decompresses a request body sent with Content-Encoding gzip, so
+// the decompressed content is stored. It records the first decoding error to
+// tell malformed bodies apart from failing FileSystems.
+type gzipBody struct {
+	r   *gzip.Reader
+	err error
+}
+
+func newGzipBody(r io.Reader) (*gzipBody, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &gzipBody{r: gr}, nil
+}
+
+func (b *gzipBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil && err != io.EOF && b.err == nil {
+		b.err = err
+	}
+	return n, err
+}
+
+// openUnchanged returns the file stored under key if its content has the hex
+// encoded SHA1 given by the client, so uploading the same content again
+// doesn't need to write it. Otherwise nil is returned.
+func openUnchanged(fs ent.FileSystem, b *ent.Bucket, key, sha1 string) (ent.File, error) {
+	if sha1 == "" {
+		return nil, nil
+	}
+
+	f, err := fs.Open(b, key)
+	if err == ent.ErrFileNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := f.Hash()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if !strings.EqualFold(hex.EncodeToString(h), sha1) {
+		f.Close()
+		return nil, nil
+	}
+
+	return f, nil
+}
+
+// handleCopy stores the file named by the copy source header, given as
+// bucket/key, under the key of the request. The caller has to be allowed to
+// read the source bucket.
+func handleCopy(p ent.Provider, fs ent.FileSystem) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			bucket = r.URL.Query().Get(ent.KeyBucket)
+			key    = r.URL.Query().Get(ent.KeyBlob)
+			source = strings.SplitN(r.Header.Get(ent.HeaderCopySource), "/", 2)
+			start  = time.Now()
+		)
+		defer r.Body.Close()
+
+		b, err := getBucket(p, bucket)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		if b.ReadOnly {
+			respondError(w, r, ent.ErrBucketReadOnly)
+			return
+		}
+
+		if !b.AllowsKey(key) {
+			respondError(w, r, ent.ErrKeyNotAllowed)
+			return
+		}
+
+		if len(source) != 2 || source[0] == "" {
+			respondError(w, r, ent.ErrInvalidParam)
+			return
+		}
+
+		source[1], err = ent.NormalizeKey(source[1])
+		if err == nil {
+			err = validateKey(source[1])
+		}
+		if err != nil || source[0] == bucket && source[1] == key {
+			respondError(w, r, ent.ErrInvalidParam)
+			return
+		}
+
+		sb, err := getBucket(p, source[0])
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		if !sb.CanRead(identity(r)) {
+			respondError(w, r, ent.ErrForbidden)
+			return
+		}
+
+		src, err := fs.Open(sb, source[1])
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+		defer src.Close()
+
+		err = checkExpired(fs, sb, source[1])
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		err = checkRetention(fs, b, key)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		f, err := fs.Create(b, key, src)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+		defer f.Close()
+
+		err = setExpires(fs, b, key, time.Time{})
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		err = writeCreatedHeaders(w, f)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+		respondJSON(w, http.StatusCreated, ent.ResponseCreated{
+			Duration: time.Since(start),
+			File: ent.ResponseFile{
+				Key:          key,
+				Bucket:       b,
+				Created:      f.Created(),
+				LastModified: f.LastModified(),
+				CRC32C:       w.Header().Get(ent.HeaderCRC32C),
+			},
+		})
+	}
+}
+
+func handleRestore(p ent.Provider, fs ent.FileSystem) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			bucket = r.URL.Query().Get(ent.KeyBucket)
+			key    = r.URL.Query().Get(ent.KeyBlob)
+			start  = time.Now()
+		)
+		defer r.Body.Close()
+
+		b, err := getBucket(p, bucket)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		if b.ReadOnly {
+			respondError(w, r, ent.ErrBucketReadOnly)
+			return
+		}
+
+		err = fs.Restore(b, key)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		f, err := fs.Open(b, key)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+		defer f.Close()
+
+		err = writeCreatedHeaders(w, f)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+		respondJSON(w, http.StatusOK, ent.ResponseCreated{
+			Duration: time.Since(start),
+			File: ent.ResponseFile{
+				Key:          key,
+				Bucket:       b,
+				Created:      f.Created(),
+				LastModified: f.LastModified(),
+				CRC32C:       w.Header().Get(ent.HeaderCRC32C),
+			},
+		})
+	}
+}
+
+func handleDelete(p ent.Provider, fs ent.FileSystem) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			bucket = r.URL.Query().Get(ent.KeyBucket)
+			key    = r.URL.Query().Get(ent.KeyBlob)
+			start  = time.Now()
+		)
+		defer r.Body.Close()
+
+		b, err := getBucket(p, bucket)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		if b.ReadOnly {
+			respondError(w, r, ent.ErrBucketReadOnly)
+			return
+		}
+
+		f, err := fs.Open(b, key)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+		defer f.Close()
+
+		err = checkRetention(fs, b, key)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		err = fs.Delete(b, key)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		respondJSON(w, http.StatusOK, ent.ResponseCreated{
+			Duration: time.Since(start),
+			File: ent.ResponseFile{
+				Bucket:       b,
+				Key:          key,
+				Created:      f.Created(),
+				LastModified: f.LastModified(),
+			},
+		})
+	}
+}
+
+// handleDeletePrefix deletes all files whose key starts with the prefix param.
+// An empty prefix only deletes all files of the bucket if the all param is
+// true as well. Files which can't be deleted, like retained ones, are reported
+// without stopping the deletion of the others.
+func handleDeletePrefix(p ent.Provider, fs ent.FileSystem) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			bucket = r.URL.Query().Get(ent.KeyBucket)
+			prefix = r.URL.Query().Get(ent.ParamPrefix)
+			all    = r.URL.Query().Get(ent.ParamAll) == "true"
+			start  = time.Now()
+		)
+		defer r.Body.Close()
+
+		b, err := getBucket(p, bucket)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		if b.ReadOnly {
+			respondError(w, r, ent.ErrBucketReadOnly)
+			return
+		}
+
+		if prefix == "" && !all {
+			respondError(w, r, ent.ErrInvalidParam)
+			return
+		}
+
+		// Keys are collected first as backends may not allow deleting files
+		// while walking them.
+		keys := []string{}
+
+		err = fs.Walk(b, prefix, ent.ModifiedRange{}, func(f ent.File) error {
+			keys = append(keys, f.Key())
+			return nil
+		})
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		res := ent.ResponseBatchDelete{}
+
+		for _, key := range keys {
+			err := checkRetention(fs, b, key)
+			if err == nil {
+				err = fs.Delete(b, key)
+			}
+			if err != nil {
+				res.Failed++
+				res.Errors = append(res.Errors, ent.ResponseDeleteError{
+					Key:   key,
+					Error: err.Error(),
+				})
+				continue
+			}
+
+			res.Deleted++
+		}
+
+		res.Duration = time.Since(start)
+
+		respondJSON(w, http.StatusOK, res)
+	}
+}
+
+func handleExists(p ent.Provider, fs ent.FileSystem) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			bucket = r.URL.Query().Get(ent.KeyBucket)
+			key    = r.URL.Query().Get(ent.KeyBlob)
+		)
+
+		b, err := getBucket(p, bucket)
+		if err != nil {
+			respondHEADError(w, err)
+			return
+		}
+
+		f, err := fs.Open(b, key)
+		if err != nil {
+			respondHEADError(w, err)
+			return
+		}
+		defer f.Close()
+
+		err = checkExpired(fs, b, key)
+		if err != nil {
+			respondHEADError(w, err)
+			return
+		}
+
+		err = writeServedHeaders(w, r, f)
+		if err != nil {
+			respondHEADError(w, err)
+			return
+		}
+
+		if notModified(w, r, f.LastModified()) {
+			respondHEAD(w, http.StatusNotModified)
+			return
+		}
+
+		size, err := f.Size()
+		if err != nil {
+			respondHEADError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func handleGet(p ent.Provider, fs ent.FileSystem) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			bucket  = r.URL.Query().Get(ent.KeyBucket)
+			key     = r.URL.Query().Get(ent.KeyBlob)
+			version = r.URL.Query().Get(ent.ParamVersion)
+		)
+
+		b, err := getBucket(p, bucket)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		// Versions are kept after the file has been deleted, they are listed
+		// without opening it.
+		if _, ok := r.URL.Query()[ent.ParamVersions]; ok {
+			vs, err := fs.Versions(b, key)
+			if err != nil {
+				respondError(w, r, err)
+				return
+			}
+
+			if len(vs) == 0 {
+				respondError(w, r, ent.ErrFileNotFound)
+				return
+			}
+
+			respondJSON(w, http.StatusOK, ent.ResponseVersions{
+				Key:      key,
+				Versions: vs,
+			})
+			return
+		}
+
+		var f ent.File
+		if version != "" {
+			f, err = fs.OpenVersion(b, key, version)
+		} else {
+			f, err = fs.Open(b, key)
+		}
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+		defer f.Close()
+
+		if version == "" {
+			err = checkExpired(fs, b, key)
+			if err != nil {
+				respondError(w, r, err)
+				return
+			}
+		}
+
+		if _, ok := r.URL.Query()[ent.ParamMeta]; ok {
+			stat, err := statFile(fs, b, key, f, version)
+			if err != nil {
+				respondError(w, r, err)
+				return
+			}
+
+			respondJSON(w, http.StatusOK, stat)
+			return
+		}
+
+		if _, ok := r.URL.Query()[ent.ParamRetention]; ok {
+			m, err := fs.Meta(b, key)
+			if err != nil {
+				respondError(w, r, err)
+				return
+			}
+
+			respondJSON(w, http.StatusOK, ent.ResponseRetention{
+				Key:         key,
+				RetainUntil: m.RetainUntil,
+			})
+			return
+		}
+
+		err = writeServedHeaders(w, r, f)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		if notModified(w, r, f.LastModified()) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		serveBlob(w, r, f)
+	}
+}
+
+// statFile describes the file f stored under key without its content. Meta is
+// only set for the current content of a file, versions carry none.
+func statFile(
+	fs ent.FileSystem,
+	b *ent.Bucket,
+	key string,
+	f ent.File,
+	version string,
+) (ent.ResponseFile, error) {
+	size, err := f.Size()
+	if err != nil {
+		return ent.ResponseFile{}, err
+	}
+
+	hash, err := f.Hash()
+	if err != nil {
+		return ent.ResponseFile{}, err
+	}
+
+	stat := ent.ResponseFile{
+		Key:          key,
+		Bucket:       b,
+		Created:      f.Created(),
+		LastModified: f.LastModified(),
+		Size:         size,
+		Hash:         hex.EncodeToString(hash),
+	}
+
+	if version == "" {
+		m, err := fs.Meta(b, key)
+		if err != nil {
+			return ent.ResponseFile{}, err
+		}
+
+		stat.Meta = &m
+	}
+
+	return stat, nil
+}
+
+func handleGetByHash(p ent.Provider, fs *hashIndexFS) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			bucket = r.URL.Query().Get(ent.KeyBucket)
+			hash   = r.URL.Query().Get(ent.KeyHash)
+		)
+
+		b, err := getBucket(p, bucket)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		f, err := fs.OpenByHash(b, hash)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+		defer f.Close()
+
+		err = checkExpired(fs, b, f.Key())
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		err = writeServedHeaders(w, r, f)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		if notModified(w, r, f.LastModified()) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		serveBlob(w, r, f)
+	}
+}
+
+// bucketFileCountLimit caps the number of files counted when probing a
+// bucket, keeping the probe cheap for large buckets.
+const bucketFileCountLimit = 10000
+
+func handleBucketExists(p ent.Provider, fs ent.FileSystem) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b, err := getBucket(p, r.URL.Query().Get(ent.KeyBucket))
+		if err != nil {
+			respondHEADError(w, err)
+			return
+		}
+
+		// The files are counted without collecting them, the walk stops once
+		// the count passes the limit.
+		files := 0
+		err = fs.Walk(b, "", ent.ModifiedRange{}, func(ent.File) error {
+			files++
+			if files > bucketFileCountLimit {
+				return errWalkLimit
+			}
+			return nil
+		})
+		if err != nil && err != errWalkLimit {
+			respondHEADError(w, err)
+			return
+		}
+
+		count := strconv.Itoa(files)
+		if files > bucketFileCountLimit {
+			count = strconv.Itoa(bucketFileCountLimit) + "+"
+		}
+
+		w.Header().Set(ent.HeaderBucketFileCount, count)
+		respondHEAD(w, http.StatusOK)
+	}
+}
+
+func handleBucketList(p ent.Provider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			start = time.Now()
+		)
+
+		bs, err := p.List()
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		respondJSON(w, http.StatusOK, ent.ResponseBucketList{
+			Count:    len(bs),
+			Duration: time.Since(start),
+			Buckets:  bs,
+		})
+	}
+}
+
+// reloadProvider is a Provider which can refresh its buckets at runtime.
+type reloadProvider interface {
+	ent.Provider
+	Reload() error
+}
+
+// readinessChecker is implemented by components which need to be functional
+// for the server to accept traffic.
+type readinessChecker interface {
+	Ready() error
+}
+
+// handleMethodNotAllowed answers requests for registered paths with a method
+// no route of router is registered for, the methods of the routes matching
+// the path are listed in the Allow header.
+func handleMethodNotAllowed(router *pat.Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", strings.Join(allowedMethods(router, r), ", "))
+		respondError(w, r, ent.ErrMethodNotAllowed)
+	}
+}
+
+// routeMethods are the methods routes are registered for.
+var routeMethods = []string{"GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS"}
+
+// allowedMethods returns the methods router has a route for the path of r for.
+func allowedMethods(router *pat.Router, r *http.Request) []string {
+	allowed := []string{}
+
+	for _, method := range routeMethods {
+		probe := new(http.Request)
+		*probe = *r
+		probe.Method = method
+
+		var match mux.RouteMatch
+		if router.Match(probe, &match) && match.MatchErr == nil {
+			allowed = append(allowed, method)
+		}
+	}
+
+	return allowed
+}
+
+func handleHealth() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		respondJSON(w, http.StatusOK, ent.ResponseHealth{
+			Status:  "ok",
+			Version: Version,
+		})
+	}
+}
+
+func handleReady(checks ...readinessChecker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, c := range checks {
+			err := c.Ready()
+			if err != nil {
+				log.Printf("ERROR not ready: %s", err)
+				respondJSON(w, http.StatusServiceUnavailable, ent.ResponseError{
+					Code:        http.StatusServiceUnavailable,
+					Error:       err.Error(),
+					Description: http.StatusText(http.StatusServiceUnavailable),
+				})
+				return
+			}
+		}
+
+		respondJSON(w, http.StatusOK, ent.ResponseHealth{
+			Status:  "ok",
+			Version: Version,
+		})
+	}
+}
+
+func handleReload(p reloadProvider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		err := p.Reload()
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		bs, err := p.List()
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		respondJSON(w, http.StatusOK, ent.ResponseBucketList{
+			Count:    len(bs),
+			Duration: time.Since(start),
+			Buckets:  bs,
+		})
+	}
+}
+
+func handleBucketStats(p ent.Provider, fs ent.FileSystem) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		b, err := getBucket(p, r.URL.Query().Get(ent.KeyBucket))
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		stats, err := fs.Stats(b)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		respondJSON(w, http.StatusOK, ent.ResponseBucketStats{
+			FileCount:  stats.Files,
+			TotalBytes: int64(stats.Bytes),
+			Duration:   time.Since(start),
+		})
+	}
+}
+
+func handleFileList(p ent.Provider, fs ent.FileSystem) http.HandlerFunc {
+	var (
+		bundle = handleBundle(p, fs)
+		stats  = handleBucketStats(p, fs)
+	)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.URL.Query()[ent.ParamStats]; ok {
+			stats(w, r)
+			return
+		}
+
+		if r.URL.Query().Get(ent.ParamBundle) != "" {
+			bundle(w, r)
+			return
+		}
+
+		var (
+			start       = time.Now()
+			limit       = ent.DefaultLimit
+			modified    = ent.ModifiedRange{}
+			bucket      = r.URL.Query().Get(ent.KeyBucket)
+			beforeValue = r.URL.Query().Get(ent.ParamModifiedBefore)
+			delimiter   = r.URL.Query().Get(ent.ParamDelimiter)
+			endBefore   = r.URL.Query().Get(ent.ParamEndBefore)
+			format      = r.URL.Query().Get(ent.ParamFormat)
+			limitValue  = r.URL.Query().Get(ent.ParamLimit)
+			marker      = r.URL.Query().Get(ent.ParamMarker)
+			prefix      = r.URL.Query().Get(ent.ParamPrefix)
+			sinceValue  = r.URL.Query().Get(ent.ParamModifiedSince)
+			sortValue   = r.URL.Query().Get(ent.ParamSort)
+			startAfter  = r.URL.Query().Get(ent.ParamStartAfter)
+		)
+
+		// Markers and key ranges imply key order, which is kept over the
+		// default.
+		if sortValue == "" && marker == "" && startAfter == "" && endBefore == "" {
+			sortValue = defaultSort
+		}
+
+		b, err := getBucket(p, bucket)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		// A limit of 0 would list nothing, which is never what was meant
+		// and is refused rather than taken as the default.
+		if limitValue != "" {
+			limit, err = strconv.ParseUint(limitValue, 10, 64)
+			if err != nil || limit == 0 {
+				respondError(w, r, ent.ErrInvalidParam)
+				return
+			}
+		}
+
+		if sinceValue != "" {
+			modified.Since, err = time.Parse(time.RFC3339, sinceValue)
+			if err != nil {
+				respondError(w, r, ent.ErrInvalidParam)
+				return
+			}
+		}
+
+		if beforeValue != "" {
+			modified.Before, err = time.Parse(time.RFC3339, beforeValue)
+			if err != nil {
+				respondError(w, r, ent.ErrInvalidParam)
+				return
+			}
+		}
+
+		sortStrategy, err := createSortStrategy(sortValue)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		if format != "" && format != ent.FormatJSON && format != ent.FormatXML {
+			respondError(w, r, ent.ErrInvalidParam)
+			return
+		}
+
+		// Keys are only delimited by slashes, which are directories of the
+		// disk backend.
+		if delimiter != "" && delimiter != "/" {
+			respondError(w, r, ent.ErrInvalidParam)
+			return
+		}
+
+		// Listings in ascending key order can be continued after the last key
+		// of a page, which is the order used whenever a marker or key range is
+		// passed.
+		var (
+			byKey  = sortValue == ent.OrderAscending+ent.OrderKey
+			ranged = startAfter != "" || endBefore != ""
+		)
+		if (marker != "" || ranged) && sortValue != "" && !byKey {
+			respondError(w, r, ent.ErrInvalidParam)
+			return
+		}
+
+		paged := marker != "" || ranged || byKey
+		// Common prefixes have no place in NDJSON, which only holds files.
+		ndjson := format == "" && delimiter == "" && accepts(r, ent.ContentTypeNDJSON)
+
+		// Unsorted listings are streamed as the files are walked, without
+		// holding all of them in memory.
+		if ndjson && !paged && sortValue == "" {
+			respondNDJSON(w, r, b, func(fn func(ent.File) error) error {
+				n := uint64(0)
+
+				err := fs.Walk(b, prefix, modified, func(f ent.File) error {
+					if n == limit {
+						return errWalkLimit
+					}
+					n++
+
+					return fn(f)
+				})
+				if err == errWalkLimit {
+					return nil
+				}
+				return err
+			})
+			return
+		}
+
+		var (
+			files      ent.Files
+			prefixes   []string
+			nextMarker string
+			first      = pageStart(marker, startAfter)
+		)
+		switch {
+		case paged && delimiter != "":
+			files, prefixes, nextMarker, err = listDirPage(fs, b, prefix, modified, first, endBefore, limit)
+		case paged:
+			files, nextMarker, err = listPage(fs, b, prefix, modified, first, endBefore, limit)
+		case delimiter != "":
+			files, prefixes, err = listDir(fs, b, prefix, modified, limit, sortStrategy)
+		default:
+			files, err = listFiles(fs, b, prefix, modified, limit, sortStrategy)
+		}
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		if format == ent.FormatXML {
+			result, err := createListBucketResult(fs, b, prefix, marker, nextMarker, limit, files)
+			if err != nil {
+				respondError(w, r, err)
+				return
+			}
+
+			if delimiter != "" {
+				result.Delimiter = delimiter
+				for _, p := range prefixes {
+					result.CommonPrefixes = append(result.CommonPrefixes, ent.ResponseCommonPrefix{Prefix: p})
+				}
+			}
+
+			respondXML(w, http.StatusOK, result)
+			return
+		}
+
+		if ndjson {
+			if nextMarker != "" {
+				w.Header().Set(ent.HeaderNextMarker, nextMarker)
+			}
+
+			respondNDJSON(w, r, b, func(fn func(ent.File) error) error {
+				for _, f := range files {
+					err := fn(f)
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			return
+		}
+
+		responseFiles, err := createResponseFiles(files, b)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		respondJSON(w, http.StatusOK, ent.ResponseFileList{
+			Count:          len(responseFiles),
+			Duration:       time.Since(start),
+			Bucket:         b,
+			Files:          responseFiles,
+			NextMarker:     nextMarker,
+			CommonPrefixes: prefixes,
+		})
+	}
+}
+
+// listFiles lists the files of bucket like List, only listing those last
+// modified in the range. Filtered listings walk the files, as List takes no
+// range.
+func listFiles(
+	fs ent.FileSystem,
+	bucket *ent.Bucket,
+	prefix string,
+	modified ent.ModifiedRange,
+	limit uint64,
+	sortStrategy ent.SortStrategy,
+) (ent.Files, error) {
+	if modified.Since.IsZero() && modified.Before.IsZero() {
+		return fs.List(bucket, prefix, limit, sortStrategy)
+	}
+
+	files := ent.Files{}
+
+	err := fs.Walk(bucket, prefix, modified, func(f ent.File) error {
+		files = append(files, f)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sortStrategy.Sort(files)
+
+	if limit < uint64(len(files)) {
+		files = files[:limit]
+	}
+
+	return files, nil
+}
+
+// listDir lists the files of bucket directly below prefix like List does and
+// returns the common prefixes of the keys below them in ascending order. Common
+// prefixes are neither limited nor paged.
+func listDir(
+	fs ent.FileSystem,
+	bucket *ent.Bucket,
+	prefix string,
+	modified ent.ModifiedRange,
+	limit uint64,
+	sortStrategy ent.SortStrategy,
+) (ent.Files, []string, error) {
+	var (
+		files    = ent.Files{}
+		prefixes = []string{}
+	)
+
+	err := fs.WalkDir(
+		bucket,
+		prefix,
+		modified,
+		func(f ent.File) error {
+			files = append(files, f)
+			return nil
+		},
+		func(p string) error {
+			prefixes = append(prefixes, p)
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sortStrategy.Sort(files)
+	sort.Strings(prefixes)
+
+	if limit < uint64(len(files)) {
+		files = files[:limit]
+	}
+
+	return files, prefixes, nil
+}
+
+// handleOptions answers with the methods allowed on the route in the Allow
+// header. Routes of buckets which don't exist are answered with 404.
+func handleOptions(p ent.Provider, methods ...string) http.Handler {
+	allow := strings.Join(append(methods, "OPTIONS"), ", ")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if bucket := r.URL.Query().Get(ent.KeyBucket); bucket != "" {
+			_, err := p.Get(bucket)
+			if err != nil {
+				respondError(w, r, err)
+				return
+			}
+		}
+
+		w.Header().Set("Allow", allow)
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// corsConfig describes the cross-origin requests which are allowed. Every
+// origin is allowed if origins is empty. The response headers in expose are
+// readable by the scripts making the requests.
+type corsConfig struct {
+	origins []string
+	methods []string
+	headers []string
+	expose  []string
+}
+
+// corsRequestHeaders are the request headers allowed in cross-origin requests
+// by default, all headers requests to ent are read from.
+var corsRequestHeaders = []string{
+	"Accept",
+	"Authorization",
+	"Content-Type",
+	"Origin",
+	"Range",
+	ent.HeaderContentRange,
+	ent.HeaderIfModifiedSince,
+	ent.HeaderIfNoneMatch,
+	ent.HeaderCopySource,
+	ent.HeaderExpires,
+	ent.HeaderMode,
+	ent.HeaderOwner,
+	ent.HeaderRetainUntil,
+	ent.HeaderSHA1,
+}
+
+// corsExposeHeaders are the response headers exposed to cross-origin requests
+// by default, all headers ent answers with which browsers hide otherwise.
+var corsExposeHeaders = []string{
+	ent.HeaderContentRange,
+	ent.HeaderETag,
+	ent.HeaderBucketFileCount,
+	ent.HeaderCRC32C,
+	ent.HeaderError,
+	ent.HeaderNextMarker,
+	ent.HeaderUploadOffset,
+}
+
+func addCORSHeaders(c corsConfig, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := "*"
+
+		if len(c.origins) > 0 {
+			w.Header().Add("Vary", "Origin")
+
+			origin = r.Header.Get("Origin")
+			if !containsFold(c.origins, origin) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(c.headers, ", "))
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(c.methods, ", "))
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if len(c.expose) > 0 {
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(c.expose, ", "))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// splitList returns the elements of the comma-separated list s.
+func splitList(s string) []string {
+	list := []string{}
+
+	for _, e := range strings.Split(s, ",") {
+		e = strings.TrimSpace(e)
+		if e != "" {
+			list = append(list, e)
+		}
+	}
+
+	return list
+}
+
+func containsFold(list []string, s string) bool {
+	for _, e := range list {
+		if strings.EqualFold(e, s) {
+			return true
+		}
 	}
+
+	return false
 }
 
-func handleExists(p ent.Provider, fs ent.FileSystem) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		var (
-			bucket = r.URL.Query().Get(ent.KeyBucket)
-			key    = r.URL.Query().Get(ent.KeyBlob)
-		)
+// adminOnly answers requests of callers other than the given admins with
+// ErrForbidden. Without admins every request is.
+func adminOnly(admins []string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := identity(r)
 
-		b, err := p.Get(bucket)
-		if err != nil {
-			respondHEAD(w, errorStatusCode(err))
-			return
+		for _, admin := range admins {
+			if id != "" && strings.EqualFold(admin, id) {
+				next.ServeHTTP(w, r)
+				return
+			}
 		}
 
-		f, err := fs.Open(b, key)
-		if err != nil {
-			respondHEAD(w, errorStatusCode(err))
-			return
-		}
-		defer f.Close()
+		respondError(w, r, ent.ErrForbidden)
+	})
+}
 
-		err = writeBlobHeaders(w, f)
+func authorize(p ent.Provider, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := p.Get(r.URL.Query().Get(ent.KeyBucket))
 		if err != nil {
-			respondHEAD(w, errorStatusCode(err))
+			// Unknown buckets are reported by the wrapped handler.
+			next.ServeHTTP(w, r)
 			return
 		}
 
-		respondHEAD(w, http.StatusOK)
-	}
-}
-
-func handleGet(p ent.Provider, fs ent.FileSystem) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
 		var (
-			bucket = r.URL.Query().Get(ent.KeyBucket)
-			key    = r.URL.Query().Get(ent.KeyBlob)
+			id      = identity(r)
+			allowed bool
 		)
 
-		b, err := p.Get(bucket)
-		if err != nil {
-			respondError(w, r, err)
-			return
+		switch r.Method {
+		case "GET", "HEAD":
+			allowed = b.CanRead(id)
+		default:
+			allowed = b.CanWrite(id)
 		}
 
-		f, err := fs.Open(b, key)
-		if err != nil {
-			respondError(w, r, err)
-			return
-		}
-		defer f.Close()
+		if !allowed {
+			if r.Method == "HEAD" {
+				respondHEADError(w, ent.ErrForbidden)
+				return
+			}
 
-		err = writeBlobHeaders(w, f)
-		if err != nil {
-			respondError(w, r, err)
+			respondError(w, r, ent.ErrForbidden)
 			return
 		}
 
-		http.ServeContent(w, r, key, f.LastModified(), f)
-	}
+		next.ServeHTTP(w, r)
+	})
 }
 
-func handleBucketList(p ent.Provider) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		var (
-			start = time.Now()
-		)
+// Keys are stored as paths by the disk backend, whose filesystem caps the
+// length of names, usually at 255 bytes. The limit on segments leaves room for
+// the extension of meta sidecars.
+var (
+	maxKeyLen     = 1024
+	maxSegmentLen = 255 - len(metaExt)
+)
 
-		bs, err := p.List()
-		if err != nil {
-			respondError(w, r, err)
-			return
-		}
+// validateKey rejects keys longer than maxKeyLen or with a segment longer than
+// maxSegmentLen with ErrInvalidParam, a limit of 0 disables it. Keys naming
+// bookkeeping files of the disk backend are rejected as well.
+func validateKey(key string) error {
+	if maxKeyLen > 0 && len(key) > maxKeyLen {
+		return ent.ErrInvalidParam
+	}
 
-		respondJSON(w, http.StatusOK, ent.ResponseBucketList{
-			Count:    len(bs),
-			Duration: time.Since(start),
-			Buckets:  bs,
-		})
+	if isReserved(key) {
+		return ent.ErrInvalidParam
+	}
+
+	if maxSegmentLen > 0 {
+		for _, segment := range strings.Split(key, "/") {
+			if len(segment) > maxSegmentLen {
+				return ent.ErrInvalidParam
+			}
+		}
 	}
+
+	return nil
 }
 
-func handleFileList(p ent.Provider, fs ent.FileSystem) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		var (
-			start      = time.Now()
-			limit      = ent.DefaultLimit
-			bucket     = r.URL.Query().Get(ent.KeyBucket)
-			limitValue = r.URL.Query().Get(ent.ParamLimit)
-			prefix     = r.URL.Query().Get(ent.ParamPrefix)
-			sortValue  = r.URL.Query().Get(ent.ParamSort)
-		)
+// normalizeKey replaces the key of the request with its normalized form, so
+// a//b and a/b name the same file. Malformed keys and keys exceeding the
+// length limits are answered with ErrInvalidParam.
+func normalizeKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
 
-		b, err := p.Get(bucket)
-		if err != nil {
-			respondError(w, r, err)
-			return
+		key, err := ent.NormalizeKey(q.Get(ent.KeyBlob))
+		if err == nil {
+			err = validateKey(key)
 		}
-
-		if limitValue != "" {
-			limit, err = strconv.ParseUint(limitValue, 10, 64)
-			if err != nil {
-				respondError(w, r, ent.ErrInvalidParam)
+		if err != nil {
+			if r.Method == "HEAD" {
+				respondHEADError(w, err)
 				return
 			}
-		}
 
-		sortStrategy, err := createSortStrategy(sortValue)
-		if err != nil {
 			respondError(w, r, err)
 			return
 		}
 
-		files, err := fs.List(b, prefix, limit, sortStrategy)
-		if err != nil {
-			respondError(w, r, err)
-			return
-		}
+		q.Set(ent.KeyBlob, key)
+		r.URL.RawQuery = q.Encode()
 
-		responseFiles, err := createResponseFiles(files, b)
-		if err != nil {
-			respondError(w, r, err)
-			return
-		}
+		next.ServeHTTP(w, r)
+	})
+}
 
-		respondJSON(w, http.StatusOK, ent.ResponseFileList{
-			Count:    len(responseFiles),
-			Duration: time.Since(start),
-			Bucket:   b,
-			Files:    responseFiles,
-		})
+// getBucket returns the Bucket with the given name, an empty name is answered
+// with ErrEmptyBucket and a name no bucket can have with ErrInvalidParam
+// instead of looking it up.
+func getBucket(p ent.Provider, name string) (*ent.Bucket, error) {
+	if name == "" {
+		return nil, ent.ErrEmptyBucket
 	}
+
+	if validateBucketName(name) != nil {
+		return nil, ent.ErrInvalidParam
+	}
+
+	return p.Get(name)
 }
 
-func handleOptions() http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-	})
+// identity returns the email address the caller claims to act as.
+func identity(r *http.Request) string {
+	v := r.Header.Get(ent.HeaderOwner)
+
+	addr, err := mail.ParseAddress(v)
+	if err != nil {
+		return strings.TrimSpace(v)
+	}
+
+	return addr.Address
 }
 
-func addCORSHeaders(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Headers", "Accept, Authorization, Content-Type, Origin")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
+// Modes of the bucket label of metrics.
+const (
+	bucketLabelAll   = "all"
+	bucketLabelKnown = "known"
+)
 
-		next.ServeHTTP(w, r)
-	})
+// unknownBucketLabel is recorded instead of buckets missing from bucketLabels.
+const unknownBucketLabel = "unknown"
+
+// bucketLabels, if set, restricts the bucket label of metrics to the buckets it
+// knows, so requests for arbitrary buckets can't add series.
+var bucketLabels ent.Provider
+
+// bucketLabel returns the value of the bucket label for requests to name.
+func bucketLabel(name string) string {
+	if bucketLabels == nil || name == "" {
+		return name
+	}
+
+	_, err := bucketLabels.Get(name)
+	if err != nil {
+		return unknownBucketLabel
+	}
+
+	return name
 }
 
 func metrics(op string, next http.Handler) http.Handler {
+	return observe(op, nil, next)
+}
+
+// observe records the metrics of every request answered by next and, if l is
+// not nil, writes an access log entry for it.
+func observe(op string, l *accessLog, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var (
 			start = time.Now()
@@ -423,29 +2585,59 @@ func metrics(op string, next http.Handler) http.Handler {
 
 		r.Body = rd
 
+		inflight := inflightRequests.WithLabelValues(op)
+		inflight.Inc()
+		defer inflight.Dec()
+
 		next.ServeHTTP(rc, r)
 
-		d := time.Since(start)
-		labels := map[string]string{
-			"bucket":    r.URL.Query().Get(ent.KeyBucket),
-			"method":    strings.ToLower(r.Method),
-			"operation": op,
-			"status":    strconv.Itoa(rc.status),
-		}
+		var (
+			d      = time.Since(start)
+			bucket = r.URL.Query().Get(ent.KeyBucket)
+			labels = map[string]string{
+				"bucket":    bucketLabel(bucket),
+				"method":    strings.ToLower(r.Method),
+				"operation": op,
+				"status":    strconv.Itoa(rc.status),
+			}
+		)
 
 		requestBytes.With(labels).Add(float64(rd.BytesRead))
 		requestDurations.With(labels).Observe(float64(d))
+		requestDurationsSeconds.With(labels).Observe(d.Seconds())
 		responseBytes.With(labels).Add(float64(rc.size))
+
+		if l != nil {
+			l.write(accessLogEntry{
+				Time:      start,
+				Bucket:    bucket,
+				Key:       r.URL.Query().Get(ent.KeyBlob),
+				Method:    r.Method,
+				Operation: op,
+				Status:    rc.status,
+				BytesIn:   rd.BytesRead,
+				BytesOut:  rc.size,
+				Duration:  d,
+			})
+		}
 	})
 }
 
 func errorStatusCode(err error) int {
 	code := http.StatusInternalServerError
 	switch err {
-	case ent.ErrBucketNotFound, ent.ErrFileNotFound:
+	case ent.ErrBucketNotFound, ent.ErrFileNotFound, ent.ErrUploadNotFound:
 		code = http.StatusNotFound
-	case ent.ErrInvalidParam:
+	case ent.ErrMethodNotAllowed:
+		code = http.StatusMethodNotAllowed
+	case ent.ErrBucketReadOnly, ent.ErrForbidden, ent.ErrRetentionActive:
+		code = http.StatusForbidden
+	case ent.ErrEmptyBody, ent.ErrEmptyBucket, ent.ErrHashMismatch, ent.ErrInvalidBody, ent.ErrInvalidParam, ent.ErrKeyNotAllowed:
 		code = http.StatusBadRequest
+	case ent.ErrFileExists:
+		code = http.StatusPreconditionFailed
+	case ent.ErrUploadOffset:
+		code = http.StatusConflict
 	}
 	return code
 }
@@ -465,12 +2657,127 @@ func respondHEAD(w http.ResponseWriter, code int) {
 	w.WriteHeader(code)
 }
 
+// respondHEADError answers HEAD requests failing with err, which is carried
+// in the X-Ent-Error header as the response has no body to tell it.
+func respondHEADError(w http.ResponseWriter, err error) {
+	w.Header().Set(ent.HeaderError, err.Error())
+	respondHEAD(w, errorStatusCode(err))
+}
+
 func respondJSON(w http.ResponseWriter, code int, payload interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
 	json.NewEncoder(w).Encode(payload)
 }
 
+// accepts reports whether the Accept header of r lists mediaType.
+func accepts(r *http.Request, mediaType string) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		name := strings.TrimSpace(strings.SplitN(part, ";", 2)[0])
+		if strings.EqualFold(name, mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// errWalkLimit stops a walk once the limit of files has been passed on.
+var errWalkLimit = errors.New("limit reached")
+
+// respondNDJSON writes a line of JSON for every file walk passes on, as soon as
+// it is passed. Once the first line is written the status can't be changed
+// anymore, errors after it end the response early.
+func respondNDJSON(
+	w http.ResponseWriter,
+	r *http.Request,
+	b *ent.Bucket,
+	walk func(fn func(ent.File) error) error,
+) {
+	var (
+		enc     = json.NewEncoder(w)
+		started = false
+	)
+
+	start := func() {
+		if !started {
+			w.Header().Set("Content-Type", ent.ContentTypeNDJSON)
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+	}
+
+	err := walk(func(f ent.File) error {
+		start()
+
+		return enc.Encode(ent.ResponseFile{
+			Key:          f.Key(),
+			LastModified: f.LastModified(),
+			Bucket:       b,
+		})
+	})
+	if err != nil && !started {
+		respondError(w, r, err)
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR could not stream %s: %s", r.RequestURI, err)
+		return
+	}
+
+	start()
+}
+
+func respondXML(w http.ResponseWriter, code int, payload interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(code)
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(payload)
+}
+
+// reportUsage measures the storage usage of every bucket known to p every
+// interval.
+func reportUsage(p ent.Provider, fs ent.FileSystem, interval time.Duration) {
+	reported := map[string]bool{}
+
+	for {
+		reported = updateUsage(p, fs, reported)
+		time.Sleep(interval)
+	}
+}
+
+// updateUsage sets the usage gauges of the buckets of p and deletes those of
+// the buckets reported before which were removed since. It returns the names
+// of the buckets reported now.
+func updateUsage(p ent.Provider, fs ent.FileSystem, reported map[string]bool) map[string]bool {
+	bs, err := p.List()
+	if err != nil {
+		log.Printf("ERROR listing buckets for usage: %s", err)
+		return reported
+	}
+
+	current := map[string]bool{}
+
+	for _, b := range bs {
+		current[b.Name] = true
+
+		n, err := fs.Usage(b)
+		if err != nil {
+			log.Printf("ERROR %s", err)
+			continue
+		}
+
+		bucketBytes.WithLabelValues(b.Name).Set(float64(n))
+	}
+
+	for name := range reported {
+		if !current[name] {
+			bucketBytes.DeleteLabelValues(name)
+		}
+	}
+
+	return current
+}
+
 type readerDelegator struct {
 	io.ReadCloser
 	BytesRead int
@@ -499,6 +2806,9 @@ func (r *responseRecorder) WriteHeader(code int) {
 	r.ResponseWriter.WriteHeader(code)
 }
 
+// createResponseFiles describes files in a listing. Their creation time is left
+// out, the disk backend records it in sidecars which would have to be read for
+// every file listed.
 func createResponseFiles(files ent.Files, bucket *ent.Bucket) ([]ent.ResponseFile, error) {
 	responseFiles := make([]ent.ResponseFile, len(files))
 	for i, file := range files {
@@ -511,6 +2821,63 @@ func createResponseFiles(files ent.Files, bucket *ent.Bucket) ([]ent.ResponseFil
 	return responseFiles, nil
 }
 
+// createListBucketResult describes files in the S3 ListBucket format. Every
+// file is opened to determine its ETag and size as served by GET, both are
+// taken from the digests recorded when it was stored rather than read from
+// its content. Listings are only reported as truncated if there is a marker
+// to continue them.
+func createListBucketResult(
+	fs ent.FileSystem,
+	bucket *ent.Bucket,
+	prefix string,
+	marker string,
+	nextMarker string,
+	limit uint64,
+	files ent.Files,
+) (ent.ResponseListBucketResult, error) {
+	result := ent.ResponseListBucketResult{
+		Name:        bucket.Name,
+		Prefix:      prefix,
+		Marker:      marker,
+		NextMarker:  nextMarker,
+		MaxKeys:     limit,
+		IsTruncated: nextMarker != "",
+		Contents:    make([]ent.ResponseBucketContents, len(files)),
+	}
+
+	for i, file := range files {
+		f, err := fs.Open(bucket, file.Key())
+		if err != nil {
+			return result, err
+		}
+
+		etag, err := f.ETag()
+		if err != nil {
+			f.Close()
+			return result, err
+		}
+
+		size, err := f.Size()
+		f.Close()
+		if err != nil {
+			return result, err
+		}
+
+		result.Contents[i] = ent.ResponseBucketContents{
+			Key:          file.Key(),
+			LastModified: file.LastModified(),
+			ETag:         etag,
+			Size:         size,
+		}
+	}
+
+	return result, nil
+}
+
+// defaultSort is the sort param applied to listings passing neither a sort, a
+// marker nor a key range.
+var defaultSort = ""
+
 func createSortStrategy(value string) (ent.SortStrategy, error) {
 	if value == "" {
 		return ent.NoOpStrategy(), nil
@@ -545,13 +2912,105 @@ func createSortStrategy(value string) (ent.SortStrategy, error) {
 	}
 }
 
+// checkExpired returns ErrFileNotFound if the file stored under key has
+// expired but not been deleted by the reaper yet.
+func checkExpired(fs ent.FileSystem, b *ent.Bucket, key string) error {
+	m, err := fs.Meta(b, key)
+	if err != nil {
+		return err
+	}
+
+	if m.IsExpired(time.Now()) {
+		return ent.ErrFileNotFound
+	}
+
+	return nil
+}
+
+// setExpires records when the file stored under key expires, a zero time
+// removes a previously recorded expiry. Meta is only written if it changes.
+func setExpires(fs ent.FileSystem, b *ent.Bucket, key string, expires time.Time) error {
+	return updateMeta(fs, b, key, func(m *ent.Meta) {
+		if !m.Expires.Equal(expires) {
+			m.Expires = expires
+		}
+	})
+}
+
+// checkRetention returns ErrRetentionActive if the file stored under key must
+// not be overwritten or deleted yet.
+func checkRetention(fs ent.FileSystem, b *ent.Bucket, key string) error {
+	m, err := fs.Meta(b, key)
+	if err != nil {
+		return err
+	}
+
+	if m.IsRetained(time.Now()) {
+		return ent.ErrRetentionActive
+	}
+
+	return nil
+}
+
+// serveBlob writes the content of f compressed with the response encoding
+// of r, see responseEncoding.
+func serveBlob(w http.ResponseWriter, r *http.Request, f ent.File) {
+	encoding := responseEncoding(r)
+	if encoding == "" {
+		http.ServeContent(w, r, f.Key(), f.LastModified(), f)
+		return
+	}
+
+	ew := newEncodedResponseWriter(w, encoding)
+	defer ew.Close()
+
+	http.ServeContent(ew, r, f.Key(), f.LastModified(), f)
+}
+
+// writeCreatedHeaders writes the headers of a file stored by a request, which
+// leave out the ETag and CRC32C unless responseHash is set.
+func writeCreatedHeaders(w http.ResponseWriter, f ent.File) error {
+	if responseHash {
+		return writeBlobHeaders(w, f)
+	}
+
+	w.Header().Add(ent.HeaderLastModified, f.LastModified().Format(time.RFC3339Nano))
+	return nil
+}
+
+// writeServedHeaders writes the headers of a file whose content is sent in
+// response to r. Content sent encoded has an ETag of its own, as it differs
+// from the content stored byte for byte.
+func writeServedHeaders(w http.ResponseWriter, r *http.Request, f ent.File) error {
+	err := writeBlobHeaders(w, f)
+	if err != nil {
+		return err
+	}
+
+	if compressResponses {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+
+	if encoding := responseEncoding(r); encoding != "" {
+		w.Header().Set(ent.HeaderETag, encodedETag(w.Header().Get(ent.HeaderETag), encoding))
+	}
+
+	return nil
+}
+
 func writeBlobHeaders(w http.ResponseWriter, f ent.File) error {
-	h, err := f.Hash()
+	etag, err := f.ETag()
+	if err != nil {
+		return err
+	}
+
+	crc, err := fileCRC32C(f)
 	if err != nil {
 		return err
 	}
 
-	w.Header().Add(ent.HeaderETag, hex.EncodeToString(h))
+	w.Header().Add(ent.HeaderETag, etag)
+	w.Header().Add(ent.HeaderCRC32C, crc)
 	w.Header().Add(ent.HeaderLastModified, f.LastModified().Format(time.RFC3339Nano))
 	return nil
 }
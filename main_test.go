@@ -2,12 +2,16 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"crypto/sha1"
 	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/mail"
@@ -15,9 +19,15 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/gorilla/pat"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/soundcloud/ent/lib"
 )
 
@@ -68,356 +78,2624 @@ func TestHandleCreate(t *testing.T) {
 	if resp.File.Key != key {
 		t.Errorf("keys differ: %s != %s", resp.File.Key, key)
 	}
+
+	raw, err := ioutil.ReadFile(fixtureZip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crc := fmt.Sprintf("%08x", crc32.Checksum(raw, crc32.MakeTable(crc32.Castagnoli)))
+
+	if have, want := res.Header.Get(ent.HeaderCRC32C), crc; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	if have, want := resp.File.CRC32C, crc; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
 }
 
-func TestHandleCreateInvalidBucket(t *testing.T) {
-	fs := ent.NewMemoryFS()
+func TestHandleCreateKeepsCreated(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-created-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
 
-	r := pat.New()
-	r.Post(ent.RouteFile, handleCreate(ent.NewMemoryProvider(), fs))
+	var (
+		fs = newDiskFS(tmp)
+		b  = ent.NewBucket("created", ent.Owner{})
+		r  = pat.New()
+	)
+
+	r.Post(ent.RouteFile, handleCreate(ent.NewMemoryProvider(b), fs))
 
 	ts := httptest.NewServer(r)
 	defer ts.Close()
 
-	ep := fmt.Sprintf("%s/%s/%s", ts.URL, "fake-bucket", "cat.zip")
-	res, err := http.Post(ep, "text/plain", bytes.NewReader([]byte("fake file")))
-	if err != nil {
-		t.Fatal(err)
+	create := func(content string) ent.ResponseFile {
+		res, err := http.Post(ts.URL+"/"+b.Name+"/audited.txt", "text/plain", strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		resp := ent.ResponseCreated{}
+
+		err = json.NewDecoder(res.Body).Decode(&resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return resp.File
 	}
-	defer res.Body.Close()
 
-	resp := ent.ResponseError{}
-	err = json.NewDecoder(res.Body).Decode(&resp)
-	if err != nil {
-		t.Fatal(err)
+	first := create("first")
+
+	time.Sleep(10 * time.Millisecond)
+
+	second := create("second")
+
+	if first.Created.IsZero() {
+		t.Fatal("created missing from response")
 	}
 
-	if res.StatusCode != http.StatusNotFound {
-		t.Errorf("HTTP %d", res.StatusCode)
+	if have, want := second.Created, first.Created; !have.Equal(want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	if !second.LastModified.After(first.LastModified) {
+		t.Errorf("last modified %v not after %v", second.LastModified, first.LastModified)
 	}
 }
 
-func TestHandleDelete(t *testing.T) {
+func TestHandleCreateUnchanged(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-unchanged-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
 	var (
-		b   = ent.NewBucket("handle-delete", ent.Owner{})
-		fs  = ent.NewMemoryFS()
+		fs  = newDiskFS(tmp)
+		b   = ent.NewBucket("unchanged", ent.Owner{})
 		r   = pat.New()
-		key = filepath.Base(fixtureZip)
+		key = "same.txt"
 	)
 
-	r.Delete(ent.RouteFile, handleDelete(ent.NewMemoryProvider(b), fs))
+	r.Post(ent.RouteFile, handleCreate(ent.NewMemoryProvider(b), fs))
 
 	ts := httptest.NewServer(r)
 	defer ts.Close()
 
-	f, err := os.Open(fixtureZip)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	file, err := fs.Create(b, key, f)
+	_, err = fs.Create(b, key, strings.NewReader("content"))
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	req, err := http.NewRequest(
-		"DELETE",
-		fmt.Sprintf("%s/%s/%s", ts.URL, b.Name, key),
-		nil,
+	var (
+		p     = filepath.Join(tmp, b.Name, key)
+		mtime = time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
 	)
+
+	err = os.Chtimes(p, mtime, mtime)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	res, err := (&http.Client{}).Do(req)
-	if err != nil {
-		t.Fatal(err)
+	post := func(content string) int {
+		sum := sha1.Sum([]byte(content))
+
+		req, err := http.NewRequest("POST", fmt.Sprintf("%s/%s/%s", ts.URL, b.Name, key), strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(ent.HeaderSHA1, hex.EncodeToString(sum[:]))
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		return res.StatusCode
 	}
-	defer res.Body.Close()
 
-	if have, want := res.StatusCode, http.StatusOK; have != want {
+	if have, want := post("content"), http.StatusOK; have != want {
 		t.Errorf("have %d, want %d", have, want)
 	}
 
-	resp := ent.ResponseDeleted{}
-
-	err = json.NewDecoder(res.Body).Decode(&resp)
+	stat, err := os.Stat(p)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if have, want := resp.File.Key, key; have != want {
-		t.Errorf("want %v, got %v", have, want)
+	if have, want := stat.ModTime(), mtime; !have.Equal(want) {
+		t.Errorf("have %v, want %v", have, want)
 	}
 
-	if have, want := resp.File.LastModified, file.LastModified(); !have.Equal(want) {
-		t.Errorf("want %v, got %v", have, want)
+	if have, want := post("changed"), http.StatusCreated; have != want {
+		t.Errorf("have %d, want %d", have, want)
 	}
 
-	if have, want := resp.File.Bucket, b; !reflect.DeepEqual(have, want) {
-		t.Errorf("want %v, got %v", have, want)
+	stat, err = os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	if _, have := fs.Open(b, key); !ent.IsFileNotFound(have) {
-		t.Errorf("have %s, want %s", have, ent.ErrFileNotFound)
+	if stat.ModTime().Equal(mtime) {
+		t.Errorf("changed content not written")
 	}
 }
 
-func TestHandleGetLastModifiedReturnsNotModified(t *testing.T) {
+func TestHandleCreateGzip(t *testing.T) {
 	var (
-		fs = ent.NewMemoryFS()
-		b  = ent.NewBucket("handle-get", ent.Owner{})
-		k  = "foo.zip"
-		r  = pat.New()
+		fs      = ent.NewMemoryFS()
+		b       = ent.NewBucket("gzip", ent.Owner{})
+		r       = pat.New()
+		content = bytes.Repeat([]byte("uncompressed content "), 100)
+		buf     = &bytes.Buffer{}
 	)
 
-	r.Get(ent.RouteFile, handleGet(ent.NewMemoryProvider(b), fs))
+	r.Post(ent.RouteFile, handleCreate(ent.NewMemoryProvider(b), fs))
 
 	ts := httptest.NewServer(r)
 	defer ts.Close()
 
-	f, err := os.Open(fixtureZip)
+	gw := gzip.NewWriter(buf)
+	_, err := gw.Write(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = gw.Close()
 	if err != nil {
 		t.Fatal(err)
 	}
+	compressed := buf.Bytes()
 
-	file, err := fs.Create(b, k, f)
+	post := func(key string, body []byte) int {
+		req, err := http.NewRequest("POST", fmt.Sprintf("%s/%s/%s", ts.URL, b.Name, key), bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Encoding", "gzip")
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		return res.StatusCode
+	}
+
+	if have, want := post("gzipped.txt", compressed), http.StatusCreated; have != want {
+		t.Fatalf("have %d, want %d", have, want)
+	}
+
+	f, err := fs.Open(b, "gzipped.txt")
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer f.Close()
 
-	req, _ := http.NewRequest("GET", fmt.Sprintf("%s/%s/%s", ts.URL, b.Name, k), nil)
-	req.Header.Add("If-Modified-Since", file.LastModified().UTC().Format(http.TimeFormat))
+	h, err := f.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	res, err := http.DefaultClient.Do(req)
+	sum := sha1.Sum(content)
+
+	if have, want := hex.EncodeToString(h), hex.EncodeToString(sum[:]); have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	raw, err := ioutil.ReadAll(f)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer res.Body.Close()
 
-	if have, want := res.StatusCode, http.StatusNotModified; have != want {
-		t.Errorf("have %d, want %d", have, want)
+	if !bytes.Equal(raw, content) {
+		t.Errorf("stored content differs from the uncompressed content")
+	}
+
+	for name, body := range map[string][]byte{
+		"plain.txt":     content,
+		"truncated.txt": compressed[:len(compressed)/2],
+	} {
+		if have, want := post(name, body), http.StatusBadRequest; have != want {
+			t.Errorf("%s: have %d, want %d", name, have, want)
+		}
 	}
 }
 
-func TestHandleGet(t *testing.T) {
+func TestHandleCreatePut(t *testing.T) {
 	var (
 		fs = ent.NewMemoryFS()
-		b  = ent.NewBucket("handle-get", ent.Owner{})
-		k  = "foo.zip"
+		b  = ent.NewBucket("ent", ent.Owner{})
 		r  = pat.New()
 	)
 
-	r.Get(ent.RouteFile, handleGet(ent.NewMemoryProvider(b), fs))
+	r.Put(ent.RouteFile, handleCreate(ent.NewMemoryProvider(b), fs))
 
 	ts := httptest.NewServer(r)
 	defer ts.Close()
 
-	f, err := os.Open(fixtureZip)
-	if err != nil {
-		t.Fatal(err)
-	}
+	var (
+		key = "put/file.txt"
+		ep  = fmt.Sprintf("%s/%s/%s", ts.URL, b.Name, key)
+	)
 
-	file, err := fs.Create(b, k, f)
+	req, err := http.NewRequest("PUT", ep, bytes.NewReader([]byte("put content")))
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	ep := fmt.Sprintf("%s/%s/%s", ts.URL, b.Name, k)
-	res, err := http.Get(ep)
+	res, err := http.DefaultClient.Do(req)
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer res.Body.Close()
 
-	if have, want := res.StatusCode, http.StatusOK; have != want {
+	if have, want := res.StatusCode, http.StatusCreated; have != want {
 		t.Errorf("have %d, want %d", have, want)
 	}
 
-	hash := sha1.New()
+	resp := ent.ResponseCreated{}
 
-	_, err = io.Copy(hash, res.Body)
+	err = json.NewDecoder(res.Body).Decode(&resp)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	test, err := file.Hash()
+	if have, want := resp.File.Key, key; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	f, err := fs.Open(b, key)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	var (
-		have = hex.EncodeToString(hash.Sum(nil))
-		want = hex.EncodeToString(test)
-	)
+	raw, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	if have != want {
-		t.Errorf("have %v, want %v", have, want)
+	if have, want := string(raw), "put content"; have != want {
+		t.Errorf("have %q, want %q", have, want)
 	}
 }
 
-func TestHandleBucketList(t *testing.T) {
-	var (
-		bs = createBuckets([]string{"peer", "nxt", "master"})
-		r  = pat.New()
-	)
+func TestHandleCreateInvalidBucket(t *testing.T) {
+	fs := ent.NewMemoryFS()
 
-	r.Get("/", handleBucketList(ent.NewMemoryProvider(bs...)))
+	r := pat.New()
+	r.Post(ent.RouteFile, handleCreate(ent.NewMemoryProvider(), fs))
 
 	ts := httptest.NewServer(r)
 	defer ts.Close()
 
-	res, err := http.Get(ts.URL)
+	ep := fmt.Sprintf("%s/%s/%s", ts.URL, "fake-bucket", "cat.zip")
+	res, err := http.Post(ep, "text/plain", bytes.NewReader([]byte("fake file")))
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer res.Body.Close()
 
-	resp := ent.ResponseBucketList{}
+	resp := ent.ResponseError{}
 	err = json.NewDecoder(res.Body).Decode(&resp)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if res.StatusCode != http.StatusOK {
+	if res.StatusCode != http.StatusNotFound {
 		t.Errorf("HTTP %d", res.StatusCode)
 	}
-
-	if resp.Count != len(bs) {
-		t.Errorf("not enough buckets returned: %d != %d", resp.Count, len(bs))
-	}
-
-	if !reflect.DeepEqual(toMap(resp.Buckets), toMap(bs)) {
-		t.Errorf("wrong answer")
-	}
 }
 
-func TestHandleFileList(t *testing.T) {
+func TestHandleCreateEmptyBody(t *testing.T) {
 	var (
-		name = "master"
-		bs   = createBuckets([]string{name})
-		fs   = ent.NewMemoryFS()
-		p    = "list/files"
-		r    = pat.New()
+		permissive = ent.NewBucket("permissive", ent.Owner{})
+		strict     = &ent.Bucket{Name: "strict", RejectEmpty: true}
+		fs         = ent.NewMemoryFS()
+		r          = pat.New()
 	)
 
-	r.Get(ent.RouteBucket, handleFileList(ent.NewMemoryProvider(bs...), fs))
+	r.Post(ent.RouteFile, handleCreate(ent.NewMemoryProvider(permissive, strict), fs))
 
 	ts := httptest.NewServer(r)
 	defer ts.Close()
 
-	f, err := os.Open(fixtureZip)
-	if err != nil {
-		t.Fatal(err)
-	}
+	for _, input := range []struct {
+		bucket *ent.Bucket
+		body   string
+		status int
+	}{
+		{permissive, "", http.StatusCreated},
+		{strict, "", http.StatusBadRequest},
+		{strict, "content", http.StatusCreated},
+	} {
+		ep := fmt.Sprintf("%s/%s/%s", ts.URL, input.bucket.Name, "marker")
 
-	for i := 0; i < 10; i++ {
-		_, err := fs.Create(bs[0], fmt.Sprintf("%s/%d", p, i), f)
+		res, err := http.Post(ep, "text/plain", bytes.NewReader([]byte(input.body)))
 		if err != nil {
 			t.Fatal(err)
 		}
-	}
-
-	inputs := []struct {
-		count int
-		vs    url.Values
-	}{
-		{
-			count: 1,
-			vs:    url.Values{"limit": []string{"1"}, "sort": []string{"+lastModified"}},
-		},
-		{
-			count: 10,
-			vs:    url.Values{"prefix": []string{p}},
-		},
-		{
-			count: 4,
-			vs:    url.Values{"limit": []string{"4"}, "prefix": []string{p}, "sort": []string{"-key"}},
-		},
-	}
+		res.Body.Close()
 
-	for _, input := range inputs {
-		filesURL := fmt.Sprintf("%s/%s?%s", ts.URL, name, input.vs.Encode())
-
-		files, err := getFiles(filesURL)
-		if err != nil {
-			t.Error(err)
+		if have, want := res.StatusCode, input.status; have != want {
+			t.Errorf("%s %q: have %d, want %d", input.bucket.Name, input.body, have, want)
 		}
+	}
 
-		if have, want := len(files), input.count; have != want {
-			t.Logf("%#v", files)
-			t.Errorf("have %d, want %d", have, want)
-		}
+	_, err := fs.Open(permissive, "marker")
+	if err != nil {
+		t.Errorf("empty file not stored: %s", err)
 	}
 }
 
-func TestHandleFileListInvalidParams(t *testing.T) {
+func TestHandleKeyPattern(t *testing.T) {
+	p, err := newDiskProvider("./fixture")
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	var (
-		name = "master"
-		bs   = createBuckets([]string{name})
-		fs   = ent.NewMemoryFS()
-		p    = "invalid/files"
-		r    = pat.New()
+		fs = ent.NewMemoryFS()
+		r  = pat.New()
+	)
+
+	r.Post(ent.RouteFile, handleCreate(p, fs))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	for _, input := range []struct {
+		key    string
+		status int
+	}{
+		{"logs/2016/05/app.log", http.StatusCreated},
+		{"logs/app.log", http.StatusBadRequest},
+	} {
+		res, err := http.Post(
+			fmt.Sprintf("%s/logs/%s", ts.URL, input.key),
+			"text/plain",
+			strings.NewReader("content"),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp := ent.ResponseError{}
+
+		err = json.NewDecoder(res.Body).Decode(&resp)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have, want := res.StatusCode, input.status; have != want {
+			t.Errorf("%s: have %d, want %d", input.key, have, want)
+		}
+
+		if input.status == http.StatusBadRequest {
+			if have, want := resp.Error, ent.ErrKeyNotAllowed.Error(); have != want {
+				t.Errorf("%s: have %q, want %q", input.key, have, want)
+			}
+		}
+	}
+}
+
+func TestHandleReadOnlyBucket(t *testing.T) {
+	var (
+		b  = &ent.Bucket{Name: "archive", ReadOnly: true}
+		fs = ent.NewMemoryFS()
+		r  = pat.New()
+		p  = ent.NewMemoryProvider(b)
+	)
+
+	r.Add("GET", ent.RouteFile, handleGet(p, fs))
+	r.Add("POST", ent.RouteFile, handleCreate(p, fs))
+	r.Add("DELETE", ent.RouteFile, handleDelete(p, fs))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	_, err := fs.Create(b, "seeded.txt", strings.NewReader("seeded"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, input := range []struct {
+		method string
+		key    string
+		status int
+	}{
+		{"POST", "new.txt", http.StatusForbidden},
+		{"POST", "seeded.txt", http.StatusForbidden},
+		{"DELETE", "seeded.txt", http.StatusForbidden},
+		{"GET", "seeded.txt", http.StatusOK},
+	} {
+		req, err := http.NewRequest(
+			input.method,
+			fmt.Sprintf("%s/%s/%s", ts.URL, b.Name, input.key),
+			strings.NewReader("content"),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if have, want := res.StatusCode, input.status; have != want {
+			t.Errorf("%s %s: have %d, want %d", input.method, input.key, have, want)
+		}
+	}
+
+	_, err = fs.Open(b, "new.txt")
+	if have, want := err, ent.ErrFileNotFound; have != want {
+		t.Errorf("have %v, want %v", have, want)
+	}
+}
+
+func TestHandleEmptyBucket(t *testing.T) {
+	var (
+		fs = ent.NewMemoryFS()
+		p  = ent.NewMemoryProvider(ent.NewBucket("ent", ent.Owner{}))
+	)
+
+	for _, input := range []struct {
+		method  string
+		handler http.Handler
+	}{
+		{"GET", handleGet(p, fs)},
+		{"POST", handleCreate(p, fs)},
+		{"DELETE", handleDelete(p, fs)},
+		{"GET", handleFileList(p, fs)},
+	} {
+		req := httptest.NewRequest(
+			input.method,
+			"/?"+url.Values{ent.KeyBucket: {""}, ent.KeyBlob: {"file.txt"}}.Encode(),
+			strings.NewReader("content"),
+		)
+		w := httptest.NewRecorder()
+
+		input.handler.ServeHTTP(w, req)
+
+		if have, want := w.Code, http.StatusBadRequest; have != want {
+			t.Errorf("%s: have %d, want %d", input.method, have, want)
+		}
+
+		res := ent.ResponseError{}
+
+		err := json.NewDecoder(w.Body).Decode(&res)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have, want := res.Error, ent.ErrEmptyBucket.Error(); have != want {
+			t.Errorf("%s: have %q, want %q", input.method, have, want)
+		}
+	}
+
+	req := httptest.NewRequest("HEAD", "/", nil)
+	w := httptest.NewRecorder()
+
+	handleBucketExists(p, fs).ServeHTTP(w, req)
+
+	if have, want := w.Code, http.StatusBadRequest; have != want {
+		t.Errorf("HEAD: have %d, want %d", have, want)
+	}
+}
+
+func TestHandleNormalizeKey(t *testing.T) {
+	var (
+		b  = ent.NewBucket("keys", ent.Owner{})
+		fs = ent.NewMemoryFS()
+		h  = normalizeKey(handleCreate(ent.NewMemoryProvider(b), fs))
+	)
+
+	// The router redirects paths with empty or dot segments, keys are passed
+	// as params to not depend on it.
+	for _, input := range []struct {
+		key    string
+		status int
+	}{
+		{"nested//file.txt", http.StatusCreated},
+		{"nested/", http.StatusBadRequest},
+		{"./file.txt", http.StatusBadRequest},
+		{"nested/../file.txt", http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest(
+			"POST",
+			"/?"+url.Values{ent.KeyBucket: {b.Name}, ent.KeyBlob: {input.key}}.Encode(),
+			strings.NewReader("content"),
+		)
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		if have, want := w.Code, input.status; have != want {
+			t.Errorf("%q: have %d, want %d", input.key, have, want)
+		}
+	}
+
+	_, err := fs.Open(b, "nested/file.txt")
+	if err != nil {
+		t.Errorf("normalized key not stored: %s", err)
+	}
+}
+
+func TestHandleKeyTooLong(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-keylen-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		b = ent.NewBucket("keys", ent.Owner{})
+		h = normalizeKey(handleCreate(ent.NewMemoryProvider(b), newDiskFS(tmp)))
+	)
+
+	for _, input := range []struct {
+		key    string
+		status int
+	}{
+		{strings.Repeat("a", maxSegmentLen), http.StatusCreated},
+		{strings.Repeat("a", 300), http.StatusBadRequest},
+		{strings.Repeat("nested/", maxKeyLen/7) + "file.txt", http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest(
+			"POST",
+			"/?"+url.Values{ent.KeyBucket: {b.Name}, ent.KeyBlob: {input.key}}.Encode(),
+			strings.NewReader("content"),
+		)
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		if have, want := w.Code, input.status; have != want {
+			t.Errorf("%d bytes: have %d, want %d", len(input.key), have, want)
+		}
+	}
+}
+
+func TestHandleCreateIfNoneMatch(t *testing.T) {
+	var (
+		b  = ent.NewBucket("ent", ent.Owner{})
+		fs = ent.NewMemoryFS()
+		r  = pat.New()
+	)
+
+	r.Post(ent.RouteFile, handleCreate(ent.NewMemoryProvider(b), fs))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	ep := fmt.Sprintf("%s/%s/%s", ts.URL, b.Name, "once.txt")
+
+	for _, input := range []struct {
+		body   string
+		status int
+	}{
+		{"first", http.StatusCreated},
+		{"second", http.StatusPreconditionFailed},
+	} {
+		req, err := http.NewRequest("POST", ep, bytes.NewReader([]byte(input.body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(ent.HeaderIfNoneMatch, "*")
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if have, want := res.StatusCode, input.status; have != want {
+			t.Errorf("%s: have %d, want %d", input.body, have, want)
+		}
+	}
+
+	f, err := fs.Open(b, "once.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := string(raw), "first"; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+}
+
+func TestHandleDelete(t *testing.T) {
+	var (
+		b   = ent.NewBucket("handle-delete", ent.Owner{})
+		fs  = ent.NewMemoryFS()
+		r   = pat.New()
+		key = filepath.Base(fixtureZip)
+	)
+
+	r.Delete(ent.RouteFile, handleDelete(ent.NewMemoryProvider(b), fs))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	f, err := os.Open(fixtureZip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := fs.Create(b, key, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest(
+		"DELETE",
+		fmt.Sprintf("%s/%s/%s", ts.URL, b.Name, key),
+		nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := (&http.Client{}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if have, want := res.StatusCode, http.StatusOK; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+
+	resp := ent.ResponseDeleted{}
+
+	err = json.NewDecoder(res.Body).Decode(&resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := resp.File.Key, key; have != want {
+		t.Errorf("want %v, got %v", have, want)
+	}
+
+	if have, want := resp.File.LastModified, file.LastModified(); !have.Equal(want) {
+		t.Errorf("want %v, got %v", have, want)
+	}
+
+	if have, want := resp.File.Bucket, b; !reflect.DeepEqual(have, want) {
+		t.Errorf("want %v, got %v", have, want)
+	}
+
+	if _, have := fs.Open(b, key); !ent.IsFileNotFound(have) {
+		t.Errorf("have %s, want %s", have, ent.ErrFileNotFound)
+	}
+}
+
+func TestHandleDeletePrefix(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-delete-prefix-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		b  = ent.NewBucket("delete-prefix", ent.Owner{})
+		fs = newDiskFS(tmp)
+		r  = pat.New()
+	)
+
+	r.Delete(ent.RouteBucket, handleDeletePrefix(ent.NewMemoryProvider(b), fs))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	for _, key := range []string{
+		"logs/2016/a.txt",
+		"logs/2016/b.txt",
+		"logs/2016/retained.txt",
+		"logs/2017/c.txt",
+		"logs2016.txt",
+	} {
+		_, err := fs.Create(b, key, strings.NewReader(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = fs.SetMeta(b, "logs/2016/retained.txt", ent.Meta{RetainUntil: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	del := func(query url.Values) (int, ent.ResponseBatchDelete) {
+		req, err := http.NewRequest("DELETE", fmt.Sprintf("%s/%s?%s", ts.URL, b.Name, query.Encode()), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		resp := ent.ResponseBatchDelete{}
+		if res.StatusCode == http.StatusOK {
+			err = json.NewDecoder(res.Body).Decode(&resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		return res.StatusCode, resp
+	}
+
+	// An empty prefix has to be confirmed to delete the whole bucket.
+	code, _ := del(url.Values{})
+	if have, want := code, http.StatusBadRequest; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+
+	code, resp := del(url.Values{ent.ParamPrefix: {"logs/2016/"}})
+	if have, want := code, http.StatusOK; have != want {
+		t.Fatalf("have %d, want %d", have, want)
+	}
+
+	if have, want := resp.Deleted, 2; have != want {
+		t.Errorf("have %d deleted, want %d", have, want)
+	}
+
+	if have, want := resp.Failed, 1; have != want {
+		t.Fatalf("have %d failed, want %d", have, want)
+	}
+
+	if have, want := resp.Errors[0].Key, "logs/2016/retained.txt"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	for key, exists := range map[string]bool{
+		"logs/2016/a.txt":        false,
+		"logs/2016/b.txt":        false,
+		"logs/2016/retained.txt": true,
+		"logs/2017/c.txt":        true,
+		"logs2016.txt":           true,
+	} {
+		_, err := fs.Open(b, key)
+		if have, want := err == nil, exists; have != want {
+			t.Errorf("%s: have exists %t, want %t", key, have, want)
+		}
+	}
+
+	code, resp = del(url.Values{ent.ParamAll: {"true"}})
+	if have, want := code, http.StatusOK; have != want {
+		t.Fatalf("have %d, want %d", have, want)
+	}
+
+	if have, want := resp.Deleted, 2; have != want {
+		t.Errorf("have %d deleted, want %d", have, want)
+	}
+}
+
+func TestHandleRetention(t *testing.T) {
+	var (
+		b           = ent.NewBucket("handle-retention", ent.Owner{})
+		fs          = ent.NewMemoryFS()
+		p           = ent.NewMemoryProvider(b)
+		r           = pat.New()
+		key         = "retained.file"
+		retainUntil = time.Now().Add(300 * time.Millisecond)
+	)
+
+	r.Delete(ent.RouteFile, handleDelete(p, fs))
+	r.Get(ent.RouteFile, handleGet(p, fs))
+	r.Post(ent.RouteFile, handleCreate(p, fs))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	ep := fmt.Sprintf("%s/%s/%s", ts.URL, b.Name, key)
+
+	req, err := http.NewRequest("POST", ep, bytes.NewReader([]byte("retained")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(ent.HeaderRetainUntil, retainUntil.Format(time.RFC3339Nano))
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if have, want := res.StatusCode, http.StatusCreated; have != want {
+		t.Fatalf("have %d, want %d", have, want)
+	}
+
+	res, err = http.Get(ep + "?" + ent.ParamRetention)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	retention := ent.ResponseRetention{}
+
+	err = json.NewDecoder(res.Body).Decode(&retention)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := retention.RetainUntil, retainUntil; !have.Equal(want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	for _, method := range []string{"POST", "DELETE"} {
+		req, err := http.NewRequest(method, ep, bytes.NewReader([]byte("overwrite")))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if have, want := res.StatusCode, http.StatusForbidden; have != want {
+			t.Errorf("%s: have %d, want %d", method, have, want)
+		}
+	}
+
+	time.Sleep(time.Until(retainUntil))
+
+	req, err = http.NewRequest("DELETE", ep, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if have, want := res.StatusCode, http.StatusOK; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+}
+
+func TestHandleExpires(t *testing.T) {
+	var (
+		fs  = ent.NewMemoryFS()
+		b   = ent.NewBucket("expires", ent.Owner{})
+		p   = ent.NewMemoryProvider(b)
+		r   = pat.New()
+		key = "ephemeral.file"
+	)
+
+	r.Add("HEAD", ent.RouteFile, handleExists(p, fs))
+	r.Get(ent.RouteFile, handleGet(p, fs))
+	r.Post(ent.RouteFile, handleCreate(p, fs))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	ep := fmt.Sprintf("%s/%s/%s", ts.URL, b.Name, key)
+
+	create := func(expires string) {
+		req, err := http.NewRequest("POST", ep, bytes.NewReader([]byte("ephemeral")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expires != "" {
+			req.Header.Set(ent.HeaderExpires, expires)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if have, want := res.StatusCode, http.StatusCreated; have != want {
+			t.Fatalf("have %d, want %d", have, want)
+		}
+	}
+
+	status := func(method string) int {
+		req, err := http.NewRequest(method, ep, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		return res.StatusCode
+	}
+
+	create(time.Now().Add(-time.Minute).Format(time.RFC3339))
+
+	m, err := fs.Meta(b, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Expires.IsZero() {
+		t.Fatal("expiry not stored")
+	}
+
+	for _, method := range []string{"GET", "HEAD"} {
+		if have, want := status(method), http.StatusNotFound; have != want {
+			t.Errorf("%s: have %d, want %d", method, have, want)
+		}
+	}
+
+	// Storing the file again without expiry keeps it.
+	create("")
+
+	for _, method := range []string{"GET", "HEAD"} {
+		if have, want := status(method), http.StatusOK; have != want {
+			t.Errorf("%s: have %d, want %d", method, have, want)
+		}
+	}
+}
+
+func TestHandleGetLastModifiedReturnsNotModified(t *testing.T) {
+	var (
+		fs = ent.NewMemoryFS()
+		b  = ent.NewBucket("handle-get", ent.Owner{})
+		k  = "foo.zip"
+		r  = pat.New()
+	)
+
+	r.Get(ent.RouteFile, handleGet(ent.NewMemoryProvider(b), fs))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	f, err := os.Open(fixtureZip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := fs.Create(b, k, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", fmt.Sprintf("%s/%s/%s", ts.URL, b.Name, k), nil)
+	req.Header.Add("If-Modified-Since", file.LastModified().UTC().Format(http.TimeFormat))
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if have, want := res.StatusCode, http.StatusNotModified; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+}
+
+func TestHandleExistsContentLength(t *testing.T) {
+	var (
+		fs = ent.NewMemoryFS()
+		b  = ent.NewBucket("handle-exists", ent.Owner{})
+		k  = "foo.zip"
+		r  = pat.New()
+	)
+
+	r.Add("HEAD", ent.RouteFile, handleExists(ent.NewMemoryProvider(b), fs))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	raw, err := ioutil.ReadFile(fixtureZip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = fs.Create(b, k, bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.Head(fmt.Sprintf("%s/%s/%s", ts.URL, b.Name, k))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if have, want := res.StatusCode, http.StatusOK; have != want {
+		t.Fatalf("have %d, want %d", have, want)
+	}
+
+	if have, want := res.ContentLength, int64(len(raw)); have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+}
+
+func TestHandleExistsErrorHeader(t *testing.T) {
+	var (
+		fs = ent.NewMemoryFS()
+		b  = ent.NewBucket("handle-exists", ent.Owner{})
+		r  = pat.New()
+	)
+
+	r.Add("HEAD", ent.RouteFile, handleExists(ent.NewMemoryProvider(b), fs))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	for _, input := range []struct {
+		bucket string
+		err    error
+	}{
+		{"missing", ent.ErrBucketNotFound},
+		{b.Name, ent.ErrFileNotFound},
+	} {
+		res, err := http.Head(fmt.Sprintf("%s/%s/missing.zip", ts.URL, input.bucket))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if have, want := res.StatusCode, http.StatusNotFound; have != want {
+			t.Errorf("%s: have %d, want %d", input.bucket, have, want)
+		}
+
+		if have, want := res.Header.Get(ent.HeaderError), input.err.Error(); have != want {
+			t.Errorf("%s: have %q, want %q", input.bucket, have, want)
+		}
+	}
+}
+
+func TestHandleExistsReturnsNotModified(t *testing.T) {
+	var (
+		fs = ent.NewMemoryFS()
+		b  = ent.NewBucket("handle-exists", ent.Owner{})
+		k  = "foo.zip"
+		r  = pat.New()
+	)
+
+	r.Add("HEAD", ent.RouteFile, handleExists(ent.NewMemoryProvider(b), fs))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	file, err := fs.Create(b, k, bytes.NewReader([]byte("unchanged")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := file.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		etag         = hex.EncodeToString(h)
+		lastModified = file.LastModified().UTC().Format(http.TimeFormat)
+		earlier      = file.LastModified().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	)
+
+	for _, test := range []struct {
+		header string
+		value  string
+		status int
+	}{
+		{ent.HeaderIfNoneMatch, etag, http.StatusNotModified},
+		{ent.HeaderIfNoneMatch, "other", http.StatusOK},
+		{ent.HeaderIfModifiedSince, lastModified, http.StatusNotModified},
+		{ent.HeaderIfModifiedSince, earlier, http.StatusOK},
+	} {
+		req, err := http.NewRequest("HEAD", fmt.Sprintf("%s/%s/%s", ts.URL, b.Name, k), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(test.header, test.value)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if have, want := res.StatusCode, test.status; have != want {
+			t.Errorf("%s %s: have %d, want %d", test.header, test.value, have, want)
+		}
+
+		if have, want := res.Header.Get(ent.HeaderETag), etag; have != want {
+			t.Errorf("%s %s: have %s, want %s", test.header, test.value, have, want)
+		}
+	}
+}
+
+func TestHandleGetETagReturnsNotModified(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-handle-get-etag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		fs = newHashIndexFS(newDiskFS(tmp))
+		b  = ent.NewBucket("handle-get", ent.Owner{})
+		p  = ent.NewMemoryProvider(b)
+		k  = "etag.txt"
+		r  = pat.New()
+	)
+
+	r.Get(ent.RouteFileByHash, handleGetByHash(p, fs))
+	r.Get(ent.RouteFile, handleGet(p, fs))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	_, err = fs.Create(b, k, bytes.NewReader([]byte("cached content")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.Get(fmt.Sprintf("%s/%s/%s", ts.URL, b.Name, k))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	etag := res.Header.Get(ent.HeaderETag)
+	if etag == "" {
+		t.Fatal("missing ETag")
+	}
+
+	for _, ep := range []string{
+		fmt.Sprintf("%s/%s/%s", ts.URL, b.Name, k),
+		fmt.Sprintf("%s/%s/_by-hash/%s", ts.URL, b.Name, etag),
+	} {
+		req, _ := http.NewRequest("GET", ep, nil)
+		req.Header.Set(ent.HeaderIfNoneMatch, etag)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		raw, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have, want := res.StatusCode, http.StatusNotModified; have != want {
+			t.Errorf("GET %s: have %d, want %d", ep, have, want)
+		}
+
+		if have, want := len(raw), 0; have != want {
+			t.Errorf("GET %s: have %d bytes, want %d", ep, have, want)
+		}
+	}
+}
+
+func TestHandleGet(t *testing.T) {
+	var (
+		fs = ent.NewMemoryFS()
+		b  = ent.NewBucket("handle-get", ent.Owner{})
+		k  = "foo.zip"
+		r  = pat.New()
+	)
+
+	r.Get(ent.RouteFile, handleGet(ent.NewMemoryProvider(b), fs))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	f, err := os.Open(fixtureZip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := fs.Create(b, k, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ep := fmt.Sprintf("%s/%s/%s", ts.URL, b.Name, k)
+	res, err := http.Get(ep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if have, want := res.StatusCode, http.StatusOK; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+
+	hash := sha1.New()
+
+	_, err = io.Copy(hash, res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	test, err := file.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		have = hex.EncodeToString(hash.Sum(nil))
+		want = hex.EncodeToString(test)
+	)
+
+	if have != want {
+		t.Errorf("have %v, want %v", have, want)
+	}
+}
+
+func TestHandleGetMeta(t *testing.T) {
+	var (
+		fs      = ent.NewMemoryFS()
+		b       = ent.NewBucket("handle-get-meta", ent.Owner{})
+		k       = "nested/meta.txt"
+		content = "described, not sent"
+		expires = time.Now().Add(time.Hour)
+		r       = pat.New()
+	)
+
+	r.Get(ent.RouteFile, handleGet(ent.NewMemoryProvider(b), fs))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	f, err := fs.Create(b, k, strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = setExpires(fs, b, k, expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.Get(fmt.Sprintf("%s/%s/%s?%s", ts.URL, b.Name, k, ent.ParamMeta))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if have, want := res.StatusCode, http.StatusOK; have != want {
+		t.Fatalf("have %d, want %d", have, want)
+	}
+
+	stat := ent.ResponseFile{}
+
+	err = json.NewDecoder(res.Body).Decode(&stat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha1.Sum([]byte(content))
+
+	if have, want := stat.Key, k; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	if have, want := stat.Size, int64(len(content)); have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+
+	if have, want := stat.Hash, hex.EncodeToString(sum[:]); have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	if have, want := stat.LastModified, f.LastModified(); !have.Equal(want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	if stat.Meta == nil {
+		t.Fatal("meta missing")
+	}
+
+	if have, want := stat.Meta.Expires, expires; !have.Equal(want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	res, err = http.Get(fmt.Sprintf("%s/%s/missing.txt?%s", ts.URL, b.Name, ent.ParamMeta))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if have, want := res.StatusCode, http.StatusNotFound; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+}
+
+func TestHandleGetDirectoryKey(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-handle-get-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		fs = newDiskFS(tmp)
+		b  = ent.NewBucket("handle-get", ent.Owner{})
+		p  = ent.NewMemoryProvider(b)
+		r  = pat.New()
+	)
+
+	r.Add("HEAD", ent.RouteFile, handleExists(p, fs))
+	r.Get(ent.RouteFile, handleGet(p, fs))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	_, err = fs.Create(b, "nested/dir/file.txt", bytes.NewReader([]byte("content")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"nested", "nested/dir", "nested/dir/"} {
+		ep := fmt.Sprintf("%s/%s/%s", ts.URL, b.Name, key)
+
+		res, err := http.Get(ep)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp := ent.ResponseError{}
+		err = json.NewDecoder(res.Body).Decode(&resp)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("GET %s: %s", key, err)
+		}
+
+		if have, want := res.StatusCode, http.StatusNotFound; have != want {
+			t.Errorf("GET %s: have %d, want %d", key, have, want)
+		}
+
+		if have, want := resp.Code, http.StatusNotFound; have != want {
+			t.Errorf("GET %s: have %d, want %d", key, have, want)
+		}
+
+		res, err = http.Head(ep)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if have, want := res.StatusCode, http.StatusNotFound; have != want {
+			t.Errorf("HEAD %s: have %d, want %d", key, have, want)
+		}
+
+		if have, want := res.ContentLength, int64(0); have != want {
+			t.Errorf("HEAD %s: have %d, want %d", key, have, want)
+		}
+	}
+}
+
+func TestHandleBucketList(t *testing.T) {
+	var (
+		bs = createBuckets([]string{"peer", "nxt", "master"})
+		r  = pat.New()
+	)
+
+	r.Get("/", handleBucketList(ent.NewMemoryProvider(bs...)))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	resp := ent.ResponseBucketList{}
+	err = json.NewDecoder(res.Body).Decode(&resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("HTTP %d", res.StatusCode)
+	}
+
+	if resp.Count != len(bs) {
+		t.Errorf("not enough buckets returned: %d != %d", resp.Count, len(bs))
+	}
+
+	if !reflect.DeepEqual(toMap(resp.Buckets), toMap(bs)) {
+		t.Errorf("wrong answer")
+	}
+}
+
+func TestHandleBucketExists(t *testing.T) {
+	var (
+		fs    = ent.NewMemoryFS()
+		b     = ent.NewBucket("probed", ent.Owner{})
+		large = ent.NewBucket("large", ent.Owner{})
+		r     = pat.New()
+	)
+
+	r.Add("HEAD", ent.RouteBucket, handleBucketExists(ent.NewMemoryProvider(b, large), fs))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	for _, key := range []string{"a", "b", "c"} {
+		_, err := fs.Create(b, key, bytes.NewReader([]byte(key)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Counting stops past the limit.
+	for i := 0; i < bucketFileCountLimit+2; i++ {
+		_, err := fs.Create(large, strconv.Itoa(i), bytes.NewReader(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, input := range []struct {
+		bucket string
+		status int
+		count  string
+	}{
+		{b.Name, http.StatusOK, "3"},
+		{large.Name, http.StatusOK, "10000+"},
+		{"unknown", http.StatusNotFound, ""},
+	} {
+		res, err := http.Head(fmt.Sprintf("%s/%s", ts.URL, input.bucket))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if have, want := res.StatusCode, input.status; have != want {
+			t.Errorf("%s: have %d, want %d", input.bucket, have, want)
+		}
+
+		if have, want := res.Header.Get(ent.HeaderBucketFileCount), input.count; have != want {
+			t.Errorf("%s: have %q, want %q", input.bucket, have, want)
+		}
+	}
+}
+
+func TestHandleBucketStats(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-stats-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		fs = newDiskFS(tmp)
+		b  = ent.NewBucket("stats", ent.Owner{})
+		r  = pat.New()
+	)
+
+	r.Get(ent.RouteBucket, handleFileList(ent.NewMemoryProvider(b), fs))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	ep := fmt.Sprintf("%s/%s?%s", ts.URL, b.Name, ent.ParamStats)
+
+	stats := func() ent.ResponseBucketStats {
+		res, err := http.Get(ep)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		if have, want := res.StatusCode, http.StatusOK; have != want {
+			t.Fatalf("have %d, want %d", have, want)
+		}
+
+		resp := ent.ResponseBucketStats{}
+
+		err = json.NewDecoder(res.Body).Decode(&resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return resp
+	}
+
+	resp := stats()
+
+	if have, want := resp.FileCount, 0; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+
+	if have, want := resp.TotalBytes, int64(0); have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+
+	for key, content := range map[string]string{
+		"a":          "1",
+		"nested/b":   "12345",
+		"nested/c/d": "1234567890",
+	} {
+		_, err := fs.Create(b, key, strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp = stats()
+
+	if have, want := resp.FileCount, 3; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+
+	if have, want := resp.TotalBytes, int64(16); have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+}
+
+func TestHandleFileListNDJSON(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-ndjson-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		fs   = newDiskFS(tmp)
+		b    = ent.NewBucket("ndjson", ent.Owner{})
+		r    = pat.New()
+		keys = []string{"a", "b", "nested/c", "nested/d", "nested/deeper/e"}
+	)
+
+	r.Get(ent.RouteBucket, handleFileList(ent.NewMemoryProvider(b), fs))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	for _, key := range keys {
+		_, err := fs.Create(b, key, strings.NewReader(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		query      string
+		lines      int
+		nextMarker string
+	}{
+		{"", len(keys), ""},
+		{ent.ParamLimit + "=2", 2, ""},
+		{ent.ParamLimit + "=18446744073709551615", len(keys), ""},
+		{ent.ParamPrefix + "=nested/", 3, ""},
+		{ent.ParamSort + "=%2Bkey&" + ent.ParamLimit + "=2", 2, "b"},
+	} {
+		req, err := http.NewRequest("GET", fmt.Sprintf("%s/%s?%s", ts.URL, b.Name, test.query), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", ent.ContentTypeNDJSON)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have, want := res.Header.Get("Content-Type"), ent.ContentTypeNDJSON; have != want {
+			t.Errorf("%q: have %s, want %s", test.query, have, want)
+		}
+
+		if have, want := res.Header.Get(ent.HeaderNextMarker), test.nextMarker; have != want {
+			t.Errorf("%q: have %q, want %q", test.query, have, want)
+		}
+
+		var (
+			dec   = json.NewDecoder(res.Body)
+			lines = 0
+		)
+
+		for dec.More() {
+			f := ent.ResponseFile{}
+
+			err := dec.Decode(&f)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if f.Key == "" {
+				t.Errorf("%q: line %d without key", test.query, lines)
+			}
+			lines++
+		}
+		res.Body.Close()
+
+		if have, want := lines, test.lines; have != want {
+			t.Errorf("%q: have %d lines, want %d", test.query, have, want)
+		}
+	}
+}
+
+func TestHandleFileList(t *testing.T) {
+	var (
+		name = "master"
+		bs   = createBuckets([]string{name})
+		fs   = ent.NewMemoryFS()
+		p    = "list/files"
+		r    = pat.New()
+	)
+
+	r.Get(ent.RouteBucket, handleFileList(ent.NewMemoryProvider(bs...), fs))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	f, err := os.Open(fixtureZip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		_, err := fs.Create(bs[0], fmt.Sprintf("%s/%d", p, i), f)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	inputs := []struct {
+		count int
+		vs    url.Values
+	}{
+		{
+			count: 1,
+			vs:    url.Values{"limit": []string{"1"}, "sort": []string{"+lastModified"}},
+		},
+		{
+			count: 10,
+			vs:    url.Values{"prefix": []string{p}},
+		},
+		{
+			count: 4,
+			vs:    url.Values{"limit": []string{"4"}, "prefix": []string{p}, "sort": []string{"-key"}},
+		},
+		{
+			count: 0,
+			vs:    url.Values{"modifiedSince": []string{time.Now().Add(time.Hour).Format(time.RFC3339)}},
+		},
+		{
+			count: 10,
+			vs:    url.Values{"modifiedBefore": []string{time.Now().Add(time.Hour).Format(time.RFC3339)}},
+		},
+		{
+			count: 3,
+			vs:    url.Values{"marker": []string{p + "/6"}},
+		},
+		{
+			count: 2,
+			vs:    url.Values{"limit": []string{"2"}, "marker": []string{p + "/6"}, "sort": []string{"+key"}},
+		},
+	}
+
+	for _, input := range inputs {
+		filesURL := fmt.Sprintf("%s/%s?%s", ts.URL, name, input.vs.Encode())
+
+		files, err := getFiles(filesURL)
+		if err != nil {
+			t.Error(err)
+		}
+
+		if have, want := len(files), input.count; have != want {
+			t.Logf("%#v", files)
+			t.Errorf("have %d, want %d", have, want)
+		}
+	}
+}
+
+func TestHandleFileListMarker(t *testing.T) {
+	var (
+		b  = ent.NewBucket("marker", ent.Owner{})
+		fs = ent.NewMemoryFS()
+		r  = pat.New()
+	)
+
+	r.Get(ent.RouteBucket, handleFileList(ent.NewMemoryProvider(b), fs))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	for i := 0; i < 5; i++ {
+		_, err := fs.Create(b, fmt.Sprintf("file-%d", i), strings.NewReader("content"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var (
+		marker = ""
+		keys   = []string{}
+	)
+
+	for pages := 1; ; pages++ {
+		vs := url.Values{"limit": []string{"2"}, "sort": []string{"+key"}}
+		if marker != "" {
+			vs.Set(ent.ParamMarker, marker)
+		}
+
+		res, err := http.Get(fmt.Sprintf("%s/%s?%s", ts.URL, b.Name, vs.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		list := ent.ResponseFileList{}
+
+		err = json.NewDecoder(res.Body).Decode(&list)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, f := range list.Files {
+			keys = append(keys, f.Key)
+		}
+
+		if list.NextMarker == "" {
+			if have, want := pages, 3; have != want {
+				t.Errorf("have %d pages, want %d", have, want)
+			}
+			break
+		}
+
+		if have, want := list.NextMarker, keys[len(keys)-1]; have != want {
+			t.Fatalf("have %q, want %q", have, want)
+		}
+
+		marker = list.NextMarker
+	}
+
+	want := []string{"file-0", "file-1", "file-2", "file-3", "file-4"}
+	if have := keys; !reflect.DeepEqual(have, want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+}
+
+func TestHandleFileListDefaultSort(t *testing.T) {
+	defer func(sort string) { defaultSort = sort }(defaultSort)
+	defaultSort = ent.OrderAscending + ent.OrderKey
+
+	var (
+		b    = ent.NewBucket("sorted", ent.Owner{})
+		fs   = ent.NewMemoryFS()
+		r    = pat.New()
+		keys = []string{}
+	)
+
+	r.Get(ent.RouteBucket, handleFileList(ent.NewMemoryProvider(b), fs))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	// The MemoryFS lists files in random order unless sorted.
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("file-%02d", i)
+		keys = append(keys, key)
+
+		_, err := fs.Create(b, key, strings.NewReader("content"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list := func(query string) []string {
+		res, err := http.Get(fmt.Sprintf("%s/%s?%s", ts.URL, b.Name, query))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		list := ent.ResponseFileList{}
+
+		err = json.NewDecoder(res.Body).Decode(&list)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		listed := []string{}
+		for _, f := range list.Files {
+			listed = append(listed, f.Key)
+		}
+
+		return listed
+	}
+
+	if have, want := list(""), keys; !reflect.DeepEqual(have, want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	reversed := []string{}
+	for i := len(keys) - 1; i >= 0; i-- {
+		reversed = append(reversed, keys[i])
+	}
+
+	// An explicit sort overrides the default.
+	if have, want := list("sort=-key"), reversed; !reflect.DeepEqual(have, want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+}
+
+func TestHandleFileListDelimiter(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-handle-file-list-delimiter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		b  = ent.NewBucket("delimiter", ent.Owner{})
+		fs = newDiskFS(tmp)
+		r  = pat.New()
+	)
+
+	r.Get(ent.RouteBucket, handleFileList(ent.NewMemoryProvider(b), fs))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	for _, key := range []string{"logs/2016/a.log", "logs/2017/b.log", "logs/c.log", "logs/d.log", "top.log"} {
+		_, err := fs.Create(b, key, strings.NewReader(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err := http.Get(fmt.Sprintf("%s/%s?prefix=logs/&delimiter=/&sort=%%2Bkey", ts.URL, b.Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if have, want := res.StatusCode, http.StatusOK; have != want {
+		t.Fatalf("have %d, want %d", have, want)
+	}
+
+	list := ent.ResponseFileList{}
+
+	err = json.NewDecoder(res.Body).Decode(&list)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listed := []string{}
+	for _, f := range list.Files {
+		listed = append(listed, f.Key)
+
+		// Listings don't read the sidecars holding the creation time.
+		if !f.Created.IsZero() {
+			t.Errorf("%s: created listed", f.Key)
+		}
+	}
+
+	if have, want := listed, []string{"logs/c.log", "logs/d.log"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	if have, want := list.CommonPrefixes, []string{"logs/2016/", "logs/2017/"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	res, err = http.Get(fmt.Sprintf("%s/%s?delimiter=/&format=xml", ts.URL, b.Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	result := ent.ResponseListBucketResult{}
+
+	err = xml.NewDecoder(res.Body).Decode(&result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := result.CommonPrefixes, []ent.ResponseCommonPrefix{{Prefix: "logs/"}}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	if have, want := len(result.Contents), 1; have != want {
+		t.Errorf("have %d contents, want %d", have, want)
+	}
+}
+
+func TestHandleFileListKeyRange(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-handle-file-list-range")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		b    = ent.NewBucket("range", ent.Owner{})
+		all  = []string{}
+		fses = map[string]ent.FileSystem{
+			"disk":   newDiskFS(tmp),
+			"memory": ent.NewMemoryFS(),
+		}
+		// Boundaries are both stored keys and keys in between.
+		bounds = []string{"", "key-05", "key-10", "key-155", ""}
+	)
+
+	for i := 0; i < 20; i++ {
+		all = append(all, fmt.Sprintf("key-%02d", i))
+	}
+
+	for name, fs := range fses {
+		r := pat.New()
+		r.Get(ent.RouteBucket, handleFileList(ent.NewMemoryProvider(b), fs))
+
+		ts := httptest.NewServer(r)
+		defer ts.Close()
+
+		for _, key := range all {
+			_, err := fs.Create(b, key, strings.NewReader("content"))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var (
+			keys = []string{}
+			seen = map[string]bool{}
+		)
+
+		for i := 0; i < len(bounds)-1; i++ {
+			vs := url.Values{}
+			if bounds[i] != "" {
+				vs.Set(ent.ParamStartAfter, bounds[i])
+			}
+			if bounds[i+1] != "" {
+				vs.Set(ent.ParamEndBefore, bounds[i+1])
+			}
+
+			res, err := http.Get(fmt.Sprintf("%s/%s?%s", ts.URL, b.Name, vs.Encode()))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			list := ent.ResponseFileList{}
+
+			err = json.NewDecoder(res.Body).Decode(&list)
+			res.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, f := range list.Files {
+				if seen[f.Key] {
+					t.Errorf("%s: %s listed in more than one range", name, f.Key)
+				}
+				seen[f.Key] = true
+
+				keys = append(keys, f.Key)
+			}
+		}
+
+		if have, want := keys, all; !reflect.DeepEqual(have, want) {
+			t.Errorf("%s: have %v, want %v", name, have, want)
+		}
+	}
+}
+
+func TestHandleFileListXML(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-handle-file-list-xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		fs    = newDiskFS(tmp)
+		b     = ent.NewBucket("xml", ent.Owner{})
+		r     = pat.New()
+		blobs = map[string]string{
+			"a/first.txt":  "first",
+			"a/second.txt": "the second blob",
+			"b/third.txt":  "third",
+		}
+	)
+
+	r.Get(ent.RouteBucket, handleFileList(ent.NewMemoryProvider(b), fs))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	for key, content := range blobs {
+		_, err := fs.Create(b, key, strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err := http.Get(fmt.Sprintf("%s/%s?format=xml&prefix=a/&sort=%%2Bkey", ts.URL, b.Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if have, want := res.Header.Get("Content-Type"), "application/xml"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	result := ent.ResponseListBucketResult{}
+
+	err = xml.NewDecoder(res.Body).Decode(&result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := result.Name, b.Name; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	if have, want := len(result.Contents), 2; have != want {
+		t.Fatalf("have %d, want %d", have, want)
+	}
+
+	for i, key := range []string{"a/first.txt", "a/second.txt"} {
+		var (
+			c   = result.Contents[i]
+			sum = sha1.Sum([]byte(blobs[key]))
+		)
+
+		if have, want := c.Key, key; have != want {
+			t.Errorf("have %s, want %s", have, want)
+		}
+
+		if have, want := c.Size, int64(len(blobs[key])); have != want {
+			t.Errorf("%s: have %d, want %d", key, have, want)
+		}
+
+		if have, want := c.ETag, hex.EncodeToString(sum[:]); have != want {
+			t.Errorf("%s: have %s, want %s", key, have, want)
+		}
+
+		if c.LastModified.IsZero() {
+			t.Errorf("%s: missing LastModified", key)
+		}
+	}
+}
+
+func TestCreateListBucketResultRecorded(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-list-bucket-result")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		fs      = newCompressFS(newDiskFS(tmp))
+		b       = ent.NewBucket("recorded", ent.Owner{})
+		content = strings.Repeat("recorded ", 1<<10)
+		sum     = sha1.Sum([]byte(content))
+	)
+	b.Compression = ent.CompressionGzip
+
+	f, err := fs.Create(b, "blob.txt", strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// The stored content is zeroed, only the recorded digests are right.
+	p := filepath.Join(tmp, b.Name, "blob.txt")
+
+	stat, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(p, make([]byte, stat.Size()), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := fs.List(b, "", ent.DefaultLimit, ent.NoOpStrategy())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := createListBucketResult(fs, b, "", "", "", 0, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := len(result.Contents), 1; have != want {
+		t.Fatalf("have %d, want %d", have, want)
+	}
+
+	if have, want := result.Contents[0].ETag, hex.EncodeToString(sum[:]); have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	if have, want := result.Contents[0].Size, int64(len(content)); have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+}
+
+func TestHandleFileListInvalidParams(t *testing.T) {
+	var (
+		name = "master"
+		bs   = createBuckets([]string{name})
+		fs   = ent.NewMemoryFS()
+		p    = "invalid/files"
+		r    = pat.New()
 	)
 
 	r.Get(ent.RouteBucket, handleFileList(ent.NewMemoryProvider(bs...), fs))
 
-	ts := httptest.NewServer(r)
-	defer ts.Close()
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	f, err := os.Open(fixtureZip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		_, err := fs.Create(bs[0], fmt.Sprintf("%s/%d", p, i), f)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	inputs := []url.Values{
+		url.Values{"limit": []string{"-1"}},
+		url.Values{"limit": []string{"asd"}},
+		url.Values{"limit": []string{"0"}},
+		url.Values{"limit": []string{"18446744073709551616"}},
+		url.Values{"limit": []string{"4"}, "prefix": []string{p}, "sort": []string{"key"}},
+		url.Values{"limit": []string{"4"}, "prefix": []string{p}, "sort": []string{"-key1"}},
+		url.Values{"limit": []string{"12"}, "prefix": []string{p}, "sort": []string{"-1k2ey"}},
+		url.Values{"sort": []string{"+LastModified"}},
+		url.Values{"modifiedSince": []string{"yesterday"}},
+		url.Values{"modifiedBefore": []string{"2016-05-01"}},
+		url.Values{"format": []string{"yaml"}},
+		url.Values{"marker": []string{p}, "sort": []string{"-key"}},
+		url.Values{"startAfter": []string{p}, "sort": []string{"+lastModified"}},
+		url.Values{"delimiter": []string{","}},
+	}
+
+	for _, input := range inputs {
+		filesURL := fmt.Sprintf("%s/%s?%s", ts.URL, name, input.Encode())
+
+		res, err := http.Get(filesURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		if have, want := res.StatusCode, http.StatusBadRequest; have != want {
+			t.Errorf("have %d, want %d", have, want)
+		}
+	}
+}
+
+func TestHandleUnrouted(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-unrouted-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	p := ent.NewMemoryProvider(ent.NewBucket("routed", ent.Owner{}))
+
+	ts := httptest.NewServer(newTestRouter(p, tmp, corsConfig{}))
+	defer ts.Close()
+
+	for _, test := range []struct {
+		method string
+		path   string
+		code   int
+		err    error
+		allow  string
+	}{
+		// Paths no route serves are routed to the bucket routes.
+		{"GET", "/unknown", http.StatusNotFound, ent.ErrBucketNotFound, ""},
+		{"PATCH", "/routed", http.StatusMethodNotAllowed, ent.ErrMethodNotAllowed, "GET, HEAD, POST, DELETE, OPTIONS"},
+		{"PATCH", "/routed/file.txt", http.StatusMethodNotAllowed, ent.ErrMethodNotAllowed, "GET, HEAD, POST, PUT, DELETE, OPTIONS"},
+	} {
+		req, err := http.NewRequest(test.method, ts.URL+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp := ent.ResponseError{}
+		err = json.NewDecoder(res.Body).Decode(&resp)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("%s %s: %s", test.method, test.path, err)
+		}
+
+		if have, want := res.StatusCode, test.code; have != want {
+			t.Errorf("%s %s: have %d, want %d", test.method, test.path, have, want)
+		}
+
+		if have, want := res.Header.Get("Content-Type"), "application/json"; have != want {
+			t.Errorf("%s %s: have %s, want %s", test.method, test.path, have, want)
+		}
+
+		if have, want := res.Header.Get("Allow"), test.allow; have != want {
+			t.Errorf("%s %s: have Allow %q, want %q", test.method, test.path, have, want)
+		}
+
+		if have, want := resp.Code, test.code; have != want {
+			t.Errorf("%s %s: have %d, want %d", test.method, test.path, have, want)
+		}
+
+		if have, want := resp.Error, test.err.Error(); have != want {
+			t.Errorf("%s %s: have %q, want %q", test.method, test.path, have, want)
+		}
+	}
+}
+
+// newTestRouter returns the router of the server storing files in dir, with
+// requests left uninstrumented.
+func newTestRouter(p ent.Provider, dir string, cors corsConfig) *pat.Router {
+	var (
+		backend = newDiskFS(dir)
+		fs      = newHashIndexFS(backend)
+	)
+
+	return newRouter(routerConfig{
+		provider: p,
+		backend:  backend,
+		fs:       fs,
+		mfs:      newMultipartFS(fs, filepath.Join(dir, "multipart")),
+		cors:     cors,
+		instrument: func(op string, next http.Handler) http.Handler {
+			return next
+		},
+	})
+}
+
+func TestHandleHealth(t *testing.T) {
+	r := pat.New()
+	r.Get(ent.RouteHealth, handleHealth())
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + ent.RouteHealth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if have, want := res.StatusCode, http.StatusOK; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+
+	resp := ent.ResponseHealth{}
+
+	err = json.NewDecoder(res.Body).Decode(&resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := resp, (ent.ResponseHealth{Status: "ok", Version: Version}); have != want {
+		t.Errorf("have %v, want %v", have, want)
+	}
+}
+
+func TestHandleReady(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-ready")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		fs   = newDiskFS(filepath.Join(tmp, "root")).(*diskFS)
+		r    = pat.New()
+		ts   = httptest.NewServer(r)
+		pDir = filepath.Join(tmp, "policies")
+	)
+	defer ts.Close()
+
+	err = os.Mkdir(pDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := newDiskProvider(pDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.Get(ent.RouteReady, handleReady(p, fs))
+
+	res, err := http.Get(ts.URL + ent.RouteReady)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if have, want := res.StatusCode, http.StatusOK; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+
+	// A regular file in place of the root directory can't be written to.
+	err = ioutil.WriteFile(filepath.Join(tmp, "file"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.root = filepath.Join(tmp, "file")
+
+	res, err = http.Get(ts.URL + ent.RouteReady)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if have, want := res.StatusCode, http.StatusServiceUnavailable; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+}
+
+func TestHandleOptions(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-options-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	p := ent.NewMemoryProvider(ent.NewBucket("options", ent.Owner{}))
+
+	ts := httptest.NewServer(newTestRouter(p, tmp, corsConfig{}))
+	defer ts.Close()
+
+	for _, input := range []struct {
+		path   string
+		status int
+		allow  string
+	}{
+		{"/options/nested/file.txt", http.StatusOK, "GET, HEAD, POST, PUT, DELETE, OPTIONS"},
+		{"/options", http.StatusOK, "GET, HEAD, POST, DELETE, OPTIONS"},
+		{"/", http.StatusOK, "GET, OPTIONS"},
+		{"/unknown/file.txt", http.StatusNotFound, ""},
+		{"/unknown", http.StatusNotFound, ""},
+	} {
+		req, err := http.NewRequest("OPTIONS", ts.URL+input.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if have, want := res.StatusCode, input.status; have != want {
+			t.Errorf("%s: have %d, want %d", input.path, have, want)
+		}
+
+		if have, want := res.Header.Get("Allow"), input.allow; have != want {
+			t.Errorf("%s: have %q, want %q", input.path, have, want)
+		}
+	}
+}
+
+func TestAddCORSHeaders(t *testing.T) {
+	var (
+		methods = []string{"GET", "POST", "PUT", "DELETE"}
+		headers = []string{"Accept", "Authorization", "Content-Type", "Origin"}
+		expose  = []string{ent.HeaderETag, ent.HeaderCRC32C}
+	)
+
+	for _, input := range []struct {
+		origins []string
+		origin  string
+		want    map[string]string
+	}{
+		{
+			nil,
+			"http://example.com",
+			map[string]string{
+				"Access-Control-Allow-Headers":  "Accept, Authorization, Content-Type, Origin",
+				"Access-Control-Allow-Methods":  "GET, POST, PUT, DELETE",
+				"Access-Control-Allow-Origin":   "*",
+				"Access-Control-Expose-Headers": "ETag, X-Ent-CRC32C",
+				"Vary":                          "",
+			},
+		},
+		{
+			[]string{"http://allowed.com", "http://example.com"},
+			"http://example.com",
+			map[string]string{
+				"Access-Control-Allow-Headers":  "Accept, Authorization, Content-Type, Origin",
+				"Access-Control-Allow-Methods":  "GET, POST, PUT, DELETE",
+				"Access-Control-Allow-Origin":   "http://example.com",
+				"Access-Control-Expose-Headers": "ETag, X-Ent-CRC32C",
+				"Vary":                          "Origin",
+			},
+		},
+		{
+			[]string{"http://allowed.com"},
+			"http://example.com",
+			map[string]string{
+				"Access-Control-Allow-Headers":  "",
+				"Access-Control-Allow-Methods":  "",
+				"Access-Control-Allow-Origin":   "",
+				"Access-Control-Expose-Headers": "",
+				"Vary":                          "Origin",
+			},
+		},
+	} {
+		c := corsConfig{
+			origins: input.origins,
+			methods: methods,
+			headers: headers,
+			expose:  expose,
+		}
+
+		ts := httptest.NewServer(addCORSHeaders(c, http.HandlerFunc(http.NotFound)))
 
-	f, err := os.Open(fixtureZip)
-	if err != nil {
-		t.Fatal(err)
-	}
+		req, err := http.NewRequest("GET", ts.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Origin", input.origin)
 
-	for i := 0; i < 10; i++ {
-		_, err := fs.Create(bs[0], fmt.Sprintf("%s/%d", p, i), f)
+		res, err := http.DefaultClient.Do(req)
 		if err != nil {
 			t.Fatal(err)
 		}
+		res.Body.Close()
+		ts.Close()
+
+		for key, want := range input.want {
+			if have := res.Header.Get(key); have != want {
+				t.Errorf("%v %s: want %q, have %q", input.origins, key, want, have)
+			}
+		}
 	}
+}
 
-	inputs := []url.Values{
-		url.Values{"limit": []string{"-1"}},
-		url.Values{"limit": []string{"asd"}},
-		url.Values{"limit": []string{"4"}, "prefix": []string{p}, "sort": []string{"key"}},
-		url.Values{"limit": []string{"4"}, "prefix": []string{p}, "sort": []string{"-key1"}},
-		url.Values{"limit": []string{"12"}, "prefix": []string{p}, "sort": []string{"-1k2ey"}},
-		url.Values{"sort": []string{"+LastModified"}},
+func TestRouterCORS(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-router-cors")
+	if err != nil {
+		t.Fatal(err)
 	}
+	defer os.RemoveAll(tmp)
 
-	for _, input := range inputs {
-		filesURL := fmt.Sprintf("%s/%s?%s", ts.URL, name, input.Encode())
+	p := ent.NewMemoryProvider(ent.NewBucket("cors", ent.Owner{}))
 
-		res, err := http.Get(filesURL)
+	ts := httptest.NewServer(newTestRouter(p, tmp, corsConfig{
+		methods: []string{"GET", "HEAD"},
+		headers: corsRequestHeaders,
+		expose:  corsExposeHeaders,
+	}))
+	defer ts.Close()
+
+	// HEAD requests are answered with the CORS headers like GET.
+	for _, path := range []string{"/cors", "/cors/file.txt"} {
+		req, err := http.NewRequest("HEAD", ts.URL+path, nil)
 		if err != nil {
 			t.Fatal(err)
 		}
-		defer res.Body.Close()
+		req.Header.Set("Origin", "http://example.com")
 
-		if have, want := res.StatusCode, http.StatusBadRequest; have != want {
-			t.Errorf("have %d, want %d", have, want)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if have, want := res.Header.Get("Access-Control-Allow-Origin"), "*"; have != want {
+			t.Errorf("%s: have %q, want %q", path, have, want)
+		}
+
+		expose := res.Header.Get("Access-Control-Expose-Headers")
+		for _, header := range []string{ent.HeaderETag, ent.HeaderCRC32C, ent.HeaderUploadOffset} {
+			if !strings.Contains(expose, header) {
+				t.Errorf("%s: %s not exposed in %q", path, header, expose)
+			}
 		}
 	}
 }
 
-func TestAddCORSHeaders(t *testing.T) {
-	ts := httptest.NewServer(addCORSHeaders(http.HandlerFunc(http.NotFound)))
+func TestAuthorize(t *testing.T) {
+	var (
+		owner  = mail.Address{Name: "owner", Address: "owner@ent.io"}
+		writer = mail.Address{Name: "writer", Address: "writer@ent.io"}
+		reader = mail.Address{Name: "reader", Address: "reader@ent.io"}
+		open   = ent.NewBucket("open", ent.Owner{Email: owner})
+		closed = &ent.Bucket{
+			Name:    "closed",
+			Owner:   ent.Owner{Email: owner},
+			Writers: []ent.Owner{{Email: writer}},
+			Readers: []ent.Owner{{Email: reader}},
+		}
+		fs = ent.NewMemoryFS()
+		p  = ent.NewMemoryProvider(open, closed)
+		r  = pat.New()
+	)
+
+	r.Add("GET", ent.RouteFile, authorize(p, handleGet(p, fs)))
+	r.Add("POST", ent.RouteFile, authorize(p, handleCreate(p, fs)))
+
+	ts := httptest.NewServer(r)
 	defer ts.Close()
 
-	res, err := http.Get(ts.URL)
-	if err != nil {
-		t.Fatal(err)
+	inputs := []struct {
+		method   string
+		bucket   string
+		identity string
+		status   int
+	}{
+		{"POST", open.Name, "", http.StatusCreated},
+		{"GET", open.Name, "", http.StatusOK},
+		{"POST", closed.Name, writer.String(), http.StatusCreated},
+		{"POST", closed.Name, owner.Address, http.StatusCreated},
+		{"GET", closed.Name, writer.Address, http.StatusOK},
+		{"GET", closed.Name, reader.Address, http.StatusOK},
+		{"POST", closed.Name, reader.Address, http.StatusForbidden},
+		{"POST", closed.Name, "", http.StatusForbidden},
+		{"GET", closed.Name, "stranger@ent.io", http.StatusForbidden},
 	}
-	defer res.Body.Close()
 
-	for key, want := range map[string]string{
-		"Access-Control-Allow-Headers": "Accept, Authorization, Content-Type, Origin",
-		"Access-Control-Allow-Methods": "GET, POST, DELETE",
-		"Access-Control-Allow-Origin":  "*",
-	} {
-		if have := res.Header.Get(key); have != want {
-			t.Errorf("want %s, have %s", want, have)
+	for _, input := range inputs {
+		req, err := http.NewRequest(
+			input.method,
+			fmt.Sprintf("%s/%s/%s", ts.URL, input.bucket, "authorized.file"),
+			bytes.NewReader([]byte("content")),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if input.identity != "" {
+			req.Header.Set(ent.HeaderOwner, input.identity)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if have, want := res.StatusCode, input.status; have != want {
+			t.Errorf(
+				"%s %s as %q: have %d, want %d",
+				input.method,
+				input.bucket,
+				input.identity,
+				have,
+				want,
+			)
 		}
 	}
 }
@@ -447,10 +2725,10 @@ func getFiles(url string) ([]ent.ResponseFile, error) {
 	return resp.Files, nil
 }
 
-func toMap(bucketsList []*ent.Bucket) map[ent.Bucket]int {
-	bucketMap := map[ent.Bucket]int{}
+func toMap(bucketsList []*ent.Bucket) map[string]*ent.Bucket {
+	bucketMap := map[string]*ent.Bucket{}
 	for _, bucket := range bucketsList {
-		bucketMap[*bucket]++
+		bucketMap[bucket.Name] = bucket
 	}
 	return bucketMap
 }
@@ -469,3 +2747,381 @@ func createBuckets(names []string) []*ent.Bucket {
 
 	return bs
 }
+
+func TestMetricsInflightRequests(t *testing.T) {
+	var (
+		op       = "handleInflightTest"
+		inflight = func() float64 {
+			m := &dto.Metric{}
+			err := inflightRequests.WithLabelValues(op).Write(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return m.GetGauge().GetValue()
+		}
+	)
+
+	ts := httptest.NewServer(metrics(op, http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if have, want := inflight(), 1.0; have != want {
+				t.Errorf("have %v in flight, want %v", have, want)
+			}
+		},
+	)))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if have, want := inflight(), 0.0; have != want {
+		t.Errorf("have %v in flight, want %v", have, want)
+	}
+}
+
+func TestSetupMetricsNamespace(t *testing.T) {
+	setupMetrics("tenant", "blobs")
+	defer setupMetrics(Program, "")
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(requestBytes)
+	reg.MustRegister(bucketBytes)
+
+	requestBytes.WithLabelValues("bucket", "get", "op", "200").Add(1)
+	bucketBytes.WithLabelValues("bucket").Set(1)
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{}
+	for _, mf := range mfs {
+		names = append(names, mf.GetName())
+	}
+
+	want := []string{"tenant_blobs_bucket_bytes", "tenant_blobs_request_bytes_total"}
+
+	if have := names; !reflect.DeepEqual(have, want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+}
+
+func TestMetricsRequestDurationHistogram(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(requestDurationsSeconds)
+
+	var (
+		op = "handleHistogramTest"
+		r  = pat.New()
+	)
+
+	r.Get(ent.RouteBucket, metrics(op, http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+		},
+	)).ServeHTTP)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/histogram")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"bucket":    "histogram",
+		"method":    "get",
+		"operation": op,
+		"status":    strconv.Itoa(http.StatusTeapot),
+	}
+
+	var count uint64
+
+	for _, mf := range mfs {
+		if mf.GetName() != "ent_request_duration_seconds" {
+			continue
+		}
+
+		for _, m := range mf.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+
+			if reflect.DeepEqual(labels, want) {
+				count += m.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+
+	if have, want := count, uint64(1); have != want {
+		t.Errorf("have %d samples, want %d", have, want)
+	}
+}
+
+func TestMetricsKnownBucketLabel(t *testing.T) {
+	defer func(p ent.Provider) { bucketLabels = p }(bucketLabels)
+	bucketLabels = ent.NewMemoryProvider(ent.NewBucket("known", ent.Owner{}))
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(requestDurationsSeconds)
+
+	var (
+		op = "handleBucketLabelTest"
+		r  = pat.New()
+	)
+
+	r.Get(ent.RouteBucket, metrics(op, http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		},
+	)).ServeHTTP)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	for _, path := range []string{"/known", "/random-1", "/random-2"} {
+		res, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	samples := map[string]uint64{}
+
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+
+			if labels["operation"] == op {
+				samples[labels["bucket"]] += m.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+
+	if have, want := samples, map[string]uint64{"known": 1, unknownBucketLabel: 2}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+}
+
+func TestUpdateUsage(t *testing.T) {
+	setupMetrics(Program, "")
+	defer setupMetrics(Program, "")
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(bucketBytes)
+
+	var (
+		kept    = ent.NewBucket("usage-kept", ent.Owner{})
+		removed = ent.NewBucket("usage-removed", ent.Owner{})
+		fs      = ent.NewMemoryFS()
+	)
+
+	_, err := fs.Create(kept, "blob", strings.NewReader("12345"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gauges := func() map[string]float64 {
+		mfs, err := reg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		values := map[string]float64{}
+
+		for _, mf := range mfs {
+			for _, m := range mf.GetMetric() {
+				values[m.GetLabel()[0].GetValue()] = m.GetGauge().GetValue()
+			}
+		}
+
+		return values
+	}
+
+	reported := updateUsage(ent.NewMemoryProvider(kept, removed), fs, map[string]bool{})
+
+	if have, want := gauges(), map[string]float64{"usage-kept": 5, "usage-removed": 0}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	// The gauge of a removed bucket is deleted rather than left at its last
+	// value.
+	updateUsage(ent.NewMemoryProvider(kept), fs, reported)
+
+	if have, want := gauges(), map[string]float64{"usage-kept": 5}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+}
+
+func TestServeGracefulShutdown(t *testing.T) {
+	var (
+		started = make(chan struct{})
+		release = make(chan struct{})
+		stop    = make(chan os.Signal, 1)
+		done    = make(chan error, 1)
+		bodies  = make(chan string, 1)
+	)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+			w.Write([]byte("completed"))
+		}),
+	}
+
+	go func() {
+		done <- serve(srv, []net.Listener{l}, stop, 5*time.Second)
+	}()
+
+	go func() {
+		res, err := http.Get("http://" + l.Addr().String())
+		if err != nil {
+			bodies <- err.Error()
+			return
+		}
+		defer res.Body.Close()
+
+		raw, _ := ioutil.ReadAll(res.Body)
+		bodies <- string(raw)
+	}()
+
+	<-started
+	stop <- syscall.SIGTERM
+
+	// The listener is closed before in-flight requests are drained.
+	refused := false
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			refused = true
+			break
+		}
+		conn.Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if !refused {
+		t.Error("new connections accepted during shutdown")
+	}
+
+	close(release)
+
+	if have, want := <-bodies, "completed"; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+
+	err = <-done
+	if err != nil {
+		t.Errorf("shutdown failed: %s", err)
+	}
+}
+
+func TestHandleCopy(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-copy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		owner  = mail.Address{Name: "owner", Address: "owner@ent.io"}
+		reader = mail.Address{Name: "reader", Address: "reader@ent.io"}
+		open   = ent.NewBucket("open", ent.Owner{Email: owner})
+		closed = &ent.Bucket{
+			Name:    "closed",
+			Owner:   ent.Owner{Email: owner},
+			Readers: []ent.Owner{{Email: reader}},
+		}
+		fs = newMultipartFS(newDiskFS(tmp), filepath.Join(tmp, "uploads"))
+		p  = ent.NewMemoryProvider(open, closed)
+		r  = pat.New()
+	)
+
+	r.Add("POST", ent.RouteFile, handleUpload(p, fs))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	_, err = fs.Create(closed, "source.txt", strings.NewReader("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inputs := []struct {
+		source   string
+		key      string
+		identity string
+		status   int
+	}{
+		{"closed/source.txt", "copy.txt", reader.Address, http.StatusCreated},
+		{"closed/source.txt", "copy.txt", "", http.StatusForbidden},
+		{"closed/missing.txt", "copy.txt", reader.Address, http.StatusNotFound},
+		{"missing/source.txt", "copy.txt", reader.Address, http.StatusNotFound},
+		{"../source.txt", "copy.txt", reader.Address, http.StatusBadRequest},
+		{"closed", "copy.txt", reader.Address, http.StatusBadRequest},
+		{"open/copy.txt", "copy.txt", "", http.StatusBadRequest},
+	}
+
+	for _, input := range inputs {
+		req, err := http.NewRequest(
+			"POST",
+			fmt.Sprintf("%s/%s/%s", ts.URL, open.Name, input.key),
+			nil,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(ent.HeaderCopySource, input.source)
+		req.Header.Set(ent.HeaderOwner, input.identity)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if have, want := res.StatusCode, input.status; have != want {
+			t.Errorf("copy %s as %q: have %d, want %d", input.source, input.identity, have, want)
+		}
+	}
+
+	f, err := fs.Open(open, "copy.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := string(raw), "content"; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+
+	"github.com/soundcloud/ent/lib"
+	bolt "go.etcd.io/bbolt"
+)
+
+// createOptions describe how a file is stored by createWithMeta.
+type createOptions struct {
+	// exclusive fails the Create with ErrFileExists if the key is taken.
+	exclusive bool
+	// meta is stored with the content, replacing the Meta recorded for the
+	// key except for Created.
+	meta ent.Meta
+	// content digests the content before it is encoded to be stored, like
+	// compressed or encrypted, so FileSystems recording digests can record
+	// the ones of the content as read back as well. It covers all of the
+	// content once all of the encoded content has been read.
+	content *ent.Digest
+}
+
+// metaCreator is implemented by FileSystems which store the Meta of a file in
+// the same step as its content, under the lock of its key, so no reader sees
+// the content with the Meta of the file it replaced. Content under an active
+// retention is not replaced, ErrRetentionActive is returned instead.
+type metaCreator interface {
+	CreateMeta(bucket *ent.Bucket, key string, r io.Reader, o createOptions) (ent.File, error)
+}
+
+// createWithMeta stores the content read from r under key along with the Meta
+// of o. FileSystems which don't store both at once get the Meta set after the
+// content, which leaves a window in which the content is read with the Meta
+// it replaced.
+func createWithMeta(
+	fs ent.FileSystem,
+	bucket *ent.Bucket,
+	key string,
+	r io.Reader,
+	o createOptions,
+) (ent.File, error) {
+	if mc, ok := fs.(metaCreator); ok {
+		return mc.CreateMeta(bucket, key, r, o)
+	}
+
+	create := fs.Create
+	if o.exclusive {
+		create = fs.CreateExclusive
+	}
+
+	f, err := create(bucket, key, r)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := fs.Meta(bucket, key)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	o.meta.Created = m.Created
+	if o.meta == m {
+		return f, nil
+	}
+
+	err = fs.SetMeta(bucket, key, o.meta)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// metaOpener is implemented by FileSystems which read the Meta of a file
+// along with opening it, so the Meta is the one of the content opened even
+// if it is replaced concurrently.
+type metaOpener interface {
+	OpenMeta(bucket *ent.Bucket, key string) (ent.File, ent.Meta, error)
+}
+
+// openWithMeta opens the file under key and reads its Meta. FileSystems which
+// don't read both at once get the Meta read after opening the file, which
+// may be the one of content replacing it meanwhile.
+func openWithMeta(fs ent.FileSystem, bucket *ent.Bucket, key string) (ent.File, ent.Meta, error) {
+	if mo, ok := fs.(metaOpener); ok {
+		return mo.OpenMeta(bucket, key)
+	}
+
+	f, err := fs.Open(bucket, key)
+	if err != nil {
+		return nil, ent.Meta{}, err
+	}
+
+	m, err := fs.Meta(bucket, key)
+	if err != nil {
+		f.Close()
+		return nil, ent.Meta{}, err
+	}
+
+	return f, m, nil
+}
+
+// metaUpdater is implemented by FileSystems which update the Meta of a file
+// under the lock of its key, so the Meta of content replacing the file
+// meanwhile isn't overwritten with the one read before.
+type metaUpdater interface {
+	// UpdateMeta calls fn with the Meta stored for the file and stores it
+	// as changed by fn. Nothing is written if fn leaves it unchanged.
+	UpdateMeta(bucket *ent.Bucket, key string, fn func(*ent.Meta)) error
+}
+
+// updateMeta changes the Meta of the file under key with fn. FileSystems which
+// don't update it at once get the Meta read and stored in two steps, which
+// may store it over the Meta of content replacing the file meanwhile.
+func updateMeta(fs ent.FileSystem, bucket *ent.Bucket, key string, fn func(*ent.Meta)) error {
+	if mu, ok := fs.(metaUpdater); ok {
+		return mu.UpdateMeta(bucket, key, fn)
+	}
+
+	m, err := fs.Meta(bucket, key)
+	if err != nil {
+		return err
+	}
+
+	prev := m
+	fn(&m)
+	if m == prev {
+		return nil
+	}
+
+	return fs.SetMeta(bucket, key, m)
+}
+
+// CreateMeta writes the sidecar holding the Meta before the content is moved
+// in place.
+func (fs *diskFS) CreateMeta(
+	bucket *ent.Bucket,
+	key string,
+	r io.Reader,
+	o createOptions,
+) (ent.File, error) {
+	return fs.create(bucket, key, r, o)
+}
+
+// CreateMeta stores the Meta in the transaction storing the content.
+func (fs *boltFS) CreateMeta(
+	bucket *ent.Bucket,
+	key string,
+	r io.Reader,
+	o createOptions,
+) (ent.File, error) {
+	return fs.create(bucket, key, r, o)
+}
+
+// CreateMeta adds the codec of the bucket to the Meta.
+func (fs *compressFS) CreateMeta(
+	bucket *ent.Bucket,
+	key string,
+	r io.Reader,
+	o createOptions,
+) (ent.File, error) {
+	return fs.create(bucket, key, r, o)
+}
+
+// CreateMeta adds the encryption to the Meta.
+func (fs *encryptedFS) CreateMeta(
+	bucket *ent.Bucket,
+	key string,
+	r io.Reader,
+	o createOptions,
+) (ent.File, error) {
+	return fs.create(bucket, key, r, o)
+}
+
+func (fs *hashIndexFS) CreateMeta(
+	bucket *ent.Bucket,
+	key string,
+	r io.Reader,
+	o createOptions,
+) (ent.File, error) {
+	f, err := createWithMeta(fs.FileSystem, bucket, key, r, o)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.index(bucket, f)
+
+	return f, nil
+}
+
+func (fs *multipartFS) CreateMeta(
+	bucket *ent.Bucket,
+	key string,
+	r io.Reader,
+	o createOptions,
+) (ent.File, error) {
+	return createWithMeta(fs.FileSystem, bucket, key, r, o)
+}
+
+// UpdateMeta rewrites the sidecar under the lock of the key, which Creates
+// hold while placing the content along with its sidecar.
+func (fs *diskFS) UpdateMeta(bucket *ent.Bucket, key string, fn func(*ent.Meta)) error {
+	p := pathForFile(fs, bucket, key)
+
+	unlock := fs.keys.lock(p)
+	defer unlock()
+
+	stat, err := os.Stat(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = ent.ErrFileNotFound
+		}
+		return err
+	}
+	if stat.IsDir() {
+		return ent.ErrFileNotFound
+	}
+
+	fs.dirs.RLock()
+	defer fs.dirs.RUnlock()
+
+	s, err := readSidecar(p)
+	if err != nil {
+		return err
+	}
+
+	prev := s.Meta
+	fn(&s.Meta)
+	if s.Meta == prev {
+		return nil
+	}
+
+	return fs.writeSidecar(p, s)
+}
+
+// UpdateMeta reads and stores the Meta in the same transaction.
+func (fs *boltFS) UpdateMeta(bucket *ent.Bucket, key string, fn func(*ent.Meta)) error {
+	return fs.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket.Name))
+		if b == nil || b.Get([]byte(key)) == nil {
+			return ent.ErrFileNotFound
+		}
+
+		m, err := boltMeta(tx, bucket, []byte(key))
+		if err != nil {
+			return err
+		}
+
+		prev := m
+		fn(&m)
+		if m == prev {
+			return nil
+		}
+
+		v, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+
+		mb, err := tx.CreateBucketIfNotExists(boltMetaBucket(bucket))
+		if err != nil {
+			return err
+		}
+
+		return mb.Put([]byte(key), v)
+	})
+}
+
+// UpdateMeta keeps the codec recorded for the content stored at the time of
+// the update, as it describes the stored content rather than an attribute set
+// by clients.
+func (fs *compressFS) UpdateMeta(bucket *ent.Bucket, key string, fn func(*ent.Meta)) error {
+	return updateMeta(fs.FileSystem, bucket, key, func(m *ent.Meta) {
+		codec := m.Compression
+		fn(m)
+		m.Compression = codec
+	})
+}
+
+// UpdateMeta keeps the encryption recorded for the content stored at the time
+// of the update, as it describes the stored content rather than an attribute
+// set by clients.
+func (fs *encryptedFS) UpdateMeta(bucket *ent.Bucket, key string, fn func(*ent.Meta)) error {
+	return updateMeta(fs.FileSystem, bucket, key, func(m *ent.Meta) {
+		encryption := m.Encryption
+		fn(m)
+		m.Encryption = encryption
+	})
+}
+
+// UpdateMeta updates the Meta as stored by the wrapped FileSystem.
+func (fs *hashIndexFS) UpdateMeta(bucket *ent.Bucket, key string, fn func(*ent.Meta)) error {
+	return updateMeta(fs.FileSystem, bucket, key, fn)
+}
+
+// UpdateMeta updates the Meta as stored by the wrapped FileSystem.
+func (fs *multipartFS) UpdateMeta(bucket *ent.Bucket, key string, fn func(*ent.Meta)) error {
+	return updateMeta(fs.FileSystem, bucket, key, fn)
+}
+
+// OpenMeta opens the file and reads its sidecar under the lock of the key,
+// which Creates hold while placing both.
+func (fs *diskFS) OpenMeta(bucket *ent.Bucket, key string) (ent.File, ent.Meta, error) {
+	unlock := fs.keys.lock(pathForFile(fs, bucket, key))
+	defer unlock()
+
+	f, err := fs.open(bucket, key)
+	if err != nil {
+		return nil, ent.Meta{}, err
+	}
+
+	return f, f.sidecar.Meta, nil
+}
+
+// OpenMeta reads the content and the Meta in the same transaction.
+func (fs *boltFS) OpenMeta(bucket *ent.Bucket, key string) (ent.File, ent.Meta, error) {
+	var (
+		f *boltFile
+		m ent.Meta
+	)
+
+	err := fs.db.View(func(tx *bolt.Tx) error {
+		var err error
+
+		f, err = fs.open(tx, bucket, key)
+		if err != nil {
+			return err
+		}
+
+		m, err = boltMeta(tx, bucket, []byte(key))
+		return err
+	})
+	if err != nil {
+		return nil, ent.Meta{}, err
+	}
+
+	return f, m, nil
+}
+
+// OpenMeta decrypts the file with the encryption recorded in the Meta read
+// along with it.
+func (fs *encryptedFS) OpenMeta(bucket *ent.Bucket, key string) (ent.File, ent.Meta, error) {
+	f, m, err := openWithMeta(fs.FileSystem, bucket, key)
+	if err != nil {
+		return nil, ent.Meta{}, err
+	}
+
+	df, err := fs.decrypt(f, m.Encryption)
+	if err != nil {
+		return nil, ent.Meta{}, err
+	}
+
+	// The digests recorded for content compressed before it was encrypted
+	// are the ones of the decompressed content.
+	if ef, ok := df.(*encryptedFile); ok && m.Compression == "" {
+		ef.recorded = true
+	}
+
+	return df, m, nil
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/soundcloud/ent/lib"
+)
+
+func TestCreateWithMeta(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-create-meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	bolt, cleanup := newTestBoltFS(t)
+	defer cleanup()
+
+	b := ent.NewBucket("meta", ent.Owner{})
+
+	for name, fs := range map[string]ent.FileSystem{
+		"disk":     newDiskFS(tmp),
+		"direct":   newDiskFS(tmp, withDirectWrite(true)),
+		"bolt":     bolt,
+		"compress": newCompressFS(newDiskFS(tmp)),
+		"memory":   ent.NewMemoryFS(),
+	} {
+		var (
+			key     = name + ".txt"
+			expires = time.Now().Add(time.Hour).Round(0)
+			retain  = time.Now().Add(time.Hour).Round(0)
+		)
+
+		f, err := createWithMeta(fs, b, key, strings.NewReader("first"), createOptions{
+			meta: ent.Meta{Expires: expires},
+		})
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		f.Close()
+
+		first, err := fs.Meta(b, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have, want := first.Expires, expires; !have.Equal(want) {
+			t.Errorf("%s: have %v, want %v", name, have, want)
+		}
+
+		// The Meta of the replaced content is dropped, except for the time
+		// the key was first stored.
+		f, err = createWithMeta(fs, b, key, strings.NewReader("second"), createOptions{
+			meta: ent.Meta{RetainUntil: retain},
+		})
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		f.Close()
+
+		second, err := fs.Meta(b, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !second.Expires.IsZero() {
+			t.Errorf("%s: expiry of replaced content kept: %v", name, second.Expires)
+		}
+
+		if have, want := second.RetainUntil, retain; !have.Equal(want) {
+			t.Errorf("%s: have %v, want %v", name, have, want)
+		}
+
+		if have, want := second.Created, first.Created; !have.Equal(want) {
+			t.Errorf("%s: have created %v, want %v", name, have, want)
+		}
+
+		_, err = createWithMeta(fs, b, key, strings.NewReader("third"), createOptions{
+			exclusive: true,
+		})
+		if have, want := err, ent.ErrFileExists; have != want {
+			t.Errorf("%s: have %v, want %v", name, have, want)
+		}
+	}
+}
+
+func TestCreateWithMetaRetention(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-create-retention")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	bolt, cleanup := newTestBoltFS(t)
+	defer cleanup()
+
+	var (
+		b      = ent.NewBucket("retention", ent.Owner{})
+		retain = createOptions{
+			meta: ent.Meta{RetainUntil: time.Now().Add(time.Hour)},
+		}
+	)
+
+	// Backends storing the Meta with the content check the retention under
+	// the lock of the key, so it can't be raced by a concurrent Create.
+	for name, fs := range map[string]ent.FileSystem{
+		"disk":   newDiskFS(tmp),
+		"direct": newDiskFS(tmp, withDirectWrite(true)),
+		"bolt":   bolt,
+	} {
+		key := name + ".txt"
+
+		f, err := createWithMeta(fs, b, key, strings.NewReader("retained"), retain)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		f.Close()
+
+		_, err = fs.Create(b, key, strings.NewReader("replaced"))
+		if have, want := err, ent.ErrRetentionActive; have != want {
+			t.Errorf("%s: have %v, want %v", name, have, want)
+		}
+
+		err = fs.Delete(b, key)
+		if have, want := err, ent.ErrRetentionActive; have != want {
+			t.Errorf("%s: have %v, want %v", name, have, want)
+		}
+
+		f, err = fs.Open(b, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		content, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have, want := string(content), "retained"; have != want {
+			t.Errorf("%s: have %q, want %q", name, have, want)
+		}
+	}
+}
+
+func TestUpdateMeta(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-update-meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	bolt, cleanup := newTestBoltFS(t)
+	defer cleanup()
+
+	encrypted, err := newEncryptedFS(newDiskFS(tmp), bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		b       = ent.NewBucket("update", ent.Owner{})
+		expires = time.Now().Add(time.Hour).Round(0)
+		retain  = time.Now().Add(time.Hour).Round(0)
+	)
+	b.Compression = ent.CompressionGzip
+
+	// Backends store what they are given, the wrappers encoding the content
+	// keep what they recorded about it.
+	for _, input := range []struct {
+		name  string
+		fs    ent.FileSystem
+		keeps bool
+	}{
+		{"disk", newDiskFS(tmp), false},
+		{"bolt", bolt, false},
+		{"memory", ent.NewMemoryFS(), false},
+		{"compress", newCompressFS(newDiskFS(tmp)), true},
+		{"compress, encrypt", newHashIndexFS(newCompressFS(encrypted)), true},
+	} {
+		var (
+			name = input.name
+			fs   = input.fs
+			key  = strings.Replace(name, ", ", "-", -1) + ".txt"
+		)
+
+		f, err := createWithMeta(fs, b, key, strings.NewReader("content"), createOptions{
+			meta: ent.Meta{Expires: expires},
+		})
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		f.Close()
+
+		stored, err := fs.Meta(b, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = updateMeta(fs, b, key, func(m *ent.Meta) {
+			m.RetainUntil = retain
+			m.Compression = ""
+			m.Encryption = ""
+		})
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		m, err := fs.Meta(b, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have, want := m.RetainUntil, retain; !have.Equal(want) {
+			t.Errorf("%s: have %v, want %v", name, have, want)
+		}
+
+		if have, want := m.Expires, stored.Expires; !have.Equal(want) {
+			t.Errorf("%s: have %v, want %v", name, have, want)
+		}
+
+		want := ent.Meta{}
+		if input.keeps {
+			want = stored
+		}
+
+		if have, want := m.Compression, want.Compression; have != want {
+			t.Errorf("%s: have compression %q, want %q", name, have, want)
+		}
+
+		if have, want := m.Encryption, want.Encryption; have != want {
+			t.Errorf("%s: have encryption %q, want %q", name, have, want)
+		}
+
+		err = updateMeta(fs, b, "missing.txt", func(m *ent.Meta) {
+			m.RetainUntil = retain
+		})
+		if have, want := err, ent.ErrFileNotFound; have != want {
+			t.Errorf("%s: have %v, want %v", name, have, want)
+		}
+	}
+}
+
+func TestDiskFSUpdateMetaLocksKey(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-update-meta-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		b  = ent.NewBucket("update-lock", ent.Owner{})
+		fs = newDiskFS(tmp).(*diskFS)
+	)
+
+	f, err := fs.Create(b, "locked.txt", strings.NewReader("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// A Create replacing the file holds the lock of the key.
+	unlock := fs.keys.lock(pathForFile(fs, b, "locked.txt"))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fs.UpdateMeta(b, "locked.txt", func(m *ent.Meta) {
+			m.Expires = time.Now().Add(time.Hour)
+		})
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("update passed the lock of the key: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	unlock()
+
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandleReservedKey(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-reserved-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		b = ent.NewBucket("reserved", ent.Owner{})
+		h = normalizeKey(handleCreate(ent.NewMemoryProvider(b), newDiskFS(tmp)))
+	)
+
+	for _, input := range []struct {
+		key    string
+		status int
+	}{
+		{"doc.txt", http.StatusCreated},
+		{"doc.txt" + metaExt, http.StatusBadRequest},
+		{"nested" + metaExt + "/doc.txt", http.StatusBadRequest},
+		{pendingPrefix + "doc.txt", http.StatusBadRequest},
+		{"nested/" + trashDir + "/doc.txt", http.StatusBadRequest},
+		{versionsDir + "/doc.txt", http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest(
+			"POST",
+			"/?"+url.Values{ent.KeyBucket: {b.Name}, ent.KeyBlob: {input.key}}.Encode(),
+			strings.NewReader("{not json"),
+		)
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		if have, want := w.Code, input.status; have != want {
+			t.Errorf("%s: have %d, want %d", input.key, have, want)
+		}
+	}
+
+	// The sidecar of doc.txt is left alone, so it can still be replaced.
+	f, err := newDiskFS(tmp).Create(b, "doc.txt", strings.NewReader("replaced"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+}
+
+func TestOpenRecordedDigests(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-recorded-digests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	encrypted, err := newEncryptedFS(newDiskFS(tmp), bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		content = strings.Repeat("recorded ", 1<<10)
+		sum     = sha1.Sum([]byte(content))
+		b       = ent.NewBucket("recorded", ent.Owner{})
+	)
+	b.Compression = ent.CompressionGzip
+
+	for name, fs := range map[string]ent.FileSystem{
+		"disk":              newDiskFS(tmp),
+		"compress":          newCompressFS(newDiskFS(tmp)),
+		"encrypt":           encrypted,
+		"compress, encrypt": newCompressFS(encrypted),
+	} {
+		key := strings.Replace(name, ", ", "-", -1) + ".txt"
+
+		f, err := fs.Create(b, key, strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		// Zeroing the stored content leaves its size, the digests of a
+		// handle have to come from the sidecar to be right.
+		p := filepath.Join(tmp, b.Name, key)
+
+		stat, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = ioutil.WriteFile(p, make([]byte, stat.Size()), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		os.Chtimes(p, stat.ModTime(), stat.ModTime())
+
+		f, err = fs.Open(b, key)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		h, err := f.Hash()
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		if have, want := hex.EncodeToString(h), hex.EncodeToString(sum[:]); have != want {
+			t.Errorf("%s: have %s, want %s", name, have, want)
+		}
+
+		crc, err := f.CRC32C()
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		if have, want := crc, crc32.Checksum([]byte(content), ent.CRC32CTable); have != want {
+			t.Errorf("%s: have %08x, want %08x", name, have, want)
+		}
+
+		size, err := f.Size()
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		if have, want := size, int64(len(content)); have != want {
+			t.Errorf("%s: have %d, want %d", name, have, want)
+		}
+
+		f.Close()
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/soundcloud/ent/lib"
+)
+
+const (
+	maxParts   = 10000
+	partExt    = ".part"
+	uploadFile = "upload.json"
+)
+
+var uploadIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// multipartFS wraps a FileSystem and allows files to be uploaded in several
+// parts. Parts are staged as files in dir and only stored in the wrapped
+// FileSystem once the upload is completed. The state of an upload is kept in
+// dir entirely, uploads can be continued after a restart. Resumable uploads
+// sending ranges of a file are staged in dir as well.
+type multipartFS struct {
+	ent.FileSystem
+
+	dir    string
+	ranges keyLocks
+}
+
+// multipartUpload identifies the file an upload is for.
+type multipartUpload struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+}
+
+func newMultipartFS(fs ent.FileSystem, dir string) *multipartFS {
+	return &multipartFS{
+		FileSystem: fs,
+		dir:        dir,
+	}
+}
+
+// CreateMultipart begins an upload in parts of the file under key and returns
+// the id of the upload.
+func (fs *multipartFS) CreateMultipart(bucket *ent.Bucket, key string) (string, error) {
+	raw := make([]byte, 16)
+
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", err
+	}
+
+	var (
+		id  = hex.EncodeToString(raw)
+		dir = filepath.Join(fs.dir, id)
+	)
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	u, err := json.Marshal(multipartUpload{
+		Bucket: bucket.Name,
+		Key:    key,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, uploadFile), u, 0644)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("storing upload failed: %s", err)
+	}
+
+	return id, nil
+}
+
+// PutPart stages part n of the upload with id and returns the SHA1 of its
+// content. A part uploaded before under the same number is replaced.
+func (fs *multipartFS) PutPart(
+	bucket *ent.Bucket,
+	key, id string,
+	n int,
+	r io.Reader,
+) ([]byte, error) {
+	dir, err := fs.upload(bucket, key, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if n < 1 || n > maxParts {
+		return nil, ent.ErrInvalidParam
+	}
+
+	tmp, err := ioutil.TempFile(dir, "pending-")
+	if err != nil {
+		return nil, err
+	}
+
+	// Partially written parts must not be left behind.
+	renamed := false
+	defer func() {
+		tmp.Close()
+		if !renamed {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	h := sha1.New()
+
+	_, err = io.Copy(io.MultiWriter(tmp, h), r)
+	if err != nil {
+		return nil, fmt.Errorf("storing part failed: %s", err)
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return nil, fmt.Errorf("storing part failed: %s", err)
+	}
+
+	err = os.Rename(tmp.Name(), partPath(dir, n))
+	if err != nil {
+		return nil, fmt.Errorf("rename failed: %s", err)
+	}
+	renamed = true
+
+	return h.Sum(nil), nil
+}
+
+// CompleteMultipart stores the given parts of the upload with id concatenated
+// as the file under key. Parts have to be listed in ascending order. If hash
+// is not empty the concatenated content has to match it. The upload is
+// discarded once the file is stored.
+func (fs *multipartFS) CompleteMultipart(
+	bucket *ent.Bucket,
+	key, id string,
+	parts []int,
+	hash string,
+) (ent.File, error) {
+	dir, err := fs.upload(bucket, key, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(parts) == 0 {
+		return nil, ent.ErrInvalidParam
+	}
+
+	paths := make([]string, len(parts))
+
+	for i, n := range parts {
+		if n < 1 || i > 0 && n <= parts[i-1] {
+			return nil, ent.ErrInvalidParam
+		}
+
+		paths[i] = partPath(dir, n)
+
+		_, err := os.Stat(paths[i])
+		if os.IsNotExist(err) {
+			return nil, ent.ErrInvalidParam
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if hash != "" {
+		h := sha1.New()
+		r := &partsReader{paths: paths}
+
+		_, err := io.Copy(h, r)
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		if sum := hex.EncodeToString(h.Sum(nil)); sum != hash {
+			return nil, ent.ErrHashMismatch
+		}
+	}
+
+	r := &partsReader{paths: paths}
+	defer r.Close()
+
+	f, err := fs.FileSystem.Create(bucket, key, r)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.RemoveAll(dir)
+	if err != nil {
+		log.Printf("ERROR removing upload %s: %s", id, err)
+	}
+
+	return f, nil
+}
+
+// AbortMultipart discards the upload with id and the parts staged for it.
+func (fs *multipartFS) AbortMultipart(bucket *ent.Bucket, key, id string) error {
+	dir, err := fs.upload(bucket, key, id)
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(dir)
+}
+
+// SweepUploads removes the multipart and resumable uploads which received no
+// content since before, as they have been abandoned, and returns their
+// number. Uploads still in progress have to receive content within the
+// threshold.
+func (fs *multipartFS) SweepUploads(before time.Time) (int, error) {
+	n := 0
+
+	infos, err := ioutil.ReadDir(fs.dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	for _, info := range infos {
+		if !info.IsDir() || !uploadIDPattern.MatchString(info.Name()) {
+			continue
+		}
+
+		swept, err := sweepUpload(filepath.Join(fs.dir, info.Name()), before)
+		if err != nil {
+			return n, err
+		}
+		if swept {
+			n++
+		}
+	}
+
+	infos, err = ioutil.ReadDir(filepath.Join(fs.dir, rangesDir))
+	if os.IsNotExist(err) {
+		return n, nil
+	}
+	if err != nil {
+		return n, err
+	}
+
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+
+		dir := filepath.Join(fs.dir, rangesDir, info.Name())
+
+		// Ranges are appended under the lock, which is held while the upload
+		// is checked so it isn't removed while receiving content.
+		unlock := fs.ranges.lock(dir)
+		swept, err := sweepUpload(dir, before)
+		unlock()
+		if err != nil {
+			return n, err
+		}
+		if swept {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// sweepUpload removes the upload staged in dir if neither dir nor any of the
+// files in it have been modified since before.
+func sweepUpload(dir string, before time.Time) (bool, error) {
+	fi, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	last := fi.ModTime()
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+
+	for _, info := range infos {
+		if info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+
+	if !last.Before(before) {
+		return false, nil
+	}
+
+	err = os.RemoveAll(dir)
+	if err != nil {
+		return false, fmt.Errorf("sweep failed: %s", err)
+	}
+
+	return true, nil
+}
+
+// upload returns the directory of the upload with id after verifying it was
+// begun for the file under key.
+func (fs *multipartFS) upload(bucket *ent.Bucket, key, id string) (string, error) {
+	// The id is used as a path and must not point outside of the uploads.
+	if !uploadIDPattern.MatchString(id) {
+		return "", ent.ErrUploadNotFound
+	}
+
+	dir := filepath.Join(fs.dir, id)
+
+	raw, err := ioutil.ReadFile(filepath.Join(dir, uploadFile))
+	if os.IsNotExist(err) {
+		return "", ent.ErrUploadNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+
+	u := multipartUpload{}
+
+	err = json.Unmarshal(raw, &u)
+	if err != nil {
+		return "", fmt.Errorf("reading upload failed: %s", err)
+	}
+
+	if u.Bucket != bucket.Name || u.Key != key {
+		return "", ent.ErrUploadNotFound
+	}
+
+	return dir, nil
+}
+
+func partPath(dir string, n int) string {
+	return filepath.Join(dir, strconv.Itoa(n)+partExt)
+}
+
+// partsReader reads the files at paths one after another, holding only one of
+// them open at a time.
+type partsReader struct {
+	paths []string
+	f     *os.File
+}
+
+func (r *partsReader) Read(p []byte) (int, error) {
+	for {
+		if r.f == nil {
+			if len(r.paths) == 0 {
+				return 0, io.EOF
+			}
+
+			f, err := os.Open(r.paths[0])
+			if err != nil {
+				return 0, err
+			}
+
+			r.f, r.paths = f, r.paths[1:]
+		}
+
+		n, err := r.f.Read(p)
+		if err == io.EOF {
+			r.f.Close()
+			r.f = nil
+
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+
+		return n, err
+	}
+}
+
+func (r *partsReader) Close() error {
+	if r.f == nil {
+		return nil
+	}
+
+	return r.f.Close()
+}
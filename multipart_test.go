@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/pat"
+	"github.com/soundcloud/ent/lib"
+)
+
+func TestHandleMultipartUpload(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-multipart-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		b     = ent.NewBucket("multipart", ent.Owner{})
+		fs    = newMultipartFS(newDiskFS(filepath.Join(tmp, "root")), filepath.Join(tmp, "uploads"))
+		r     = pat.New()
+		key   = "assembled.bin"
+		parts = []string{"first part, ", "second part"}
+		sum   = sha1.Sum([]byte(parts[0] + parts[1]))
+	)
+
+	r.Post(ent.RouteFile, handleUpload(ent.NewMemoryProvider(b), fs))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	ep := fmt.Sprintf("%s/%s/%s", ts.URL, b.Name, key)
+
+	upload := ent.ResponseUpload{}
+	multipartPost(t, ep+"?uploads", nil, http.StatusOK, &upload)
+
+	// Parts can be uploaded in any order.
+	for _, n := range []int{2, 1} {
+		part := ent.ResponsePart{}
+		multipartPost(
+			t,
+			fmt.Sprintf("%s?uploadId=%s&part=%d", ep, upload.UploadID, n),
+			[]byte(parts[n-1]),
+			http.StatusOK,
+			&part,
+		)
+
+		partSum := sha1.Sum([]byte(parts[n-1]))
+
+		if have, want := part.SHA1, hex.EncodeToString(partSum[:]); have != want {
+			t.Errorf("part %d: have %s, want %s", n, have, want)
+		}
+	}
+
+	complete := func(parts []int, hash string) []byte {
+		raw, err := json.Marshal(ent.RequestComplete{Parts: parts, SHA1: hash})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+
+	multipartPost(t, ep+"?uploadId="+upload.UploadID, complete([]int{2, 1}, ""), http.StatusBadRequest, nil)
+	multipartPost(t, ep+"?uploadId="+upload.UploadID, complete([]int{1, 2}, hex.EncodeToString(make([]byte, 20))), http.StatusBadRequest, nil)
+
+	created := ent.ResponseCreated{}
+	multipartPost(t, ep+"?uploadId="+upload.UploadID, complete([]int{1, 2}, hex.EncodeToString(sum[:])), http.StatusCreated, &created)
+
+	if have, want := created.File.Key, key; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	raw, err := ioutil.ReadFile(filepath.Join(tmp, "root", b.Name, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := string(raw), parts[0]+parts[1]; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+
+	// The upload is discarded once completed.
+	multipartPost(t, ep+"?uploadId="+upload.UploadID, complete([]int{1, 2}, ""), http.StatusNotFound, nil)
+}
+
+func multipartPost(t *testing.T, url string, body []byte, status int, obj interface{}) {
+	res, err := http.Post(url, "application/octet-stream", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if have, want := res.StatusCode, status; have != want {
+		t.Fatalf("POST %s: have %d, want %d", url, have, want)
+	}
+
+	if obj == nil {
+		return
+	}
+
+	err = json.NewDecoder(res.Body).Decode(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandleAbortMultipart(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-multipart-abort")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		b  = ent.NewBucket("multipart", ent.Owner{})
+		p  = ent.NewMemoryProvider(b)
+		fs = newMultipartFS(newDiskFS(filepath.Join(tmp, "root")), filepath.Join(tmp, "uploads"))
+		r  = pat.New()
+	)
+
+	r.Post(ent.RouteFile, handleUpload(p, fs))
+	r.Delete(ent.RouteFile, handleRemove(p, fs))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	ep := fmt.Sprintf("%s/%s/aborted.bin", ts.URL, b.Name)
+
+	upload := ent.ResponseUpload{}
+	multipartPost(t, ep+"?uploads", nil, http.StatusOK, &upload)
+	multipartPost(t, ep+"?uploadId="+upload.UploadID+"&part=1", []byte("part"), http.StatusOK, nil)
+
+	abort := func(ep string) int {
+		req, err := http.NewRequest("DELETE", ep+"?uploadId="+upload.UploadID, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		return res.StatusCode
+	}
+
+	// Uploads are only aborted for the key they were begun for.
+	if have, want := abort(fmt.Sprintf("%s/%s/other.bin", ts.URL, b.Name)), http.StatusNotFound; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+
+	if have, want := abort(ep), http.StatusOK; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+
+	_, err = os.Stat(filepath.Join(tmp, "uploads", upload.UploadID))
+	if !os.IsNotExist(err) {
+		t.Errorf("parts left behind: %v", err)
+	}
+
+	if have, want := abort(ep), http.StatusNotFound; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+}
+
+func TestMultipartFSSweepUploads(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-multipart-sweep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		b     = ent.NewBucket("multipart", ent.Owner{})
+		fs    = newMultipartFS(newDiskFS(filepath.Join(tmp, "root")), filepath.Join(tmp, "uploads"))
+		stale = time.Now().Add(-48 * time.Hour)
+	)
+
+	age := func(dir string) {
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, info := range infos {
+			err = os.Chtimes(filepath.Join(dir, info.Name()), stale, stale)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err = os.Chtimes(dir, stale, stale)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	abandoned, err := fs.CreateMultipart(b, "abandoned.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = fs.PutPart(b, "abandoned.bin", abandoned, 1, strings.NewReader("part"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	age(filepath.Join(tmp, "uploads", abandoned))
+
+	// A part received recently keeps the upload.
+	active, err := fs.CreateMultipart(b, "active.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	age(filepath.Join(tmp, "uploads", active))
+
+	_, err = fs.PutPart(b, "active.bin", active, 1, strings.NewReader("part"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Ranges are staged in the upload directory for backends which can't
+	// stage them.
+	ranged := newMultipartFS(ent.NewMemoryFS(), fs.dir)
+
+	_, _, err = ranged.PutRange(b, "ranged.bin", contentRange{start: 0, end: 4, total: 8}, strings.NewReader("half"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	age(fs.rangeDir(b, "ranged.bin"))
+
+	n, err := fs.SweepUploads(time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := n, 2; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+
+	_, err = fs.PutPart(b, "abandoned.bin", abandoned, 2, strings.NewReader("part"))
+	if have, want := err, ent.ErrUploadNotFound; have != want {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	_, err = fs.PutPart(b, "active.bin", active, 2, strings.NewReader("part"))
+	if err != nil {
+		t.Errorf("active upload swept: %s", err)
+	}
+
+	_, err = os.Stat(fs.rangeDir(b, "ranged.bin"))
+	if !os.IsNotExist(err) {
+		t.Errorf("ranges left behind: %v", err)
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/soundcloud/ent/lib"
+)
+
+// keyWalker is implemented by FileSystems which can walk the files of a
+// bucket in ascending key order, so a page of a listing is read without
+// reading the files before and after it.
+type keyWalker interface {
+	// WalkKeys calls fn like Walk but in ascending key order, starting with
+	// the first key not before start. errUnordered is returned without
+	// calling fn if the files can't be walked in key order.
+	WalkKeys(
+		bucket *ent.Bucket,
+		prefix string,
+		modified ent.ModifiedRange,
+		start string,
+		fn func(ent.File) error,
+	) error
+}
+
+// errUnordered is returned by WalkKeys of FileSystems which can't walk their
+// files in key order.
+var errUnordered = errors.New("files can't be walked in key order")
+
+// walkKeys walks the files of bucket in key order, FileSystems which can't
+// are answered with errUnordered.
+func walkKeys(
+	fs ent.FileSystem,
+	bucket *ent.Bucket,
+	prefix string,
+	modified ent.ModifiedRange,
+	start string,
+	fn func(ent.File) error,
+) error {
+	kw, ok := fs.(keyWalker)
+	if !ok {
+		return errUnordered
+	}
+
+	return kw.WalkKeys(bucket, prefix, modified, start, fn)
+}
+
+// pageStart returns the first key a page continuing after marker and
+// starting at startAfter can hold. No key sorts between a key and the key
+// extended by a NUL byte.
+func pageStart(marker, startAfter string) string {
+	if marker != "" && marker+"\x00" > startAfter {
+		return marker + "\x00"
+	}
+	return startAfter
+}
+
+// page collects the files of a page of a listing: the first limit files with
+// keys in [start, end), and the one following them which tells that the
+// listing continues. An empty end leaves the range open. Files are added in
+// any order, only limit+1 of them are held at any time.
+type page struct {
+	start string
+	end   string
+	limit uint64
+	files keyHeap
+}
+
+// add adds f to the page if it belongs to it. Walking in key order, errWalkLimit
+// is returned once no later file can belong to the page.
+func (p *page) add(f ent.File, ordered bool) error {
+	key := f.Key()
+
+	if key < p.start {
+		return nil
+	}
+	if p.end != "" && key >= p.end {
+		if ordered {
+			return errWalkLimit
+		}
+		return nil
+	}
+
+	if uint64(len(p.files)) <= p.limit {
+		heap.Push(&p.files, f)
+	} else if key < p.files[0].Key() {
+		p.files[0] = f
+		heap.Fix(&p.files, 0)
+	}
+
+	if ordered && uint64(len(p.files)) > p.limit {
+		return errWalkLimit
+	}
+
+	return nil
+}
+
+// result returns the files of the page in ascending key order and the marker
+// to continue with if the listing continues.
+func (p *page) result() (ent.Files, string) {
+	files := ent.Files(p.files)
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Key() < files[j].Key()
+	})
+
+	if uint64(len(files)) <= p.limit {
+		return files, ""
+	}
+
+	files = files[:p.limit]
+
+	return files, files[len(files)-1].Key()
+}
+
+// keyHeap is a max-heap of files by key, the last key of a page is replaced
+// when a file sorting before it is added.
+type keyHeap ent.Files
+
+func (h keyHeap) Len() int           { return len(h) }
+func (h keyHeap) Less(i, j int) bool { return h[i].Key() > h[j].Key() }
+func (h keyHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *keyHeap) Push(x interface{}) {
+	*h = append(*h, x.(ent.File))
+}
+
+func (h *keyHeap) Pop() interface{} {
+	old := *h
+	f := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return f
+}
+
+// listPage lists the files of bucket in [start, end) up to limit in
+// ascending key order and returns the marker to continue with if more files
+// follow. FileSystems walking in key order stop after the page, all others
+// are walked in full.
+func listPage(
+	fs ent.FileSystem,
+	bucket *ent.Bucket,
+	prefix string,
+	modified ent.ModifiedRange,
+	start string,
+	end string,
+	limit uint64,
+) (ent.Files, string, error) {
+	p := &page{start: start, end: end, limit: limit}
+
+	err := walkKeys(fs, bucket, prefix, modified, start, func(f ent.File) error {
+		return p.add(f, true)
+	})
+	if err == errUnordered {
+		err = fs.Walk(bucket, prefix, modified, func(f ent.File) error {
+			return p.add(f, false)
+		})
+	}
+	if err != nil && err != errWalkLimit {
+		return nil, "", err
+	}
+
+	files, next := p.result()
+
+	return files, next, nil
+}
+
+// listDirPage lists the files of bucket directly below prefix like listPage
+// and returns the common prefixes of the keys below them in ascending order.
+// Common prefixes are neither limited nor paged.
+func listDirPage(
+	fs ent.FileSystem,
+	bucket *ent.Bucket,
+	prefix string,
+	modified ent.ModifiedRange,
+	start string,
+	end string,
+	limit uint64,
+) (ent.Files, []string, string, error) {
+	var (
+		p        = &page{start: start, end: end, limit: limit}
+		prefixes = []string{}
+	)
+
+	err := fs.WalkDir(
+		bucket,
+		prefix,
+		modified,
+		func(f ent.File) error {
+			return p.add(f, false)
+		},
+		func(p string) error {
+			prefixes = append(prefixes, p)
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	sort.Strings(prefixes)
+
+	files, next := p.result()
+
+	return files, prefixes, next, nil
+}
+
+// WalkKeys reads the directories of the bucket in key order, skipping those
+// which only hold keys before start. Sharded keys are spread over the shard
+// directories regardless of their order and are not walked in key order.
+func (fs *diskFS) WalkKeys(
+	bucket *ent.Bucket,
+	prefix string,
+	modified ent.ModifiedRange,
+	start string,
+	fn func(ent.File) error,
+) error {
+	if fs.shard {
+		return errUnordered
+	}
+
+	return fs.walkKeys(filepath.Join(fs.root, bucket.Name), "", prefix, modified, start, fn)
+}
+
+// walkKeys walks the directory dir holding the keys starting with dirKey.
+func (fs *diskFS) walkKeys(
+	dir string,
+	dirKey string,
+	prefix string,
+	modified ent.ModifiedRange,
+	start string,
+	fn func(ent.File) error,
+) error {
+	// In case the directory does not exist yet for a bucket, because no files
+	// have been stored yet we treat it as if the bucket is empty.
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Keys below a directory continue with a slash, which sorts after some
+	// characters file names can continue with, like "a-b" before "a/b".
+	keyOf := func(info os.FileInfo) string {
+		if info.IsDir() {
+			return dirKey + info.Name() + "/"
+		}
+		return dirKey + info.Name()
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return keyOf(infos[i]) < keyOf(infos[j])
+	})
+
+	for _, info := range infos {
+		if isIgnored(fs.ignore, info.Name()) {
+			continue
+		}
+
+		key := keyOf(info)
+
+		if info.IsDir() {
+			// Skip directories which can't contain keys with the prefix or
+			// only keys before start.
+			if !strings.HasPrefix(key, prefix) && !strings.HasPrefix(prefix, key) {
+				continue
+			}
+			if key < start && !strings.HasPrefix(start, key) {
+				continue
+			}
+
+			err = fs.walkKeys(filepath.Join(dir, info.Name()), key, prefix, modified, start, fn)
+		} else if key >= start &&
+			strings.HasPrefix(key, prefix) &&
+			modified.Contains(info.ModTime()) {
+			// The file is only opened once read, like when walking.
+			f := newFile(nil, key)
+			f.lastModified = info.ModTime()
+			f.metaPath = filepath.Join(dir, info.Name())
+			f.path = f.metaPath
+
+			err = fn(f)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// WalkKeys walks the files as stored by the wrapped FileSystem.
+func (fs *compressFS) WalkKeys(
+	bucket *ent.Bucket,
+	prefix string,
+	modified ent.ModifiedRange,
+	start string,
+	fn func(ent.File) error,
+) error {
+	return walkKeys(fs.FileSystem, bucket, prefix, modified, start, fn)
+}
+
+// WalkKeys walks the files as stored by the wrapped FileSystem.
+func (fs *encryptedFS) WalkKeys(
+	bucket *ent.Bucket,
+	prefix string,
+	modified ent.ModifiedRange,
+	start string,
+	fn func(ent.File) error,
+) error {
+	return walkKeys(fs.FileSystem, bucket, prefix, modified, start, fn)
+}
+
+// WalkKeys walks the files as stored by the wrapped FileSystem.
+func (fs *hashIndexFS) WalkKeys(
+	bucket *ent.Bucket,
+	prefix string,
+	modified ent.ModifiedRange,
+	start string,
+	fn func(ent.File) error,
+) error {
+	return walkKeys(fs.FileSystem, bucket, prefix, modified, start, fn)
+}
+
+// WalkKeys walks the files as stored by the wrapped FileSystem.
+func (fs *multipartFS) WalkKeys(
+	bucket *ent.Bucket,
+	prefix string,
+	modified ent.ModifiedRange,
+	start string,
+	fn func(ent.File) error,
+) error {
+	return walkKeys(fs.FileSystem, bucket, prefix, modified, start, fn)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/soundcloud/ent/lib"
+)
+
+func TestListPage(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-list-page")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	bolt, cleanup := newTestBoltFS(t)
+	defer cleanup()
+
+	var (
+		b = ent.NewBucket("page", ent.Owner{})
+		// A slash sorts after a dash, the keys below directory a follow a-b.
+		keys = []string{"a-b", "a/b", "a/c/d", "a0", "b", "c/d/e", "c/f"}
+	)
+
+	for name, fs := range map[string]ent.FileSystem{
+		"disk":    newDiskFS(filepath.Join(tmp, "disk")),
+		"sharded": newDiskFS(filepath.Join(tmp, "sharded"), withSharding(true)),
+		"bolt":    bolt,
+		"memory":  ent.NewMemoryFS(),
+	} {
+		for i := len(keys) - 1; i >= 0; i-- {
+			_, err := fs.Create(b, keys[i], strings.NewReader(keys[i]))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		listed := []string{}
+		marker := ""
+		for {
+			files, next, err := listPage(fs, b, "", ent.ModifiedRange{}, pageStart(marker, ""), "", 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, f := range files {
+				listed = append(listed, f.Key())
+			}
+
+			if next == "" {
+				break
+			}
+			marker = next
+		}
+
+		if have, want := listed, keys; !reflect.DeepEqual(have, want) {
+			t.Errorf("%s: have %v, want %v", name, have, want)
+		}
+
+		for _, input := range []struct {
+			prefix string
+			start  string
+			end    string
+			keys   []string
+			next   string
+		}{
+			{"", "", "", []string{"a-b", "a/b", "a/c/d"}, "a/c/d"},
+			{"a", "a/", "", []string{"a/b", "a/c/d", "a0"}, ""},
+			{"", "a/c", "c", []string{"a/c/d", "a0", "b"}, ""},
+			{"c/", pageStart("c/d/e", ""), "", []string{"c/f"}, ""},
+			{"", "d", "", []string{}, ""},
+		} {
+			files, next, err := listPage(fs, b, input.prefix, ent.ModifiedRange{}, input.start, input.end, 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			have := []string{}
+			for _, f := range files {
+				have = append(have, f.Key())
+			}
+
+			if want := input.keys; !reflect.DeepEqual(have, want) {
+				t.Errorf("%s %q %q: have %v, want %v", name, input.prefix, input.start, have, want)
+			}
+
+			if have, want := next, input.next; have != want {
+				t.Errorf("%s %q %q: have next %q, want %q", name, input.prefix, input.start, have, want)
+			}
+		}
+	}
+}
+
+func TestDiskFSWalkKeys(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "diskfs-walk-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		b  = ent.NewBucket("walk-keys", ent.Owner{})
+		fs = newDiskFS(tmp).(*diskFS)
+	)
+
+	for _, key := range []string{"y/2", "y/1", "x/2", "x/1"} {
+		_, err := fs.Create(b, key, strings.NewReader(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	walked := []string{}
+
+	// The walk stops once fn has seen enough.
+	err = fs.WalkKeys(b, "", ent.ModifiedRange{}, "x/2", func(f ent.File) error {
+		walked = append(walked, f.Key())
+		if len(walked) == 2 {
+			return errWalkLimit
+		}
+		return nil
+	})
+	if have, want := err, errWalkLimit; have != want {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	if have, want := walked, []string{"x/2", "y/1"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+}
@@ -1,28 +1,63 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/mail"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/soundcloud/ent/lib"
+	"gopkg.in/yaml.v2"
 )
 
+// Policies are JSON files with policyExt, or YAML files if it is followed by
+// one of yamlExts.
 const policyExt = ".entpolicy"
 
+var yamlExts = []string{".yaml", ".yml"}
+
+// Bucket names are used as directory names by the FileSystems, they start
+// with a letter or digit and consist of letters, digits, dots, dashes and
+// underscores only, so they can neither escape the root nor clash with the
+// hidden directories within it.
+const maxBucketNameLen = 63
+
+var bucketNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// validateBucketName rejects names which aren't safe to use as a directory.
+func validateBucketName(name string) error {
+	if len(name) > maxBucketNameLen {
+		return fmt.Errorf("bucket name %q longer than %d", name, maxBucketNameLen)
+	}
+
+	if !bucketNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid bucket name %q", name)
+	}
+
+	return nil
+}
+
 type diskProvider struct {
+	dir string
+
+	mu      sync.RWMutex
 	buckets map[string]*ent.Bucket
-	dir     string
 }
 
-func newDiskProvider(dir string) (ent.Provider, error) {
+func newDiskProvider(dir string) (*diskProvider, error) {
 	p := &diskProvider{
 		buckets: map[string]*ent.Bucket{},
 		dir:     dir,
 	}
 
-	err := filepath.Walk(p.dir, p.walk)
+	err := p.Reload()
 	if err != nil {
 		return nil, err
 	}
@@ -31,6 +66,9 @@ func newDiskProvider(dir string) (ent.Provider, error) {
 }
 
 func (p *diskProvider) Get(name string) (*ent.Bucket, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
 	b, ok := p.buckets[name]
 	if !ok {
 		return nil, ent.ErrBucketNotFound
@@ -39,6 +77,9 @@ func (p *diskProvider) Get(name string) (*ent.Bucket, error) {
 }
 
 func (p *diskProvider) List() ([]*ent.Bucket, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
 	bs := []*ent.Bucket{}
 	for _, b := range p.buckets {
 		bs = append(bs, b)
@@ -46,34 +87,349 @@ func (p *diskProvider) List() ([]*ent.Bucket, error) {
 	return bs, nil
 }
 
-func (p *diskProvider) loadBucket(name string) error {
-	f, err := os.Open(name)
+// Ready reports an error if the policy directory is no longer accessible.
+func (p *diskProvider) Ready() error {
+	stat, err := os.Stat(p.dir)
+	if err != nil {
+		return fmt.Errorf("policy dir: %s", err)
+	}
+
+	if !stat.IsDir() {
+		return fmt.Errorf("policy dir: %s is not a directory", p.dir)
+	}
+
+	return nil
+}
+
+// Reload walks the policy directory and replaces the known buckets with the
+// ones found. On error the previously loaded buckets are kept.
+func (p *diskProvider) Reload() error {
+	buckets := map[string]*ent.Bucket{}
+
+	err := filepath.Walk(p.dir, p.walk(buckets))
 	if err != nil {
 		return err
 	}
 
-	b := &ent.Bucket{}
-	err = json.NewDecoder(f).Decode(b)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.buckets = buckets
+
+	return nil
+}
+
+// Validate loads every policy in the directory without replacing the known
+// buckets. All policies failing to load are reported, as policyErrors.
+func (p *diskProvider) Validate() error {
+	errs := policyErrors{}
+
+	err := filepath.Walk(p.dir, p.walkPolicies(func(path string) error {
+		_, err := loadBucket(path)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		return nil
+	}))
 	if err != nil {
 		return err
 	}
 
-	// TODO(alx): Validate bucket configuration.
-	p.buckets[b.Name] = b
+	if len(errs) > 0 {
+		return errs
+	}
 
 	return nil
 }
 
-func (p *diskProvider) walk(path string, f os.FileInfo, err error) error {
+// policyErrors lists the errors of policies which failed to load.
+type policyErrors []error
+
+func (errs policyErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// loadBucket decodes the JSON or YAML policy in the file name. Errors name the
+// file and, for malformed input, the line of it.
+func loadBucket(name string) (*ent.Bucket, error) {
+	raw, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &ent.Bucket{}
+
+	if isYAMLPolicy(name) {
+		err = yaml.Unmarshal(raw, b)
+	} else {
+		err = json.NewDecoder(bytes.NewReader(raw)).Decode(b)
+	}
+	if err != nil {
+		if line := errorLine(raw, err); line > 0 {
+			return nil, fmt.Errorf("%s:%d: %s", name, line, err)
+		}
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+
+	err = prepareBucket(b)
 	if err != nil {
-		return fmt.Errorf("walking provider dir: %s", err)
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+
+	return b, nil
+}
+
+// prepareBucket validates the configuration of b and compiles its KeyPattern.
+func prepareBucket(b *ent.Bucket) error {
+	err := validateBucketName(b.Name)
+	if err != nil {
+		return err
+	}
+
+	switch b.Compression {
+	case "", ent.CompressionNone, ent.CompressionGzip, ent.CompressionZstd:
+	default:
+		return fmt.Errorf("unknown compression %q", b.Compression)
+	}
+
+	err = b.CompileKeyPattern()
+	if err != nil {
+		return fmt.Errorf("invalid key pattern: %s", err)
+	}
+
+	// TODO(alx): Validate bucket configuration.
+	return nil
+}
+
+// isPolicy reports whether the file at path is a JSON or YAML policy.
+func isPolicy(path string) bool {
+	if filepath.Ext(path) == policyExt {
+		return true
+	}
+
+	return isYAMLPolicy(path)
+}
+
+func isYAMLPolicy(path string) bool {
+	for _, ext := range yamlExts {
+		if strings.HasSuffix(path, policyExt+ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// errorLine returns the line of raw a JSON decoding error occurred at, 0 if
+// the error carries no position. Errors of the YAML decoder name the line
+// themselves.
+func errorLine(raw []byte, err error) int {
+	var offset int64
+
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		offset = e.Offset
+	case *json.UnmarshalTypeError:
+		offset = e.Offset
+	default:
+		return 0
 	}
-	if path != p.dir && f.IsDir() {
-		return filepath.SkipDir
+
+	if offset > int64(len(raw)) {
+		offset = int64(len(raw))
 	}
-	if filepath.Ext(path) != policyExt {
+
+	return bytes.Count(raw[:offset], []byte("\n")) + 1
+}
+
+func (p *diskProvider) walk(buckets map[string]*ent.Bucket) filepath.WalkFunc {
+	return p.walkPolicies(func(path string) error {
+		b, err := loadBucket(path)
+		if err != nil {
+			return err
+		}
+
+		buckets[b.Name] = b
+
 		return nil
+	})
+}
+
+// walkPolicies calls fn with the path of every policy in the directory.
+func (p *diskProvider) walkPolicies(fn func(path string) error) filepath.WalkFunc {
+	return func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return fmt.Errorf("walking provider dir: %s", err)
+		}
+		if path != p.dir && f.IsDir() {
+			return filepath.SkipDir
+		}
+		if !isPolicy(path) {
+			return nil
+		}
+
+		return fn(path)
+	}
+}
+
+// envBuckets names the environment variable the env provider reads buckets
+// from, as comma-separated list of name:owner pairs, e.g.
+// ENT_BUCKETS=logs:ops@example.com,media:web@example.com.
+const envBuckets = "ENT_BUCKETS"
+
+// envProvider serves buckets defined in an environment variable, for
+// deployments without a policy directory. The buckets are open to everybody
+// and use the defaults for all other settings.
+type envProvider struct {
+	ent.Provider
+}
+
+// newEnvProvider parses the buckets defined in the environment variable name.
+func newEnvProvider(name string) (*envProvider, error) {
+	buckets := []*ent.Bucket{}
+
+	for _, def := range splitList(os.Getenv(name)) {
+		parts := strings.SplitN(def, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("%s: invalid bucket %q, want name:owner", name, def)
+		}
+
+		err := validateBucketName(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+
+		addr, err := mail.ParseAddress(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid owner of bucket %q: %s", name, parts[0], err)
+		}
+
+		buckets = append(buckets, ent.NewBucket(parts[0], ent.Owner{Email: *addr}))
 	}
 
-	return p.loadBucket(path)
+	return &envProvider{Provider: ent.NewMemoryProvider(buckets...)}, nil
+}
+
+// providerConfig holds the settings of the Provider backends.
+type providerConfig struct {
+	dir string
+	url string
+	ttl time.Duration
+}
+
+// newProvider returns the Provider for the given backends, which are chained
+// in order if there are several.
+func newProvider(backends []string, cfg providerConfig) (ent.Provider, error) {
+	ps := []ent.Provider{}
+
+	for _, backend := range backends {
+		var (
+			p   ent.Provider
+			err error
+		)
+
+		switch backend {
+		case "disk":
+			p, err = newDiskProvider(cfg.dir)
+		case "env":
+			p, err = newEnvProvider(envBuckets)
+		case "http":
+			var hp *httpProvider
+
+			hp, err = newHTTPProvider(cfg.url, cfg.ttl)
+			if err == nil {
+				go hp.run()
+			}
+			p = hp
+		default:
+			return nil, fmt.Errorf("unknown Provider backend %q", backend)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		ps = append(ps, p)
+	}
+
+	switch len(ps) {
+	case 0:
+		return nil, fmt.Errorf("no Provider backend given")
+	case 1:
+		return ps[0], nil
+	}
+
+	return multiProvider(ps), nil
+}
+
+// multiProvider chains Providers. Buckets are looked up in order and the
+// first Provider knowing a bucket wins, also for listings.
+type multiProvider []ent.Provider
+
+func (mp multiProvider) Get(name string) (*ent.Bucket, error) {
+	for _, p := range mp {
+		b, err := p.Get(name)
+		if err == ent.ErrBucketNotFound {
+			continue
+		}
+		return b, err
+	}
+
+	return nil, ent.ErrBucketNotFound
+}
+
+func (mp multiProvider) List() ([]*ent.Bucket, error) {
+	var (
+		bs   = []*ent.Bucket{}
+		seen = map[string]bool{}
+	)
+
+	for _, p := range mp {
+		list, err := p.List()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, b := range list {
+			if seen[b.Name] {
+				continue
+			}
+			seen[b.Name] = true
+
+			bs = append(bs, b)
+		}
+	}
+
+	return bs, nil
+}
+
+// Ready reports the first error of the chained Providers checking their
+// readiness.
+func (mp multiProvider) Ready() error {
+	for _, p := range mp {
+		if c, ok := p.(readinessChecker); ok {
+			err := c.Ready()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Reload reloads the chained Providers which support it.
+func (mp multiProvider) Reload() error {
+	for _, p := range mp {
+		if rp, ok := p.(reloadProvider); ok {
+			err := rp.Reload()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/soundcloud/ent/lib"
+)
+
+// httpProvider serves the buckets listed by a control plane, which answers
+// GET {url}/buckets like GET / of ent. The list is cached for ttl and
+// refreshed in the background by run.
+type httpProvider struct {
+	url    string
+	ttl    time.Duration
+	retry  time.Duration
+	client *http.Client
+
+	mu        sync.RWMutex
+	buckets   map[string]*ent.Bucket
+	fetched   time.Time
+	attempted time.Time
+	err       error
+
+	// reloading is the fetch in flight, concurrent Reloads wait for it
+	// instead of fetching once more.
+	reloadMu  sync.Mutex
+	reloading *reloadCall
+}
+
+// reloadCall is a fetch of the buckets which concurrent Reloads share.
+type reloadCall struct {
+	done chan struct{}
+	err  error
+}
+
+// httpProviderRetry is the time after a fetch during which buckets missing
+// from the cache, or stale while the control plane fails, are not fetched
+// again. Requests for unknown buckets are answered from the cache meanwhile.
+const httpProviderRetry = 5 * time.Second
+
+// newHTTPProvider returns an httpProvider holding the buckets of the control
+// plane at url, it fails if they can't be fetched.
+func newHTTPProvider(url string, ttl time.Duration) (*httpProvider, error) {
+	p := &httpProvider{
+		url:     strings.TrimRight(url, "/"),
+		ttl:     ttl,
+		retry:   httpProviderRetry,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		buckets: map[string]*ent.Bucket{},
+	}
+
+	err := p.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Get returns the cached bucket, buckets missing from the cache or stale are
+// fetched once more unless that has been tried within retry. Stale buckets
+// are served while the control plane can't be reached.
+func (p *httpProvider) Get(name string) (*ent.Bucket, error) {
+	p.mu.RLock()
+	_, ok := p.buckets[name]
+	var (
+		fresh  = time.Since(p.fetched) < p.ttl
+		recent = time.Since(p.attempted) < p.retry
+	)
+	p.mu.RUnlock()
+
+	if !(ok && fresh) && !recent {
+		err := p.Reload()
+		if err != nil {
+			log.Printf("ERROR refreshing buckets: %s", err)
+		}
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	b, ok := p.buckets[name]
+	if ok {
+		return b, nil
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	return nil, ent.ErrBucketNotFound
+}
+
+// List returns the cached buckets, fetching them if the cache is stale.
+// Stale buckets are served while the control plane can't be reached.
+func (p *httpProvider) List() ([]*ent.Bucket, error) {
+	p.mu.RLock()
+	var (
+		fresh  = time.Since(p.fetched) < p.ttl
+		recent = time.Since(p.attempted) < p.retry
+	)
+	p.mu.RUnlock()
+
+	if !fresh && !recent {
+		err := p.Reload()
+		if err != nil {
+			log.Printf("ERROR refreshing buckets: %s", err)
+		}
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	bs := []*ent.Bucket{}
+	for _, b := range p.buckets {
+		bs = append(bs, b)
+	}
+	return bs, nil
+}
+
+// Ready reports the error of the last fetch.
+func (p *httpProvider) Ready() error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.err
+}
+
+// Reload fetches the buckets from the control plane and replaces the cached
+// ones. On error the cached buckets are kept. Reloads while a fetch is in
+// flight share its outcome.
+func (p *httpProvider) Reload() error {
+	p.reloadMu.Lock()
+	if c := p.reloading; c != nil {
+		p.reloadMu.Unlock()
+		<-c.done
+		return c.err
+	}
+
+	c := &reloadCall{done: make(chan struct{})}
+	p.reloading = c
+	p.reloadMu.Unlock()
+
+	c.err = p.reload()
+
+	p.reloadMu.Lock()
+	p.reloading = nil
+	p.reloadMu.Unlock()
+	close(c.done)
+
+	return c.err
+}
+
+func (p *httpProvider) reload() error {
+	buckets, err := p.fetch()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.attempted = time.Now()
+	p.err = err
+	if err != nil {
+		return err
+	}
+
+	p.buckets = buckets
+	p.fetched = p.attempted
+
+	return nil
+}
+
+// run refreshes the cached buckets every ttl.
+func (p *httpProvider) run() {
+	for range time.Tick(p.ttl) {
+		err := p.Reload()
+		if err != nil {
+			log.Printf("ERROR refreshing buckets: %s", err)
+		}
+	}
+}
+
+func (p *httpProvider) fetch() (map[string]*ent.Bucket, error) {
+	res, err := p.client.Get(p.url + "/buckets")
+	if err != nil {
+		return nil, fmt.Errorf("fetching buckets failed: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching buckets failed: %s", res.Status)
+	}
+
+	list := ent.ResponseBucketList{}
+
+	err = json.NewDecoder(res.Body).Decode(&list)
+	if err != nil {
+		return nil, fmt.Errorf("decoding buckets failed: %s", err)
+	}
+
+	buckets := map[string]*ent.Bucket{}
+
+	for _, b := range list.Buckets {
+		err := prepareBucket(b)
+		if err != nil {
+			return nil, fmt.Errorf("bucket %s: %s", b.Name, err)
+		}
+
+		buckets[b.Name] = b
+	}
+
+	return buckets, nil
+}
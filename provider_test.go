@@ -1,10 +1,20 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"net/mail"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/soundcloud/ent/lib"
 )
@@ -15,7 +25,7 @@ func TestDiskProviderInit(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	names := []string{"bit", "doge", "ripples"}
+	names := []string{"archive", "bit", "doge", "logs", "ripples", "streams"}
 
 	for _, name := range names {
 		addr, err := mail.ParseAddress(fmt.Sprintf("%s team <%s@bucket.io>", name, name))
@@ -42,11 +52,273 @@ func TestDiskProviderInit(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if len(bs) != 3 {
+	if len(bs) != 6 {
 		t.Errorf("wrong number of buckets returned: %d", len(bs))
 	}
 }
 
+func TestDiskProviderReadOnly(t *testing.T) {
+	p, err := newDiskProvider("./fixture")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, readOnly := range map[string]bool{"archive": true, "bit": false} {
+		b, err := p.Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have, want := b.ReadOnly, readOnly; have != want {
+			t.Errorf("%s: have %t, want %t", name, have, want)
+		}
+	}
+}
+
+func TestDiskProviderYAML(t *testing.T) {
+	p, err := newDiskProvider("./fixture")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := p.Get("streams")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := b.Name, "streams"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	if have, want := b.Owner.Email.Address, "streams@bucket.io"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	if have, want := b.Compression, ent.CompressionGzip; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	if !b.CanRead("deploy@bucket.io") || b.CanWrite("deploy@bucket.io") {
+		t.Errorf("readers not loaded: %+v", b.Readers)
+	}
+
+	tmp, err := ioutil.TempDir("", "ent-provider-yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	err = ioutil.WriteFile(
+		filepath.Join(tmp, "broken.entpolicy.yml"),
+		[]byte("name: broken\nowner: [\n"),
+		0644,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = newDiskProvider(tmp)
+	if err == nil || !strings.Contains(err.Error(), "broken.entpolicy.yml") {
+		t.Errorf("error doesn't name the policy: %v", err)
+	}
+}
+
+func TestDiskProviderKeyPattern(t *testing.T) {
+	p, err := newDiskProvider("./fixture")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := p.Get("logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, allowed := range map[string]bool{
+		"logs/2016/05/app.log": true,
+		"logs/16/05/app.log":   false,
+		"app.log":              false,
+	} {
+		if have, want := b.AllowsKey(key), allowed; have != want {
+			t.Errorf("%s: have %t, want %t", key, have, want)
+		}
+	}
+
+	tmp, err := ioutil.TempDir("", "ent-provider-pattern")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	err = ioutil.WriteFile(
+		filepath.Join(tmp, "broken.entpolicy"),
+		[]byte(`{"name": "broken", "keyPattern": "logs/("}`),
+		0644,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = newDiskProvider(tmp)
+	if err == nil {
+		t.Error("invalid key pattern accepted")
+	}
+}
+
+func TestDiskProviderOwner(t *testing.T) {
+	p, err := newDiskProvider("./fixture/owners")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	legacy, err := p.Get("legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := ent.Owner{Email: mail.Address{Name: "legacy team", Address: "legacy@bucket.io"}}
+
+	if have := legacy.Owner; !reflect.DeepEqual(have, want) {
+		t.Errorf("have %+v, want %+v", have, want)
+	}
+
+	extended, err := p.Get("extended")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want = ent.Owner{
+		Email:     mail.Address{Name: "extended team", Address: "extended@bucket.io"},
+		ID:        "u-1234",
+		Team:      "storage",
+		CreatedAt: time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC),
+	}
+
+	if have := extended.Owner; !reflect.DeepEqual(have, want) {
+		t.Errorf("have %+v, want %+v", have, want)
+	}
+
+	// Fields which aren't known are left out of bucket listings.
+	for b, fields := range map[*ent.Bucket][]string{
+		legacy:   {"email"},
+		extended: {"createdAt", "email", "id", "team"},
+	} {
+		raw, err := json.Marshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		encoded := struct {
+			Owner map[string]interface{} `json:"owner"`
+		}{}
+
+		err = json.Unmarshal(raw, &encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		have := []string{}
+		for field := range encoded.Owner {
+			have = append(have, field)
+		}
+		sort.Strings(have)
+
+		if !reflect.DeepEqual(have, fields) {
+			t.Errorf("%s: have %v, want %v", b.Name, have, fields)
+		}
+
+		decoded := ent.Bucket{}
+
+		err = json.Unmarshal(raw, &decoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have, want := decoded.Owner, b.Owner; !reflect.DeepEqual(have, want) {
+			t.Errorf("%s: have %+v, want %+v", b.Name, have, want)
+		}
+	}
+}
+
+func TestDiskProviderValidate(t *testing.T) {
+	err := (&diskProvider{dir: "./fixture"}).Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = (&diskProvider{dir: "./fixture/broken"}).Validate()
+
+	errs, ok := err.(policyErrors)
+	if !ok {
+		t.Fatalf("have %v, want policy errors", err)
+	}
+
+	if have, want := len(errs), 2; have != want {
+		t.Fatalf("have %d errors, want %d", have, want)
+	}
+
+	for i, prefix := range []string{
+		"fixture/broken/codec.entpolicy: ",
+		"fixture/broken/syntax.entpolicy:3: ",
+	} {
+		if have := errs[i].Error(); !strings.HasPrefix(have, prefix) {
+			t.Errorf("have %q, want prefix %q", have, prefix)
+		}
+	}
+
+	_, err = newDiskProvider("./fixture/broken")
+	if err == nil || !strings.Contains(err.Error(), "fixture/broken/") {
+		t.Errorf("error doesn't name the policy: %v", err)
+	}
+}
+
+func TestDiskProviderInvalidBucketName(t *testing.T) {
+	for _, name := range []string{
+		"",
+		"..",
+		"../evil",
+		"nested/bucket",
+		".versions",
+		"bell\a",
+		"new\nline",
+		strings.Repeat("a", maxBucketNameLen+1),
+	} {
+		tmp, err := ioutil.TempDir("", "ent-provider-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		raw, err := json.Marshal(ent.NewBucket(name, ent.Owner{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = ioutil.WriteFile(filepath.Join(tmp, "invalid"+policyExt), raw, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = newDiskProvider(tmp)
+		if err == nil {
+			t.Errorf("bucket name %q accepted", name)
+		}
+
+		os.RemoveAll(tmp)
+	}
+
+	for _, name := range []string{"bit", "media-v2", "logs_2016.archive"} {
+		err := validateBucketName(name)
+		if err != nil {
+			t.Errorf("bucket name %q rejected: %s", name, err)
+		}
+	}
+
+	_, err := getBucket(ent.NewMemoryProvider(), "../evil")
+	if have, want := err, ent.ErrInvalidParam; have != want {
+		t.Errorf("have %v, want %v", have, want)
+	}
+}
+
 func TestDiskProviderBucketNotFound(t *testing.T) {
 	p, err := newDiskProvider("./fixture")
 	if err != nil {
@@ -58,3 +330,325 @@ func TestDiskProviderBucketNotFound(t *testing.T) {
 		t.Errorf("got wrong error: %s", err)
 	}
 }
+
+func TestDiskProviderReload(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-provider-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	p, err := newDiskProvider(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = p.Get("bit")
+	if !ent.IsBucketNotFound(err) {
+		t.Fatalf("got wrong error: %s", err)
+	}
+
+	raw, err := ioutil.ReadFile("./fixture/bit.entpolicy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(tmp, "bit.entpolicy"), raw, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = p.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := p.Get("bit")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := b.Name, "bit"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+}
+
+func TestEnvProvider(t *testing.T) {
+	const name = "ENT_BUCKETS_TEST"
+
+	defer os.Unsetenv(name)
+
+	err := os.Setenv(name, "logs:ops@bucket.io, media:web team <web@bucket.io>")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := newEnvProvider(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bs, err := p.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := len(bs), 2; have != want {
+		t.Errorf("have %d buckets, want %d", have, want)
+	}
+
+	for name, owner := range map[string]string{
+		"logs":  "ops@bucket.io",
+		"media": "web@bucket.io",
+	} {
+		b, err := p.Get(name)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		if have, want := b.Owner.Email.Address, owner; have != want {
+			t.Errorf("%s: have %s, want %s", name, have, want)
+		}
+	}
+
+	_, err = p.Get("unknown")
+	if !ent.IsBucketNotFound(err) {
+		t.Errorf("got wrong error: %v", err)
+	}
+
+	for _, value := range []string{"logs", ":ops@bucket.io", "logs:not-an-address"} {
+		err = os.Setenv(name, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = newEnvProvider(name)
+		if err == nil {
+			t.Errorf("%q accepted", value)
+		}
+	}
+}
+
+func TestMultiProvider(t *testing.T) {
+	var (
+		owner = func(addr string) ent.Owner {
+			return ent.Owner{Email: mail.Address{Address: addr}}
+		}
+		first = ent.NewMemoryProvider(
+			ent.NewBucket("shared", owner("first@bucket.io")),
+			ent.NewBucket("only-first", owner("first@bucket.io")),
+		)
+		second = ent.NewMemoryProvider(
+			ent.NewBucket("shared", owner("second@bucket.io")),
+			ent.NewBucket("only-second", owner("second@bucket.io")),
+		)
+		p = multiProvider{first, second}
+	)
+
+	for name, addr := range map[string]string{
+		"shared":      "first@bucket.io",
+		"only-first":  "first@bucket.io",
+		"only-second": "second@bucket.io",
+	} {
+		b, err := p.Get(name)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		if have, want := b.Owner.Email.Address, addr; have != want {
+			t.Errorf("%s: have %s, want %s", name, have, want)
+		}
+	}
+
+	_, err := p.Get("unknown")
+	if !ent.IsBucketNotFound(err) {
+		t.Errorf("got wrong error: %v", err)
+	}
+
+	bs, err := p.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{}
+	for _, b := range bs {
+		names = append(names, b.Name)
+	}
+	sort.Strings(names)
+
+	if have, want := names, []string{"only-first", "only-second", "shared"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	_, err = newProvider([]string{"disk", "bolt"}, providerConfig{dir: "./fixture"})
+	if err == nil {
+		t.Error("unknown backend accepted")
+	}
+}
+
+func TestHTTPProviderCache(t *testing.T) {
+	var (
+		fetches = 0
+		buckets = []*ent.Bucket{ent.NewBucket("cached", ent.Owner{})}
+	)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/buckets" {
+			http.NotFound(w, r)
+			return
+		}
+
+		fetches++
+		json.NewEncoder(w).Encode(ent.ResponseBucketList{
+			Count:   len(buckets),
+			Buckets: buckets,
+		})
+	}))
+	defer ts.Close()
+
+	p, err := newHTTPProvider(ts.URL, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		b, err := p.Get("cached")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have, want := b.Name, "cached"; have != want {
+			t.Errorf("have %s, want %s", have, want)
+		}
+	}
+
+	_, err = p.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cache hits within the TTL don't fetch again.
+	if have, want := fetches, 1; have != want {
+		t.Errorf("have %d fetches, want %d", have, want)
+	}
+
+	buckets = append(buckets, ent.NewBucket("added", ent.Owner{}))
+
+	// Misses right after a fetch are answered from the cache.
+	_, err = p.Get("added")
+	if !ent.IsBucketNotFound(err) {
+		t.Errorf("got wrong error: %v", err)
+	}
+
+	if have, want := fetches, 1; have != want {
+		t.Errorf("have %d fetches, want %d", have, want)
+	}
+
+	// Later a miss fetches once more and finds buckets added in the meantime.
+	p.retry = 0
+
+	_, err = p.Get("added")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = p.Get("unknown")
+	if !ent.IsBucketNotFound(err) {
+		t.Errorf("got wrong error: %v", err)
+	}
+
+	if have, want := fetches, 3; have != want {
+		t.Errorf("have %d fetches, want %d", have, want)
+	}
+}
+
+func TestHTTPProviderStale(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		fetches = 0
+		fail    = false
+		release = make(chan struct{})
+	)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetches++
+		n, f := fetches, fail
+		mu.Unlock()
+
+		if n > 1 {
+			<-release
+		}
+
+		if f {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+
+		json.NewEncoder(w).Encode(ent.ResponseBucketList{
+			Buckets: []*ent.Bucket{ent.NewBucket("stale", ent.Owner{})},
+		})
+	}))
+	defer ts.Close()
+
+	p, err := newHTTPProvider(ts.URL, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	fail = true
+	mu.Unlock()
+
+	// Outdate the cache.
+	p.fetched = time.Time{}
+	p.attempted = time.Time{}
+
+	var (
+		wg      sync.WaitGroup
+		results = make(chan error, 10)
+	)
+
+	for i := 0; i < cap(results); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			b, err := p.Get("stale")
+			if err == nil && b.Name != "stale" {
+				err = fmt.Errorf("have %s, want stale", b.Name)
+			}
+			results <- err
+		}()
+	}
+
+	// Give the requests time to queue up behind the fetch in flight.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(results)
+
+	// Stale buckets are served while the control plane fails.
+	for err := range results {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	if p.Ready() == nil {
+		t.Error("failed fetch not reported")
+	}
+
+	// Unknown buckets are not fetched again right away.
+	_, err = p.Get("unknown")
+	if err == nil {
+		t.Error("unknown bucket found")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if have, want := fetches, 2; have != want {
+		t.Errorf("have %d fetches, want %d", have, want)
+	}
+}
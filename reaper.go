@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/soundcloud/ent/lib"
+)
+
+// runReaper deletes the expired files of every bucket known to p every
+// interval. If trash is not nil files deleted longer than retention ago are
+// purged from it as well.
+func runReaper(
+	p ent.Provider,
+	fs ent.FileSystem,
+	trash trashPurger,
+	retention time.Duration,
+	interval time.Duration,
+) {
+	for {
+		now := time.Now()
+
+		reap(p, fs, now)
+
+		if trash != nil {
+			_, err := trash.PurgeTrash(now.Add(-retention))
+			if err != nil {
+				log.Printf("ERROR purging trash: %s", err)
+			}
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// expiredDeleter is implemented by FileSystems which check the expiry of a
+// file under the same lock it is deleted with, so content stored under the
+// key again after the file expired is kept.
+type expiredDeleter interface {
+	// DeleteExpired deletes the file under key if it is expired at now,
+	// errNotExpired is returned otherwise.
+	DeleteExpired(bucket *ent.Bucket, key string, now time.Time) error
+}
+
+// errNotExpired is returned when a file to be reaped is no longer expired.
+var errNotExpired = errors.New("file not expired")
+
+// deleteExpired deletes the file under key if it is expired at now. The
+// expiry is checked again right before deleting the file with FileSystems
+// which can't check it while deleting, which narrows but doesn't close the
+// window for a replacement to be deleted.
+func deleteExpired(fs ent.FileSystem, bucket *ent.Bucket, key string, now time.Time) error {
+	if d, ok := fs.(expiredDeleter); ok {
+		return d.DeleteExpired(bucket, key, now)
+	}
+
+	m, err := fs.Meta(bucket, key)
+	if err != nil {
+		return err
+	}
+
+	err = reapable(m, now)
+	if err != nil {
+		return err
+	}
+
+	return fs.Delete(bucket, key)
+}
+
+// reapable returns errNotExpired unless m is expired at now and not
+// retained.
+func reapable(m ent.Meta, now time.Time) error {
+	if !m.IsExpired(now) || m.IsRetained(now) {
+		return errNotExpired
+	}
+	return nil
+}
+
+// reap deletes the files which are expired at now and returns their number.
+// Files still under retention are kept until the retention ended.
+func reap(p ent.Provider, fs ent.FileSystem, now time.Time) int {
+	bs, err := p.List()
+	if err != nil {
+		log.Printf("ERROR listing buckets for reaping: %s", err)
+		return 0
+	}
+
+	n := 0
+
+	for _, b := range bs {
+		// The expired files are collected first, as backends may not allow
+		// deleting files while they are walked.
+		expired := []string{}
+
+		err := fs.Walk(b, "", ent.ModifiedRange{}, func(f ent.File) error {
+			m, err := fs.Meta(b, f.Key())
+			if err != nil {
+				log.Printf("ERROR reading meta of %s/%s: %s", b.Name, f.Key(), err)
+				return nil
+			}
+
+			if reapable(m, now) == nil {
+				expired = append(expired, f.Key())
+			}
+
+			return nil
+		})
+		if err != nil {
+			log.Printf("ERROR walking %s for reaping: %s", b.Name, err)
+			continue
+		}
+
+		for _, key := range expired {
+			// The file has been replaced or deleted in the meantime.
+			err = deleteExpired(fs, b, key, now)
+			if err == errNotExpired || err == ent.ErrFileNotFound {
+				continue
+			}
+			if err != nil {
+				log.Printf("ERROR reaping %s/%s: %s", b.Name, key, err)
+				continue
+			}
+
+			n++
+		}
+	}
+
+	return n
+}
+
+// DeleteExpired checks the expiry under the lock of the key.
+func (fs *diskFS) DeleteExpired(bucket *ent.Bucket, key string, now time.Time) error {
+	return fs.delete(bucket, key, func(m ent.Meta) error {
+		return reapable(m, now)
+	})
+}
+
+// DeleteExpired checks the expiry in the transaction deleting the file.
+func (fs *boltFS) DeleteExpired(bucket *ent.Bucket, key string, now time.Time) error {
+	return fs.delete(bucket, key, func(m ent.Meta) error {
+		return reapable(m, now)
+	})
+}
+
+// DeleteExpired deletes the file as stored by the wrapped FileSystem.
+func (fs *compressFS) DeleteExpired(bucket *ent.Bucket, key string, now time.Time) error {
+	return deleteExpired(fs.FileSystem, bucket, key, now)
+}
+
+// DeleteExpired deletes the file as stored by the wrapped FileSystem.
+func (fs *encryptedFS) DeleteExpired(bucket *ent.Bucket, key string, now time.Time) error {
+	return deleteExpired(fs.FileSystem, bucket, key, now)
+}
+
+// DeleteExpired deletes the file as stored by the wrapped FileSystem and
+// removes it from the index.
+func (fs *hashIndexFS) DeleteExpired(bucket *ent.Bucket, key string, now time.Time) error {
+	err := deleteExpired(fs.FileSystem, bucket, key, now)
+	if err != nil {
+		return err
+	}
+
+	fs.unindex(bucket, key)
+
+	return nil
+}
+
+// DeleteExpired deletes the file as stored by the wrapped FileSystem.
+func (fs *multipartFS) DeleteExpired(bucket *ent.Bucket, key string, now time.Time) error {
+	return deleteExpired(fs.FileSystem, bucket, key, now)
+}
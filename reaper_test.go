@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/soundcloud/ent/lib"
+)
+
+func TestReap(t *testing.T) {
+	var (
+		fs  = ent.NewMemoryFS()
+		b   = ent.NewBucket("reap", ent.Owner{})
+		p   = ent.NewMemoryProvider(b)
+		now = time.Now()
+	)
+
+	for key, m := range map[string]ent.Meta{
+		"expired":  {Expires: now.Add(-time.Minute)},
+		"future":   {Expires: now.Add(time.Minute)},
+		"forever":  {},
+		"retained": {Expires: now.Add(-time.Minute), RetainUntil: now.Add(time.Minute)},
+	} {
+		_, err := fs.Create(b, key, strings.NewReader(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = fs.SetMeta(b, key, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if have, want := reap(p, fs, now), 1; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+
+	_, err := fs.Open(b, "expired")
+	if have, want := err, ent.ErrFileNotFound; have != want {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	for _, key := range []string{"future", "forever", "retained"} {
+		_, err := fs.Open(b, key)
+		if err != nil {
+			t.Errorf("%s: %s", key, err)
+		}
+	}
+
+	// Once its retention ended the file is reaped as well.
+	if have, want := reap(p, fs, now.Add(2*time.Minute)), 2; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+}
+
+func TestDeleteExpiredReplaced(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-delete-expired")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	bolt, cleanup := newTestBoltFS(t)
+	defer cleanup()
+
+	var (
+		b   = ent.NewBucket("delete-expired", ent.Owner{})
+		now = time.Now()
+	)
+
+	for name, fs := range map[string]ent.FileSystem{
+		"disk": newHashIndexFS(newCompressFS(newDiskFS(tmp))),
+		"bolt": bolt,
+	} {
+		f, err := createWithMeta(fs, b, "doc", strings.NewReader("expired"), createOptions{
+			meta: ent.Meta{Expires: now.Add(-time.Minute)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		// Stored again after the reaper found the file expired.
+		f, err = fs.Create(b, "doc", strings.NewReader("replaced"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		err = deleteExpired(fs, b, "doc", now)
+		if have, want := err, errNotExpired; have != want {
+			t.Errorf("%s: have %v, want %v", name, have, want)
+		}
+
+		_, err = fs.Meta(b, "doc")
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+}
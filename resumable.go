@@ -0,0 +1,543 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/soundcloud/ent/lib"
+)
+
+const (
+	rangesDir     = "ranges"
+	rangeDataFile = "data"
+	// rangePrefix starts the names of the files a diskFS stages resumable
+	// uploads in, they are temporary files as well.
+	rangePrefix = pendingPrefix + "range-"
+)
+
+// rangeStager is implemented by FileSystems which stage the ranges of
+// resumable uploads next to the files they store, so a complete upload is
+// placed by renaming it rather than copied. The encryptedFS doesn't, as the
+// content would be staged unencrypted next to the files.
+type rangeStager interface {
+	// StageRange appends the content of r, which is the range rng of the file
+	// under key, to the staged upload and returns the number of bytes
+	// received. Once all of them are received the staged content is returned
+	// as well, it is stored by passing it to Create and has to be closed.
+	StageRange(
+		bucket *ent.Bucket,
+		key string,
+		rng contentRange,
+		r io.Reader,
+	) (int64, *stagedRange, error)
+}
+
+// errUnstaged is returned by stageRange for FileSystems which can't stage the
+// ranges of resumable uploads.
+var errUnstaged = errors.New("ranges can't be staged")
+
+// stageRange stages the range rng of the file under key if fs can,
+// FileSystems which can't are answered with errUnstaged.
+func stageRange(
+	fs ent.FileSystem,
+	bucket *ent.Bucket,
+	key string,
+	rng contentRange,
+	r io.Reader,
+) (int64, *stagedRange, error) {
+	rs, ok := fs.(rangeStager)
+	if !ok {
+		return 0, nil, errUnstaged
+	}
+
+	return rs.StageRange(bucket, key, rng, r)
+}
+
+// stagedRange is the content of a complete resumable upload staged by a
+// diskFS. Reaching its Create unchanged it is placed by renaming it, wrappers
+// encoding the content read it instead. The upload is locked until the
+// stagedRange is closed.
+type stagedRange struct {
+	*os.File
+
+	fs     *diskFS
+	unlock func()
+}
+
+// discard removes the staged content if it hasn't been placed.
+func (s *stagedRange) discard() error {
+	err := os.Remove(s.Name())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *stagedRange) Close() error {
+	defer s.unlock()
+	return s.File.Close()
+}
+
+// contentRange is a Content-Range of a resumable upload, the range [start,
+// end) of a file of total bytes. Ranges given as */total ask for the number
+// of bytes received so far.
+type contentRange struct {
+	start, end, total int64
+	status            bool
+}
+
+// parseContentRange parses Content-Range headers in the form of bytes
+// first-last/total, where last is inclusive, and bytes */total.
+func parseContentRange(v string) (contentRange, error) {
+	if !strings.HasPrefix(v, "bytes ") {
+		return contentRange{}, ent.ErrInvalidParam
+	}
+
+	spec := strings.TrimPrefix(v, "bytes ")
+
+	i := strings.LastIndex(spec, "/")
+	if i < 0 {
+		return contentRange{}, ent.ErrInvalidParam
+	}
+
+	total, err := strconv.ParseInt(spec[i+1:], 10, 64)
+	if err != nil || total <= 0 {
+		return contentRange{}, ent.ErrInvalidParam
+	}
+
+	if spec[:i] == "*" {
+		return contentRange{total: total, status: true}, nil
+	}
+
+	bounds := strings.SplitN(spec[:i], "-", 2)
+	if len(bounds) != 2 {
+		return contentRange{}, ent.ErrInvalidParam
+	}
+
+	start, err := strconv.ParseInt(bounds[0], 10, 64)
+	if err != nil {
+		return contentRange{}, ent.ErrInvalidParam
+	}
+
+	last, err := strconv.ParseInt(bounds[1], 10, 64)
+	if err != nil || start < 0 || last < start || last >= total {
+		return contentRange{}, ent.ErrInvalidParam
+	}
+
+	return contentRange{start: start, end: last + 1, total: total}, nil
+}
+
+// rangeUpload identifies the file a resumable upload is for and its size.
+type rangeUpload struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Total  int64  `json:"total"`
+}
+
+// PutRange appends the content of r, which is the range rng of the file under
+// key, to the resumable upload of the file and returns the number of bytes
+// received so far. Content is staged by the wrapped FileSystem if it can and
+// in dir otherwise until the last byte is received, at which point the file
+// is stored and returned. Bytes received before are skipped, so ranges can be
+// sent again. Ranges starting after the bytes received fail with
+// ErrUploadOffset. Bytes read from r before it fails are kept, the upload is
+// resumed from the number of bytes returned. Ranges given as */total only
+// report the bytes received.
+func (fs *multipartFS) PutRange(
+	bucket *ent.Bucket,
+	key string,
+	rng contentRange,
+	r io.Reader,
+) (int64, ent.File, error) {
+	received, staged, err := stageRange(fs.FileSystem, bucket, key, rng, r)
+	if err != errUnstaged {
+		if err != nil || staged == nil {
+			return received, nil, err
+		}
+		defer staged.Close()
+
+		f, err := fs.FileSystem.Create(bucket, key, staged)
+		if err != nil {
+			return received, nil, err
+		}
+
+		// Content encoded while stored has been copied.
+		err = staged.discard()
+		if err != nil {
+			log.Printf("ERROR removing upload of %s/%s: %s", bucket.Name, key, err)
+		}
+
+		return received, f, nil
+	}
+
+	var (
+		dir    = fs.rangeDir(bucket, key)
+		upload = rangeUpload{
+			Bucket: bucket.Name,
+			Key:    key,
+			Total:  rng.total,
+		}
+	)
+
+	unlock := fs.ranges.lock(dir)
+	defer unlock()
+
+	if rng.status {
+		return rangeStatus(dir, upload)
+	}
+
+	err = fs.beginRange(dir, upload, rng.start == 0)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	received, err = appendRange(filepath.Join(dir, rangeDataFile), rng, r)
+	if err != nil || received < rng.total {
+		return received, nil, err
+	}
+
+	src, err := os.Open(filepath.Join(dir, rangeDataFile))
+	if err != nil {
+		return received, nil, err
+	}
+	defer src.Close()
+
+	f, err := fs.FileSystem.Create(bucket, key, src)
+	if err != nil {
+		return received, nil, err
+	}
+
+	err = os.RemoveAll(dir)
+	if err != nil {
+		log.Printf("ERROR removing upload of %s/%s: %s", bucket.Name, key, err)
+	}
+
+	return received, f, nil
+}
+
+// rangeStatus returns the number of bytes received for the upload staged in
+// dir without beginning it.
+func rangeStatus(dir string, upload rangeUpload) (int64, ent.File, error) {
+	raw, err := ioutil.ReadFile(filepath.Join(dir, uploadFile))
+	if os.IsNotExist(err) {
+		return 0, nil, nil
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	u := rangeUpload{}
+
+	err = json.Unmarshal(raw, &u)
+	if err != nil {
+		return 0, nil, fmt.Errorf("reading upload failed: %s", err)
+	}
+
+	if u != upload {
+		return 0, nil, ent.ErrInvalidParam
+	}
+
+	stat, err := os.Stat(filepath.Join(dir, rangeDataFile))
+	if os.IsNotExist(err) {
+		return 0, nil, nil
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return stat.Size(), nil, nil
+}
+
+// appendRange appends the bytes of rng read from r which follow the ones
+// received before to the file at p and returns the number of bytes received.
+func appendRange(p string, rng contentRange, r io.Reader) (int64, error) {
+	data, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, err
+	}
+
+	stat, err := data.Stat()
+	if err != nil {
+		data.Close()
+		return 0, err
+	}
+
+	received := stat.Size()
+
+	if rng.end > received {
+		if rng.start > received {
+			data.Close()
+			return received, ent.ErrUploadOffset
+		}
+
+		_, err = io.CopyN(ioutil.Discard, r, received-rng.start)
+		if err == nil {
+			var n int64
+
+			n, err = io.Copy(data, io.LimitReader(r, rng.end-received))
+			received += n
+		}
+	}
+
+	if cerr := data.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return received, fmt.Errorf("storing range failed: %s", err)
+	}
+
+	return received, nil
+}
+
+// beginRange records the upload in dir unless it has been begun before. An
+// upload begun for a file of another size is discarded if restart is set and
+// fails with ErrInvalidParam otherwise.
+func (fs *multipartFS) beginRange(dir string, upload rangeUpload, restart bool) error {
+	p := filepath.Join(dir, uploadFile)
+
+	raw, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		err = os.MkdirAll(dir, 0755)
+		if err != nil {
+			return err
+		}
+
+		raw, err = json.Marshal(upload)
+		if err != nil {
+			return err
+		}
+
+		err = ioutil.WriteFile(p, raw, 0644)
+		if err != nil {
+			return fmt.Errorf("storing upload failed: %s", err)
+		}
+
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	u := rangeUpload{}
+
+	err = json.Unmarshal(raw, &u)
+	if err != nil {
+		return fmt.Errorf("reading upload failed: %s", err)
+	}
+
+	if u == upload {
+		return nil
+	}
+
+	if !restart {
+		return ent.ErrInvalidParam
+	}
+
+	err = os.RemoveAll(dir)
+	if err != nil {
+		return err
+	}
+
+	return fs.beginRange(dir, upload, false)
+}
+
+// StageRange stages the upload in a temporary file next to the files of the
+// bucket, named after the key and the size of the file. An upload begun for a
+// file of another size is discarded by a range starting over and fails all
+// others with ErrInvalidParam. Ranges given as */total don't begin uploads.
+func (fs *diskFS) StageRange(
+	bucket *ent.Bucket,
+	key string,
+	rng contentRange,
+	r io.Reader,
+) (int64, *stagedRange, error) {
+	err := checkKey(key)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	dir := fs.tmpDir
+	if dir == "" {
+		dir = filepath.Join(fs.root, bucket.Name)
+	}
+
+	var (
+		h      = sha1.Sum([]byte(bucket.Name + "/" + key))
+		prefix = filepath.Join(dir, rangePrefix+hex.EncodeToString(h[:])+"-")
+		p      = prefix + strconv.FormatInt(rng.total, 10)
+	)
+
+	// Uploads of all sizes are locked, so one starting over can replace
+	// another.
+	unlock := fs.keys.lock(prefix)
+
+	received, err := fs.stageRange(prefix, p, rng, r)
+	if err != nil || received < rng.total || rng.status {
+		unlock()
+		return received, nil, err
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		unlock()
+		return received, nil, err
+	}
+
+	return received, &stagedRange{File: f, fs: fs, unlock: unlock}, nil
+}
+
+// stageRange appends rng to the file at p, prefix is shared by the files of
+// uploads of the key of other sizes. The caller holds the lock of prefix.
+func (fs *diskFS) stageRange(prefix, p string, rng contentRange, r io.Reader) (int64, error) {
+	others, err := filepath.Glob(prefix + "*")
+	if err != nil {
+		return 0, err
+	}
+
+	for _, other := range others {
+		if other == p {
+			continue
+		}
+		if rng.status || rng.start > 0 {
+			return 0, ent.ErrInvalidParam
+		}
+
+		err = os.Remove(other)
+		if err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+	}
+
+	if rng.status {
+		stat, err := os.Stat(p)
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		return stat.Size(), nil
+	}
+
+	err = os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return 0, err
+	}
+
+	received, err := appendRange(p, rng, r)
+	if err != nil {
+		return received, err
+	}
+
+	if fs.fsync && received == rng.total {
+		f, err := os.Open(p)
+		if err != nil {
+			return received, err
+		}
+		defer f.Close()
+
+		err = syncFile(f)
+		if err != nil {
+			return received, fmt.Errorf("sync failed: %s", err)
+		}
+	}
+
+	return received, nil
+}
+
+// createStaged places the content of a resumable upload staged by the diskFS
+// under dst by renaming it, it is only read to digest it.
+func (fs *diskFS) createStaged(
+	bucket *ent.Bucket,
+	dst string,
+	key string,
+	s *stagedRange,
+	o createOptions,
+) (ent.File, error) {
+	stat, err := s.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	f := newFile(s.File, key)
+	f.lazy = fs.lazyHash
+
+	if !f.lazy {
+		_, err = copyBuffer(f.digest, io.NewSectionReader(s.File, 0, stat.Size()))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	unlock := fs.keys.lock(dst)
+	defer unlock()
+
+	prev, err := checkReplace(dst, o.exclusive)
+	if err != nil {
+		return nil, err
+	}
+
+	if fs.versioning && !o.exclusive {
+		err = fs.archive(bucket, key, dst)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sc := newSidecar(prev, o, stat.ModTime(), f.storedDigests())
+
+	renamed, err := fs.place(s.Name(), dst, prev, sc, o.exclusive)
+	if err != nil {
+		return nil, err
+	}
+
+	// Exclusively placed content is linked, the staged file is left behind.
+	if !renamed {
+		s.discard()
+	}
+
+	err = f.reopen(dst, sc.Created)
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// StageRange stages ranges in the wrapped FileSystem, which is passed the
+// content as received and compressed when it is stored.
+func (fs *compressFS) StageRange(
+	bucket *ent.Bucket,
+	key string,
+	rng contentRange,
+	r io.Reader,
+) (int64, *stagedRange, error) {
+	return stageRange(fs.FileSystem, bucket, key, rng, r)
+}
+
+// StageRange stages ranges in the wrapped FileSystem.
+func (fs *hashIndexFS) StageRange(
+	bucket *ent.Bucket,
+	key string,
+	rng contentRange,
+	r io.Reader,
+) (int64, *stagedRange, error) {
+	return stageRange(fs.FileSystem, bucket, key, rng, r)
+}
+
+// rangeDir returns the directory the resumable upload of the file under key
+// is staged in, keys are hashed as they may contain slashes.
+func (fs *multipartFS) rangeDir(bucket *ent.Bucket, key string) string {
+	h := sha1.Sum([]byte(bucket.Name + "/" + key))
+	return filepath.Join(fs.dir, rangesDir, hex.EncodeToString(h[:]))
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/soundcloud/ent/lib"
+)
+
+func TestHandlePutRangeResume(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-resumable-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		b       = ent.NewBucket("resumable", ent.Owner{})
+		key     = "nested/resumed.bin"
+		content = []byte(strings.Repeat("resumable upload content ", 4096))
+		total   = len(content)
+		sum     = sha1.Sum(content)
+		root    = filepath.Join(tmp, "root")
+		// The disk backend stages ranges next to the files of the bucket,
+		// others in the upload directory.
+		staging = map[string]string{
+			"disk":   filepath.Join(root, b.Name, rangePrefix+"*"),
+			"memory": filepath.Join(tmp, "uploads", rangesDir, "*"),
+		}
+	)
+
+	for name, fs := range map[string]*multipartFS{
+		"disk":   newMultipartFS(newDiskFS(root), filepath.Join(tmp, "uploads")),
+		"memory": newMultipartFS(ent.NewMemoryFS(), filepath.Join(tmp, "uploads")),
+	} {
+		h := handleUpload(ent.NewMemoryProvider(b), fs)
+
+		put := func(rng string, body []byte) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(
+				"POST",
+				"/?"+url.Values{ent.KeyBucket: {b.Name}, ent.KeyBlob: {key}}.Encode(),
+				bytes.NewReader(body),
+			)
+			req.Header.Set(ent.HeaderContentRange, rng)
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			return w
+		}
+
+		offset := func(w *httptest.ResponseRecorder) int {
+			n, err := strconv.Atoi(w.Header().Get(ent.HeaderUploadOffset))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return n
+		}
+
+		staged := func() []string {
+			ps, err := filepath.Glob(staging[name])
+			if err != nil {
+				t.Fatal(err)
+			}
+			return ps
+		}
+
+		// Asking for the offset doesn't begin an upload.
+		w := put(fmt.Sprintf("bytes */%d", total), nil)
+
+		if have, want := offset(w), 0; have != want {
+			t.Errorf("%s: have offset %d, want %d", name, have, want)
+		}
+
+		if ps := staged(); len(ps) != 0 {
+			t.Errorf("%s: upload begun by status: %v", name, ps)
+		}
+
+		// The connection drops after half of the first range was sent.
+		w = put(fmt.Sprintf("bytes 0-%d/%d", total/2-1, total), content[:total/4])
+
+		if have, want := w.Code, http.StatusAccepted; have != want {
+			t.Fatalf("%s: have %d, want %d", name, have, want)
+		}
+
+		w = put(fmt.Sprintf("bytes */%d", total), nil)
+
+		if have, want := offset(w), total/4; have != want {
+			t.Fatalf("%s: have offset %d, want %d", name, have, want)
+		}
+
+		// Ranges leaving a gap are rejected.
+		w = put(fmt.Sprintf("bytes %d-%d/%d", total/2, total-1, total), content[total/2:])
+
+		if have, want := w.Code, http.StatusConflict; have != want {
+			t.Errorf("%s: have %d, want %d", name, have, want)
+		}
+
+		if have, want := offset(w), total/4; have != want {
+			t.Errorf("%s: have offset %d, want %d", name, have, want)
+		}
+
+		// Bytes received before are skipped when a range is sent again.
+		w = put(fmt.Sprintf("bytes 0-%d/%d", total/2-1, total), content[:total/2])
+
+		if have, want := offset(w), total/2; have != want {
+			t.Fatalf("%s: have offset %d, want %d", name, have, want)
+		}
+
+		// Uploads of another size only replace the upload if they start over.
+		w = put(fmt.Sprintf("bytes */%d", total+1), nil)
+
+		if have, want := w.Code, http.StatusBadRequest; have != want {
+			t.Errorf("%s: have %d, want %d", name, have, want)
+		}
+
+		ps := staged()
+		if have, want := len(ps), 1; have != want {
+			t.Fatalf("%s: have %d staged, want %d", name, have, want)
+		}
+
+		before, err := os.Stat(ps[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w = put(fmt.Sprintf("bytes %d-%d/%d", total/2, total-1, total), content[total/2:])
+
+		if have, want := w.Code, http.StatusCreated; have != want {
+			t.Fatalf("%s: have %d, want %d", name, have, want)
+		}
+
+		if have, want := w.Header().Get(ent.HeaderETag), hex.EncodeToString(sum[:]); have != want {
+			t.Errorf("%s: have %s, want %s", name, have, want)
+		}
+
+		f, err := fs.Open(b, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stored, err := f.Hash()
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have, want := stored, sum[:]; !bytes.Equal(have, want) {
+			t.Errorf("%s: have %x, want %x", name, have, want)
+		}
+
+		if ps := staged(); len(ps) != 0 {
+			t.Errorf("%s: upload not removed: %v", name, ps)
+		}
+
+		if name != "disk" {
+			continue
+		}
+
+		// The staged file is placed by renaming it.
+		after, err := os.Stat(filepath.Join(root, b.Name, key))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !os.SameFile(before, after) {
+			t.Errorf("%s: staged file copied", name)
+		}
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	for _, v := range []string{
+		"",
+		"bytes 0-9",
+		"bytes 0-9/0",
+		"bytes 5-4/10",
+		"bytes 0-10/10",
+		"bytes -1-4/10",
+		"items 0-9/10",
+		"bytes */*",
+	} {
+		_, err := parseContentRange(v)
+		if err != ent.ErrInvalidParam {
+			t.Errorf("%q: have %v, want %v", v, err, ent.ErrInvalidParam)
+		}
+	}
+
+	rng, err := parseContentRange("bytes 10-19/30")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := rng, (contentRange{start: 10, end: 20, total: 30}); have != want {
+		t.Errorf("have %+v, want %+v", have, want)
+	}
+}
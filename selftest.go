@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/soundcloud/ent/lib"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	selfTestBucket = "ent-selftest"
+	selfTestSize   = 4096
+)
+
+// selfTestStep reports the outcome of a single step of the self-test.
+type selfTestStep struct {
+	Name     string
+	Duration time.Duration
+	Err      error
+}
+
+// bucketPurger is implemented by FileSystems which can remove a bucket with
+// everything stored for it, including its trash and versions.
+type bucketPurger interface {
+	PurgeBucket(bucket *ent.Bucket) error
+}
+
+// selfTest exercises the full storage path of fs by storing, reading back,
+// verifying and deleting a canary file. It stops at the first failing step
+// and returns its error alongside the steps run so far. Unless purger is nil
+// the canary bucket is purged after, so no trash or versions pile up.
+func selfTest(fs ent.FileSystem, purger bucketPurger) ([]selfTestStep, error) {
+	var (
+		b       = ent.NewBucket(selfTestBucket, ent.Owner{})
+		key     = fmt.Sprintf("canary-%d", time.Now().UnixNano())
+		content = make([]byte, selfTestSize)
+		steps   = []selfTestStep{}
+	)
+
+	_, err := rand.Read(content)
+	if err != nil {
+		return steps, err
+	}
+
+	sum := sha1.Sum(content)
+
+	type check struct {
+		name string
+		run  func() error
+	}
+
+	checks := []check{
+		{"create", func() error {
+			f, err := fs.Create(b, key, bytes.NewReader(content))
+			if err != nil {
+				return err
+			}
+			return f.Close()
+		}},
+		{"read", func() error {
+			f, err := fs.Open(b, key)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			raw, err := ioutil.ReadAll(f)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(raw, content) {
+				return fmt.Errorf("content differs after %d bytes read", len(raw))
+			}
+			return nil
+		}},
+		{"hash", func() error {
+			f, err := fs.Open(b, key)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			h, err := f.Hash()
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(h, sum[:]) {
+				return fmt.Errorf("hash mismatch: %x != %x", h, sum)
+			}
+			return nil
+		}},
+		{"delete", func() error {
+			err := fs.Delete(b, key)
+			if err != nil {
+				return err
+			}
+
+			_, err = fs.Open(b, key)
+			if !ent.IsFileNotFound(err) {
+				return fmt.Errorf("file still present after delete: %v", err)
+			}
+			return nil
+		}},
+	}
+	if purger != nil {
+		checks = append(checks, check{"purge", func() error {
+			return purger.PurgeBucket(b)
+		}})
+	}
+
+	for _, step := range checks {
+		start := time.Now()
+		err := step.run()
+
+		steps = append(steps, selfTestStep{
+			Name:     step.name,
+			Duration: time.Since(start),
+			Err:      err,
+		})
+
+		if err != nil {
+			return steps, fmt.Errorf("selftest %s failed: %s", step.name, err)
+		}
+	}
+
+	return steps, nil
+}
+
+// PurgeBucket removes the directories of the bucket, its trash and versions.
+func (fs *diskFS) PurgeBucket(bucket *ent.Bucket) error {
+	for _, dir := range []string{
+		filepath.Join(fs.root, bucket.Name),
+		filepath.Join(fs.root, trashDir, bucket.Name),
+		filepath.Join(fs.root, versionsDir, bucket.Name),
+	} {
+		err := os.RemoveAll(dir)
+		if err != nil {
+			return fmt.Errorf("purge failed: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// PurgeBucket removes the bolt buckets holding the files of the bucket, their
+// chunks and Meta.
+func (fs *boltFS) PurgeBucket(bucket *ent.Bucket) error {
+	return fs.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{
+			[]byte(bucket.Name),
+			boltChunkBucket(bucket),
+			boltMetaBucket(bucket),
+		} {
+			err := tx.DeleteBucket(name)
+			if err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
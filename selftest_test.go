@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/soundcloud/ent/lib"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestSelfTest(t *testing.T) {
+	steps, err := selfTest(ent.NewMemoryFS(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := len(steps), 4; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+
+	for _, step := range steps {
+		if step.Err != nil {
+			t.Errorf("step %s: %s", step.Name, step.Err)
+		}
+	}
+}
+
+func TestSelfTestBrokenFS(t *testing.T) {
+	steps, err := selfTest(corruptFS{ent.NewMemoryFS()}, nil)
+	if err == nil {
+		t.Fatal("expected selftest to fail")
+	}
+
+	last := steps[len(steps)-1]
+
+	if have, want := last.Name, "read"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+}
+
+// corruptFS stores something else than what it is given.
+type corruptFS struct {
+	ent.FileSystem
+}
+
+func (fs corruptFS) Create(b *ent.Bucket, key string, r io.Reader) (ent.File, error) {
+	return fs.FileSystem.Create(b, key, strings.NewReader("corrupted"))
+}
+
+func TestSelfTestPurge(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-selftest-purge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	store, cleanup := newTestBoltFS(t)
+	defer cleanup()
+
+	disk := newDiskFS(tmp, withTrash(true), withVersioning(true))
+
+	for name, backend := range map[string]ent.FileSystem{
+		"disk": disk,
+		"bolt": store,
+	} {
+		steps, err := selfTest(newHashIndexFS(newCompressFS(backend)), backend.(bucketPurger))
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		if have, want := steps[len(steps)-1].Name, "purge"; have != want {
+			t.Errorf("%s: have %s, want %s", name, have, want)
+		}
+	}
+
+	for _, dir := range []string{
+		filepath.Join(tmp, selfTestBucket),
+		filepath.Join(tmp, trashDir, selfTestBucket),
+		filepath.Join(tmp, versionsDir, selfTestBucket),
+	} {
+		_, err := os.Stat(dir)
+		if !os.IsNotExist(err) {
+			t.Errorf("%s left behind: %v", dir, err)
+		}
+	}
+
+	buckets := 0
+	err = store.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func([]byte, *bolt.Bucket) error {
+			buckets++
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := buckets, 0; have != want {
+		t.Errorf("have %d bolt buckets, want %d", have, want)
+	}
+}
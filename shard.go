@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+)
+
+// Sharded files are stored below two levels of directories within their
+// bucket named after the first bytes of the hex encoded SHA1 of their key,
+// bucket/ab/cd/key, so no directory holds more than a fraction of the files
+// of a bucket.
+const shardLevels = 2
+
+// withSharding makes the diskFS store files in shard directories derived from
+// their key. Files stored without sharding are not found with it and vice
+// versa, the layout of a root can't be switched without moving its files.
+func withSharding(enabled bool) diskOption {
+	return func(fs *diskFS) {
+		fs.shard = enabled
+	}
+}
+
+// shardDir returns the shard directories of key relative to its bucket.
+func shardDir(key string) string {
+	h := sha1.Sum([]byte(key))
+	enc := hex.EncodeToString(h[:shardLevels])
+
+	dirs := make([]string, shardLevels)
+	for i := range dirs {
+		dirs[i] = enc[2*i : 2*i+2]
+	}
+
+	return strings.Join(dirs, "/")
+}
+
+// unshard returns the key of the file at rel, its path relative to the bucket,
+// and whether rel is within the shard directories of the key. Files outside
+// of their shard, like ones stored before sharding was enabled, can't be
+// opened by their key and aren't listed.
+func unshard(rel string) (string, bool) {
+	parts := strings.SplitN(rel, "/", shardLevels+1)
+	if len(parts) <= shardLevels {
+		return "", false
+	}
+
+	key := parts[shardLevels]
+
+	return key, strings.Join(parts[:shardLevels], "/") == shardDir(key)
+}
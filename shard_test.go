@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/soundcloud/ent/lib"
+)
+
+func TestDiskFSShard(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-diskfs-shard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		b    = ent.NewBucket("shard", ent.Owner{})
+		fs   = newDiskFS(tmp, withSharding(true))
+		keys = []string{"a/b/c", "a/b/d/e", "a/bc", "a/bcd/e", "ab"}
+	)
+
+	for _, key := range keys {
+		f, err := fs.Create(b, key, strings.NewReader(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		_, err = os.Stat(filepath.Join(tmp, b.Name, shardDir(key), key))
+		if err != nil {
+			t.Errorf("%s not stored in its shard: %s", key, err)
+		}
+	}
+
+	for _, key := range keys {
+		f, err := fs.Open(b, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		content, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have, want := string(content), key; have != want {
+			t.Errorf("have %q, want %q", have, want)
+		}
+	}
+
+	// Files outside of their shard, like ones stored before sharding was
+	// enabled, are not listed.
+	err = ioutil.WriteFile(filepath.Join(tmp, b.Name, "unsharded"), []byte("unsharded"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for prefix, want := range map[string][]string{
+		"":      keys,
+		"a/":    {"a/b/c", "a/b/d/e", "a/bc", "a/bcd/e"},
+		"a/b/":  {"a/b/c", "a/b/d/e"},
+		"a/bc":  {"a/bc", "a/bcd/e"},
+		"a/bc/": {},
+	} {
+		all, err := fs.List(b, prefix, ent.DefaultLimit, ent.ByKeyStrategy(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		have := []string{}
+		for _, f := range all {
+			have = append(have, f.Key())
+		}
+
+		if !reflect.DeepEqual(have, want) {
+			t.Errorf("prefix %q: have %v, want %v", prefix, have, want)
+		}
+	}
+
+	err = fs.Delete(b, "a/bc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = fs.Open(b, "a/bc")
+	if err != ent.ErrFileNotFound {
+		t.Errorf("have %v, want %v", err, ent.ErrFileNotFound)
+	}
+}
+
+func TestShardDir(t *testing.T) {
+	dir := shardDir("nested/key.txt")
+
+	if !regexp.MustCompile(`^[0-9a-f]{2}/[0-9a-f]{2}$`).MatchString(dir) {
+		t.Errorf("malformed shard %q", dir)
+	}
+
+	if have, want := shardDir("nested/key.txt"), dir; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	key, ok := unshard(dir + "/nested/key.txt")
+	if !ok {
+		t.Errorf("%s not in its shard", dir)
+	}
+
+	if have, want := key, "nested/key.txt"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	for _, rel := range []string{"nested/key.txt", "00/00/nested/key.txt", dir} {
+		_, ok := unshard(rel)
+		if ok {
+			t.Errorf("%s reported in its shard", rel)
+		}
+	}
+}
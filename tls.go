@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// newTLSConfig loads the certificate and key to serve HTTPS with. If clientCA
+// is set, clients have to present a certificate signed by one of the CAs in it.
+func newTLSConfig(certFile, keyFile, clientCA string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading certificate failed: %s", err)
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if clientCA == "" {
+		return cfg, nil
+	}
+
+	raw, err := ioutil.ReadFile(clientCA)
+	if err != nil {
+		return nil, fmt.Errorf("loading client CA failed: %s", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(raw) {
+		return nil, fmt.Errorf("loading client CA failed: no certificates in %s", clientCA)
+	}
+
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	cfg.ClientCAs = pool
+
+	return cfg, nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServeTLS(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-tls-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	certFile, keyFile := writeSelfSignedCert(t, tmp)
+
+	for _, clientCA := range []string{"", certFile} {
+		cfg, err := newTLSConfig(certFile, keyFile, clientCA)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var (
+			addr = l.Addr().String()
+			srv  = &http.Server{
+				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.Write([]byte("secure"))
+				}),
+			}
+		)
+
+		go srv.Serve(tls.NewListener(l, cfg))
+
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pool := x509.NewCertPool()
+		pool.AddCert(leaf)
+
+		client := &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					RootCAs:      pool,
+					Certificates: []tls.Certificate{cert},
+				},
+			},
+		}
+
+		res, err := client.Get("https://" + addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have, want := string(raw), "secure"; have != want {
+			t.Errorf("have %q, want %q", have, want)
+		}
+
+		res, err = http.Get("http://" + addr)
+		if err == nil {
+			res.Body.Close()
+
+			if res.StatusCode == http.StatusOK {
+				t.Errorf("plaintext request answered with %d", res.StatusCode)
+			}
+		}
+
+		if clientCA != "" {
+			anonymous := &http.Client{
+				Transport: &http.Transport{
+					TLSClientConfig: &tls.Config{RootCAs: pool},
+				},
+			}
+
+			res, err = anonymous.Get("https://" + addr)
+			if err == nil {
+				res.Body.Close()
+				t.Errorf("request without client certificate answered with %d", res.StatusCode)
+			}
+		}
+
+		srv.Close()
+	}
+}
+
+func TestNewTLSConfigInvalid(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-tls-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	certFile, keyFile := writeSelfSignedCert(t, tmp)
+
+	_, err = newTLSConfig(filepath.Join(tmp, "missing.pem"), keyFile, "")
+	if err == nil {
+		t.Error("missing certificate accepted")
+	}
+
+	_, err = newTLSConfig(certFile, keyFile, keyFile)
+	if err == nil {
+		t.Error("client CA without certificates accepted")
+	}
+}
+
+// writeSelfSignedCert writes a self-signed certificate for 127.0.0.1 usable by
+// servers and clients alike into dir and returns the paths of it and its key.
+func writeSelfSignedCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ent"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth,
+			x509.ExtKeyUsageClientAuth,
+		},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rawKey, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		certFile = filepath.Join(dir, "cert.pem")
+		keyFile  = filepath.Join(dir, "key.pem")
+	)
+
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: rawKey}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
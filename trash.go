@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/soundcloud/ent/lib"
+)
+
+// Deleted files are kept in the trash directory within the root, mirroring
+// the layout of their bucket. Their name carries the time of deletion as
+// nanoseconds since epoch, key.1462104000000000000, so several deletions of
+// the same key can be told apart.
+const trashDir = ".trash"
+
+// trashPurger is implemented by FileSystems which keep deleted files around
+// until they are purged.
+type trashPurger interface {
+	PurgeTrash(before time.Time) (int, error)
+}
+
+// withTrash makes Delete move files to the trash instead of removing them,
+// from where they can be restored.
+func withTrash(enabled bool) diskOption {
+	return func(fs *diskFS) {
+		fs.trash = enabled
+	}
+}
+
+// moveToTrash moves the file at p and its Meta into the trash.
+func (fs *diskFS) moveToTrash(bucket *ent.Bucket, key, p string) error {
+	dst := fmt.Sprintf(
+		"%s.%d",
+		filepath.Join(fs.root, trashDir, bucket.Name, key),
+		time.Now().UnixNano(),
+	)
+
+	err := os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return fmt.Errorf("trash failed: %s", err)
+	}
+
+	err = os.Rename(p, dst)
+	if err != nil {
+		return fmt.Errorf("trash failed: %s", err)
+	}
+
+	err = os.Rename(p+metaExt, dst+metaExt)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("meta trash failed: %s", err)
+	}
+
+	return nil
+}
+
+// Restore moves the most recently deleted file under key back from the trash.
+// ErrFileNotFound is returned if the trash holds no such file and
+// ErrFileExists if a file has been stored under key since.
+func (fs *diskFS) Restore(bucket *ent.Bucket, key string) error {
+	var (
+		base   = filepath.Join(fs.root, trashDir, bucket.Name, key)
+		latest int64
+	)
+
+	infos, err := ioutil.ReadDir(filepath.Dir(base))
+	if os.IsNotExist(err) {
+		return ent.ErrFileNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		deleted, ok := trashTime(filepath.Base(base), info)
+		if ok && deleted > latest {
+			latest = deleted
+		}
+	}
+
+	if latest == 0 {
+		return ent.ErrFileNotFound
+	}
+
+	var (
+		src = fmt.Sprintf("%s.%d", base, latest)
+		dst = pathForFile(fs, bucket, key)
+	)
+
+	unlock := fs.keys.lock(dst)
+	defer unlock()
+
+	fs.dirs.RLock()
+	defer fs.dirs.RUnlock()
+
+	_, err = os.Stat(dst)
+	if err == nil {
+		return ent.ErrFileExists
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return fmt.Errorf("restore failed: %s", err)
+	}
+
+	err = os.Rename(src, dst)
+	if err != nil {
+		return fmt.Errorf("restore failed: %s", err)
+	}
+
+	err = os.Rename(src+metaExt, dst+metaExt)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("meta restore failed: %s", err)
+	}
+
+	return nil
+}
+
+// PurgeTrash permanently removes the files deleted before the given time and
+// returns their number.
+func (fs *diskFS) PurgeTrash(before time.Time) (int, error) {
+	n := 0
+
+	err := filepath.Walk(
+		filepath.Join(fs.root, trashDir),
+		func(path string, info os.FileInfo, err error) error {
+			// Meta is purged along with its file before the walk reaches it.
+			if os.IsNotExist(err) && path != filepath.Join(fs.root, trashDir) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			if info.IsDir() || filepath.Ext(path) == metaExt {
+				return nil
+			}
+
+			i := strings.LastIndex(path, ".")
+			if i < 0 {
+				return nil
+			}
+
+			deleted, err := strconv.ParseInt(path[i+1:], 10, 64)
+			if err != nil || !time.Unix(0, deleted).Before(before) {
+				return nil
+			}
+
+			err = os.Remove(path)
+			if err != nil {
+				return fmt.Errorf("purge failed: %s", err)
+			}
+
+			err = os.Remove(path + metaExt)
+			if err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("meta purge failed: %s", err)
+			}
+
+			n++
+
+			return nil
+		},
+	)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	return n, err
+}
+
+// trashTime returns the time of deletion encoded in the name of a trashed
+// file if it has been stored under name.
+func trashTime(name string, info os.FileInfo) (int64, bool) {
+	if info.IsDir() || !strings.HasPrefix(info.Name(), name+".") {
+		return 0, false
+	}
+
+	deleted, err := strconv.ParseInt(strings.TrimPrefix(info.Name(), name+"."), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return deleted, true
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/pat"
+	"github.com/soundcloud/ent/lib"
+)
+
+func TestDiskFSTrashRestore(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-trash-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		fs          = newDiskFS(tmp, withTrash(true))
+		b           = ent.NewBucket("trash", ent.Owner{})
+		key         = "nested/deleted.txt"
+		retainUntil = time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+	)
+
+	for _, content := range []string{"first", "second"} {
+		_, err := fs.Create(b, key, strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = fs.SetMeta(b, key, ent.Meta{RetainUntil: retainUntil})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = fs.Delete(b, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = fs.Open(b, key)
+	if have, want := err, ent.ErrFileNotFound; have != want {
+		t.Fatalf("have %v, want %v", have, want)
+	}
+
+	err = fs.Restore(b, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := fs.Open(b, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The most recent deletion is restored.
+	if have, want := string(raw), "second"; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+
+	m, err := fs.Meta(b, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := m.RetainUntil, retainUntil; !have.Equal(want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	err = fs.Restore(b, key)
+	if have, want := err, ent.ErrFileExists; have != want {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	err = fs.Restore(b, "never/deleted.txt")
+	if have, want := err, ent.ErrFileNotFound; have != want {
+		t.Errorf("have %v, want %v", have, want)
+	}
+}
+
+func TestDiskFSPurgeTrash(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-trash-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		fs  = newDiskFS(tmp, withTrash(true))
+		b   = ent.NewBucket("trash", ent.Owner{})
+		key = "purged.txt"
+	)
+
+	n, err := fs.(trashPurger).PurgeTrash(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := n, 0; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+
+	_, err = fs.Create(b, key, strings.NewReader("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fs.Delete(b, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Files deleted after the given time are kept.
+	n, err = fs.(trashPurger).PurgeTrash(time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := n, 0; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+
+	n, err = fs.(trashPurger).PurgeTrash(time.Now().Add(time.Nanosecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := n, 1; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+
+	err = fs.Restore(b, key)
+	if have, want := err, ent.ErrFileNotFound; have != want {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Join(tmp, trashDir, b.Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := len(entries), 0; have != want {
+		t.Errorf("have %d entries, want %d", have, want)
+	}
+}
+
+func TestHandleRestore(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-trash-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		fs  = newMultipartFS(newDiskFS(tmp, withTrash(true)), filepath.Join(tmp, "uploads"))
+		b   = ent.NewBucket("restore", ent.Owner{})
+		p   = ent.NewMemoryProvider(b)
+		r   = pat.New()
+		key = "restored.txt"
+	)
+
+	r.Delete(ent.RouteFile, handleDelete(p, fs))
+	r.Post(ent.RouteFile, handleUpload(p, fs))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	ep := fmt.Sprintf("%s/%s/%s", ts.URL, b.Name, key)
+
+	_, err = fs.Create(b, key, strings.NewReader("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("DELETE", ep, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if have, want := res.StatusCode, http.StatusOK; have != want {
+		t.Fatalf("have %d, want %d", have, want)
+	}
+
+	created := ent.ResponseCreated{}
+	multipartPost(t, ep+"?restore", nil, http.StatusOK, &created)
+
+	if have, want := created.File.Key, key; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	// Nothing is left in the trash to restore.
+	multipartPost(t, ep+"?restore", nil, http.StatusNotFound, nil)
+}
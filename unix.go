@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// listenUnix listens on the Unix domain socket at path. A socket left behind
+// by a process which exited without removing it is replaced, one still
+// accepting connections and files other than sockets are left alone.
+func listenUnix(path string) (net.Listener, error) {
+	fi, err := os.Lstat(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	case fi.Mode()&os.ModeSocket == 0:
+		return nil, fmt.Errorf("%s exists and is not a socket", path)
+	default:
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+
+		err = os.Remove(path)
+		if err != nil {
+			return nil, fmt.Errorf("removing stale socket failed: %s", err)
+		}
+	}
+
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/pat"
+	"github.com/soundcloud/ent/lib"
+)
+
+func TestServeUnix(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-unix-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	path := filepath.Join(tmp, "ent.sock")
+
+	// A socket left behind by a crashed process.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := listenUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = listenUnix(path)
+	if err == nil {
+		t.Error("socket in use replaced")
+	}
+
+	r := pat.New()
+	r.Get(ent.RouteHealth, handleHealth())
+
+	var (
+		srv  = &http.Server{Handler: r}
+		stop = make(chan os.Signal, 1)
+		done = make(chan error, 1)
+	)
+
+	go func() {
+		done <- serve(srv, []net.Listener{l}, stop, 5*time.Second)
+	}()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			},
+		},
+	}
+
+	res, err := client.Get("http://ent" + ent.RouteHealth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if have, want := res.StatusCode, http.StatusOK; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+
+	stop <- os.Interrupt
+
+	err = <-done
+	if err != nil {
+		t.Errorf("shutdown failed: %s", err)
+	}
+
+	_, err = os.Stat(path)
+	if !os.IsNotExist(err) {
+		t.Errorf("socket left behind: %v", err)
+	}
+
+	err = ioutil.WriteFile(path, []byte("not a socket"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = listenUnix(path)
+	if err == nil {
+		t.Error("regular file replaced")
+	}
+}
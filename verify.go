@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/soundcloud/ent/lib"
+)
+
+// verifier is implemented by FileSystems which record the hash of files when
+// they are stored and can tell whether their content still matches it.
+type verifier interface {
+	// Verify hashes the content of the file under key as stored. Files
+	// without a recorded hash get the current one recorded, unless the bucket
+	// is read-only.
+	Verify(bucket *ent.Bucket, key string) (verification, error)
+}
+
+// verification is the outcome of verifying a file, both hashes are hex
+// encoded SHA1s of the content as stored.
+type verification struct {
+	hash     string
+	expected string
+}
+
+// status tells whether the content matches the recorded hash.
+func (v verification) status() string {
+	switch {
+	case v.expected == "":
+		return ent.VerifyRecorded
+	case v.expected != v.hash:
+		return ent.VerifyMismatch
+	default:
+		return ent.VerifyMatch
+	}
+}
+
+// verifyFile verifies the file under key, backends which don't record hashes
+// can't be asked to.
+func verifyFile(fs ent.FileSystem, bucket *ent.Bucket, key string) (verification, error) {
+	v, ok := fs.(verifier)
+	if !ok {
+		return verification{}, ent.ErrInvalidParam
+	}
+
+	return v.Verify(bucket, key)
+}
+
+// Verify reads the file under key again and compares its hash with the one
+// recorded in its sidecar. Files stored lazily or before hashes were recorded
+// have none, the current hash is recorded for later verifications unless the
+// bucket is read-only. Writes to the key wait for the verification to
+// complete.
+func (fs *diskFS) Verify(bucket *ent.Bucket, key string) (verification, error) {
+	err := checkKey(key)
+	if err != nil {
+		return verification{}, err
+	}
+
+	p := pathForFile(fs, bucket, key)
+
+	unlock := fs.keys.lock(p)
+	defer unlock()
+
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return verification{}, ent.ErrFileNotFound
+	}
+	if err != nil {
+		return verification{}, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return verification{}, err
+	}
+	if stat.IsDir() {
+		return verification{}, ent.ErrFileNotFound
+	}
+
+	h := sha1.New()
+
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return verification{}, err
+	}
+
+	s, err := readSidecar(p)
+	if err != nil {
+		return verification{}, err
+	}
+
+	v := verification{
+		hash:     hex.EncodeToString(h.Sum(nil)),
+		expected: s.Hash,
+	}
+
+	if v.expected == "" && !bucket.ReadOnly {
+		s.Hash = v.hash
+
+		err = fs.writeSidecar(p, s)
+		if err != nil {
+			return verification{}, err
+		}
+	}
+
+	return v, nil
+}
+
+// Verify verifies the file as stored by the wrapped FileSystem.
+func (fs *compressFS) Verify(bucket *ent.Bucket, key string) (verification, error) {
+	return verifyFile(fs.FileSystem, bucket, key)
+}
+
+// Verify verifies the file as stored by the wrapped FileSystem.
+func (fs *encryptedFS) Verify(bucket *ent.Bucket, key string) (verification, error) {
+	return verifyFile(fs.FileSystem, bucket, key)
+}
+
+// Verify verifies the file as stored by the wrapped FileSystem.
+func (fs *hashIndexFS) Verify(bucket *ent.Bucket, key string) (verification, error) {
+	return verifyFile(fs.FileSystem, bucket, key)
+}
+
+// Verify verifies the file as stored by the wrapped FileSystem.
+func (fs *multipartFS) Verify(bucket *ent.Bucket, key string) (verification, error) {
+	return verifyFile(fs.FileSystem, bucket, key)
+}
+
+// handleVerify answers whether the content of a file still matches the hash
+// recorded when it was stored, a mismatch is answered with 409.
+func handleVerify(p ent.Provider, fs ent.FileSystem) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			bucket = r.URL.Query().Get(ent.KeyBucket)
+			key    = r.URL.Query().Get(ent.KeyBlob)
+		)
+		defer r.Body.Close()
+
+		b, err := getBucket(p, bucket)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		v, err := verifyFile(fs, b, key)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		code := http.StatusOK
+		if v.status() == ent.VerifyMismatch {
+			log.Printf("ERROR %s/%s hash mismatch: have %s, want %s", b.Name, key, v.hash, v.expected)
+			code = http.StatusConflict
+		}
+
+		respondJSON(w, code, ent.ResponseVerify{
+			Key:      key,
+			Status:   v.status(),
+			Hash:     v.hash,
+			Expected: v.expected,
+		})
+	}
+}
+
+// handleVerifyBucket verifies every file of a bucket below the optional
+// prefix and writes a line of JSON for each as soon as it is verified. Files
+// deleted while walking the bucket are skipped.
+func handleVerifyBucket(p ent.Provider, fs ent.FileSystem) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			bucket = r.URL.Query().Get(ent.KeyBucket)
+			prefix = r.URL.Query().Get(ent.ParamPrefix)
+		)
+		defer r.Body.Close()
+
+		if _, ok := r.URL.Query()[ent.ParamVerify]; !ok {
+			respondError(w, r, ent.ErrInvalidParam)
+			return
+		}
+
+		b, err := getBucket(p, bucket)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		var (
+			enc     = json.NewEncoder(w)
+			started = false
+		)
+
+		start := func() {
+			if !started {
+				w.Header().Set("Content-Type", ent.ContentTypeNDJSON)
+				w.WriteHeader(http.StatusOK)
+				started = true
+			}
+		}
+
+		err = fs.Walk(b, prefix, ent.ModifiedRange{}, func(f ent.File) error {
+			v, err := verifyFile(fs, b, f.Key())
+			if err == ent.ErrFileNotFound {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			if v.status() == ent.VerifyMismatch {
+				log.Printf("ERROR %s/%s hash mismatch: have %s, want %s", b.Name, f.Key(), v.hash, v.expected)
+			}
+
+			start()
+
+			return enc.Encode(ent.ResponseVerify{
+				Key:      f.Key(),
+				Status:   v.status(),
+				Hash:     v.hash,
+				Expected: v.expected,
+			})
+		})
+		if err != nil && !started {
+			respondError(w, r, err)
+			return
+		}
+		if err != nil {
+			log.Printf("ERROR could not stream %s: %s", r.RequestURI, err)
+			return
+		}
+
+		start()
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/pat"
+	"github.com/soundcloud/ent/lib"
+)
+
+func TestDiskFSVerify(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-diskfs-verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		b  = ent.NewBucket("verify", ent.Owner{})
+		fs = newDiskFS(tmp)
+	)
+
+	f, err := fs.Create(b, "clean.txt", strings.NewReader("clean content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	v, err := fs.(verifier).Verify(b, "clean.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := v.status(), ent.VerifyMatch; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	// Flipping bits on disk is only noticed by reading the content again.
+	err = ioutil.WriteFile(filepath.Join(tmp, b.Name, "clean.txt"), []byte("clean cOntent"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err = fs.(verifier).Verify(b, "clean.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := v.status(), ent.VerifyMismatch; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	if v.hash == v.expected {
+		t.Errorf("have hash %s equal to expected", v.hash)
+	}
+
+	// Lazily hashed files have their hash recorded by the first verification.
+	lazy := newDiskFS(tmp, withLazyHash(true))
+
+	f, err = lazy.Create(b, "lazy.txt", strings.NewReader("lazy content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	for _, want := range []string{ent.VerifyRecorded, ent.VerifyMatch} {
+		v, err := lazy.(verifier).Verify(b, "lazy.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have := v.status(); have != want {
+			t.Errorf("have %s, want %s", have, want)
+		}
+	}
+
+	// Read-only buckets are verified without recording the hash.
+	readOnly := ent.NewBucket("verify", ent.Owner{})
+	readOnly.ReadOnly = true
+
+	f, err = lazy.Create(b, "read-only.txt", strings.NewReader("read-only content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	for _, want := range []string{ent.VerifyRecorded, ent.VerifyRecorded} {
+		v, err := lazy.(verifier).Verify(readOnly, "read-only.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have := v.status(); have != want {
+			t.Errorf("have %s, want %s", have, want)
+		}
+	}
+
+	_, err = fs.(verifier).Verify(b, "missing.txt")
+	if err != ent.ErrFileNotFound {
+		t.Errorf("have %v, want %v", err, ent.ErrFileNotFound)
+	}
+}
+
+func TestHandleVerify(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-verify-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		b  = ent.NewBucket("ent", ent.Owner{})
+		p  = ent.NewMemoryProvider(b)
+		fs = newHashIndexFS(newCompressFS(newDiskFS(tmp)))
+	)
+
+	for _, key := range []string{"clean.txt", "corrupted.txt"} {
+		f, err := fs.Create(b, key, strings.NewReader(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+
+	err = ioutil.WriteFile(filepath.Join(tmp, b.Name, "corrupted.txt"), []byte("rotten"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := pat.New()
+	r.Post(ent.RouteFile, handleVerify(p, fs))
+	r.Post(ent.RouteBucket, handleVerifyBucket(p, fs))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	for key, want := range map[string]struct {
+		code   int
+		status string
+	}{
+		"clean.txt":     {http.StatusOK, ent.VerifyMatch},
+		"corrupted.txt": {http.StatusConflict, ent.VerifyMismatch},
+	} {
+		res, err := http.Post(fmt.Sprintf("%s/%s/%s?verify", ts.URL, b.Name, key), "text/plain", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp := ent.ResponseVerify{}
+		err = json.NewDecoder(res.Body).Decode(&resp)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have, want := res.StatusCode, want.code; have != want {
+			t.Errorf("%s: have %d, want %d", key, have, want)
+		}
+
+		if have, want := resp.Status, want.status; have != want {
+			t.Errorf("%s: have %s, want %s", key, have, want)
+		}
+	}
+
+	res, err := http.Post(fmt.Sprintf("%s/%s?verify", ts.URL, b.Name), "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if have, want := res.Header.Get("Content-Type"), ent.ContentTypeNDJSON; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	statuses := map[string]string{}
+
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		resp := ent.ResponseVerify{}
+
+		err := json.Unmarshal(scanner.Bytes(), &resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		statuses[resp.Key] = resp.Status
+	}
+
+	if have, want := statuses["clean.txt"], ent.VerifyMatch; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	if have, want := statuses["corrupted.txt"], ent.VerifyMismatch; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	if have, want := len(statuses), 2; have != want {
+		t.Errorf("have %d files, want %d", have, want)
+	}
+}
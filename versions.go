@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/soundcloud/ent/lib"
+)
+
+// Prior versions of files are kept in the versions directory within the root.
+// Every key has a directory of its own named after the SHA1 of the key, as keys
+// can't be used as directories themselves. It holds the content of every
+// version named by its hash and an index listing the versions in the order
+// they were replaced.
+const (
+	versionsDir   = ".versions"
+	versionsIndex = "index.json"
+)
+
+var versionHashPattern = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// withVersioning makes Create and Delete keep the content replaced or removed
+// as a version of the file, which can be listed and opened by its hash.
+func withVersioning(enabled bool) diskOption {
+	return func(fs *diskFS) {
+		fs.versioning = enabled
+	}
+}
+
+// Versions returns the versions kept for the file under key, oldest first.
+// The content currently stored is listed last and marked as current.
+func (fs *diskFS) Versions(bucket *ent.Bucket, key string) ([]ent.Version, error) {
+	// Holding the lock of the key the current content isn't replaced while
+	// it is described, nor archived while the versions are read.
+	unlock := fs.keys.lock(pathForFile(fs, bucket, key))
+	defer unlock()
+
+	fs.versionsMu.Lock()
+	vs, err := fs.readVersions(bucket, key)
+	fs.versionsMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := fs.currentVersion(bucket, key)
+	if err == ent.ErrFileNotFound {
+		return vs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	current.Current = true
+
+	return append(vs, current), nil
+}
+
+// OpenVersion returns the version of the file under key with the given hash.
+func (fs *diskFS) OpenVersion(bucket *ent.Bucket, key, hash string) (ent.File, error) {
+	// The hash is used as a path and must not point outside of the versions.
+	if !versionHashPattern.MatchString(hash) {
+		return nil, ent.ErrFileNotFound
+	}
+
+	f, err := os.Open(filepath.Join(fs.versionDir(bucket, key), hash))
+	if err == nil {
+		stat, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		vf := newFile(f, key)
+		vf.lastModified = stat.ModTime()
+
+		return vf, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	unlock := fs.keys.lock(pathForFile(fs, bucket, key))
+	defer unlock()
+
+	current, err := fs.currentVersion(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if current.Hash != hash {
+		return nil, ent.ErrFileNotFound
+	}
+
+	cf, err := fs.open(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cf, nil
+}
+
+// archive keeps the content stored at p as a version of the file under key
+// before it is replaced or removed. Nothing is kept if there is no content.
+func (fs *diskFS) archive(bucket *ent.Bucket, key, p string) error {
+	v, err := fs.currentVersion(bucket, key)
+	if err == ent.ErrFileNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	dir := fs.versionDir(bucket, key)
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return fmt.Errorf("archiving failed: %s", err)
+	}
+
+	// The content is shared with the version by a link, which already exists
+	// if the same content has been archived before.
+	err = os.Link(p, filepath.Join(dir, v.Hash))
+	if err != nil && !os.IsExist(err) {
+		return fmt.Errorf("archiving failed: %s", err)
+	}
+
+	fs.versionsMu.Lock()
+	defer fs.versionsMu.Unlock()
+
+	vs, err := fs.readVersions(bucket, key)
+	if err != nil {
+		return err
+	}
+
+	raw, err := json.Marshal(append(vs, v))
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, versionsIndex), raw, 0644)
+	if err != nil {
+		return fmt.Errorf("archiving failed: %s", err)
+	}
+
+	return nil
+}
+
+// currentVersion describes the content currently stored under key by the
+// hash recorded for it, the content is only hashed if none has been recorded.
+// The caller holds the lock of the key.
+func (fs *diskFS) currentVersion(bucket *ent.Bucket, key string) (ent.Version, error) {
+	f, err := fs.open(bucket, key)
+	if err != nil {
+		return ent.Version{}, err
+	}
+	defer f.Close()
+
+	hash := f.sidecar.Hash
+	if hash == "" {
+		h := sha1.New()
+
+		_, err = io.Copy(h, f)
+		if err != nil {
+			return ent.Version{}, err
+		}
+
+		hash = hex.EncodeToString(h.Sum(nil))
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		return ent.Version{}, err
+	}
+
+	return ent.Version{
+		Hash:         hash,
+		LastModified: stat.ModTime(),
+		Compression:  f.sidecar.Compression,
+		Encryption:   f.sidecar.Encryption,
+	}, nil
+}
+
+// readVersions returns the versions recorded in the index of key, the caller
+// must hold versionsMu.
+func (fs *diskFS) readVersions(bucket *ent.Bucket, key string) ([]ent.Version, error) {
+	vs := []ent.Version{}
+
+	raw, err := ioutil.ReadFile(filepath.Join(fs.versionDir(bucket, key), versionsIndex))
+	if os.IsNotExist(err) {
+		return vs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(raw, &vs)
+	if err != nil {
+		return nil, fmt.Errorf("reading versions failed: %s", err)
+	}
+
+	return vs, nil
+}
+
+func (fs *diskFS) versionDir(bucket *ent.Bucket, key string) string {
+	h := sha1.Sum([]byte(key))
+	return filepath.Join(fs.root, versionsDir, bucket.Name, hex.EncodeToString(h[:]))
+}
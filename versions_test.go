@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/pat"
+	"github.com/soundcloud/ent/lib"
+)
+
+func TestDiskFSVersions(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-versions-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		fs  = newDiskFS(tmp, withVersioning(true))
+		b   = ent.NewBucket("versions", ent.Owner{})
+		key = "nested/versioned.txt"
+	)
+
+	for _, content := range []string{"first", "second"} {
+		_, err := fs.Create(b, key, strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	vs, err := fs.Versions(b, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := len(vs), 2; have != want {
+		t.Fatalf("have %d, want %d", have, want)
+	}
+
+	for i, content := range []string{"first", "second"} {
+		sum := sha1.Sum([]byte(content))
+
+		if have, want := vs[i].Hash, hex.EncodeToString(sum[:]); have != want {
+			t.Errorf("version %d: have %s, want %s", i, have, want)
+		}
+
+		if have, want := vs[i].Current, i == 1; have != want {
+			t.Errorf("version %d: have %t, want %t", i, have, want)
+		}
+
+		f, err := fs.OpenVersion(b, key, vs[i].Hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have, want := string(raw), content; have != want {
+			t.Errorf("version %d: have %q, want %q", i, have, want)
+		}
+	}
+
+	err = fs.Delete(b, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vs, err = fs.Versions(b, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The deleted content is kept as a version, none is current anymore.
+	if have, want := len(vs), 2; have != want {
+		t.Fatalf("have %d, want %d", have, want)
+	}
+
+	if vs[1].Current {
+		t.Errorf("deleted version still current")
+	}
+
+	_, err = fs.OpenVersion(b, key, "../../../etc/passwd")
+	if have, want := err, ent.ErrFileNotFound; have != want {
+		t.Errorf("have %v, want %v", have, want)
+	}
+}
+
+func TestDiskFSVersionsRecordedHash(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-versions-recorded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		b       = ent.NewBucket("versions-recorded", ent.Owner{})
+		content = "recorded"
+		sum     = sha1.Sum([]byte(content))
+		zeroed  = sha1.Sum(make([]byte, len(content)))
+	)
+
+	for _, input := range []struct {
+		lazy bool
+		hash []byte
+	}{
+		// The hash recorded while storing describes the current version.
+		{false, sum[:]},
+		// Without a recorded hash the content is hashed as stored.
+		{true, zeroed[:]},
+	} {
+		var (
+			fs  = newDiskFS(tmp, withVersioning(true), withLazyHash(input.lazy))
+			key = fmt.Sprintf("lazy-%t.txt", input.lazy)
+		)
+
+		_, err := fs.Create(b, key, strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Zeroing the stored content tells whether it has been read again.
+		err = ioutil.WriteFile(filepath.Join(tmp, b.Name, key), make([]byte, len(content)), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		vs, err := fs.Versions(b, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have, want := len(vs), 1; have != want {
+			t.Fatalf("lazy %t: have %d, want %d", input.lazy, have, want)
+		}
+
+		if have, want := vs[0].Hash, hex.EncodeToString(input.hash); have != want {
+			t.Errorf("lazy %t: have %s, want %s", input.lazy, have, want)
+		}
+	}
+}
+
+func TestHandleGetVersions(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ent-versions-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		fs  = newDiskFS(tmp, withVersioning(true))
+		b   = ent.NewBucket("versions", ent.Owner{})
+		r   = pat.New()
+		key = "versioned.txt"
+	)
+
+	r.Get(ent.RouteFile, handleGet(ent.NewMemoryProvider(b), fs))
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	for _, content := range []string{"older", "newer"} {
+		_, err := fs.Create(b, key, strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ep := fmt.Sprintf("%s/%s/%s", ts.URL, b.Name, key)
+
+	res, err := http.Get(ep + "?" + ent.ParamVersions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	versions := ent.ResponseVersions{}
+
+	err = json.NewDecoder(res.Body).Decode(&versions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := len(versions.Versions), 2; have != want {
+		t.Fatalf("have %d, want %d", have, want)
+	}
+
+	res, err = http.Get(ep + "?" + ent.ParamVersion + "=" + versions.Versions[0].Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := res.StatusCode, http.StatusOK; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+
+	if have, want := string(raw), "older"; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+
+	res, err = http.Get(ep + "?" + ent.ParamVersion + "=" + strings.Repeat("0", 40))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if have, want := res.StatusCode, http.StatusNotFound; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+}